@@ -0,0 +1,374 @@
+package apis
+
+import (
+	"errors"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+
+	"github.com/Simon-Martens/caveman/auth/oauth2"
+	"github.com/Simon-Martens/caveman/db/attempts"
+	"github.com/Simon-Martens/caveman/db/sessions"
+	"github.com/Simon-Martens/caveman/db/users"
+	"github.com/Simon-Martens/caveman/manager"
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/Simon-Martens/caveman/tools/webauthn"
+	"github.com/labstack/echo/v4"
+)
+
+// AuthConfig defines where the HTML form handlers redirect to.
+// Form errors redirect back to the form page with an ?error=<code> query parameter.
+type AuthConfig struct {
+	LoginPage      string
+	RegisterPage   string
+	SetupPage      string
+	ForgotPage     string
+	ResetPage      string
+	PasswordPage   string
+	VerifyPage     string
+	EmailPage      string
+	SessionsPage   string
+	TwoFactorPage  string
+	IdentitiesPage string
+	InvitePage     string
+	LoginRedirect  string
+	LogoutRedirect string
+
+	// Passkeys is the relying party of passkeys. Unset fields are derived from
+	// the name and URL settings, the domain of the URL is the relying party id.
+	Passkeys webauthn.RelyingParty
+
+	// Providers are the OpenID Connect providers users can log in with. The
+	// callback URLs are derived from the URL setting, see bindOAuth2Api.
+	Providers []*oauth2.Provider
+
+	// SendPasswordReset delivers a password reset link to the user. It is called
+	// in the background, so the response time does not tell if the user exists.
+	// If nil, the link is sent with the app mailer, see MailLink.
+	SendPasswordReset func(user *users.User, link string) error
+
+	// SendVerification delivers an email verification link to the user, after
+	// registration or an email change. It is called in the background.
+	// If nil, the link is sent with the app mailer, see MailLink.
+	SendVerification func(user *users.User, link string) error
+
+	// SendInvite delivers an invite link to the invited user, which only has the
+	// email and role set. It is called in the background.
+	// If nil, the link is sent with the app mailer, see MailLink.
+	SendInvite func(user *users.User, link string) error
+}
+
+// DefaultAuthConfig returns the default auth config.
+func DefaultAuthConfig() AuthConfig {
+	return AuthConfig{
+		LoginPage:      "/login",
+		RegisterPage:   "/register",
+		SetupPage:      "/setup",
+		ForgotPage:     "/forgot",
+		ResetPage:      "/reset",
+		PasswordPage:   "/password",
+		VerifyPage:     "/verify",
+		EmailPage:      "/email",
+		SessionsPage:   "/sessions",
+		TwoFactorPage:  "/login/2fa",
+		IdentitiesPage: "/identities",
+		InvitePage:     "/invite",
+		LoginRedirect:  "/",
+		LogoutRedirect: "/",
+	}
+}
+
+// LoginRequest is the body of a login request, either as JSON or as form.
+// Remember selects a long session, in forms it is read as checkbox.
+type LoginRequest struct {
+	Email    string `json:"email" form:"email"`
+	Password string `json:"password" form:"password"`
+	Remember bool   `json:"remember"`
+}
+
+// RegisterRequest is the body of a registration request, either as JSON or as form.
+type RegisterRequest struct {
+	Name     string `json:"name" form:"name"`
+	Email    string `json:"email" form:"email"`
+	Password string `json:"password" form:"password"`
+}
+
+// bindAuthApi registers the JSON auth api and the HTML form handlers.
+func bindAuthApi(app *manager.Manager, e *echo.Echo, config ServeConfig) {
+	api := authApi{app: app, cookie: config.Cookie, config: config.Auth}
+	if api.config.SendPasswordReset == nil {
+		api.config.SendPasswordReset = MailLink(app, PasswordResetMail)
+	}
+	if api.config.SendVerification == nil {
+		api.config.SendVerification = MailLink(app, VerificationMail)
+	}
+	if api.config.SendInvite == nil {
+		api.config.SendInvite = MailLink(app, InviteMail)
+	}
+
+	g := e.Group("/api/auth")
+	g.POST("/login", api.login)
+	g.POST("/logout", api.logout)
+	g.POST("/register", api.register)
+
+	e.POST(config.Auth.LoginPage, api.loginForm)
+	e.POST(config.Auth.RegisterPage, api.registerForm)
+	e.POST("/logout", api.logoutForm)
+
+	bindPasswordApi(api, e, g)
+	bindVerifyApi(api, e, g)
+	bindSessionsApi(api, e, g)
+	bindTwoFactorApi(api, e, g)
+	bindPasskeysApi(api, e, g)
+	bindOAuth2Api(api, e, g)
+	bindInvitesApi(api, e, g)
+}
+
+type authApi struct {
+	app    *manager.Manager
+	cookie CookieConfig
+	config AuthConfig
+}
+
+// login responds with 202 and the stage of the pending session if the login
+// needs a second factor, see bindTwoFactorApi.
+func (api *authApi) login(c echo.Context) error {
+	user, stage, err := api.doLogin(c)
+	if err != nil {
+		return err
+	}
+
+	if stage != "" {
+		return c.JSON(http.StatusAccepted, map[string]any{"second_factor": stage})
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{"user": user})
+}
+
+func (api *authApi) loginForm(c echo.Context) error {
+	_, stage, err := api.doLogin(c)
+	if err != nil {
+		return formError(c, api.config.LoginPage, err)
+	}
+
+	if stage != "" {
+		return c.Redirect(http.StatusSeeOther, api.twoFactorPage(stage, nextPath(c, "")))
+	}
+
+	return c.Redirect(http.StatusSeeOther, nextPath(c, api.config.LoginRedirect))
+}
+
+func (api *authApi) logout(c echo.Context) error {
+	if err := api.doLogout(c); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (api *authApi) logoutForm(c echo.Context) error {
+	if err := api.doLogout(c); err != nil {
+		return err
+	}
+
+	return c.Redirect(http.StatusSeeOther, api.config.LogoutRedirect)
+}
+
+func (api *authApi) register(c echo.Context) error {
+	user, err := api.doRegister(c)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{"user": user})
+}
+
+func (api *authApi) registerForm(c echo.Context) error {
+	user, err := api.doRegister(c)
+	if err != nil {
+		return formError(c, api.config.RegisterPage, err)
+	}
+
+	if !user.Verified && api.app.CMSettings().RequireVerification {
+		return c.Redirect(http.StatusSeeOther, api.config.LoginPage+"?verify=1")
+	}
+
+	return c.Redirect(http.StatusSeeOther, nextPath(c, api.config.LoginRedirect))
+}
+
+// doLogin checks the credentials and starts a session. If the user needs a
+// second factor, a pending session is started instead and its stage returned.
+func (api *authApi) doLogin(c echo.Context) (*users.User, string, error) {
+	req := LoginRequest{}
+	if err := c.Bind(&req); err != nil || req.Email == "" || req.Password == "" {
+		return nil, "", NewApiError(http.StatusBadRequest, ErrCodeInvalidRequest, "Email and password are required.")
+	}
+
+	if !req.Remember {
+		switch c.FormValue("remember") {
+		case "on", "true", "1":
+			req.Remember = true
+		}
+	}
+
+	user, err := api.app.Users().CheckGetUserFrom(req.Email, req.Password, c.RealIP())
+	if err == users.ErrSecondFactorRequired || err == users.ErrSecondFactorSetupRequired {
+		stage, err := api.startPendingLogin(c, user, err, !req.Remember)
+		if err != nil {
+			return nil, "", err
+		}
+		return user, stage, nil
+	} else if errors.Is(err, attempts.ErrRateLimited) {
+		return nil, "", rateLimitError(c, err)
+	} else if errors.Is(err, users.ErrUserNotFound) || errors.Is(err, users.ErrWrongPassword) {
+		// Both errors get the same response, so accounts can't be enumerated
+		return nil, "", NewApiError(http.StatusUnauthorized, ErrCodeInvalidCredentials, "Invalid email or password.")
+	} else if aerr := accountError(err); aerr != nil {
+		return nil, "", aerr
+	} else if err != nil {
+		return nil, "", err
+	}
+
+	if err := startSession(api.app, c, api.cookie, user, !req.Remember); err != nil {
+		return nil, "", err
+	}
+
+	return user, "", nil
+}
+
+// accountError turns the errors of users that may not log in into ApiErrors, see
+// [users.UserManager.CheckLogin]. For other errors it returns nil.
+func accountError(err error) error {
+	if errors.Is(err, users.ErrUserInactive) {
+		return NewApiError(http.StatusForbidden, ErrCodeAccountInactive, "Your account is deactivated.")
+	} else if errors.Is(err, users.ErrUserExpired) {
+		return NewApiError(http.StatusForbidden, ErrCodeAccountExpired, "Your account is expired.")
+	} else if errors.Is(err, users.ErrUserNotVerified) {
+		return NewApiError(http.StatusForbidden, ErrCodeNotVerified, "Please verify your email address first.")
+	}
+
+	return nil
+}
+
+func (api *authApi) doLogout(c echo.Context) error {
+	if session := GetSession(c); session != nil {
+		if err := api.app.Sessions().DeleteBySession(session.Session); err != nil {
+			return err
+		}
+	}
+
+	ClearSessionCookie(c, api.cookie)
+	return nil
+}
+
+func (api *authApi) doRegister(c echo.Context) (*users.User, error) {
+	if !api.app.CMSettings().Registration {
+		return nil, NewApiError(http.StatusForbidden, ErrCodeRegistrationDisabled, "Registration is disabled.")
+	}
+
+	req := RegisterRequest{}
+	if err := c.Bind(&req); err != nil {
+		return nil, NewApiError(http.StatusBadRequest, ErrCodeInvalidRequest, "Invalid request.")
+	}
+
+	addr, err := mail.ParseAddress(req.Email)
+	if err != nil || addr.Address != req.Email {
+		return nil, NewApiError(http.StatusBadRequest, ErrCodeInvalidEmail, "Invalid email address.")
+	}
+
+	if len(req.Password) < models.DEFAULT_MIN_PASSWORD_LENGTH {
+		return nil, NewApiError(http.StatusBadRequest, ErrCodeInvalidPassword, "The password is too short.")
+	}
+
+	user, err := api.app.Users().Insert(&users.User{
+		Name:   strings.TrimSpace(req.Name),
+		Email:  req.Email,
+		Active: true,
+	}, req.Password)
+	if err != nil {
+		// Most likely the email is taken. We don't tell, see doLogin.
+		api.app.Logger().Info("Registration failed", "error", err)
+		return nil, NewApiError(http.StatusBadRequest, ErrCodeRegistrationFailed, "Registration failed.")
+	}
+
+	if err := api.sendVerification(user); err != nil {
+		return nil, err
+	}
+
+	// Unverified users can't log in, so they don't get a session either
+	if api.app.CMSettings().RequireVerification {
+		return user, nil
+	}
+
+	if err := startSession(api.app, c, api.cookie, user, true); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// startSession creates a new session for the user and sets the session cookie.
+// A session of the request, if any, is deleted to prevent session fixation, so
+// every login results in a new session token.
+func startSession(app *manager.Manager, c echo.Context, cookie CookieConfig, user *users.User, short bool) error {
+	if old := GetSession(c); old != nil {
+		_ = app.Sessions().DeleteBySession(old.Session)
+	}
+
+	session, err := app.Sessions().Insert(user.ID, short, c.Request().UserAgent(), c.RealIP())
+	if err != nil {
+		return err
+	}
+
+	SetSessionCookie(c, cookie, session, short)
+	c.Set(ContextSessionKey, session)
+	c.Set(ContextUserKey, user)
+
+	return nil
+}
+
+// rotateSession gives the session of the request a new token and updates the
+// session cookie. See [sessions.SessionManager.Rotate].
+func rotateSession(app *manager.Manager, c echo.Context, cookie CookieConfig, session *sessions.Session) error {
+	n, err := app.Sessions().Rotate(session)
+	if err != nil {
+		return err
+	}
+
+	SetSessionCookie(c, cookie, n, app.Sessions().IsShort(n))
+	c.Set(ContextSessionKey, n)
+	return nil
+}
+
+// contextFormErrorKey holds the ApiError of a form handler, see formError.
+const contextFormErrorKey string = "form_error"
+
+// formError redirects back to the form page with the error code of err.
+// Errors that are not ApiErrors are returned as they are.
+func formError(c echo.Context, page string, err error) error {
+	apiErr, ok := err.(*ApiError)
+	if !ok {
+		return err
+	}
+
+	// The error is gone after the redirect, but middlewares may need it, see RateLimit
+	c.Set(contextFormErrorKey, apiErr)
+
+	sep := "?"
+	if strings.Contains(page, "?") {
+		sep = "&"
+	}
+
+	return c.Redirect(http.StatusSeeOther, page+sep+"error="+url.QueryEscape(apiErr.Code))
+}
+
+// nextPath returns the local path given in the "next" form field, or def.
+// Only local paths are allowed to prevent open redirects.
+func nextPath(c echo.Context, def string) string {
+	next := c.FormValue("next")
+	if next == "" || !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return def
+	}
+	return next
+}
@@ -0,0 +1,87 @@
+// Package apis implements the HTTP layer of Caveman: the default Echo router,
+// middlewares and handlers, as well as starting and stopping the server.
+package apis
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Simon-Martens/caveman/manager"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// InitApi creates a new Echo router with the default Caveman middlewares
+// and routes registered. The manager must be bootstrapped.
+func InitApi(app *manager.Manager, config ServeConfig) (*echo.Echo, error) {
+	e := echo.New()
+	e.Debug = app.IsDev()
+	e.HideBanner = true
+	e.HidePort = true
+	e.HTTPErrorHandler = errorHandler(e)
+
+	extractor, err := ipExtractor(config.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	e.IPExtractor = extractor
+
+	e.Pre(middleware.RemoveTrailingSlash())
+	e.Use(middleware.Recover())
+	e.Use(middleware.Secure())
+	e.Use(LoadAPIToken(app))
+	e.Use(LoadSession(app, config.Cookie))
+	e.Use(CSRF(app, config.CSRF))
+	e.Use(RequireSetup(app, config.Auth))
+
+	bindHealthApi(app, e.Group("/api"))
+	bindAuthApi(app, e, config)
+	bindSetupApi(app, e, config)
+	bindUsersApi(app, e.Group("/api/users"), config)
+
+	return e, nil
+}
+
+// ipExtractor returns the IP extractor of the router. Without trusted proxies,
+// the IP of the connection is used, since clients can send any X-Forwarded-For
+// or X-Real-IP header, eg. to escape rate limits.
+func ipExtractor(proxies []string) (echo.IPExtractor, error) {
+	if len(proxies) == 0 {
+		return echo.ExtractIPDirect(), nil
+	}
+
+	opts := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", p)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			p = ip.String() + "/" + strconv.Itoa(bits)
+		}
+
+		_, ipnet, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", p)
+		}
+		opts = append(opts, echo.TrustIPRange(ipnet))
+	}
+
+	return echo.ExtractIPFromXFFHeader(opts...), nil
+}
+
+func bindHealthApi(app *manager.Manager, g *echo.Group) {
+	g.GET("/health", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, map[string]any{
+			"code":    http.StatusOK,
+			"message": "API is healthy.",
+		})
+	})
+}
@@ -0,0 +1,68 @@
+package apis
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/Simon-Martens/caveman/db/sessions"
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/labstack/echo/v4"
+)
+
+// CookieConfig defines the attributes of the session cookie.
+// The cookie is always HttpOnly.
+type CookieConfig struct {
+	Name     string
+	Path     string
+	Domain   string
+	Secure   bool
+	SameSite http.SameSite
+}
+
+// DefaultCookieConfig returns the default session cookie config.
+// Secure should only be false in development, where the server might be
+// reached via plain HTTP.
+func DefaultCookieConfig(secure bool) CookieConfig {
+	return CookieConfig{
+		Name:     models.DEFAULT_SESSION_COOKIE_NAME,
+		Path:     "/",
+		Secure:   secure,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// SetSessionCookie writes the session cookie for the given session.
+//
+// Short sessions are stored in a browser session cookie that is dropped when the
+// browser is closed, long sessions in a persistent cookie that expires together
+// with the session.
+func SetSessionCookie(c echo.Context, config CookieConfig, session *sessions.Session, short bool) {
+	ck := newCookie(config, session.Session)
+
+	if !short && !session.Expires.IsZero() {
+		ck.Expires = *session.Expires.Time()
+		ck.MaxAge = int(time.Until(ck.Expires).Seconds())
+	}
+
+	c.SetCookie(ck)
+}
+
+// ClearSessionCookie removes the session cookie from the browser.
+func ClearSessionCookie(c echo.Context, config CookieConfig) {
+	ck := newCookie(config, "")
+	ck.Expires = time.Unix(0, 0)
+	ck.MaxAge = -1
+	c.SetCookie(ck)
+}
+
+func newCookie(config CookieConfig, value string) *http.Cookie {
+	return &http.Cookie{
+		Name:     config.Name,
+		Value:    value,
+		Path:     config.Path,
+		Domain:   config.Domain,
+		Secure:   config.Secure,
+		HttpOnly: true,
+		SameSite: config.SameSite,
+	}
+}
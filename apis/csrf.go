@@ -0,0 +1,145 @@
+package apis
+
+import (
+	"html/template"
+	"net/http"
+
+	"github.com/Simon-Martens/caveman/manager"
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/Simon-Martens/caveman/tools/security"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+const (
+	ContextCSRFKey      string = "csrf"
+	contextCSRFFieldKey string = "csrf_field"
+)
+
+// CSRFConfig defines the config for the [CSRF] middleware.
+type CSRFConfig struct {
+	// Skipper defines a function to skip the middleware, eg. for requests
+	// authenticated by other means than a cookie.
+	Skipper middleware.Skipper
+
+	// Header and FormField are the places where the token is looked up,
+	// in that order.
+	Header    string
+	FormField string
+
+	// Cookie configures the cookie that identifies anonymous visitors.
+	Cookie CookieConfig
+}
+
+// DefaultCSRFConfig returns the default CSRF config.
+func DefaultCSRFConfig(secure bool) CSRFConfig {
+	c := CSRFConfig{
+		Skipper:   middleware.DefaultSkipper,
+		Header:    models.DEFAULT_CSRF_HEADER,
+		FormField: models.DEFAULT_CSRF_FORM_FIELD,
+		Cookie:    DefaultCookieConfig(secure),
+	}
+	c.Cookie.Name = models.DEFAULT_CSRF_COOKIE_NAME
+	return c
+}
+
+// CSRF creates a token for every request and stores it in the request context,
+// see [CSRFToken] and [CSRFField]. Requests with unsafe methods must provide a
+// valid token, otherwise they are rejected.
+//
+// Requests with a session (see [LoadSession]) get tokens bound to the session.
+// Anonymous visitors get a random id cookie the tokens are bound to instead.
+func CSRF(app *manager.Manager, config CSRFConfig) echo.MiddlewareFunc {
+	if config.Skipper == nil {
+		config.Skipper = middleware.DefaultSkipper
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			// API tokens are no cookies, so they can't be forged cross-site
+			if config.Skipper(c) || GetAPIToken(c) != nil {
+				return next(c)
+			}
+
+			sm := app.Sessions()
+			session := GetSession(c)
+
+			var anon string
+			if session == nil {
+				ck, err := c.Cookie(config.Cookie.Name)
+				if err == nil && ck.Value != "" {
+					anon = ck.Value
+				}
+			}
+
+			switch c.Request().Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			default:
+				token := c.Request().Header.Get(config.Header)
+				if token == "" {
+					token = c.FormValue(config.FormField)
+				}
+
+				var valid bool
+				if session != nil {
+					valid = sm.ValidateCSRFToken(session, token)
+				} else {
+					valid = sm.ValidateAnonymousCSRFToken(anon, token)
+				}
+
+				if !valid {
+					return echo.NewHTTPError(http.StatusForbidden, "Invalid or missing CSRF token.")
+				}
+			}
+
+			if session != nil {
+				c.Set(ContextCSRFKey, sm.CreateCSRFToken(session))
+			} else {
+				if anon == "" {
+					id, err := security.CreateRandomSHA256Token()
+					if err != nil {
+						return err
+					}
+					anon = id
+					c.SetCookie(newCookie(config.Cookie, anon))
+				}
+				c.Set(ContextCSRFKey, sm.CreateAnonymousCSRFToken(anon))
+			}
+			c.Set(contextCSRFFieldKey, config.FormField)
+
+			return next(c)
+		}
+	}
+}
+
+// CSRFToken returns the CSRF token of the request. Requires [CSRF] to run first.
+func CSRFToken(c echo.Context) string {
+	t, _ := c.Get(ContextCSRFKey).(string)
+	return t
+}
+
+// CSRFField returns a hidden form input containing the CSRF token of the request,
+// to be used in templates. Requires [CSRF] to run first.
+func CSRFField(c echo.Context) template.HTML {
+	field, _ := c.Get(contextCSRFFieldKey).(string)
+	if field == "" {
+		field = models.DEFAULT_CSRF_FORM_FIELD
+	}
+
+	return template.HTML(`<input type="hidden" name="` +
+		template.HTMLEscapeString(field) +
+		`" value="` +
+		template.HTMLEscapeString(CSRFToken(c)) +
+		`">`)
+}
+
+// CSRFTemplateFuncs returns template functions for the request, to be merged
+// into the FuncMap of request scoped templates:
+//
+//	{{ csrf_field }} or <meta name="csrf-token" content="{{ csrf_token }}">
+func CSRFTemplateFuncs(c echo.Context) template.FuncMap {
+	return template.FuncMap{
+		"csrf_token": func() string { return CSRFToken(c) },
+		"csrf_field": func() template.HTML { return CSRFField(c) },
+	}
+}
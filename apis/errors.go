@@ -0,0 +1,78 @@
+package apis
+
+import (
+	"github.com/labstack/echo/v4"
+)
+
+// Stable error codes returned by the api handlers. Clients should rely on
+// these instead of the (human readable) messages.
+const (
+	ErrCodeInvalidRequest       string = "invalid_request"
+	ErrCodeInvalidCredentials   string = "invalid_credentials"
+	ErrCodeInvalidEmail         string = "invalid_email"
+	ErrCodeInvalidPassword      string = "invalid_password"
+	ErrCodeRegistrationDisabled string = "registration_disabled"
+	ErrCodeRegistrationFailed   string = "registration_failed"
+	ErrCodeInvalidToken         string = "invalid_token"
+	ErrCodeSetupRequired        string = "setup_required"
+	ErrCodeSetupDone            string = "setup_done"
+	ErrCodeInvalidSettings      string = "invalid_settings"
+	ErrCodeNotVerified          string = "not_verified"
+	ErrCodeAccountInactive      string = "account_inactive"
+	ErrCodeAccountExpired       string = "account_expired"
+	ErrCodeNotFound             string = "not_found"
+	ErrCodeOutOfScope           string = "out_of_scope"
+	ErrCodeRateLimited          string = "rate_limited"
+	ErrCodeAccountLocked        string = "account_locked"
+	ErrCodeTwoFactorRequired    string = "two_factor_required"
+	ErrCodeNoAccount            string = "no_account"
+	ErrCodeIdentityLinked       string = "identity_linked"
+	ErrCodeProviderError        string = "provider_error"
+)
+
+// ApiError defines the response body of a failed api request.
+type ApiError struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// NewApiError creates a new ApiError.
+func NewApiError(status int, code string, message string) *ApiError {
+	return &ApiError{
+		Status:  status,
+		Code:    code,
+		Message: message,
+	}
+}
+
+// Error implements the error interface.
+func (e *ApiError) Error() string {
+	return e.Message
+}
+
+// errorHandler renders ApiErrors as JSON and falls back to the default
+// Echo error handler for every other error.
+func errorHandler(e *echo.Echo) echo.HTTPErrorHandler {
+	return func(err error, c echo.Context) {
+		apiErr, ok := err.(*ApiError)
+		if !ok {
+			e.DefaultHTTPErrorHandler(err, c)
+			return
+		}
+
+		if c.Response().Committed {
+			return
+		}
+
+		if c.Request().Method == "HEAD" {
+			err = c.NoContent(apiErr.Status)
+		} else {
+			err = c.JSON(apiErr.Status, apiErr)
+		}
+
+		if err != nil {
+			e.Logger.Error(err)
+		}
+	}
+}
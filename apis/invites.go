@@ -0,0 +1,191 @@
+package apis
+
+import (
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Simon-Martens/caveman/db/roles"
+	"github.com/Simon-Martens/caveman/db/users"
+	"github.com/Simon-Martens/caveman/manager"
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/labstack/echo/v4"
+)
+
+// InviteRequest is the body of a request that creates an invite. Seconds is the
+// lifetime of the invite, 0 selects the default.
+type InviteRequest struct {
+	Email   string `json:"email" form:"email"`
+	Role    string `json:"role" form:"role"`
+	Uses    int64  `json:"uses" form:"uses"`
+	Seconds int64  `json:"seconds" form:"seconds"`
+}
+
+// AcceptInviteRequest is the body of a request that redeems an invite. The email
+// is ignored for invites to an email.
+type AcceptInviteRequest struct {
+	Token    string `json:"token" form:"token"`
+	Name     string `json:"name" form:"name"`
+	Email    string `json:"email" form:"email"`
+	Password string `json:"password" form:"password"`
+}
+
+// bindInvitesApi registers the invites. Users with the PERMISSION_MANAGE_USERS
+// permission create invites, invited users accept them on the invite page, even
+// if registration is disabled.
+func bindInvitesApi(api authApi, e *echo.Echo, g *echo.Group) {
+	g.POST("/invites", api.invite, RequirePermission(api.app, models.PERMISSION_MANAGE_USERS))
+
+	g.POST("/invite", api.acceptInvite, RateLimit(api.app))
+	e.POST(api.config.InvitePage, api.acceptInviteForm, RateLimit(api.app))
+}
+
+// invite creates an invite and responds with its link. Invites to an email are
+// also sent to the address.
+func (api *authApi) invite(c echo.Context) error {
+	req := InviteRequest{}
+	if err := c.Bind(&req); err != nil || req.Uses < 0 || req.Seconds < 0 {
+		return NewApiError(http.StatusBadRequest, ErrCodeInvalidRequest, "Invalid request.")
+	}
+
+	req.Email = strings.TrimSpace(req.Email)
+	if req.Email != "" {
+		addr, err := mail.ParseAddress(req.Email)
+		if err != nil || addr.Address != req.Email {
+			return NewApiError(http.StatusBadRequest, ErrCodeInvalidEmail, "Invalid email address.")
+		}
+	}
+
+	// Like role changes, only admins may make others admins
+	if req.Role == models.ROLE_ADMIN && GetUser(c).Role != models.ROLE_ADMIN {
+		return NewApiError(http.StatusForbidden, ErrCodeInvalidRequest, "Only admins can invite admins.")
+	}
+
+	at, err := api.app.CreateInvite(GetUser(c).ID, req.Email, req.Role, req.Uses, time.Duration(req.Seconds)*time.Second)
+	if err == roles.ErrRoleNotFound {
+		return NewApiError(http.StatusBadRequest, ErrCodeInvalidRequest, "Unknown role.")
+	} else if err == manager.ErrInviteEmailTaken {
+		return NewApiError(http.StatusConflict, ErrCodeInvalidEmail, "The email address is already registered.")
+	} else if err != nil {
+		return err
+	}
+
+	link := InviteLink(api.app, api.config.InvitePage, at.Token)
+
+	if req.Email != "" {
+		invited := &users.User{Email: req.Email, Role: at.TokenData["role"].(string)}
+		api.app.Go(func() {
+			if err := api.config.SendInvite(invited, link); err != nil {
+				api.app.Logger().Error("Failed to send invite", "email", invited.Email, "error", err)
+			}
+		})
+	}
+
+	return c.JSON(http.StatusCreated, map[string]any{
+		"token":   at.Token,
+		"link":    link,
+		"email":   req.Email,
+		"role":    at.TokenData["role"],
+		"uses":    at.Uses,
+		"expires": at.Expires,
+	})
+}
+
+// acceptInvite responds like login, with 202 and the stage of the pending
+// session if the role of the invite requires a second factor.
+func (api *authApi) acceptInvite(c echo.Context) error {
+	user, stage, err := api.doAcceptInvite(c)
+	if err != nil {
+		return err
+	}
+
+	if stage != "" {
+		return c.JSON(http.StatusAccepted, map[string]any{"second_factor": stage})
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{"user": user})
+}
+
+func (api *authApi) acceptInviteForm(c echo.Context) error {
+	user, stage, err := api.doAcceptInvite(c)
+	if err != nil {
+		return formError(c, api.config.InvitePage+"?token="+url.QueryEscape(c.FormValue("token")), err)
+	}
+
+	if stage != "" {
+		return c.Redirect(http.StatusSeeOther, api.twoFactorPage(stage, nextPath(c, "")))
+	}
+
+	if !user.Verified && api.app.CMSettings().RequireVerification {
+		return c.Redirect(http.StatusSeeOther, api.config.LoginPage+"?verify=1")
+	}
+
+	return c.Redirect(http.StatusSeeOther, nextPath(c, api.config.LoginRedirect))
+}
+
+// doAcceptInvite registers the invited user and starts a session, like
+// doRegister. Users of roles that require a second factor get a pending session
+// to set it up. Users that still have to verify the email get no session.
+func (api *authApi) doAcceptInvite(c echo.Context) (*users.User, string, error) {
+	req := AcceptInviteRequest{}
+	if err := c.Bind(&req); err != nil || req.Token == "" {
+		return nil, "", NewApiError(http.StatusBadRequest, ErrCodeInvalidRequest, "Token and password are required.")
+	}
+
+	// We check the request first, the invite is used up when selected
+	if req.Email != "" {
+		addr, err := mail.ParseAddress(req.Email)
+		if err != nil || addr.Address != req.Email {
+			return nil, "", NewApiError(http.StatusBadRequest, ErrCodeInvalidEmail, "Invalid email address.")
+		}
+	}
+
+	if len(req.Password) < models.DEFAULT_MIN_PASSWORD_LENGTH {
+		return nil, "", NewApiError(http.StatusBadRequest, ErrCodeInvalidPassword, "The password is too short.")
+	}
+
+	user, err := api.app.AcceptInvite(req.Token, &users.User{
+		Name:  strings.TrimSpace(req.Name),
+		Email: req.Email,
+	}, req.Password)
+	if err == manager.ErrInviteInvalid {
+		return nil, "", NewApiError(http.StatusBadRequest, ErrCodeInvalidToken, "The invite is invalid or expired.")
+	} else if err == manager.ErrInviteEmail {
+		return nil, "", NewApiError(http.StatusBadRequest, ErrCodeInvalidEmail, "The email address does not match the invite.")
+	} else if err != nil && err != users.ErrSecondFactorSetupRequired {
+		// See doRegister
+		api.app.Logger().Info("Registration with invite failed", "error", err)
+		return nil, "", NewApiError(http.StatusBadRequest, ErrCodeRegistrationFailed, "Registration failed.")
+	}
+
+	if !user.Verified {
+		if err := api.sendVerification(user); err != nil {
+			return nil, "", err
+		}
+
+		if api.app.CMSettings().RequireVerification {
+			return user, "", nil
+		}
+	}
+
+	if err == users.ErrSecondFactorSetupRequired {
+		stage, err := api.startPendingLogin(c, user, err, true)
+		if err != nil {
+			return nil, "", err
+		}
+		return user, stage, nil
+	}
+
+	if err := startSession(api.app, c, api.cookie, user, true); err != nil {
+		return nil, "", err
+	}
+
+	return user, "", nil
+}
+
+// InviteLink returns the link of the invite to the page, below the URL setting.
+func InviteLink(app *manager.Manager, page, token string) string {
+	return strings.TrimRight(app.CMSettings().URL, "/") + page + "?token=" + url.QueryEscape(token)
+}
@@ -0,0 +1,66 @@
+package apis
+
+import (
+	"net/mail"
+
+	"github.com/Simon-Martens/caveman/db/users"
+	"github.com/Simon-Martens/caveman/mailer"
+	"github.com/Simon-Martens/caveman/manager"
+	"github.com/Simon-Martens/caveman/models"
+)
+
+// MailData is passed to the mail templates.
+type MailData struct {
+	User     *users.User
+	Link     string
+	Settings *models.Settings
+}
+
+// PasswordResetMail is the default template of password reset mails.
+var PasswordResetMail = &mailer.Template{
+	Subject: `Reset your password for {{ .Settings.Name }}`,
+	Text: `Hello {{ .User.Name | default .User.Email }},
+
+a password reset was requested for your account at {{ .Settings.Name }}.
+Open the following link to choose a new password:
+
+{{ .Link }}
+
+If you did not request this, you can ignore this mail.
+`,
+}
+
+// VerificationMail is the default template of email verification mails.
+var VerificationMail = &mailer.Template{
+	Subject: `Verify your email for {{ .Settings.Name }}`,
+	Text: `Hello {{ .User.Name | default .User.Email }},
+
+please confirm your email address for {{ .Settings.Name }} by opening the following link:
+
+{{ .Link }}
+
+If you did not create an account, you can ignore this mail.
+`,
+}
+
+// InviteMail is the default template of invite mails.
+var InviteMail = &mailer.Template{
+	Subject: `You are invited to {{ .Settings.Name }}`,
+	Text: `Hello,
+
+you have been invited to create an account at {{ .Settings.Name }}.
+Open the following link to choose a password:
+
+{{ .Link }}
+
+If you did not expect this invite, you can ignore this mail.
+`,
+}
+
+// MailLink returns a hook, that mails the link to the user with the app mailer.
+func MailLink(app *manager.Manager, t *mailer.Template) func(user *users.User, link string) error {
+	return func(user *users.User, link string) error {
+		data := MailData{User: user, Link: link, Settings: app.CMSettings()}
+		return app.SendTemplate(t, mail.Address{Name: user.Name, Address: user.Email}, data)
+	}
+}
@@ -0,0 +1,289 @@
+package apis
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Simon-Martens/caveman/db/apitokens"
+	"github.com/Simon-Martens/caveman/db/attempts"
+	"github.com/Simon-Martens/caveman/db/sessions"
+	"github.com/Simon-Martens/caveman/db/users"
+	"github.com/Simon-Martens/caveman/manager"
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/labstack/echo/v4"
+)
+
+// Common request context keys used by the middlewares and api handlers.
+const (
+	ContextSessionKey  string = "session"
+	ContextUserKey     string = "user"
+	ContextAPITokenKey string = "api_token"
+)
+
+// LoadAPIToken reads an API token from the "Authorization: Bearer <token>"
+// header and, if it is valid, stores the token and its user in the request
+// context. Requests without the header pass, but a presented token must be valid
+// and its scope must cover the request, otherwise the request is rejected.
+//
+// Requests authenticated by API token have no session: [LoadSession] ignores the
+// session cookie and [CSRF] does not check them, since no cookie is involved.
+func LoadAPIToken(app *manager.Manager) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			auth := c.Request().Header.Get(echo.HeaderAuthorization)
+			scheme, token, found := strings.Cut(auth, " ")
+			if !found || !strings.EqualFold(scheme, "Bearer") {
+				return next(c)
+			}
+
+			at, user, err := app.AuthenticateAPIToken(strings.TrimSpace(token))
+			if errors.Is(err, users.ErrUserInactive) {
+				return NewApiError(http.StatusForbidden, ErrCodeAccountInactive, "Your account is deactivated.")
+			} else if errors.Is(err, users.ErrUserExpired) {
+				return NewApiError(http.StatusForbidden, ErrCodeAccountExpired, "Your account is expired.")
+			} else if err != nil {
+				return NewApiError(http.StatusUnauthorized, ErrCodeInvalidToken, "The API token is invalid or expired.")
+			}
+
+			if !at.Allows(c.Request().Method, c.Request().URL.Path) {
+				return NewApiError(http.StatusForbidden, ErrCodeOutOfScope, "The API token does not allow this request.")
+			}
+
+			c.Set(ContextAPITokenKey, at)
+			c.Set(ContextUserKey, user)
+
+			return next(c)
+		}
+	}
+}
+
+// LoadSession reads the session cookie and, if it refers to a valid session,
+// stores the session and its user in the request context. It never rejects a
+// request, use [RequireAuth] or [RequirePermission] to guard routes.
+//
+// Pending sessions of logins that wait for a second factor are left alone.
+// Invalid or expired session cookies, and sessions of deactivated or expired
+// users, are removed. With sliding expiration, sessions in use are renewed,
+// see [sessions.SessionManager.Touch]. The LastSeen time of the user
+// is refreshed at most once every DEFAULT_LAST_SEEN_INTERVAL seconds.
+func LoadSession(app *manager.Manager, config CookieConfig) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			// Authenticated by API token, see LoadAPIToken
+			if GetUser(c) != nil {
+				return next(c)
+			}
+
+			ck, err := c.Cookie(config.Name)
+			if err != nil || ck.Value == "" {
+				return next(c)
+			}
+
+			session, user, err := app.Authenticate(ck.Value)
+			if err == sessions.ErrSessionPending {
+				// The login waits for a second factor, see bindTwoFactorApi
+				return next(c)
+			} else if err != nil {
+				ClearSessionCookie(c, config)
+				return next(c)
+			}
+
+			if renewed, err := app.Sessions().Touch(session); err != nil {
+				app.Logger().Error("Failed to renew session", "user", user.ID, "error", err)
+			} else if renewed && !app.Sessions().IsShort(session) {
+				SetSessionCookie(c, config, session, false)
+			}
+
+			c.Set(ContextSessionKey, session)
+			c.Set(ContextUserKey, user)
+
+			interval := time.Duration(models.DEFAULT_LAST_SEEN_INTERVAL) * time.Second
+			if user.LastSeen.IsZero() || time.Since(*user.LastSeen.Time()) > interval {
+				if err := app.Users().UpdateLastSeen(user); err != nil {
+					app.Logger().Error("Failed to update last seen", "user", user.ID, "error", err)
+				}
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// RequireAuth rejects requests without an authenticated user, by session or API
+// token. Requires [LoadSession] to run first.
+func RequireAuth() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if GetUser(c) == nil {
+				return echo.NewHTTPError(http.StatusUnauthorized, "The request requires a valid session.")
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// RequireSession rejects requests without a session, eg. for account settings
+// that must not be changed with an API token. Requires [LoadSession] to run first.
+func RequireSession() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if GetSession(c) == nil {
+				return echo.NewHTTPError(http.StatusUnauthorized, "The request requires a valid session.")
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// RequireRole rejects requests without an authenticated user or with a user that
+// has none of the given roles. API tokens must be granted all permissions of
+// their user to pass. Prefer [RequirePermission], so the access can be
+// configured. Requires [LoadSession] to run first.
+func RequireRole(roles ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			user := GetUser(c)
+			if user == nil {
+				return echo.NewHTTPError(http.StatusUnauthorized, "The request requires a valid session.")
+			}
+
+			if at := GetAPIToken(c); at != nil && !at.HasPermission(models.API_TOKEN_ALL_PERMISSIONS) {
+				return echo.NewHTTPError(http.StatusForbidden, "You are not allowed to perform this request.")
+			}
+
+			if !slices.Contains(roles, user.Role) {
+				return echo.NewHTTPError(http.StatusForbidden, "You are not allowed to perform this request.")
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// RequirePermission rejects requests without an authenticated user or with a user
+// whose role lacks one of the given permissions. Requests authenticated by API
+// token also need the permissions in the scope of the token.
+// Requires [LoadSession] to run first.
+func RequirePermission(app *manager.Manager, permissions ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			user := GetUser(c)
+			if user == nil {
+				return echo.NewHTTPError(http.StatusUnauthorized, "The request requires a valid session.")
+			}
+
+			at := GetAPIToken(c)
+			for _, p := range permissions {
+				if !app.Can(user, p) || at != nil && !at.HasPermission(p) {
+					return echo.NewHTTPError(http.StatusForbidden, "You are not allowed to perform this request.")
+				}
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// GetSession returns the session of the request or nil, if there is none.
+func GetSession(c echo.Context) *sessions.Session {
+	s, _ := c.Get(ContextSessionKey).(*sessions.Session)
+	return s
+}
+
+// GetUser returns the authenticated user of the request or nil, if there is none.
+func GetUser(c echo.Context) *users.User {
+	u, _ := c.Get(ContextUserKey).(*users.User)
+	return u
+}
+
+// GetAPIToken returns the API token the request was authenticated with or nil,
+// if there is none.
+func GetAPIToken(c echo.Context) *apitokens.APIToken {
+	at, _ := c.Get(ContextAPITokenKey).(*apitokens.APIToken)
+	return at
+}
+
+// RateLimit limits failed attempts per IP, eg. guessing tokens or passwords.
+// Requests from blocked IPs are rejected with 429. Requests fail if the handler
+// returns an ApiError with ErrCodeInvalidCredentials or ErrCodeInvalidToken, also
+// if formError turned it into a redirect. Logins need no RateLimit, they are limited
+// by the users manager, see [users.UserManager.CheckGetUserFrom].
+func RateLimit(app *manager.Manager) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			key := attempts.IPKey(c.RealIP())
+			if err := app.Attempts().Check(key); err != nil {
+				return rateLimitError(c, err)
+			}
+
+			err := next(c)
+
+			apiErr, ok := err.(*ApiError)
+			if !ok {
+				apiErr, _ = c.Get(contextFormErrorKey).(*ApiError)
+			}
+
+			if apiErr != nil && (apiErr.Code == ErrCodeInvalidCredentials || apiErr.Code == ErrCodeInvalidToken) {
+				if _, ferr := app.Attempts().Fail(key, false); ferr != nil {
+					app.Logger().Error("Failed to count failed attempt", "ip", c.RealIP(), "error", ferr)
+				}
+			}
+
+			return err
+		}
+	}
+}
+
+// LimitChallenges limits requests that store a challenge before the user proved
+// anything, eg. the begin of a passkey login, since every challenge is kept in
+// the database until it expires. Every request counts as a failed attempt of the
+// ChallengeKey of the IP, so IPs that begin logins without finishing them are
+// blocked like failed logins. Finished logins reset the key, see resetChallenges.
+func LimitChallenges(app *manager.Manager) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			key := attempts.ChallengeKey(c.RealIP())
+			if err := app.Attempts().Check(key); err != nil {
+				return rateLimitError(c, err)
+			}
+
+			if _, err := app.Attempts().Fail(key, false); err != nil {
+				return err
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// resetChallenges forgets the challenges of the IP once a login finished.
+func resetChallenges(app *manager.Manager, c echo.Context) {
+	if err := app.Attempts().Reset(attempts.ChallengeKey(c.RealIP())); err != nil {
+		app.Logger().Error("Failed to reset challenges", "ip", c.RealIP(), "error", err)
+	}
+}
+
+// rateLimitError turns the error of a blocked attempt into an ApiError and sets
+// the Retry-After header. Other errors are returned as they are.
+func rateLimitError(c echo.Context, err error) error {
+	var berr *attempts.BlockedError
+	if !errors.As(err, &berr) {
+		return err
+	}
+
+	retry := max(1, int(math.Ceil(berr.RetryAfter().Seconds())))
+	c.Response().Header().Set(echo.HeaderRetryAfter, strconv.Itoa(retry))
+
+	if berr.Locked {
+		return NewApiError(http.StatusTooManyRequests, ErrCodeAccountLocked, "Too many failed attempts, the account is locked for now.")
+	}
+
+	return NewApiError(http.StatusTooManyRequests, ErrCodeRateLimited, "Too many failed attempts, please try again later.")
+}
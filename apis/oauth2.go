@@ -0,0 +1,232 @@
+package apis
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Simon-Martens/caveman/auth/oauth2"
+	"github.com/Simon-Martens/caveman/db/identities"
+	"github.com/Simon-Martens/caveman/db/users"
+	"github.com/Simon-Martens/caveman/manager"
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/labstack/echo/v4"
+)
+
+// oauth2Path is the path of the OAuth2 api below /api/auth.
+const oauth2Path = "/oauth2"
+
+// bindOAuth2Api registers the logins with the providers of AuthConfig.Providers.
+// A login starts at /oauth2/:provider, which redirects to the provider, and ends
+// at the callback the provider redirects back to. Users link a provider to their
+// account by posting to /oauth2/:provider/link, which continues the same way.
+func bindOAuth2Api(api authApi, e *echo.Echo, g *echo.Group) {
+	g.GET(oauth2Path, api.oauth2Providers)
+	g.GET(oauth2Path+"/:provider", api.oauth2Login, RateLimit(api.app), LimitChallenges(api.app))
+	g.POST(oauth2Path+"/:provider/link", api.oauth2Link, RequireSession())
+	g.GET(oauth2Path+"/:provider/callback", api.oauth2Callback, RateLimit(api.app))
+
+	g.GET("/identities", api.identities, RequireSession())
+	g.DELETE("/identities/:id", api.unlinkIdentity, RequireSession())
+}
+
+func (api *authApi) oauth2Providers(c echo.Context) error {
+	list := make([]map[string]string, 0, len(api.config.Providers))
+	for _, p := range api.config.Providers {
+		name := p.DisplayName
+		if name == "" {
+			name = p.Name
+		}
+		list = append(list, map[string]string{"name": p.Name, "display_name": name})
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{"providers": list})
+}
+
+func (api *authApi) oauth2Login(c echo.Context) error {
+	p, err := api.provider(c)
+	if err != nil {
+		return err
+	}
+
+	return api.oauth2Begin(c, p, nil)
+}
+
+func (api *authApi) oauth2Link(c echo.Context) error {
+	p, err := api.provider(c)
+	if err != nil {
+		return err
+	}
+
+	return api.oauth2Begin(c, p, GetUser(c))
+}
+
+// oauth2Begin redirects to the provider. The state is also set as cookie, so
+// the callback only accepts it from the browser that started the login.
+func (api *authApi) oauth2Begin(c echo.Context, p *oauth2.Provider, user *users.User) error {
+	redirect, err := api.oauth2Redirect(p)
+	if err != nil {
+		return err
+	}
+
+	u, state, err := api.app.BeginOAuth2(c.Request().Context(), p, redirect, user, nextPath(c, ""))
+	if err != nil {
+		return oauth2Error(err)
+	}
+
+	c.SetCookie(api.oauth2Cookie(state, models.DEFAULT_OAUTH2_STATE_EXPIRATION))
+	return c.Redirect(http.StatusSeeOther, u)
+}
+
+// oauth2Callback finishes the login, or the link, and redirects like the login
+// form. Errors redirect to the login page, errors of links to the identities page.
+func (api *authApi) oauth2Callback(c echo.Context) error {
+	p, err := api.provider(c)
+	if err != nil {
+		return err
+	}
+
+	current := GetUser(c)
+	page := api.config.LoginPage
+	if current != nil {
+		page = api.config.IdentitiesPage
+	}
+
+	state := c.QueryParam("state")
+	ck, cerr := c.Cookie(models.DEFAULT_OAUTH2_COOKIE_NAME)
+	c.SetCookie(api.oauth2Cookie("", -1))
+
+	if cerr != nil || state == "" || subtle.ConstantTimeCompare([]byte(ck.Value), []byte(state)) != 1 {
+		return formError(c, page, oauth2Error(manager.ErrOAuth2State))
+	}
+
+	if c.QueryParam("error") != "" {
+		return formError(c, page, NewApiError(http.StatusBadGateway, ErrCodeProviderError, "The login with the provider was cancelled or failed."))
+	}
+
+	redirect, err := api.oauth2Redirect(p)
+	if err != nil {
+		return err
+	}
+
+	login, err := api.app.FinishOAuth2(c.Request().Context(), p, redirect, state, c.QueryParam("code"), current)
+	if err == nil || err == users.ErrSecondFactorRequired || err == users.ErrSecondFactorSetupRequired {
+		resetChallenges(api.app, c)
+	}
+
+	if err == users.ErrSecondFactorRequired || err == users.ErrSecondFactorSetupRequired {
+		stage, err := api.startPendingLogin(c, login.User, err, true)
+		if err != nil {
+			return err
+		}
+		return c.Redirect(http.StatusSeeOther, api.twoFactorPage(stage, login.Next))
+	} else if err != nil {
+		return formError(c, page, oauth2Error(err))
+	}
+
+	if login.Link {
+		return c.Redirect(http.StatusSeeOther, orDefault(login.Next, api.config.IdentitiesPage))
+	}
+
+	if err := startSession(api.app, c, api.cookie, login.User, true); err != nil {
+		return err
+	}
+
+	return c.Redirect(http.StatusSeeOther, orDefault(login.Next, api.config.LoginRedirect))
+}
+
+func (api *authApi) identities(c echo.Context) error {
+	ids, err := api.app.Identities().SelectByUser(GetUser(c).ID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{"identities": ids})
+}
+
+func (api *authApi) unlinkIdentity(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return NewApiError(http.StatusNotFound, ErrCodeNotFound, "Identity not found.")
+	}
+
+	if err := api.app.Identities().DeleteByID(GetUser(c).ID, id); err == identities.ErrIdentityNotFound {
+		return NewApiError(http.StatusNotFound, ErrCodeNotFound, "Identity not found.")
+	} else if err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// provider returns the provider of the path.
+func (api *authApi) provider(c echo.Context) (*oauth2.Provider, error) {
+	for _, p := range api.config.Providers {
+		if p.Name == c.Param("provider") {
+			return p, nil
+		}
+	}
+
+	return nil, NewApiError(http.StatusNotFound, ErrCodeNotFound, "Provider not found.")
+}
+
+// oauth2Redirect returns the callback URL of the provider, below the URL setting.
+func (api *authApi) oauth2Redirect(p *oauth2.Provider) (string, error) {
+	u, err := url.Parse(api.app.CMSettings().URL)
+	if err != nil || u.Host == "" {
+		return "", errors.New("oauth2 logins require the URL setting")
+	}
+
+	return strings.TrimSuffix(u.String(), "/") + "/api/auth" + oauth2Path + "/" + url.PathEscape(p.Name) + "/callback", nil
+}
+
+// oauth2Cookie returns the cookie of the state, a negative maxAge removes it. The
+// redirect back from the provider is a cross-site navigation, so the cookie is
+// always SameSite=Lax.
+func (api *authApi) oauth2Cookie(state string, maxAge int) *http.Cookie {
+	ck := newCookie(api.cookie, state)
+	ck.Name = models.DEFAULT_OAUTH2_COOKIE_NAME
+	ck.Path = "/api/auth" + oauth2Path
+	ck.SameSite = http.SameSiteLaxMode
+	ck.MaxAge = maxAge
+	if maxAge < 0 {
+		ck.Expires = time.Unix(0, 0)
+	}
+	return ck
+}
+
+// oauth2Error turns the errors of OAuth2 logins into ApiErrors. Other errors are
+// returned as they are.
+func oauth2Error(err error) error {
+	switch {
+	case errors.Is(err, manager.ErrOAuth2State):
+		return NewApiError(http.StatusBadRequest, ErrCodeInvalidToken, "The login request is invalid or expired, please try again.")
+	case errors.Is(err, manager.ErrOAuth2Invalid):
+		return NewApiError(http.StatusUnauthorized, ErrCodeInvalidCredentials, "The login with the provider failed.")
+	case errors.Is(err, manager.ErrOAuth2NoAccount):
+		return NewApiError(http.StatusForbidden, ErrCodeNoAccount, "There is no account for this login.")
+	case errors.Is(err, identities.ErrIdentityExists):
+		return NewApiError(http.StatusConflict, ErrCodeIdentityLinked, "The account at the provider is linked to another user.")
+	case errors.Is(err, identities.ErrProviderLinked):
+		return NewApiError(http.StatusConflict, ErrCodeIdentityLinked, "Your account is linked to another account at the provider.")
+	case errors.Is(err, oauth2.ErrDiscovery):
+		return NewApiError(http.StatusBadGateway, ErrCodeProviderError, "The provider is not available.")
+	}
+
+	if aerr := accountError(err); aerr != nil {
+		return aerr
+	}
+
+	return err
+}
+
+func orDefault(path, def string) string {
+	if path == "" {
+		return def
+	}
+	return path
+}
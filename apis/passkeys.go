@@ -0,0 +1,181 @@
+package apis
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/Simon-Martens/caveman/db/passkeys"
+	"github.com/Simon-Martens/caveman/manager"
+	"github.com/Simon-Martens/caveman/tools/webauthn"
+	"github.com/labstack/echo/v4"
+)
+
+// PasskeyRegisterRequest is the body of a request that registers a passkey.
+// Credential is the response of navigator.credentials.create().
+type PasskeyRegisterRequest struct {
+	Name       string                        `json:"name"`
+	Credential webauthn.RegistrationResponse `json:"credential"`
+}
+
+// PasskeyLoginRequest is the body of a login with a passkey. Credential is the
+// response of navigator.credentials.get(). Remember selects a long session.
+type PasskeyLoginRequest struct {
+	Credential webauthn.AssertionResponse `json:"credential"`
+	Remember   bool                       `json:"remember"`
+}
+
+// bindPasskeysApi registers the passkey api. Both ceremonies take two requests:
+// begin returns the options for the browser, the second request verifies the
+// response of the authenticator. Passkeys are managed by their users.
+func bindPasskeysApi(api authApi, e *echo.Echo, g *echo.Group) {
+	g.GET("/passkeys", api.passkeys, RequireSession())
+	g.DELETE("/passkeys/:id", api.removePasskey, RequireSession())
+	g.POST("/passkeys/register/begin", api.passkeyRegisterBegin, RequireSession())
+	g.POST("/passkeys/register", api.passkeyRegister, RequireSession(), RateLimit(api.app))
+
+	g.POST("/passkeys/login/begin", api.passkeyLoginBegin, RateLimit(api.app), LimitChallenges(api.app))
+	g.POST("/passkeys/login", api.passkeyLogin, RateLimit(api.app))
+}
+
+func (api *authApi) passkeys(c echo.Context) error {
+	pks, err := api.app.Passkeys().SelectByUser(GetUser(c).ID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{"passkeys": pks})
+}
+
+func (api *authApi) removePasskey(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return NewApiError(http.StatusNotFound, ErrCodeNotFound, "Passkey not found.")
+	}
+
+	if err := api.app.Passkeys().DeleteByID(GetUser(c).ID, id); err == passkeys.ErrPasskeyNotFound {
+		return NewApiError(http.StatusNotFound, ErrCodeNotFound, "Passkey not found.")
+	} else if err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (api *authApi) passkeyRegisterBegin(c echo.Context) error {
+	rp, err := api.relyingParty()
+	if err != nil {
+		return err
+	}
+
+	opts, err := api.app.BeginPasskeyRegistration(rp, GetUser(c))
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{"publicKey": opts})
+}
+
+func (api *authApi) passkeyRegister(c echo.Context) error {
+	rp, err := api.relyingParty()
+	if err != nil {
+		return err
+	}
+
+	req := PasskeyRegisterRequest{}
+	if err := c.Bind(&req); err != nil {
+		return NewApiError(http.StatusBadRequest, ErrCodeInvalidRequest, "Invalid request.")
+	}
+
+	pk, err := api.app.FinishPasskeyRegistration(rp, GetUser(c), req.Name, &req.Credential)
+	if err == passkeys.ErrPasskeyExists {
+		return NewApiError(http.StatusConflict, ErrCodeInvalidRequest, "The passkey is already registered.")
+	} else if err != nil {
+		return passkeyError(err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{"passkey": pk})
+}
+
+func (api *authApi) passkeyLoginBegin(c echo.Context) error {
+	rp, err := api.relyingParty()
+	if err != nil {
+		return err
+	}
+
+	opts, err := api.app.BeginPasskeyLogin(rp)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{"publicKey": opts})
+}
+
+// passkeyLogin starts a session for the user of the passkey. Passkeys verify the
+// user, so the login needs no second factor.
+func (api *authApi) passkeyLogin(c echo.Context) error {
+	rp, err := api.relyingParty()
+	if err != nil {
+		return err
+	}
+
+	req := PasskeyLoginRequest{}
+	if err := c.Bind(&req); err != nil {
+		return NewApiError(http.StatusBadRequest, ErrCodeInvalidRequest, "Invalid request.")
+	}
+
+	user, _, err := api.app.FinishPasskeyLogin(rp, &req.Credential)
+	if err != nil {
+		if err := accountError(err); err != nil {
+			return err
+		}
+		return passkeyError(err)
+	}
+
+	resetChallenges(api.app, c)
+	if err := startSession(api.app, c, api.cookie, user, !req.Remember); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{"user": user})
+}
+
+// passkeyError turns the errors of the passkey ceremonies into ApiErrors. Other
+// errors are returned as they are.
+func passkeyError(err error) error {
+	if errors.Is(err, manager.ErrPasskeyChallenge) {
+		return NewApiError(http.StatusBadRequest, ErrCodeInvalidToken, "The passkey request is invalid or expired, please try again.")
+	} else if errors.Is(err, manager.ErrPasskeyInvalid) {
+		return NewApiError(http.StatusUnauthorized, ErrCodeInvalidCredentials, "The passkey is invalid.")
+	}
+
+	return err
+}
+
+// relyingParty returns the relying party of passkeys, see AuthConfig.Passkeys.
+func (api *authApi) relyingParty() (webauthn.RelyingParty, error) {
+	rp := api.config.Passkeys
+	sets := api.app.CMSettings()
+
+	if rp.Name == "" {
+		rp.Name = sets.Name
+	}
+
+	if rp.ID == "" || len(rp.Origins) == 0 {
+		u, err := url.Parse(sets.URL)
+		if err != nil || u.Host == "" {
+			return rp, errors.New("passkeys require the URL setting or a relying party")
+		}
+
+		if rp.ID == "" {
+			rp.ID = u.Hostname()
+		}
+
+		if len(rp.Origins) == 0 {
+			rp.Origins = []string{u.Scheme + "://" + u.Host}
+		}
+	}
+
+	return rp, nil
+}
@@ -0,0 +1,198 @@
+package apis
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Simon-Martens/caveman/db/accesstokens"
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/labstack/echo/v4"
+)
+
+// ForgotRequest is the body of a request for a password reset link.
+type ForgotRequest struct {
+	Email string `json:"email" form:"email"`
+}
+
+// ResetRequest is the body of a request that redeems a password reset token.
+type ResetRequest struct {
+	Token    string `json:"token" form:"token"`
+	Password string `json:"password" form:"password"`
+}
+
+// PasswordRequest is the body of a password change of an authenticated user.
+type PasswordRequest struct {
+	OldPassword string `json:"old_password" form:"old_password"`
+	Password    string `json:"password" form:"password"`
+}
+
+func bindPasswordApi(api authApi, e *echo.Echo, g *echo.Group) {
+	g.POST("/forgot", api.forgot)
+	e.POST(api.config.ForgotPage, api.forgotForm)
+
+	g.POST("/reset", api.reset, RateLimit(api.app))
+	e.POST(api.config.ResetPage, api.resetForm, RateLimit(api.app))
+
+	g.POST("/password", api.password, RequireSession(), RateLimit(api.app))
+	e.POST(api.config.PasswordPage, api.passwordForm, RequireSession(), RateLimit(api.app))
+}
+
+func (api *authApi) forgot(c echo.Context) error {
+	if err := api.doForgot(c); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusAccepted, map[string]any{
+		"message": "If the email address is registered, a reset link has been sent.",
+	})
+}
+
+func (api *authApi) forgotForm(c echo.Context) error {
+	if err := api.doForgot(c); err != nil {
+		return formError(c, api.config.ForgotPage, err)
+	}
+
+	return c.Redirect(http.StatusSeeOther, api.config.ForgotPage+"?sent=1")
+}
+
+func (api *authApi) reset(c echo.Context) error {
+	if err := api.doReset(c); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (api *authApi) resetForm(c echo.Context) error {
+	if err := api.doReset(c); err != nil {
+		return formError(c, api.config.ResetPage+"?token="+url.QueryEscape(c.FormValue("token")), err)
+	}
+
+	return c.Redirect(http.StatusSeeOther, api.config.LoginPage+"?reset=1")
+}
+
+func (api *authApi) password(c echo.Context) error {
+	if err := api.doPassword(c); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (api *authApi) passwordForm(c echo.Context) error {
+	if err := api.doPassword(c); err != nil {
+		return formError(c, api.config.PasswordPage, err)
+	}
+
+	return c.Redirect(http.StatusSeeOther, api.config.PasswordPage+"?changed=1")
+}
+
+// doForgot issues a single use reset token bound to the reset page and mails it.
+// The response is the same whether the user exists or not, and so is the work
+// done before responding: the user is looked up in the background.
+func (api *authApi) doForgot(c echo.Context) error {
+	req := ForgotRequest{}
+	if err := c.Bind(&req); err != nil || req.Email == "" {
+		return NewApiError(http.StatusBadRequest, ErrCodeInvalidRequest, "Email is required.")
+	}
+
+	api.app.Go(func() {
+		if err := api.sendPasswordReset(req.Email); err != nil {
+			api.app.Logger().Error("Failed to send password reset", "error", err)
+		}
+	})
+
+	return nil
+}
+
+// sendPasswordReset sends a reset link to the user with the email, if any. Users
+// get one link every DEFAULT_MAIL_COOLDOWN seconds, so the form can't be used to
+// flood a mailbox.
+func (api *authApi) sendPasswordReset(email string) error {
+	user, err := api.app.Users().SelectByEmail(email)
+	if err != nil || user == nil {
+		return nil
+	}
+
+	exp := time.Duration(models.DEFAULT_PASSWORD_RESET_EXPIRATION) * time.Second
+	cooldown := time.Duration(models.DEFAULT_MAIL_COOLDOWN) * time.Second
+	at, err := api.app.Tokens().InsertThrottled(user.ID, 1, api.config.ResetPage, exp, cooldown, nil)
+	if err == accesstokens.ErrAccessTokenThrottled {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	link := strings.TrimRight(api.app.CMSettings().URL, "/") + api.config.ResetPage + "?token=" + url.QueryEscape(at.Token)
+	return api.config.SendPasswordReset(user, link)
+}
+
+// doReset redeems a reset token, sets the new password and ends all sessions of the user.
+func (api *authApi) doReset(c echo.Context) error {
+	req := ResetRequest{}
+	if err := c.Bind(&req); err != nil || req.Token == "" {
+		return NewApiError(http.StatusBadRequest, ErrCodeInvalidRequest, "Token and password are required.")
+	}
+
+	// We check the password first, the token is used up when selected
+	if len(req.Password) < models.DEFAULT_MIN_PASSWORD_LENGTH {
+		return NewApiError(http.StatusBadRequest, ErrCodeInvalidPassword, "The password is too short.")
+	}
+
+	at, err := api.app.Tokens().SelectByAccessToken(req.Token, c.Request().Method, api.config.ResetPage)
+	if err != nil {
+		return NewApiError(http.StatusBadRequest, ErrCodeInvalidToken, "The link is invalid or expired.")
+	}
+
+	user, err := api.app.Users().Select(at.Creator)
+	if err != nil {
+		return NewApiError(http.StatusBadRequest, ErrCodeInvalidToken, "The link is invalid or expired.")
+	}
+
+	if err := api.app.Users().SetPassword(user, req.Password); err != nil {
+		return err
+	}
+
+	if err := api.app.Sessions().DeleteByUser(user.ID); err != nil {
+		return err
+	}
+
+	// The session of the request, if any, is gone now
+	if GetSession(c) != nil {
+		ClearSessionCookie(c, api.cookie)
+	}
+
+	return nil
+}
+
+// doPassword changes the password of the authenticated user, ends all other
+// sessions of the user and rotates the token of the current one.
+func (api *authApi) doPassword(c echo.Context) error {
+	user := GetUser(c)
+	session := GetSession(c)
+
+	req := PasswordRequest{}
+	if err := c.Bind(&req); err != nil {
+		return NewApiError(http.StatusBadRequest, ErrCodeInvalidRequest, "Invalid request.")
+	}
+
+	if err := api.app.Users().CheckPassword(user, req.OldPassword); err != nil {
+		return NewApiError(http.StatusBadRequest, ErrCodeInvalidCredentials, "The current password is wrong.")
+	}
+
+	if len(req.Password) < models.DEFAULT_MIN_PASSWORD_LENGTH {
+		return NewApiError(http.StatusBadRequest, ErrCodeInvalidPassword, "The password is too short.")
+	}
+
+	if err := api.app.Users().SetPassword(user, req.Password); err != nil {
+		return err
+	}
+
+	if err := api.app.Sessions().DeleteByUserExcept(user.ID, session.Session); err != nil {
+		return err
+	}
+
+	return rotateSession(api.app, c, api.cookie, session)
+}
@@ -0,0 +1,158 @@
+package apis
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/Simon-Martens/caveman/manager"
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/labstack/echo/v4"
+)
+
+// ServeConfig defines a configuration struct for apis.Serve().
+type ServeConfig struct {
+	// Address is the TCP address to listen on, eg. "127.0.0.1:8080".
+	Address string
+
+	// CertFile and KeyFile are the paths to the TLS certificate and key.
+	// If both are set, the server is started with TLS.
+	CertFile string
+	KeyFile  string
+
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration
+
+	// TrustedProxies are the IPs or CIDR ranges of reverse proxies. The client IP,
+	// eg. for rate limits, is read from X-Forwarded-For only for requests from
+	// these proxies. Without proxies, the IP of the connection is used.
+	TrustedProxies []string
+
+	// Cookie configures the session cookie.
+	Cookie CookieConfig
+
+	// CSRF configures the CSRF protection of unsafe requests.
+	CSRF CSRFConfig
+
+	// Auth configures the login, logout and registration form handlers.
+	Auth AuthConfig
+
+	// BeforeServe is a list of functions that are called with the initialized
+	// router before the server starts. Use it to register app routes and middlewares.
+	BeforeServe []func(e *echo.Echo) error
+}
+
+// NewServeConfig creates a ServeConfig from the startup config, falling back to the
+// defaults for every unset value.
+func NewServeConfig(config models.Config) ServeConfig {
+	c := ServeConfig{
+		Address:         config.Address,
+		CertFile:        config.CertFile,
+		KeyFile:         config.KeyFile,
+		ReadTimeout:     durationOrDefault(config.ReadTimeout, models.DEFAULT_HTTP_READ_TIMEOUT),
+		WriteTimeout:    durationOrDefault(config.WriteTimeout, models.DEFAULT_HTTP_WRITE_TIMEOUT),
+		IdleTimeout:     durationOrDefault(config.IdleTimeout, models.DEFAULT_HTTP_IDLE_TIMEOUT),
+		ShutdownTimeout: durationOrDefault(config.ShutdownTimeout, models.DEFAULT_HTTP_SHUTDOWN_TIMEOUT),
+		TrustedProxies:  config.TrustedProxies,
+		Cookie:          DefaultCookieConfig(!config.Dev),
+		CSRF:            DefaultCSRFConfig(!config.Dev),
+		Auth:            DefaultAuthConfig(),
+	}
+
+	if c.Address == "" {
+		c.Address = models.DEFAULT_HTTP_ADDRESS
+	}
+
+	return c
+}
+
+// IsTLS reports whether the server should be started with TLS.
+func (c *ServeConfig) IsTLS() bool {
+	return c.CertFile != "" && c.KeyFile != ""
+}
+
+// Serve bootstraps the manager (if not already), which runs the pending migrations,
+// starts the job scheduler, initializes the router and starts the HTTP server.
+//
+// Serve blocks until the server fails or the process receives SIGINT or SIGTERM.
+// In the latter case the server is shut down gracefully and the manager is terminated.
+func Serve(app *manager.Manager, config ServeConfig) error {
+	if !app.IsBootstrapped() {
+		if err := app.Bootstrap(); err != nil {
+			return err
+		}
+	}
+
+	if err := app.Scheduler().Start(); err != nil {
+		return errors.Join(err, app.Terminate())
+	}
+
+	e, err := InitApi(app, config)
+	if err != nil {
+		return errors.Join(err, app.Terminate())
+	}
+
+	for _, f := range config.BeforeServe {
+		if err := f(e); err != nil {
+			return errors.Join(err, app.Terminate())
+		}
+	}
+
+	// We listen for signals before opening the listener, so a client that was able
+	// to connect can rely on the graceful shutdown.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server := &http.Server{
+		Addr:         config.Address,
+		Handler:      e,
+		ReadTimeout:  config.ReadTimeout,
+		WriteTimeout: config.WriteTimeout,
+		IdleTimeout:  config.IdleTimeout,
+	}
+
+	ln, err := net.Listen("tcp", config.Address)
+	if err != nil {
+		return errors.Join(err, app.Terminate())
+	}
+
+	serr := make(chan error, 1)
+	go func() {
+		if config.IsTLS() {
+			serr <- server.ServeTLS(ln, config.CertFile, config.KeyFile)
+		} else {
+			serr <- server.Serve(ln)
+		}
+	}()
+
+	app.Logger().Info("Server started", "address", ln.Addr().String(), "tls", config.IsTLS())
+
+	select {
+	case err := <-serr:
+		// The server stopped on its own, this is always an error.
+		return errors.Join(err, app.Terminate())
+	case <-ctx.Done():
+	}
+
+	app.Logger().Info("Shutting down server")
+
+	sctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+
+	err = server.Shutdown(sctx)
+	return errors.Join(err, app.Terminate())
+}
+
+func durationOrDefault(seconds, def int) time.Duration {
+	if seconds <= 0 {
+		seconds = def
+	}
+	return time.Duration(seconds) * time.Second
+}
@@ -0,0 +1,106 @@
+package apis
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/Simon-Martens/caveman/db/sessions"
+	"github.com/Simon-Martens/caveman/manager"
+	"github.com/labstack/echo/v4"
+)
+
+// bindSessionsApi registers the api of a user for its own sessions. The form
+// handler revokes the session of the "id" field, or with "all" set every other session.
+func bindSessionsApi(api authApi, e *echo.Echo, g *echo.Group) {
+	g.GET("/sessions", api.sessions, RequireSession())
+	g.DELETE("/sessions", api.revokeOthers, RequireSession())
+	g.DELETE("/sessions/:sid", api.revoke, RequireSession())
+
+	e.POST(api.config.SessionsPage, api.sessionsForm, RequireSession())
+}
+
+func (api *authApi) sessions(c echo.Context) error {
+	views, err := sessionViews(api.app, GetUser(c).ID, GetSession(c))
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{"sessions": views})
+}
+
+func (api *authApi) revoke(c echo.Context) error {
+	if err := api.doRevoke(c, c.Param("sid")); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (api *authApi) revokeOthers(c echo.Context) error {
+	if err := api.app.Sessions().DeleteByUserExcept(GetUser(c).ID, GetSession(c).Session); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (api *authApi) sessionsForm(c echo.Context) error {
+	var err error
+	if c.FormValue("all") != "" {
+		err = api.app.Sessions().DeleteByUserExcept(GetUser(c).ID, GetSession(c).Session)
+	} else {
+		err = api.doRevoke(c, c.FormValue("id"))
+	}
+
+	if err != nil {
+		return formError(c, api.config.SessionsPage, err)
+	}
+
+	// Revoking the current session is a logout
+	if GetSession(c) == nil {
+		return c.Redirect(http.StatusSeeOther, api.config.LogoutRedirect)
+	}
+
+	return c.Redirect(http.StatusSeeOther, api.config.SessionsPage+"?revoked=1")
+}
+
+// doRevoke revokes a session of the authenticated user. If it is the session of
+// the request, the session cookie is removed as well.
+func (api *authApi) doRevoke(c echo.Context, sid string) error {
+	user := GetUser(c)
+	session := GetSession(c)
+
+	id, err := strconv.ParseInt(sid, 10, 64)
+	if err != nil {
+		return NewApiError(http.StatusNotFound, ErrCodeNotFound, "Session not found.")
+	}
+
+	if err := api.app.Sessions().DeleteByID(user.ID, id); err == sessions.ErrSessionNotFound {
+		return NewApiError(http.StatusNotFound, ErrCodeNotFound, "Session not found.")
+	} else if err != nil {
+		return err
+	}
+
+	if id == session.ID {
+		ClearSessionCookie(c, api.cookie)
+		c.Set(ContextSessionKey, nil)
+		c.Set(ContextUserKey, nil)
+	}
+
+	return nil
+}
+
+// sessionViews returns the sessions of the user for display. The current session, if any, is marked.
+func sessionViews(app *manager.Manager, user int64, current *sessions.Session) ([]sessions.SessionView, error) {
+	list, err := app.Sessions().SelectByUser(user)
+	if err != nil {
+		return nil, err
+	}
+
+	views := make([]sessions.SessionView, len(list))
+	for i, s := range list {
+		views[i] = s.View(current != nil && s.ID == current.ID)
+	}
+
+	return views, nil
+}
@@ -0,0 +1,183 @@
+package apis
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"net/mail"
+	"strings"
+
+	"github.com/Simon-Martens/caveman/db/users"
+	"github.com/Simon-Martens/caveman/manager"
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/labstack/echo/v4"
+)
+
+// SetupRequest is the body of a setup request, either as JSON or as form.
+// It contains the first admin and the app settings.
+type SetupRequest struct {
+	AdminName  string `json:"admin_name" form:"admin_name"`
+	AdminEmail string `json:"admin_email" form:"admin_email"`
+	Password   string `json:"password" form:"password"`
+
+	Name    string `json:"name" form:"name"`
+	URL     string `json:"url" form:"url"`
+	Contact string `json:"contact" form:"contact"`
+	Icon    string `json:"icon" form:"icon"`
+}
+
+// RequireSetup blocks all routes except the setup routes while there is no admin.
+// Browsers are redirected to the setup page, other requests are rejected.
+func RequireSetup(app *manager.Manager, config AuthConfig) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if app.SetupState() != models.SETUP_STATE_NO_ADMIN {
+				return next(c)
+			}
+
+			// The setup might have been done by another process or the CLI
+			state, err := app.RefreshSetupState()
+			if err != nil {
+				return err
+			}
+
+			if state != models.SETUP_STATE_NO_ADMIN {
+				return next(c)
+			}
+
+			switch c.Request().URL.Path {
+			case config.SetupPage, "/api/setup", "/api/health":
+				return next(c)
+			}
+
+			if c.Request().Method == http.MethodGet && strings.Contains(c.Request().Header.Get(echo.HeaderAccept), echo.MIMETextHTML) {
+				return c.Redirect(http.StatusSeeOther, config.SetupPage)
+			}
+
+			return NewApiError(http.StatusServiceUnavailable, ErrCodeSetupRequired, "The application is not set up yet.")
+		}
+	}
+}
+
+func bindSetupApi(app *manager.Manager, e *echo.Echo, config ServeConfig) {
+	api := setupApi{app: app, cookie: config.Cookie, config: config.Auth}
+
+	e.POST("/api/setup", api.setup)
+	e.GET(config.Auth.SetupPage, api.setupPage)
+	e.POST(config.Auth.SetupPage, api.setupForm)
+}
+
+type setupApi struct {
+	app    *manager.Manager
+	cookie CookieConfig
+	config AuthConfig
+}
+
+func (api *setupApi) setup(c echo.Context) error {
+	user, err := api.doSetup(c)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{"user": user})
+}
+
+func (api *setupApi) setupForm(c echo.Context) error {
+	if _, err := api.doSetup(c); err != nil {
+		return formError(c, api.config.SetupPage, err)
+	}
+
+	return c.Redirect(http.StatusSeeOther, api.config.LoginRedirect)
+}
+
+func (api *setupApi) setupPage(c echo.Context) error {
+	if api.app.SetupState() != models.SETUP_STATE_NO_ADMIN {
+		return echo.ErrNotFound
+	}
+
+	data := map[string]any{
+		"Error": c.QueryParam("error"),
+		"CSRF":  CSRFField(c),
+		"URL":   api.app.CMSettings().URL,
+	}
+
+	return renderTemplate(c, http.StatusOK, setupTemplate, data)
+}
+
+func (api *setupApi) doSetup(c echo.Context) (*users.User, error) {
+	req := SetupRequest{}
+	if err := c.Bind(&req); err != nil {
+		return nil, NewApiError(http.StatusBadRequest, ErrCodeInvalidRequest, "Invalid request.")
+	}
+
+	addr, err := mail.ParseAddress(req.AdminEmail)
+	if err != nil || addr.Address != req.AdminEmail {
+		return nil, NewApiError(http.StatusBadRequest, ErrCodeInvalidEmail, "Invalid email address.")
+	}
+
+	if len(req.Password) < models.DEFAULT_MIN_PASSWORD_LENGTH {
+		return nil, NewApiError(http.StatusBadRequest, ErrCodeInvalidPassword, "The password is too short.")
+	}
+
+	user, err := api.app.Setup(&users.User{
+		Name:  strings.TrimSpace(req.AdminName),
+		Email: req.AdminEmail,
+	}, req.Password, &models.Settings{
+		Name:    strings.TrimSpace(req.Name),
+		URL:     strings.TrimSpace(req.URL),
+		Contact: strings.TrimSpace(req.Contact),
+		Icon:    strings.TrimSpace(req.Icon),
+	})
+	if errors.Is(err, manager.ErrSetupDone) {
+		return nil, NewApiError(http.StatusForbidden, ErrCodeSetupDone, "The application is already set up.")
+	} else if errors.Is(err, manager.ErrSettingsInvalid) {
+		return nil, NewApiError(http.StatusBadRequest, ErrCodeInvalidSettings, "Name and URL are required.")
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := startSession(api.app, c, api.cookie, user, true); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func renderTemplate(c echo.Context, status int, t *template.Template, data any) error {
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return err
+	}
+
+	return c.HTML(status, b.String())
+}
+
+var setupTemplate = template.Must(template.New("setup").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<title>Setup</title>
+</head>
+<body>
+	<h1>Setup</h1>
+	{{ if .Error }}<p class="error">Error: {{ .Error }}</p>{{ end }}
+	<form method="post">
+		{{ .CSRF }}
+		<fieldset>
+			<legend>Administrator</legend>
+			<label>Name <input name="admin_name" required></label>
+			<label>Email <input type="email" name="admin_email" required></label>
+			<label>Password <input type="password" name="password" required></label>
+		</fieldset>
+		<fieldset>
+			<legend>Application</legend>
+			<label>Name <input name="name" required></label>
+			<label>URL <input type="url" name="url" value="{{ .URL }}" required></label>
+			<label>Contact <input name="contact"></label>
+			<label>Icon <input name="icon"></label>
+		</fieldset>
+		<button type="submit">Save</button>
+	</form>
+</body>
+</html>
+`))
@@ -0,0 +1,281 @@
+package apis
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/Simon-Martens/caveman/db/attempts"
+	"github.com/Simon-Martens/caveman/db/sessions"
+	"github.com/Simon-Martens/caveman/db/twofactor"
+	"github.com/Simon-Martens/caveman/db/users"
+	"github.com/Simon-Martens/caveman/manager"
+	"github.com/labstack/echo/v4"
+)
+
+// CodeRequest is the body of a request with a code of the authenticator app, or
+// a recovery code where allowed.
+type CodeRequest struct {
+	Code string `json:"code" form:"code"`
+}
+
+// ConfirmPasswordRequest is the body of a request that needs the password of the
+// user to be confirmed.
+type ConfirmPasswordRequest struct {
+	Password string `json:"password" form:"password"`
+}
+
+// bindTwoFactorApi registers the second factor api. A login of a user with a
+// second factor results in a pending session, which is upgraded by a valid code,
+// see doLogin. Users whose role requires a second factor, but have none, set it
+// up with the pending session instead.
+func bindTwoFactorApi(api authApi, e *echo.Echo, g *echo.Group) {
+	g.GET("/2fa", api.twoFactorStatus, RequireSession())
+	g.POST("/2fa", api.twoFactor, RateLimit(api.app))
+	e.POST(api.config.TwoFactorPage, api.twoFactorForm, RateLimit(api.app))
+
+	g.POST("/2fa/setup", api.twoFactorSetup)
+	g.POST("/2fa/enable", api.twoFactorEnable, RateLimit(api.app))
+	g.POST("/2fa/disable", api.twoFactorDisable, RequireSession(), RateLimit(api.app))
+	g.POST("/2fa/recovery", api.twoFactorRecovery, RequireSession(), RateLimit(api.app))
+}
+
+func (api *authApi) twoFactorStatus(c echo.Context) error {
+	user := GetUser(c)
+
+	codes := 0
+	if user.TwoFactor {
+		n, err := api.app.TwoFactor().CountRecoveryCodes(user.ID)
+		if err != nil {
+			return err
+		}
+		codes = n
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"enabled":        user.TwoFactor,
+		"required":       api.app.Users().IsTwoFactorRequired(user),
+		"recovery_codes": codes,
+	})
+}
+
+func (api *authApi) twoFactor(c echo.Context) error {
+	user, err := api.doTwoFactor(c)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{"user": user})
+}
+
+func (api *authApi) twoFactorForm(c echo.Context) error {
+	if _, err := api.doTwoFactor(c); err != nil {
+		// Without a pending session, the login has to start over
+		if apiErr, ok := err.(*ApiError); ok && apiErr.Code == ErrCodeInvalidToken {
+			return formError(c, api.config.LoginPage, err)
+		}
+		return formError(c, api.config.TwoFactorPage, err)
+	}
+
+	return c.Redirect(http.StatusSeeOther, nextPath(c, api.config.LoginRedirect))
+}
+
+// doTwoFactor checks the code of the pending session and upgrades it.
+func (api *authApi) doTwoFactor(c echo.Context) (*users.User, error) {
+	session, user, err := api.pendingSession(c, manager.PendingSecondFactor)
+	if err != nil {
+		return nil, err
+	}
+
+	req := CodeRequest{}
+	if err := c.Bind(&req); err != nil || req.Code == "" {
+		return nil, NewApiError(http.StatusBadRequest, ErrCodeInvalidRequest, "A code is required.")
+	}
+
+	err = api.app.VerifySecondFactor(user, req.Code)
+	if errors.Is(err, attempts.ErrRateLimited) {
+		return nil, rateLimitError(c, err)
+	} else if err == twofactor.ErrInvalidCode {
+		return nil, NewApiError(http.StatusUnauthorized, ErrCodeInvalidCredentials, "The code is invalid.")
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := api.completeLogin(c, session, user); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// twoFactorSetup creates a new authenticator secret, for a user with a session or
+// a pending session that requires the setup. It must be confirmed by enable.
+func (api *authApi) twoFactorSetup(c echo.Context) error {
+	user := GetUser(c)
+	if GetSession(c) == nil {
+		var err error
+		if _, user, err = api.pendingSession(c, manager.PendingSetup); err != nil {
+			return err
+		}
+	}
+
+	t, uri, err := api.app.SetupTOTP(user)
+	if err == twofactor.ErrTOTPConfirmed {
+		return NewApiError(http.StatusConflict, ErrCodeInvalidRequest, "Two-factor authentication is already enabled.")
+	} else if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"secret": t.Secret,
+		"uri":    uri,
+	})
+}
+
+// twoFactorEnable confirms the authenticator with a code and returns the recovery
+// codes. A pending session that required the setup is upgraded.
+func (api *authApi) twoFactorEnable(c echo.Context) error {
+	user := GetUser(c)
+	var pending *sessions.Session
+	if GetSession(c) == nil {
+		var err error
+		if pending, user, err = api.pendingSession(c, manager.PendingSetup); err != nil {
+			return err
+		}
+	}
+
+	req := CodeRequest{}
+	if err := c.Bind(&req); err != nil || req.Code == "" {
+		return NewApiError(http.StatusBadRequest, ErrCodeInvalidRequest, "A code is required.")
+	}
+
+	codes, err := api.app.EnableTOTP(user, req.Code)
+	if err == twofactor.ErrInvalidCode {
+		return NewApiError(http.StatusUnauthorized, ErrCodeInvalidCredentials, "The code is invalid.")
+	} else if err == twofactor.ErrTOTPNotFound {
+		return NewApiError(http.StatusBadRequest, ErrCodeInvalidRequest, "Please set up two-factor authentication first.")
+	} else if err == twofactor.ErrTOTPConfirmed {
+		return NewApiError(http.StatusConflict, ErrCodeInvalidRequest, "Two-factor authentication is already enabled.")
+	} else if err != nil {
+		return err
+	}
+
+	if pending != nil {
+		if err := api.completeLogin(c, pending, user); err != nil {
+			return err
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{"recovery_codes": codes})
+}
+
+func (api *authApi) twoFactorDisable(c echo.Context) error {
+	user, err := api.confirmPassword(c)
+	if err != nil {
+		return err
+	}
+
+	if err := api.app.DisableTOTP(user); err == manager.ErrTwoFactorRequired {
+		return NewApiError(http.StatusForbidden, ErrCodeTwoFactorRequired, "Your role requires two-factor authentication.")
+	} else if err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (api *authApi) twoFactorRecovery(c echo.Context) error {
+	user, err := api.confirmPassword(c)
+	if err != nil {
+		return err
+	}
+
+	codes, err := api.app.RegenerateRecoveryCodes(user)
+	if err == manager.ErrTwoFactorDisabled {
+		return NewApiError(http.StatusBadRequest, ErrCodeInvalidRequest, "Two-factor authentication is not enabled.")
+	} else if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{"recovery_codes": codes})
+}
+
+// confirmPassword returns the user of the session, if the request has the right
+// password. Changes to the second factor need it, so a stolen session is not enough.
+func (api *authApi) confirmPassword(c echo.Context) (*users.User, error) {
+	user := GetUser(c)
+
+	req := ConfirmPasswordRequest{}
+	if err := c.Bind(&req); err != nil {
+		return nil, NewApiError(http.StatusBadRequest, ErrCodeInvalidRequest, "Invalid request.")
+	}
+
+	if err := api.app.Users().CheckPassword(user, req.Password); err != nil {
+		return nil, NewApiError(http.StatusBadRequest, ErrCodeInvalidCredentials, "The password is wrong.")
+	}
+
+	return user, nil
+}
+
+// pendingSession returns the pending session of the session cookie, if it waits
+// for stage, and its user.
+func (api *authApi) pendingSession(c echo.Context, stage string) (*sessions.Session, *users.User, error) {
+	ck, err := c.Cookie(api.cookie.Name)
+	if err != nil || ck.Value == "" {
+		return nil, nil, NewApiError(http.StatusUnauthorized, ErrCodeInvalidToken, "Please log in first.")
+	}
+
+	session, user, err := api.app.AuthenticatePending(ck.Value, stage)
+	if err != nil {
+		return nil, nil, NewApiError(http.StatusUnauthorized, ErrCodeInvalidToken, "The login is expired, please log in again.")
+	}
+
+	return session, user, nil
+}
+
+// startPendingLogin creates a pending session for a login that needs a second
+// factor and sets the session cookie. It returns the stage of the session.
+func (api *authApi) startPendingLogin(c echo.Context, user *users.User, cause error, short bool) (string, error) {
+	if old := GetSession(c); old != nil {
+		_ = api.app.Sessions().DeleteBySession(old.Session)
+	}
+
+	session, err := api.app.StartPendingLogin(user, cause, short, c.Request().UserAgent(), c.RealIP())
+	if err != nil {
+		return "", err
+	}
+
+	// The pending session only lives for minutes, the cookie goes with it
+	SetSessionCookie(c, api.cookie, session, true)
+	return session.Pending(), nil
+}
+
+// completeLogin upgrades the pending session and sets the session cookie.
+func (api *authApi) completeLogin(c echo.Context, pending *sessions.Session, user *users.User) error {
+	session, err := api.app.CompletePendingLogin(pending, user)
+	if err != nil {
+		return err
+	}
+
+	SetSessionCookie(c, api.cookie, session, api.app.Sessions().IsShort(session))
+	c.Set(ContextSessionKey, session)
+	c.Set(ContextUserKey, user)
+	return nil
+}
+
+// twoFactorPage returns the page a form login continues on, for the stage of
+// the pending session. The login continues on next afterwards, if not empty.
+func (api *authApi) twoFactorPage(stage, next string) string {
+	q := url.Values{}
+	if stage == manager.PendingSetup {
+		q.Set("setup", "1")
+	}
+	if next != "" {
+		q.Set("next", next)
+	}
+
+	if len(q) == 0 {
+		return api.config.TwoFactorPage
+	}
+	return api.config.TwoFactorPage + "?" + q.Encode()
+}
@@ -0,0 +1,224 @@
+package apis
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Simon-Martens/caveman/db/sessions"
+	"github.com/Simon-Martens/caveman/db/users"
+	"github.com/Simon-Martens/caveman/manager"
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/labstack/echo/v4"
+)
+
+// RoleRequest is the body of a request that changes the role of a user.
+type RoleRequest struct {
+	Role string `json:"role" form:"role"`
+}
+
+// ExtendRequest is the body of a request that extends a user account.
+type ExtendRequest struct {
+	Seconds int64 `json:"seconds" form:"seconds"`
+}
+
+// bindUsersApi registers the user administration api. All routes require the
+// PERMISSION_MANAGE_USERS permission.
+func bindUsersApi(app *manager.Manager, g *echo.Group, config ServeConfig) {
+	api := usersApi{app: app, cookie: config.Cookie}
+
+	g.Use(RequirePermission(app, models.PERMISSION_MANAGE_USERS))
+	g.POST("/:id/activate", api.activate)
+	g.POST("/:id/deactivate", api.deactivate)
+	g.POST("/:id/extend", api.extend)
+	g.POST("/:id/role", api.role)
+	g.POST("/:id/unlock", api.unlock)
+	g.DELETE("/:id/2fa", api.resetTwoFactor)
+	g.GET("/:id/sessions", api.sessions)
+	g.DELETE("/:id/sessions", api.revokeSessions)
+	g.DELETE("/:id/sessions/:sid", api.revokeSession)
+}
+
+type usersApi struct {
+	app    *manager.Manager
+	cookie CookieConfig
+}
+
+func (api *usersApi) activate(c echo.Context) error {
+	user, err := api.user(c)
+	if err != nil {
+		return err
+	}
+
+	if err := api.app.ActivateUser(user); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{"user": user})
+}
+
+func (api *usersApi) deactivate(c echo.Context) error {
+	user, err := api.user(c)
+	if err != nil {
+		return err
+	}
+
+	// Admins would lock themselves out
+	if user.ID == GetUser(c).ID {
+		return NewApiError(http.StatusBadRequest, ErrCodeInvalidRequest, "You can't deactivate yourself.")
+	}
+
+	if err := api.app.DeactivateUser(user); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{"user": user})
+}
+
+// role changes the role of a user. Only admins may make others admins or change
+// the role of admins.
+func (api *usersApi) role(c echo.Context) error {
+	user, err := api.user(c)
+	if err != nil {
+		return err
+	}
+
+	req := RoleRequest{}
+	if err := c.Bind(&req); err != nil || !api.app.Roles().IsRole(req.Role) {
+		return NewApiError(http.StatusBadRequest, ErrCodeInvalidRequest, "Unknown role.")
+	}
+
+	if (req.Role == models.ROLE_ADMIN || user.Role == models.ROLE_ADMIN) && GetUser(c).Role != models.ROLE_ADMIN {
+		return NewApiError(http.StatusForbidden, ErrCodeInvalidRequest, "Only admins can change admin roles.")
+	}
+
+	session, err := api.app.ChangeRole(user, req.Role, GetSession(c))
+	if err == manager.ErrLastAdmin {
+		return NewApiError(http.StatusBadRequest, ErrCodeInvalidRequest, "The last admin can't be demoted.")
+	} else if err != nil {
+		return err
+	}
+
+	if session != nil {
+		SetSessionCookie(c, api.cookie, session, api.app.Sessions().IsShort(session))
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{"user": user})
+}
+
+func (api *usersApi) extend(c echo.Context) error {
+	user, err := api.user(c)
+	if err != nil {
+		return err
+	}
+
+	req := ExtendRequest{}
+	if err := c.Bind(&req); err != nil || req.Seconds <= 0 {
+		return NewApiError(http.StatusBadRequest, ErrCodeInvalidRequest, "A positive number of seconds is required.")
+	}
+
+	if err := api.app.ExtendUser(user, time.Duration(req.Seconds)*time.Second); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{"user": user})
+}
+
+// unlock lifts the block or lockout of the user after too many failed logins.
+func (api *usersApi) unlock(c echo.Context) error {
+	user, err := api.user(c)
+	if err != nil {
+		return err
+	}
+
+	if err := api.app.Users().Unlock(user.Email); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// resetTwoFactor removes the second factor of the user, eg. after the user lost
+// the authenticator and the recovery codes. Sessions of the user are kept.
+func (api *usersApi) resetTwoFactor(c echo.Context) error {
+	user, err := api.user(c)
+	if err != nil {
+		return err
+	}
+
+	if err := api.app.ResetTwoFactor(user); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{"user": user})
+}
+
+// user returns the user of the :id path parameter.
+func (api *usersApi) user(c echo.Context) (*users.User, error) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return nil, NewApiError(http.StatusNotFound, ErrCodeNotFound, "User not found.")
+	}
+
+	user, err := api.app.Users().Select(id)
+	if err != nil {
+		return nil, NewApiError(http.StatusNotFound, ErrCodeNotFound, "User not found.")
+	}
+
+	return user, nil
+}
+
+func (api *usersApi) sessions(c echo.Context) error {
+	user, err := api.user(c)
+	if err != nil {
+		return err
+	}
+
+	views, err := sessionViews(api.app, user.ID, GetSession(c))
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{"sessions": views})
+}
+
+func (api *usersApi) revokeSession(c echo.Context) error {
+	user, err := api.user(c)
+	if err != nil {
+		return err
+	}
+
+	id, err := strconv.ParseInt(c.Param("sid"), 10, 64)
+	if err != nil {
+		return NewApiError(http.StatusNotFound, ErrCodeNotFound, "Session not found.")
+	}
+
+	if err := api.app.Sessions().DeleteByID(user.ID, id); err == sessions.ErrSessionNotFound {
+		return NewApiError(http.StatusNotFound, ErrCodeNotFound, "Session not found.")
+	} else if err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// revokeSessions revokes all sessions of the user. For the admin's own account,
+// the session of the request is kept.
+func (api *usersApi) revokeSessions(c echo.Context) error {
+	user, err := api.user(c)
+	if err != nil {
+		return err
+	}
+
+	if session := GetSession(c); session != nil && user.ID == session.User {
+		err = api.app.Sessions().DeleteByUserExcept(user.ID, session.Session)
+	} else {
+		err = api.app.Sessions().DeleteByUser(user.ID)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
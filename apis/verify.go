@@ -0,0 +1,190 @@
+package apis
+
+import (
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Simon-Martens/caveman/db/accesstokens"
+	"github.com/Simon-Martens/caveman/db/users"
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/Simon-Martens/caveman/tools/types"
+	"github.com/labstack/echo/v4"
+)
+
+// VerifyRequest is the body of a request that redeems a verification token.
+type VerifyRequest struct {
+	Token string `json:"token" form:"token"`
+}
+
+// EmailRequest is the body of an email change of an authenticated user.
+type EmailRequest struct {
+	Email    string `json:"email" form:"email"`
+	Password string `json:"password" form:"password"`
+}
+
+func bindVerifyApi(api authApi, e *echo.Echo, g *echo.Group) {
+	g.POST("/verify", api.verify, RateLimit(api.app))
+	g.POST("/verify/resend", api.resend)
+	e.POST(api.config.VerifyPage, api.verifyForm, RateLimit(api.app))
+
+	g.POST("/email", api.email, RequireSession(), RateLimit(api.app))
+	e.POST(api.config.EmailPage, api.emailForm, RequireSession(), RateLimit(api.app))
+}
+
+func (api *authApi) verify(c echo.Context) error {
+	if err := api.doVerify(c); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (api *authApi) verifyForm(c echo.Context) error {
+	if err := api.doVerify(c); err != nil {
+		return formError(c, api.config.VerifyPage+"?token="+url.QueryEscape(c.FormValue("token")), err)
+	}
+
+	return c.Redirect(http.StatusSeeOther, api.config.LoginPage+"?verified=1")
+}
+
+func (api *authApi) resend(c echo.Context) error {
+	if err := api.doResend(c); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusAccepted, map[string]any{
+		"message": "If the email address is registered and not verified, a link has been sent.",
+	})
+}
+
+func (api *authApi) email(c echo.Context) error {
+	if err := api.doEmail(c); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{"user": GetUser(c)})
+}
+
+func (api *authApi) emailForm(c echo.Context) error {
+	if err := api.doEmail(c); err != nil {
+		return formError(c, api.config.EmailPage, err)
+	}
+
+	return c.Redirect(http.StatusSeeOther, api.config.EmailPage+"?changed=1")
+}
+
+// sendVerification issues a single use token bound to the verify page and the
+// current email of the user and sends the link in the background.
+func (api *authApi) sendVerification(user *users.User) error {
+	exp := time.Duration(models.DEFAULT_VERIFICATION_EXPIRATION) * time.Second
+	at, err := api.app.Tokens().InsertWithData(user.ID, 1, api.config.VerifyPage, exp, types.JsonMap{"email": user.Email})
+	if err != nil {
+		return err
+	}
+
+	u := *user
+	api.app.Go(func() {
+		if err := api.mailVerification(&u, at); err != nil {
+			api.app.Logger().Error("Failed to send verification", "user", u.ID, "error", err)
+		}
+	})
+
+	return nil
+}
+
+// mailVerification sends the link of the verification token to the user.
+func (api *authApi) mailVerification(user *users.User, at *accesstokens.AccessToken) error {
+	link := strings.TrimRight(api.app.CMSettings().URL, "/") + api.config.VerifyPage + "?token=" + url.QueryEscape(at.Token)
+	return api.config.SendVerification(user, link)
+}
+
+// doVerify redeems a verification token. Tokens sent to an address the user
+// does not have anymore are invalid.
+func (api *authApi) doVerify(c echo.Context) error {
+	req := VerifyRequest{}
+	if err := c.Bind(&req); err != nil || req.Token == "" {
+		return NewApiError(http.StatusBadRequest, ErrCodeInvalidRequest, "Token is required.")
+	}
+
+	at, err := api.app.Tokens().SelectByAccessToken(req.Token, c.Request().Method, api.config.VerifyPage)
+	if err != nil {
+		return NewApiError(http.StatusBadRequest, ErrCodeInvalidToken, "The link is invalid or expired.")
+	}
+
+	user, err := api.app.Users().Select(at.Creator)
+	if err != nil || at.TokenData["email"] != user.Email {
+		return NewApiError(http.StatusBadRequest, ErrCodeInvalidToken, "The link is invalid or expired.")
+	}
+
+	return api.app.Users().SetVerified(user, true)
+}
+
+// doResend sends a new verification link. Like doForgot, the response is the
+// same whether the user exists or not, the user is looked up in the background.
+// Users get one link every DEFAULT_MAIL_COOLDOWN seconds.
+func (api *authApi) doResend(c echo.Context) error {
+	req := ForgotRequest{}
+	if err := c.Bind(&req); err != nil || req.Email == "" {
+		return NewApiError(http.StatusBadRequest, ErrCodeInvalidRequest, "Email is required.")
+	}
+
+	api.app.Go(func() {
+		if err := api.resendVerification(req.Email); err != nil {
+			api.app.Logger().Error("Failed to resend verification", "error", err)
+		}
+	})
+
+	return nil
+}
+
+func (api *authApi) resendVerification(email string) error {
+	user, err := api.app.Users().SelectByEmail(email)
+	if err != nil || user == nil || user.Verified {
+		return nil
+	}
+
+	exp := time.Duration(models.DEFAULT_VERIFICATION_EXPIRATION) * time.Second
+	cooldown := time.Duration(models.DEFAULT_MAIL_COOLDOWN) * time.Second
+	at, err := api.app.Tokens().InsertThrottled(user.ID, 1, api.config.VerifyPage, exp, cooldown, types.JsonMap{"email": user.Email})
+	if err == accesstokens.ErrAccessTokenThrottled {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return api.mailVerification(user, at)
+}
+
+// doEmail changes the email of the authenticated user and sends a verification
+// link to the new address.
+func (api *authApi) doEmail(c echo.Context) error {
+	user := GetUser(c)
+
+	req := EmailRequest{}
+	if err := c.Bind(&req); err != nil {
+		return NewApiError(http.StatusBadRequest, ErrCodeInvalidRequest, "Invalid request.")
+	}
+
+	if err := api.app.Users().CheckPassword(user, req.Password); err != nil {
+		return NewApiError(http.StatusBadRequest, ErrCodeInvalidCredentials, "The password is wrong.")
+	}
+
+	addr, err := mail.ParseAddress(req.Email)
+	if err != nil || addr.Address != req.Email {
+		return NewApiError(http.StatusBadRequest, ErrCodeInvalidEmail, "Invalid email address.")
+	}
+
+	if req.Email == user.Email {
+		return nil
+	}
+
+	if err := api.app.Users().SetEmail(user, req.Email); err != nil {
+		api.app.Logger().Info("Email change failed", "user", user.ID, "error", err)
+		return NewApiError(http.StatusBadRequest, ErrCodeInvalidEmail, "The email address can't be used.")
+	}
+
+	return api.sendVerification(user)
+}
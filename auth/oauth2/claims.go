@@ -0,0 +1,96 @@
+package oauth2
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+)
+
+// Claims are the claims of an ID token used for logins. Subject identifies the
+// user at the provider, the email may change.
+type Claims struct {
+	Issuer          string   `json:"iss"`
+	Subject         string   `json:"sub"`
+	Audience        Audience `json:"aud"`
+	AuthorizedParty string   `json:"azp,omitempty"`
+	Expiry          int64    `json:"exp"`
+	IssuedAt        int64    `json:"iat"`
+	Nonce           string   `json:"nonce,omitempty"`
+	Name            string   `json:"name,omitempty"`
+	Email           string   `json:"email,omitempty"`
+	EmailVerified   Bool     `json:"email_verified,omitempty"`
+}
+
+// Audience is the aud claim, a string or an array of strings.
+type Audience []string
+
+func (a *Audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = Audience{s}
+		return nil
+	}
+
+	var l []string
+	if err := json.Unmarshal(b, &l); err != nil {
+		return err
+	}
+	*a = l
+	return nil
+}
+
+// Bool is a boolean claim. Some providers send booleans as strings.
+type Bool bool
+
+func (v *Bool) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*v = Bool(s == "true")
+		return nil
+	}
+
+	var x bool
+	if err := json.Unmarshal(b, &x); err != nil {
+		return err
+	}
+	*v = Bool(x)
+	return nil
+}
+
+// Registration are the rules for users of a provider without a linked account.
+// If LinkByEmail, the identity is linked to the user with the verified email of
+// the claims. Otherwise, if Enabled, a new user with Role is registered, if the
+// email is verified and its domain is one of Domains. No Domains allow any.
+type Registration struct {
+	Enabled     bool
+	Role        string
+	Domains     []string
+	LinkByEmail bool
+}
+
+// Allows reports whether a user with the claims may be registered.
+func (r Registration) Allows(c *Claims) bool {
+	if !r.Enabled || !bool(c.EmailVerified) || c.Email == "" {
+		return false
+	}
+
+	if len(r.Domains) == 0 {
+		return true
+	}
+
+	i := strings.LastIndex(c.Email, "@")
+	if i < 0 {
+		return false
+	}
+
+	domain := strings.ToLower(c.Email[i+1:])
+	return slices.ContainsFunc(r.Domains, func(d string) bool {
+		return strings.EqualFold(strings.TrimPrefix(d, "@"), domain)
+	})
+}
+
+// Links reports whether the identity may be linked to the user with the email of
+// the claims.
+func (r Registration) Links(c *Claims) bool {
+	return r.LinkByEmail && bool(c.EmailVerified) && c.Email != ""
+}
@@ -0,0 +1,163 @@
+package oauth2
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+)
+
+// Signature algorithms of ID tokens, see RFC 7518. Tokens with other algorithms,
+// including "none" and the HMAC algorithms, are rejected.
+const (
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+)
+
+// jsonWebKey is a public key of a JSON Web Key Set, see RFC 7517.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// key returns the public key, or nil if the key is not supported.
+func (k jsonWebKey) key() any {
+	dec := func(s string) *big.Int {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil
+		}
+		return new(big.Int).SetBytes(b)
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, e := dec(k.N), dec(k.E)
+		if n == nil || e == nil || n.BitLen() < 2048 || !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}
+
+	case "EC":
+		x, y := dec(k.X), dec(k.Y)
+		if k.Crv != "P-256" || x == nil || y == nil || !elliptic.P256().IsOnCurve(x, y) {
+			return nil
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	}
+
+	return nil
+}
+
+type keySet []struct {
+	kid string
+	key any
+}
+
+func (s jsonWebKeySet) keySet() keySet {
+	ks := keySet{}
+	for _, k := range s.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if key := k.key(); key != nil {
+			ks = append(ks, struct {
+				kid string
+				key any
+			}{k.Kid, key})
+		}
+	}
+	return ks
+}
+
+// find returns the key with the key id. Tokens without key id can only be
+// verified if there is a single key.
+func (s keySet) find(kid string) (any, error) {
+	if kid == "" && len(s) == 1 {
+		return s[0].key, nil
+	}
+
+	for _, k := range s {
+		if kid != "" && k.kid == kid {
+			return k.key, nil
+		}
+	}
+
+	return nil, ErrUnknownKey
+}
+
+// verifyJWS checks the signature of the compact serialized JWS and returns its
+// payload. key returns the key with the key id of the header; if it fails with
+// ErrUnknownKey, it is asked again with refresh set.
+func verifyJWS(token string, key func(kid string, refresh bool) (any, error)) ([]byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidIDToken
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if err := json.Unmarshal(b, &header); err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	k, err := key(header.Kid, false)
+	if err == ErrUnknownKey {
+		k, err = key(header.Kid, true)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	ok := false
+	switch k := k.(type) {
+	case *rsa.PublicKey:
+		ok = header.Alg == AlgRS256 && rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) == nil
+	case *ecdsa.PublicKey:
+		if header.Alg == AlgES256 && len(sig) == 64 {
+			r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+			ok = ecdsa.Verify(k, digest[:], r, s)
+		}
+	}
+
+	if !ok {
+		return nil, ErrInvalidIDToken
+	}
+
+	return payload, nil
+}
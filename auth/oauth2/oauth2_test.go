@@ -0,0 +1,227 @@
+package oauth2_test
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Simon-Martens/caveman/auth/oauth2"
+	"github.com/Simon-Martens/caveman/auth/oauth2/oidctest"
+)
+
+const redirect = "http://localhost:8080/callback"
+
+var user = oidctest.User{Subject: "1234", Name: "User", Email: "user@example.com", EmailVerified: true}
+
+func provider(s *oidctest.Server) *oauth2.Provider {
+	return &oauth2.Provider{
+		Name:         "test",
+		Issuer:       s.Issuer(),
+		ClientID:     s.ClientID,
+		ClientSecret: s.ClientSecret,
+	}
+}
+
+// authorize runs the login at the provider and returns the code.
+func authorize(t *testing.T, s *oidctest.Server, p *oauth2.Provider, nonce, verifier string) string {
+	t.Helper()
+
+	u, err := p.AuthCodeURL(context.Background(), redirect, "state", nonce, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, state, err := s.Authorize(u)
+	if err != nil || state != "state" {
+		t.Fatal("Expected a code and the state", state, err)
+	}
+
+	return code
+}
+
+func TestLogin(t *testing.T) {
+	s := oidctest.New("client", "secret")
+	defer s.Close()
+	s.Login(user)
+
+	p := provider(s)
+	ctx := context.Background()
+
+	verifier, err := oauth2.NewVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := p.AuthCodeURL(ctx, redirect, "state", "nonce", verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q, _ := url.Parse(u)
+	if q.Query().Get("code_challenge") != oauth2.S256(verifier) || q.Query().Get("scope") != "openid email profile" {
+		t.Fatal("Unexpected authorization URL", u)
+	}
+
+	code := authorize(t, s, p, "nonce", verifier)
+	claims, err := p.Login(ctx, redirect, code, verifier, "nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claims.Subject != user.Subject || claims.Email != user.Email || !bool(claims.EmailVerified) || claims.Name != user.Name {
+		t.Fatalf("Unexpected claims %+v", claims)
+	}
+
+	// Codes work once
+	if _, err := p.Login(ctx, redirect, code, verifier, "nonce"); !errors.Is(err, oauth2.ErrExchange) {
+		t.Fatal("Expected ErrExchange, got", err)
+	}
+
+	// The code is bound to the verifier
+	code = authorize(t, s, p, "nonce", verifier)
+	if _, err := p.Login(ctx, redirect, code, "other", "nonce"); !errors.Is(err, oauth2.ErrExchange) {
+		t.Fatal("Expected ErrExchange, got", err)
+	}
+
+	// The ID token is bound to the nonce
+	code = authorize(t, s, p, "other", verifier)
+	if _, err := p.Login(ctx, redirect, code, verifier, "nonce"); err != oauth2.ErrNonceMismatch {
+		t.Fatal("Expected ErrNonceMismatch, got", err)
+	}
+
+	// Rotated keys are fetched again
+	s.RotateKey()
+	code = authorize(t, s, p, "nonce", verifier)
+	if _, err := p.Login(ctx, redirect, code, verifier, "nonce"); err != nil {
+		t.Fatal("Expected the rotated key to be fetched, got", err)
+	}
+
+	// Wrong client secrets
+	p = provider(s)
+	p.ClientSecret = "wrong"
+	code = authorize(t, s, p, "nonce", verifier)
+	if _, err := p.Login(ctx, redirect, code, verifier, "nonce"); !errors.Is(err, oauth2.ErrExchange) || !strings.Contains(err.Error(), "invalid_client") {
+		t.Fatal("Expected invalid_client, got", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	s := oidctest.New("client", "secret")
+	defer s.Close()
+	s.Login(user)
+
+	ctx := context.Background()
+
+	scenarios := []struct {
+		name     string
+		modify   func(claims map[string]any)
+		expected error
+	}{
+		{"valid", func(map[string]any) {}, nil},
+		{"wrong issuer", func(c map[string]any) { c["iss"] = "https://evil.com" }, oauth2.ErrInvalidIDToken},
+		{"wrong audience", func(c map[string]any) { c["aud"] = "other" }, oauth2.ErrInvalidIDToken},
+		{"audiences", func(c map[string]any) { c["aud"] = []string{"other", "client"}; c["azp"] = "client" }, nil},
+		{"audiences without azp", func(c map[string]any) { c["aud"] = []string{"other", "client"} }, oauth2.ErrInvalidIDToken},
+		{"no subject", func(c map[string]any) { delete(c, "sub") }, oauth2.ErrInvalidIDToken},
+		{"expired", func(c map[string]any) { c["exp"] = time.Now().Add(-time.Hour).Unix() }, oauth2.ErrIDTokenExpired},
+		{"issued in the future", func(c map[string]any) { c["iat"] = time.Now().Add(time.Hour).Unix() }, oauth2.ErrInvalidIDToken},
+		{"string email_verified", func(c map[string]any) { c["email_verified"] = "true" }, nil},
+	}
+
+	for _, sc := range scenarios {
+		p := provider(s)
+		s.ModifyClaims(sc.modify)
+
+		code := authorize(t, s, p, "nonce", "verifier")
+		tok, err := p.Exchange(ctx, redirect, code, "verifier")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := p.Verify(ctx, tok.IDToken, "nonce"); err != sc.expected {
+			t.Errorf("(%s) Expected %v, got %v", sc.name, sc.expected, err)
+		}
+	}
+	s.ModifyClaims(nil)
+
+	// Tampered and unsigned tokens
+	p := provider(s)
+	code := authorize(t, s, p, "nonce", "verifier")
+	tok, err := p.Exchange(ctx, redirect, code, "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(tok.IDToken, ".")
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	tampered := strings.Replace(string(payload), user.Subject, "4321", 1)
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+
+	invalid := []string{
+		"",
+		"a.b",
+		parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(tampered)) + "." + parts[2],
+		none + "." + parts[1] + ".",
+	}
+
+	for i, it := range invalid {
+		if _, err := p.Verify(ctx, it, "nonce"); err != oauth2.ErrInvalidIDToken {
+			t.Errorf("(%d) Expected ErrInvalidIDToken, got %v", i, err)
+		}
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	s := oidctest.New("client", "secret")
+	defer s.Close()
+
+	p := provider(s)
+	p.Issuer = s.Issuer() + "/"
+	if _, err := p.Metadata(context.Background()); !errors.Is(err, oauth2.ErrDiscovery) {
+		t.Fatal("Expected issuer mismatches to fail, got", err)
+	}
+
+	p = provider(s)
+	meta, err := p.Metadata(context.Background())
+	if err != nil || meta.TokenEndpoint != s.URL+"/token" {
+		t.Fatal("Expected the metadata of the provider", meta, err)
+	}
+
+	// Metadata are cached
+	s.Close()
+	if _, err := p.Metadata(context.Background()); err != nil {
+		t.Fatal("Expected cached metadata, got", err)
+	}
+}
+
+func TestRegistration(t *testing.T) {
+	claims := &oauth2.Claims{Email: "user@Example.com", EmailVerified: true}
+	unverified := &oauth2.Claims{Email: "user@example.com"}
+
+	scenarios := []struct {
+		reg      oauth2.Registration
+		claims   *oauth2.Claims
+		expected bool
+	}{
+		{oauth2.Registration{}, claims, false},
+		{oauth2.Registration{Enabled: true}, claims, true},
+		{oauth2.Registration{Enabled: true}, unverified, false},
+		{oauth2.Registration{Enabled: true, Domains: []string{"example.com"}}, claims, true},
+		{oauth2.Registration{Enabled: true, Domains: []string{"@example.com"}}, claims, true},
+		{oauth2.Registration{Enabled: true, Domains: []string{"other.com"}}, claims, false},
+	}
+
+	for i, s := range scenarios {
+		if s.reg.Allows(s.claims) != s.expected {
+			t.Errorf("(%d) Expected %v", i, s.expected)
+		}
+	}
+
+	if !(oauth2.Registration{LinkByEmail: true}).Links(claims) || (oauth2.Registration{LinkByEmail: true}).Links(unverified) {
+		t.Fatal("Expected only verified emails to be linked")
+	}
+}
@@ -0,0 +1,290 @@
+// Package oidctest provides a fake OpenID Connect provider to test logins
+// without an external provider, see package oauth2. The provider has a single
+// client and logs in the user of Login without asking.
+package oidctest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// User is the user logged in at the provider.
+type User struct {
+	Subject       string
+	Name          string
+	Email         string
+	EmailVerified bool
+}
+
+// Server is a fake OpenID Connect provider, its issuer is the URL of the server.
+type Server struct {
+	*httptest.Server
+	ClientID     string
+	ClientSecret string
+
+	mu     sync.Mutex
+	user   User
+	claims func(claims map[string]any)
+	key    *rsa.PrivateKey
+	kid    int
+	grants map[string]grant
+}
+
+type grant struct {
+	redirect  string
+	nonce     string
+	challenge string
+	user      User
+}
+
+// New starts a provider for the client. It must be closed after use.
+func New(clientID, clientSecret string) *Server {
+	s := &Server{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		grants:       map[string]grant{},
+	}
+	s.RotateKey()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", s.discovery)
+	mux.HandleFunc("GET /authorize", s.authorize)
+	mux.HandleFunc("POST /token", s.token)
+	mux.HandleFunc("GET /jwks", s.jwks)
+
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Issuer returns the issuer of the provider.
+func (s *Server) Issuer() string {
+	return s.URL
+}
+
+// Login sets the user that is logged in at the authorization endpoint.
+func (s *Server) Login(user User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.user = user
+}
+
+// ModifyClaims sets the function that modifies the claims of ID tokens, nil
+// issues valid tokens.
+func (s *Server) ModifyClaims(f func(claims map[string]any)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.claims = f
+}
+
+// RotateKey replaces the signing key with a new key with a new key id.
+func (s *Server) RotateKey() {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic("oidctest: " + err.Error())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.key = key
+	s.kid++
+}
+
+// Authorize visits the authorization URL like a browser and returns the code
+// and state the provider redirects back with.
+func (s *Server) Authorize(authURL string) (code, state string, err error) {
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	res, err := client.Get(authURL)
+	if err != nil {
+		return "", "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusFound {
+		return "", "", errors.New("oidctest: authorization failed: " + res.Status)
+	}
+
+	u, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		return "", "", err
+	}
+
+	return u.Query().Get("code"), u.Query().Get("state"), nil
+}
+
+func (s *Server) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                s.URL,
+		"authorization_endpoint":                s.URL + "/authorize",
+		"token_endpoint":                        s.URL + "/token",
+		"jwks_uri":                              s.URL + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirect := q.Get("redirect_uri")
+
+	if q.Get("response_type") != "code" || q.Get("client_id") != s.ClientID || redirect == "" ||
+		q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" ||
+		!strings.Contains(" "+q.Get("scope")+" ", " openid ") {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"error": "invalid_request"})
+		return
+	}
+
+	code := random()
+
+	s.mu.Lock()
+	s.grants[code] = grant{
+		redirect:  redirect,
+		nonce:     q.Get("nonce"),
+		challenge: q.Get("code_challenge"),
+		user:      s.user,
+	}
+	s.mu.Unlock()
+
+	u, err := url.Parse(redirect)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"error": "invalid_request"})
+		return
+	}
+
+	rq := u.Query()
+	rq.Set("code", code)
+	rq.Set("state", q.Get("state"))
+	u.RawQuery = rq.Encode()
+
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+	id, _ = url.QueryUnescape(id)
+	secret, _ = url.QueryUnescape(secret)
+	if !ok || id != s.ClientID || secret != s.ClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]any{"error": "invalid_client"})
+		return
+	}
+
+	s.mu.Lock()
+	code := r.PostFormValue("code")
+	g, found := s.grants[code]
+	delete(s.grants, code)
+	s.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if r.PostFormValue("grant_type") != "authorization_code" || !found ||
+		r.PostFormValue("redirect_uri") != g.redirect ||
+		base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	claims := map[string]any{
+		"iss":            s.URL,
+		"sub":            g.user.Subject,
+		"aud":            s.ClientID,
+		"exp":            now.Add(time.Hour).Unix(),
+		"iat":            now.Unix(),
+		"name":           g.user.Name,
+		"email":          g.user.Email,
+		"email_verified": g.user.EmailVerified,
+	}
+	if g.nonce != "" {
+		claims["nonce"] = g.nonce
+	}
+
+	idToken, err := s.sign(claims)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"error": "server_error"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": random(),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+func (s *Server) jwks(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"keys": []map[string]any{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": s.keyID(),
+			"n":   base64.RawURLEncoding.EncodeToString(s.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(s.key.E)).Bytes()),
+		}},
+	})
+}
+
+// sign returns the claims as RS256 signed JWT.
+func (s *Server) sign(claims map[string]any) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.claims != nil {
+		s.claims(claims)
+	}
+
+	header, err := json.Marshal(map[string]any{"alg": "RS256", "typ": "JWT", "kid": s.keyID()})
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func (s *Server) keyID() string {
+	return "key-" + strconv.Itoa(s.kid)
+}
+
+func random() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
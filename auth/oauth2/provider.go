@@ -0,0 +1,306 @@
+// Package oauth2 implements logins with OpenID Connect providers: discovery of
+// the endpoints and keys of a provider, the authorization code flow with PKCE and
+// the verification of ID tokens. Providers are configured with their issuer, see
+// Provider. The state of a login is kept by the caller.
+package oauth2
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrDiscovery = errors.New("provider discovery failed")
+var ErrExchange = errors.New("code exchange failed")
+var ErrInvalidIDToken = errors.New("invalid id token")
+var ErrNonceMismatch = errors.New("id token nonce mismatch")
+var ErrIDTokenExpired = errors.New("id token expired")
+var ErrUnknownKey = errors.New("unknown id token signing key")
+
+// DefaultScopes are requested if a provider has no scopes.
+var DefaultScopes = []string{"openid", "email", "profile"}
+
+// clockSkew is tolerated in the times of ID tokens.
+const clockSkew = time.Minute
+
+// maxResponseSize limits the responses of providers.
+const maxResponseSize = 1 << 20
+
+// Metadata are the provider metadata of OpenID Connect Discovery.
+type Metadata struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	UserinfoEndpoint      string   `json:"userinfo_endpoint,omitempty"`
+	JWKSURI               string   `json:"jwks_uri"`
+	CodeChallengeMethods  []string `json:"code_challenge_methods_supported,omitempty"`
+}
+
+// Token is the response of the token endpoint.
+type Token struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresIn    int64  `json:"expires_in,omitempty"`
+	IDToken      string `json:"id_token"`
+}
+
+// Provider is an OpenID Connect provider. Name identifies the provider in URLs
+// and linked identities, so it must not change. The endpoints and keys are
+// discovered from the Issuer on first use. Registration are the rules for users
+// that have no account yet. Client is used for the requests to the provider,
+// http.DefaultClient with a timeout if nil.
+type Provider struct {
+	Name         string
+	DisplayName  string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	Registration Registration
+	Client       *http.Client
+
+	mu   sync.Mutex
+	meta *Metadata
+	keys keySet
+}
+
+var defaultClient = &http.Client{Timeout: 10 * time.Second}
+
+func (p *Provider) client() *http.Client {
+	if p.Client != nil {
+		return p.Client
+	}
+	return defaultClient
+}
+
+// Metadata returns the discovered metadata of the provider. The issuer of the
+// metadata must be the issuer of the provider.
+func (p *Provider) Metadata(ctx context.Context) (*Metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.meta != nil {
+		return p.meta, nil
+	}
+
+	u := strings.TrimSuffix(p.Issuer, "/") + "/.well-known/openid-configuration"
+	meta := &Metadata{}
+	if err := p.get(ctx, u, meta); err != nil {
+		return nil, errors.Join(ErrDiscovery, err)
+	}
+
+	if meta.Issuer != p.Issuer {
+		return nil, errors.Join(ErrDiscovery, errors.New("issuer mismatch"))
+	}
+
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, errors.Join(ErrDiscovery, errors.New("endpoints missing"))
+	}
+
+	p.meta = meta
+	return meta, nil
+}
+
+// AuthCodeURL returns the URL the user is sent to for the login. The provider
+// redirects back to redirect with the code and state. The nonce is included in
+// the ID token and verifier is the PKCE code verifier, see NewVerifier.
+func (p *Provider) AuthCodeURL(ctx context.Context, redirect, state, nonce, verifier string) (string, error) {
+	meta, err := p.Metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(meta.AuthorizationEndpoint)
+	if err != nil {
+		return "", errors.Join(ErrDiscovery, err)
+	}
+
+	scopes := p.Scopes
+	if len(scopes) == 0 {
+		scopes = DefaultScopes
+	}
+	if !slices.Contains(scopes, "openid") {
+		scopes = append([]string{"openid"}, scopes...)
+	}
+
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.ClientID)
+	q.Set("redirect_uri", redirect)
+	q.Set("scope", strings.Join(scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", S256(verifier))
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+// Exchange redeems the code for the tokens of the user. The client authenticates
+// with HTTP basic auth.
+func (p *Provider) Exchange(ctx context.Context, redirect, code, verifier string) (*Token, error) {
+	meta, err := p.Metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirect)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+
+	tok := &Token{}
+	if err := p.do(req, tok); err != nil {
+		return nil, errors.Join(ErrExchange, err)
+	}
+
+	if tok.IDToken == "" {
+		return nil, errors.Join(ErrExchange, errors.New("id token missing"))
+	}
+
+	return tok, nil
+}
+
+// Verify checks the signature, issuer, audience, expiration and nonce of the ID
+// token and returns its claims. Keys of the provider are fetched again if the
+// token is signed with an unknown key, so keys can be rotated.
+func (p *Provider) Verify(ctx context.Context, idToken, nonce string) (*Claims, error) {
+	meta, err := p.Metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := verifyJWS(idToken, func(kid string, refresh bool) (any, error) {
+		return p.key(ctx, meta.JWKSURI, kid, refresh)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	claims := &Claims{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	if claims.Issuer != p.Issuer || claims.Subject == "" || !slices.Contains(claims.Audience, p.ClientID) {
+		return nil, ErrInvalidIDToken
+	}
+
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.ClientID {
+		return nil, ErrInvalidIDToken
+	}
+
+	now := time.Now()
+	if claims.Expiry == 0 || now.After(time.Unix(claims.Expiry, 0).Add(clockSkew)) {
+		return nil, ErrIDTokenExpired
+	}
+
+	if claims.IssuedAt != 0 && time.Unix(claims.IssuedAt, 0).After(now.Add(clockSkew)) {
+		return nil, ErrInvalidIDToken
+	}
+
+	if claims.Nonce != nonce {
+		return nil, ErrNonceMismatch
+	}
+
+	return claims, nil
+}
+
+// Login exchanges the code and verifies the ID token, see Exchange and Verify.
+func (p *Provider) Login(ctx context.Context, redirect, code, verifier, nonce string) (*Claims, error) {
+	tok, err := p.Exchange(ctx, redirect, code, verifier)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.Verify(ctx, tok.IDToken, nonce)
+}
+
+// key returns the key of the provider with the key id. The keys are fetched if
+// there are none yet or refresh is set.
+func (p *Provider) key(ctx context.Context, uri, kid string, refresh bool) (any, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.keys == nil || refresh {
+		jwks := &jsonWebKeySet{}
+		if err := p.get(ctx, uri, jwks); err != nil {
+			return nil, errors.Join(ErrDiscovery, err)
+		}
+		p.keys = jwks.keySet()
+	}
+
+	return p.keys.find(kid)
+}
+
+func (p *Provider) get(ctx context.Context, uri string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	return p.do(req, v)
+}
+
+func (p *Provider) do(req *http.Request, v any) error {
+	res, err := p.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(io.LimitReader(res.Body, maxResponseSize))
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		e := struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}{}
+		if json.Unmarshal(b, &e) == nil && e.Error != "" {
+			return errors.New(strings.TrimSpace(e.Error + " " + e.Description))
+		}
+		return errors.New(res.Status)
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+// NewVerifier returns a random PKCE code verifier.
+func NewVerifier() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// S256 returns the PKCE code challenge of the verifier.
+func S256(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
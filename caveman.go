@@ -6,13 +6,13 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/Simon-Martens/caveman/apis"
+	"github.com/Simon-Martens/caveman/cmd"
 	"github.com/Simon-Martens/caveman/manager"
-	"github.com/Simon-Martens/caveman/migrations"
 	"github.com/Simon-Martens/caveman/models"
 	"github.com/Simon-Martens/caveman/tools/list"
-	"github.com/Simon-Martens/caveman/tools/migration"
 	"github.com/fatih/color"
-	"github.com/pocketbase/dbx"
+	"github.com/labstack/echo/v4"
 	"github.com/spf13/cobra"
 )
 
@@ -28,6 +28,10 @@ import (
 type Caveman struct {
 	*manager.Manager
 	StartupSettings models.Config
+	ServeConfig     apis.ServeConfig
+
+	// RootCmd is the main console command
+	RootCmd *cobra.Command
 }
 
 // Creates a new Caveman instance with either the
@@ -52,18 +56,75 @@ func NewWithSettings(settings models.Config) *Caveman {
 		settings.Dev = true
 	}
 
-	cm := &Caveman{StartupSettings: settings}
+	cm := &Caveman{
+		StartupSettings: settings,
+		RootCmd: &cobra.Command{
+			Use:     filepath.Base(os.Args[0]),
+			Short:   "Caveman CLI",
+			Version: models.VERSION,
+			FParseErrWhitelist: cobra.FParseErrWhitelist{
+				UnknownFlags: true,
+			},
+			// no need to provide the default cobra completion command
+			CompletionOptions: cobra.CompletionOptions{
+				DisableDefaultCmd: true,
+			},
+		},
+	}
+
+	cm.RootCmd.SetErr(newErrWriter())
+
+	// We parse the flags eagerly, since the manager needs the data dir and dev mode.
+	// Errors are ignored here, they will be reported on command execution.
+	_ = cm.ParseFlags(settings.Dev, cm.RootCmd)
+
 	cm.Manager = manager.New(cm.StartupSettings)
+	cm.ServeConfig = apis.NewServeConfig(cm.StartupSettings)
+
+	cm.RootCmd.AddCommand(cmd.NewServeCommand(cm.Manager, &cm.ServeConfig))
+	cm.RootCmd.AddCommand(cmd.NewSetupCommand(cm.Manager))
+	cm.RootCmd.AddCommand(cmd.NewJobsCommand(cm.Manager))
+	cm.RootCmd.AddCommand(cmd.NewTokensCommand(cm.Manager))
+	cm.RootCmd.AddCommand(cmd.NewInviteCommand(cm.Manager, &cm.ServeConfig))
+	cmd.MustRegister(cm.Manager, cm.RootCmd, "")
 
 	return cm
 }
 
+// Start bootstraps the manager (if needed) and executes the root command.
+func (cm *Caveman) Start() error {
+	if !cm.skipBootstrap(cm.RootCmd) {
+		if err := cm.Bootstrap(); err != nil {
+			return err
+		}
+	}
+
+	return cm.RootCmd.Execute()
+}
+
+// Serve starts the HTTP server without going through the command line.
+// It blocks until the server is shut down, see [apis.Serve].
+func (cm *Caveman) Serve() error {
+	return apis.Serve(cm.Manager, cm.ServeConfig)
+}
+
+// OnBeforeServe registers a function that is called with the initialized router
+// before the server starts, eg. to register app routes and middlewares.
+func (cm *Caveman) OnBeforeServe(f func(e *echo.Echo) error) {
+	cm.ServeConfig.BeforeServe = append(cm.ServeConfig.BeforeServe, f)
+}
+
 // Given a cobra command, this parses the caveman relevant flags.
 func (cm *Caveman) ParseFlags(dev bool, rootCmd *cobra.Command) error {
+	dir := cm.StartupSettings.DataDir
+	if dir == "" {
+		dir = models.DEFAULT_DATA_DIR
+	}
+
 	rootCmd.PersistentFlags().StringVar(
 		&cm.StartupSettings.DataDir,
 		"dir",
-		models.DEFAULT_DATA_DIR,
+		dir,
 		"the Caveman data directory",
 	)
 
@@ -156,29 +217,9 @@ func (colored *coloredWriter) Write(p []byte) (n int, err error) {
 	return colored.c.Print(string(p))
 }
 
-type migrationsConnection struct {
-	DB             *dbx.DB
-	MigrationsList migration.MigrationsList
-}
-
-func RunMigrations(app manager.Manager) error {
-	connections := []migrationsConnection{
-		{
-			DB:             app.DB().NonConcurrentDB(),
-			MigrationsList: migrations.AppMigrations,
-		},
-	}
-
-	for _, c := range connections {
-		runner, err := migration.NewRunner(c.DB, c.MigrationsList)
-		if err != nil {
-			return err
-		}
-
-		if _, err := runner.Up(); err != nil {
-			return err
-		}
-	}
-
-	return nil
+// RunMigrations applies all pending migrations to the application databases.
+//
+// Deprecated: Use [manager.Manager.RunMigrations] instead.
+func RunMigrations(app *manager.Manager) error {
+	return app.RunMigrations()
 }
@@ -1,9 +1,14 @@
 package caveman
 
 import (
+	"net"
 	"os"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/Simon-Martens/caveman/models"
 )
 
 func TestStartup(t *testing.T) {
@@ -47,6 +52,20 @@ func TestStartup(t *testing.T) {
 
 	t.Log("Test Startup")
 
+	// The serve command blocks until it receives a signal, so we stop it as soon
+	// as the server accepts connections.
+	go func() {
+		for i := 0; i < 100; i++ {
+			conn, err := net.Dial("tcp", models.DEFAULT_HTTP_ADDRESS)
+			if err == nil {
+				conn.Close()
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		syscall.Kill(os.Getpid(), syscall.SIGINT)
+	}()
+
 	err := app.Start()
 	if err != nil {
 		t.Error(err)
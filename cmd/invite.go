@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Simon-Martens/caveman/apis"
+	"github.com/Simon-Martens/caveman/manager"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// NewInviteCommand creates and returns new command that creates invites to
+// register, eg. for closed deployments without registration. The link points
+// to the invite page of the config.
+func NewInviteCommand(app *manager.Manager, config *apis.ServeConfig) *cobra.Command {
+	var email, role string
+	var uses int64
+	var expires time.Duration
+
+	command := &cobra.Command{
+		Use:   "invite",
+		Short: "Creates an invite to register and prints the link",
+		Long: `Creates an invite to register with the given role. The link is printed once, it
+can't be shown again.
+
+With --email, the invite can only be accepted with this email address, and the
+user is registered as verified. Invites without email can be accepted with any
+address, --uses times.`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			at, err := app.CreateInvite(0, email, role, uses, expires)
+			if err != nil {
+				return err
+			}
+
+			color.Green("Successfully created invite as %q, valid until %s:", at.TokenData["role"], formatTime(at.Expires))
+			fmt.Println(apis.InviteLink(app, config.Auth.InvitePage, at.Token))
+			return nil
+		},
+	}
+
+	command.Flags().StringVar(&email, "email", "", "email address the invite is for")
+	command.Flags().StringVar(&role, "role", "", "role of the invited user (default user)")
+	command.Flags().Int64Var(&uses, "uses", 1, "number of users that can register with the invite")
+	command.Flags().DurationVar(&expires, "expires", 0, "lifetime of the invite, eg. 48h (default 7 days)")
+
+	return command
+}
@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/Simon-Martens/caveman/manager"
+	"github.com/Simon-Martens/caveman/tools/types"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// NewJobsCommand creates and returns new command that lists the registered jobs
+// and runs a job manually.
+//
+// A manual run takes the same lock as scheduled runs, so it fails if the job is
+// running in a server at the same time.
+func NewJobsCommand(app *manager.Manager) *cobra.Command {
+	command := &cobra.Command{
+		Use:          "jobs",
+		Short:        "Lists the scheduled jobs or runs one",
+		SilenceUsage: true,
+	}
+
+	list := &cobra.Command{
+		Use:          "list",
+		Short:        "Lists the registered jobs with their last and next run",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			jobs, err := app.Scheduler().Jobs()
+			if err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tSCHEDULE\tLAST RUN\tDURATION\tNEXT RUN\tSTATUS")
+
+			for _, j := range jobs {
+				status := "ok"
+				if j.IsRunning() {
+					status = "running since " + formatTime(j.RunningSince)
+				} else if j.LastError != "" {
+					status = "failed: " + j.LastError
+				} else if j.LastRun.IsZero() {
+					status = "never run"
+				}
+
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+					j.Name, j.Spec, formatTime(j.LastRun), j.Duration(), formatTime(j.NextRun), status)
+			}
+
+			return w.Flush()
+		},
+	}
+
+	run := &cobra.Command{
+		Use:          "run name",
+		Short:        "Runs a job now, independent of its schedule",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			if err := app.RunJob(command.Context(), args[0]); err != nil {
+				return err
+			}
+
+			color.Green("Successfully ran job %q.", args[0])
+			return nil
+		},
+	}
+
+	command.AddCommand(list, run)
+
+	return command
+}
+
+func formatTime(d types.DateTime) string {
+	if d.IsZero() {
+		return "-"
+	}
+	return d.Time().Local().Format("2006-01-02 15:04:05")
+}
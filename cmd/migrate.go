@@ -43,10 +43,10 @@ func MustRegister(app *manager.Manager, rootCmd *cobra.Command, dir string) {
 
 // Register registers the migratecmd plugin to the provided Caveman instance.
 func Register(app *manager.Manager, rootCmd *cobra.Command, dir string) error {
-	p := &plugin{app: *app, dir: dir}
+	p := &plugin{app: app, dir: dir}
 
-	if dir == "" {
-		dir = filepath.Join(p.app.DataDir(), "../migrations")
+	if p.dir == "" {
+		p.dir = filepath.Join(p.app.DataDir(), "../migrations")
 	}
 
 	// attach the migrate command
@@ -58,7 +58,7 @@ func Register(app *manager.Manager, rootCmd *cobra.Command, dir string) error {
 }
 
 type plugin struct {
-	app manager.Manager
+	app *manager.Manager
 	dir string
 }
 
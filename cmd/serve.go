@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"github.com/Simon-Martens/caveman/apis"
+	"github.com/Simon-Martens/caveman/manager"
+	"github.com/spf13/cobra"
+)
+
+// NewServeCommand creates and returns new command responsible for
+// starting the HTTP server.
+//
+// The config is read when the command is executed, so functions appended to
+// config.BeforeServe after the command was created are still called.
+func NewServeCommand(app *manager.Manager, config *apis.ServeConfig) *cobra.Command {
+	command := &cobra.Command{
+		Use:          "serve",
+		Short:        "Starts the web server (default to 127.0.0.1:8080 if no address is provided)",
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			return apis.Serve(app, *config)
+		},
+	}
+
+	command.PersistentFlags().StringVar(
+		&config.Address,
+		"http",
+		config.Address,
+		"TCP address to listen for the HTTP server",
+	)
+
+	command.PersistentFlags().StringVar(
+		&config.CertFile,
+		"cert",
+		config.CertFile,
+		"path to the TLS certificate file (enables TLS together with --key)",
+	)
+
+	command.PersistentFlags().StringVar(
+		&config.KeyFile,
+		"key",
+		config.KeyFile,
+		"path to the TLS key file (enables TLS together with --cert)",
+	)
+
+	command.PersistentFlags().StringSliceVar(
+		&config.TrustedProxies,
+		"trusted-proxy",
+		config.TrustedProxies,
+		"IP or CIDR range of a reverse proxy allowed to set X-Forwarded-For",
+	)
+
+	return command
+}
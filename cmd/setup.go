@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/AlecAivazis/survey/v2"
+	"github.com/Simon-Martens/caveman/db/users"
+	"github.com/Simon-Martens/caveman/manager"
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// NewSetupCommand creates and returns new command that creates the first admin
+// and the app settings, for servers without a browser at hand.
+//
+// Values not given as flags are prompted for.
+func NewSetupCommand(app *manager.Manager) *cobra.Command {
+	var admin users.User
+	var password string
+	var sets models.Settings
+
+	command := &cobra.Command{
+		Use:          "setup",
+		Short:        "Creates the first admin and the app settings",
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			state, err := app.RefreshSetupState()
+			if err != nil {
+				return err
+			}
+
+			if state != models.SETUP_STATE_NO_ADMIN {
+				return manager.ErrSetupDone
+			}
+
+			if sets.URL == "" {
+				sets.URL = app.CMSettings().URL
+			}
+
+			qs := []*survey.Question{}
+			qs = appendQuestion(qs, admin.Name, "AdminName", &survey.Input{Message: "Admin name:"}, false)
+			qs = appendQuestion(qs, admin.Email, "AdminEmail", &survey.Input{Message: "Admin email:"}, true)
+			qs = appendQuestion(qs, password, "Password", &survey.Password{Message: "Admin password:"}, true)
+			qs = appendQuestion(qs, sets.Name, "Name", &survey.Input{Message: "App name:"}, true)
+			qs = appendQuestion(qs, sets.Contact, "Contact", &survey.Input{Message: "App contact:"}, false)
+
+			answers := struct {
+				AdminName  string
+				AdminEmail string
+				Password   string
+				Name       string
+				Contact    string
+			}{admin.Name, admin.Email, password, sets.Name, sets.Contact}
+
+			if len(qs) > 0 {
+				if err := survey.Ask(qs, &answers); err != nil {
+					return err
+				}
+			}
+
+			if len(answers.Password) < models.DEFAULT_MIN_PASSWORD_LENGTH {
+				return fmt.Errorf("the password must be at least %d characters long", models.DEFAULT_MIN_PASSWORD_LENGTH)
+			}
+
+			admin.Name = answers.AdminName
+			admin.Email = answers.AdminEmail
+			sets.Name = answers.Name
+			sets.Contact = answers.Contact
+
+			user, err := app.Setup(&admin, answers.Password, &sets)
+			if err != nil {
+				return err
+			}
+
+			color.Green("Successfully created admin %q, the setup is done.", user.Email)
+			return nil
+		},
+	}
+
+	command.Flags().StringVar(&admin.Name, "admin-name", "", "name of the admin")
+	command.Flags().StringVar(&admin.Email, "admin-email", "", "email of the admin")
+	command.Flags().StringVar(&password, "password", "", "password of the admin")
+	command.Flags().StringVar(&sets.Name, "name", "", "name of the app")
+	command.Flags().StringVar(&sets.URL, "url", "", "public URL of the app")
+	command.Flags().StringVar(&sets.Contact, "contact", "", "contact of the app")
+	command.Flags().StringVar(&sets.Icon, "icon", "", "icon of the app")
+
+	return command
+}
+
+// appendQuestion appends the question, if the value was not given as flag.
+func appendQuestion(qs []*survey.Question, value string, name string, prompt survey.Prompt, required bool) []*survey.Question {
+	if value != "" {
+		return qs
+	}
+
+	q := &survey.Question{Name: name, Prompt: prompt}
+	if required {
+		q.Validate = survey.Required
+	}
+
+	return append(qs, q)
+}
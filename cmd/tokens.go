@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Simon-Martens/caveman/db/apitokens"
+	"github.com/Simon-Martens/caveman/manager"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// NewTokensCommand creates and returns new command that creates, lists and
+// revokes the API tokens of users.
+func NewTokensCommand(app *manager.Manager) *cobra.Command {
+	command := &cobra.Command{
+		Use:          "tokens",
+		Short:        "Creates, lists and revokes API tokens",
+		SilenceUsage: true,
+	}
+
+	command.AddCommand(newTokensCreateCommand(app), newTokensListCommand(app), newTokensRevokeCommand(app))
+
+	return command
+}
+
+func newTokensCreateCommand(app *manager.Manager) *cobra.Command {
+	var email string
+	var at apitokens.APIToken
+	var expires time.Duration
+
+	command := &cobra.Command{
+		Use:   "create name",
+		Short: "Creates an API token and prints it",
+		Long: `Creates an API token for a user. The token is printed once, it can't be shown again.
+
+The scope restricts the token: --permission can be given multiple times, "*"
+grants all permissions of the user. --path takes path patterns like /api/reports/**
+or /api/users/:id, --method HTTP methods. Without paths or methods, the token may
+access any path with any method.`,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			user, err := app.Users().SelectByEmail(email)
+			if err != nil {
+				return fmt.Errorf("user %q not found", email)
+			}
+
+			at.Name = args[0]
+			n, err := app.CreateAPIToken(user.ID, &at, expires)
+			if err != nil {
+				return err
+			}
+
+			color.Green("Successfully created API token %q (id %d) for %q:", n.Name, n.ID, user.Email)
+			fmt.Println(n.Token)
+			return nil
+		},
+	}
+
+	command.Flags().StringVar(&email, "user", "", "email of the user the token acts for")
+	command.Flags().StringSliceVar((*[]string)(&at.Permissions), "permission", nil, "permission the token may use, * for all")
+	command.Flags().StringSliceVar((*[]string)(&at.Paths), "path", nil, "path pattern the token may access")
+	command.Flags().StringSliceVar((*[]string)(&at.Methods), "method", nil, "HTTP method the token may use")
+	command.Flags().DurationVar(&expires, "expires", 0, "lifetime of the token, eg. 720h (default never expires)")
+	_ = command.MarkFlagRequired("user")
+
+	return command
+}
+
+func newTokensListCommand(app *manager.Manager) *cobra.Command {
+	var email string
+
+	command := &cobra.Command{
+		Use:          "list",
+		Short:        "Lists the API tokens",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			var list []*apitokens.APIToken
+			var err error
+
+			if email != "" {
+				user, uerr := app.Users().SelectByEmail(email)
+				if uerr != nil {
+					return fmt.Errorf("user %q not found", email)
+				}
+				list, err = app.APITokens().SelectByUser(user.ID)
+			} else {
+				list, err = app.APITokens().SelectAll()
+			}
+
+			if err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tNAME\tUSER\tPERMISSIONS\tPATHS\tMETHODS\tEXPIRES\tLAST USED")
+
+			for _, at := range list {
+				user := strconv.FormatInt(at.User, 10)
+				if u, err := app.Users().Select(at.User); err == nil {
+					user = u.Email
+				}
+
+				fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+					at.ID, at.Name, user, joinOr(at.Permissions, "-"), joinOr(at.Paths, "any"),
+					joinOr(at.Methods, "any"), formatTime(at.Expires), formatTime(at.LastUsed))
+			}
+
+			return w.Flush()
+		},
+	}
+
+	command.Flags().StringVar(&email, "user", "", "only list the tokens of the user with this email")
+
+	return command
+}
+
+func newTokensRevokeCommand(app *manager.Manager) *cobra.Command {
+	return &cobra.Command{
+		Use:          "revoke id",
+		Short:        "Revokes an API token",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			id, err := strconv.ParseInt(args[0], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid id %q", args[0])
+			}
+
+			if err := app.APITokens().Delete(id); err != nil {
+				return err
+			}
+
+			color.Green("Successfully revoked API token %d.", id)
+			return nil
+		},
+	}
+}
+
+func joinOr(list []string, def string) string {
+	if len(list) == 0 {
+		return def
+	}
+	return strings.Join(list, ",")
+}
@@ -1,21 +1,44 @@
 package accesstokens
 
 import (
+	"slices"
+	"strings"
+
 	"github.com/Simon-Martens/caveman/models"
+	"github.com/Simon-Martens/caveman/tools/pathmatch"
 	"github.com/Simon-Martens/caveman/tools/types"
 )
 
+// AccessToken is a token for a path, eg. in a password reset link. Path is a path
+// pattern, see pathmatch, so a token can also cover a folder and its files. If
+// Methods is not empty, the token is only valid for these HTTP methods. Creator is
+// 0 for tokens created before a login, eg. the state of an OAuth2 login. Only the
+// digest of the token is stored, so the token is only known after inserting, or
+// if the AT was selected by it.
 type AccessToken struct {
 	models.Record
-	ID        int64          `db:"pk,id"`
-	Token     string         `db:"token"`
-	TokenData types.JsonMap  `db:"token_data"`
-	Path      string         `db:"path"`
-	Creator   int64          `db:"creator_id"`
-	Expires   types.DateTime `db:"expires"`
-	Uses      int64          `db:"uses"`
+	ID        int64                   `db:"pk,id"`
+	Token     string                  `db:"-"`
+	Hash      string                  `db:"token"`
+	TokenData types.JsonMap           `db:"token_data"`
+	Path      string                  `db:"path"`
+	Methods   types.JsonArray[string] `db:"methods"`
+	Creator   int64                   `db:"creator_id"`
+	Expires   types.DateTime          `db:"expires"`
+	Uses      int64                   `db:"uses"`
 }
 
 func (a AccessToken) TableName() string {
 	return models.DEFAULT_ACCESS_TOKENS_TABLE
 }
+
+// Allows reports whether the token is valid for the method and path.
+func (a AccessToken) Allows(method, path string) bool {
+	if len(a.Methods) > 0 && !slices.ContainsFunc(a.Methods, func(m string) bool {
+		return strings.EqualFold(m, method)
+	}) {
+		return false
+	}
+
+	return pathmatch.Match(a.Path, path)
+}
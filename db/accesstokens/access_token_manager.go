@@ -3,10 +3,14 @@ package accesstokens
 import (
 	"database/sql"
 	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/Simon-Martens/caveman/db"
 	"github.com/Simon-Martens/caveman/models"
+	"github.com/Simon-Martens/caveman/tools/pathmatch"
 	"github.com/Simon-Martens/caveman/tools/security"
 	"github.com/Simon-Martens/caveman/tools/types"
 	"github.com/pocketbase/dbx"
@@ -16,8 +20,10 @@ var ErrAccessTokenExpired = errors.New("access token expired")
 var ErrAccessTokenNotFound = errors.New("access token not found")
 var ErrAccessTokenReused = errors.New("access token reuse")
 var ErrAccessTokenInvalidPath = errors.New("wrong path for access token")
+var ErrAccessTokenThrottled = errors.New("access token created too recently")
 var ErrUserInvalid = errors.New("user invalid")
 var PathInvalid = errors.New("path invalid")
+var MethodInvalid = errors.New("method invalid")
 
 type AccessTokenManager struct {
 	db      *db.DB
@@ -26,6 +32,8 @@ type AccessTokenManager struct {
 
 	long_exp  int
 	short_exp int
+
+	count_probes atomic.Bool
 }
 
 func New(db *db.DB, tablename, usertable, idfield string, l_exp, s_exp int) (*AccessTokenManager, error) {
@@ -44,6 +52,7 @@ func New(db *db.DB, tablename, usertable, idfield string, l_exp, s_exp int) (*Ac
 	s := &AccessTokenManager{
 		db:        db,
 		table:     tablename,
+		idfield:   idfield,
 		long_exp:  l_exp,
 		short_exp: s_exp,
 	}
@@ -69,11 +78,12 @@ func (s *AccessTokenManager) createTable(usertable, idfield string) error {
 			"token TOKEN NOT NULL COLLATE BINARY, " +
 			"token_data TEXT, " +
 			"path STRING NOT NULL, " +
+			"methods TEXT DEFAULT '[]', " +
 			"created INTEGER DEFAULT 0, " +
 			"uses INTEGER DEFAULT 99999999, " +
 			"modified INTEGER DEFAULT 0, " +
 			"expires INTEGER DEFAULT 0, " +
-			"creator_id INTEGER NOT NULL, " +
+			"creator_id INTEGER, " +
 			"FOREIGN KEY(creator_id) REFERENCES " + utn + "(" + idfield + "));",
 	)
 
@@ -127,10 +137,12 @@ func (s *AccessTokenManager) InsertUnsafe(at *AccessToken) error {
 		return ErrUserInvalid
 	}
 
-	if at.Path == "" {
-		return PathInvalid
+	if err := validate(at); err != nil {
+		return err
 	}
 
+	at.Hash = security.HashToken(at.Token)
+
 	db := s.db.NonConcurrentDB()
 	return db.Model(at).Insert()
 }
@@ -145,12 +157,17 @@ func (s *AccessTokenManager) InsertEternal(user int64, path string) (*AccessToke
 		Path:    path,
 	}
 
+	if err := validate(&n); err != nil {
+		return nil, err
+	}
+
 	tok, err := security.CreateRandomSHA256Token()
 	if err != nil {
 		return nil, err
 	}
 
 	n.Token = tok
+	n.Hash = security.HashToken(tok)
 
 	db := s.db.NonConcurrentDB()
 	err = db.Model(&n).Insert()
@@ -162,13 +179,6 @@ func (s *AccessTokenManager) InsertEternal(user int64, path string) (*AccessToke
 }
 
 func (s *AccessTokenManager) Insert(user int64, uses int64, path string, short bool) (*AccessToken, error) {
-	n := AccessToken{
-		Record:  models.NewRecord(),
-		Creator: user,
-		Uses:    uses,
-		Path:    path,
-	}
-
 	var dexp time.Duration
 	if short {
 		dexp = time.Duration(s.short_exp) * time.Second
@@ -176,6 +186,38 @@ func (s *AccessTokenManager) Insert(user int64, uses int64, path string, short b
 		dexp = time.Duration(s.long_exp) * time.Second
 	}
 
+	return s.InsertWithDuration(user, uses, path, dexp)
+}
+
+// InsertWithDuration creates an AT that expires after the given duration, eg. for
+// links that should be valid for a shorter time than short ATs.
+func (s *AccessTokenManager) InsertWithDuration(user int64, uses int64, path string, dexp time.Duration) (*AccessToken, error) {
+	return s.InsertWithData(user, uses, path, dexp, nil)
+}
+
+// InsertWithData creates an AT like InsertWithDuration that carries additional data,
+// eg. the email address a verification link was sent to.
+func (s *AccessTokenManager) InsertWithData(user int64, uses int64, path string, dexp time.Duration, data types.JsonMap) (*AccessToken, error) {
+	return s.InsertScoped(user, uses, path, nil, dexp, data)
+}
+
+// InsertScoped creates an AT like InsertWithData that is only valid for the given
+// HTTP methods. No methods means any method. A user of 0 creates an AT without
+// creator, eg. for flows that start before a login.
+func (s *AccessTokenManager) InsertScoped(user int64, uses int64, path string, methods []string, dexp time.Duration, data types.JsonMap) (*AccessToken, error) {
+	n := AccessToken{
+		Record:    models.NewRecord(),
+		Creator:   user,
+		Uses:      uses,
+		Path:      path,
+		Methods:   methods,
+		TokenData: data,
+	}
+
+	if err := validate(&n); err != nil {
+		return nil, err
+	}
+
 	n.Expires, _ = n.Created.Add(dexp)
 
 	tok, err := security.CreateRandomSHA256Token()
@@ -184,74 +226,296 @@ func (s *AccessTokenManager) Insert(user int64, uses int64, path string, short b
 	}
 
 	n.Token = tok
+	n.Hash = security.HashToken(tok)
+
+	err = s.model(&n).Insert()
+	if err != nil {
+		return nil, err
+	}
+
+	return &n, nil
+}
+
+// InsertThrottled creates an AT like InsertWithData, unless the user created an
+// AT for the path within cooldown that is not used up, eg. to throttle mails with
+// links. Then it fails with ErrAccessTokenThrottled. The check and the insert are
+// a single conditional INSERT, so concurrent requests create one AT.
+func (s *AccessTokenManager) InsertThrottled(user int64, uses int64, path string, dexp, cooldown time.Duration, data types.JsonMap) (*AccessToken, error) {
+	n := AccessToken{
+		Record:    models.NewRecord(),
+		Creator:   user,
+		Uses:      uses,
+		Path:      path,
+		TokenData: data,
+	}
+
+	if n.Creator == 0 {
+		return nil, ErrUserInvalid
+	}
+
+	if err := validate(&n); err != nil {
+		return nil, err
+	}
+
+	n.Expires, _ = n.Created.Add(dexp)
+	since, err := n.Created.Add(-cooldown)
+	if err != nil {
+		return nil, err
+	}
+
+	tok, err := security.CreateRandomSHA256Token()
+	if err != nil {
+		return nil, err
+	}
+
+	n.Token = tok
+	n.Hash = security.HashToken(tok)
 
 	db := s.db.NonConcurrentDB()
-	err = db.Model(&n).Insert()
+	tn := db.QuoteTableName(s.table)
+
+	res, err := db.NewQuery(
+		"INSERT INTO " + tn + " (token, token_data, path, methods, created, modified, expires, uses, creator_id) " +
+			"SELECT {:token}, {:data}, {:path}, {:methods}, {:created}, {:modified}, {:expires}, {:uses}, {:user} " +
+			"WHERE NOT EXISTS (SELECT 1 FROM " + tn + " WHERE creator_id = {:user} AND path = {:path} " +
+			"AND created > {:since} AND uses > 0)").
+		Bind(dbx.Params{
+			"token":    n.Hash,
+			"data":     n.TokenData,
+			"path":     n.Path,
+			"methods":  n.Methods,
+			"created":  n.Created,
+			"modified": n.Modified,
+			"expires":  n.Expires,
+			"uses":     n.Uses,
+			"user":     n.Creator,
+			"since":    since,
+		}).
+		Execute()
 	if err != nil {
 		return nil, err
 	}
 
+	if c, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if c == 0 {
+		return nil, ErrAccessTokenThrottled
+	}
+
+	if n.ID, err = res.LastInsertId(); err != nil {
+		return nil, err
+	}
+
 	return &n, nil
 }
 
+// model returns the model query of the AT. ATs without creator keep a NULL
+// creator_id, which satisfies the foreign key.
+func (s *AccessTokenManager) model(at *AccessToken) *dbx.ModelQuery {
+	q := s.db.NonConcurrentDB().Model(at)
+	if at.Creator == 0 {
+		q = q.Exclude("Creator")
+	}
+	return q
+}
+
+// columns selects all columns of the table, with creator 0 for ATs without creator.
+func (s *AccessTokenManager) columns() string {
+	return s.idfield + ", token, token_data, path, methods, created, modified, expires, uses, " +
+		"IFNULL(creator_id, 0) AS creator_id"
+}
+
+// CountProbes sets whether presenting an AT for a method or path it is not valid
+// for uses it up by one use. Otherwise such probes leave the AT untouched.
+func (s *AccessTokenManager) CountProbes(count bool) {
+	s.count_probes.Store(count)
+}
+
+// validate checks the path pattern and normalizes the methods of the AT.
+func validate(at *AccessToken) error {
+	if _, err := pathmatch.Compile(at.Path); err != nil {
+		return PathInvalid
+	}
+
+	for i, m := range at.Methods {
+		m = strings.ToUpper(strings.TrimSpace(m))
+		switch m {
+		case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+			http.MethodPatch, http.MethodDelete, http.MethodOptions:
+			at.Methods[i] = m
+		default:
+			return MethodInvalid
+		}
+	}
+
+	return nil
+}
+
 func (s *AccessTokenManager) DeleteByAccessToken(token string) error {
+	return s.deleteByHash(security.HashToken(token))
+}
+
+func (s *AccessTokenManager) deleteByHash(hash string) error {
 	db := s.db.NonConcurrentDB()
 	tn := db.QuoteTableName(s.table)
 
 	q := db.NewQuery(
 		"DELETE FROM " + tn + " WHERE token = {:id}").
-		Bind(dbx.Params{"id": token})
+		Bind(dbx.Params{"id": hash})
 
 	_, err := q.Execute()
 	return err
 }
 
+// Restore gives one use back to the AT, eg. if the action it was redeemed for
+// failed, so it can be redeemed again. ATs that don't exist anymore fail with
+// ErrAccessTokenNotFound.
+func (s *AccessTokenManager) Restore(at *AccessToken) error {
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	now := types.NowDateTime()
+	res, err := db.NewQuery(
+		"UPDATE " + tn + " SET uses = uses + 1, modified = {:now} WHERE " + s.idfield + " = {:id}").
+		Bind(dbx.Params{"now": now, "id": at.ID}).
+		Execute()
+	if err != nil {
+		return err
+	}
+
+	// The AT was deleted in the meantime, eg. by DeleteExpired once it was used up
+	if c, err := res.RowsAffected(); err != nil {
+		return err
+	} else if c == 0 {
+		return ErrAccessTokenNotFound
+	}
+
+	at.Uses++
+	at.Modified = now
+	return nil
+}
+
+// DeleteExpired deletes all expired and used up ATs and returns how many were deleted.
+func (s *AccessTokenManager) DeleteExpired() (int64, error) {
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	res, err := db.NewQuery(
+		"DELETE FROM " + tn + " WHERE uses < 1 OR (expires != 0 AND expires <= {:now})").
+		Bind(dbx.Params{"now": types.NowDateTime()}).
+		Execute()
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
 // We do not allow selection by AT without
 //
-//   - checking the path
+//   - checking the method and path
 //   - checking the expiration
 //   - checking & decreasing use
-func (s *AccessTokenManager) SelectByAccessToken(token string, path string) (*AccessToken, error) {
+//
+// The checks of the expiration and the decrease are done in a single conditional
+// UPDATE, so a token with N uses can be redeemed exactly N times, even by concurrent
+// requests. A token presented for a method or path it is not valid for is kept,
+// see CountProbes.
+func (s *AccessTokenManager) SelectByAccessToken(token, method, path string) (*AccessToken, error) {
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	hash := security.HashToken(token)
+	se, err := s.selectByHash(hash)
+	if err != nil {
+		return nil, ErrAccessTokenNotFound
+	}
+
+	if !se.Allows(method, path) {
+		if !se.Expires.IsZero() && !se.Expires.Time().After(time.Now()) {
+			return nil, s.rejected(hash)
+		}
+
+		if s.count_probes.Load() {
+			if err := s.probe(hash); err != nil {
+				return nil, err
+			}
+		}
+
+		return nil, ErrAccessTokenInvalidPath
+	}
+
+	now := types.NowDateTime()
+	at := AccessToken{}
+
+	err = db.NewQuery(
+		"UPDATE " + tn + " SET uses = uses - 1, modified = {:now} " +
+			"WHERE token = {:id} AND uses > 0 AND (expires = 0 OR expires > {:now}) " +
+			"RETURNING " + s.columns()).
+		Bind(dbx.Params{"id": hash, "now": now}).
+		One(&at)
+
+	if err == nil {
+		at.Token = token
+		return &at, nil
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	return nil, s.rejected(hash)
+}
+
+func (s *AccessTokenManager) selectByHash(hash string) (*AccessToken, error) {
 	db := s.db.ConcurrentDB()
 	tn := db.QuoteTableName(s.table)
 
 	se := AccessToken{}
 
 	err := db.NewQuery(
-		"SELECT * FROM " + tn + " WHERE token = {:id} LIMIT 1").
-		Bind(dbx.Params{"id": token}).
+		"SELECT " + s.columns() + " FROM " + tn + " WHERE token = {:id} LIMIT 1").
+		Bind(dbx.Params{"id": hash}).
 		One(&se)
-
 	if err != nil {
-		return nil, ErrAccessTokenNotFound
+		return nil, err
 	}
 
-	if !se.Expires.IsZero() && se.Expires.Time().Before(time.Now()) {
-		s.DeleteByAccessToken(se.Token)
-		return nil, ErrAccessTokenExpired
+	return &se, nil
+}
+
+// probe uses up one use of the AT without redeeming it.
+func (s *AccessTokenManager) probe(hash string) error {
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	_, err := db.NewQuery(
+		"UPDATE " + tn + " SET uses = uses - 1, modified = {:now} WHERE token = {:id} AND uses > 0").
+		Bind(dbx.Params{"id": hash, "now": types.NowDateTime()}).
+		Execute()
+	return err
+}
+
+// rejected returns why a token could not be consumed. Tokens that expired or were
+// used up are deleted. Used up tokens are kept until then, so reuse is noticed,
+// or until DeleteExpired purges them.
+func (s *AccessTokenManager) rejected(hash string) error {
+	se, err := s.selectByHash(hash)
+	if err != nil {
+		return ErrAccessTokenNotFound
 	}
 
-	if se.Path != path {
-		s.DeleteByAccessToken(se.Token)
-		return nil, ErrAccessTokenInvalidPath
+	if err := s.deleteByHash(se.Hash); err != nil {
+		return err
 	}
 
-	// TODO: This means I get notified on token reuse, but we we still will have a lot of
-	// tokens in the database with Uses = 0. Maybe instead delete after decresing se.Uses?
-	if se.Uses < 1 {
-		s.DeleteByAccessToken(se.Token)
-		return nil, ErrAccessTokenReused
-	} else {
-		se.Uses = se.Uses - 1
-		s.Update(&se)
+	if !se.Expires.IsZero() && !se.Expires.Time().After(time.Now()) {
+		return ErrAccessTokenExpired
 	}
 
-	return &se, nil
+	return ErrAccessTokenReused
 }
 
 func (atm *AccessTokenManager) Update(at *AccessToken) error {
-	db := atm.db.NonConcurrentDB()
 	at.Modified = types.NowDateTime()
-	err := db.Model(at).Update()
+	err := atm.model(at).Update()
 	return err
 }
@@ -0,0 +1,64 @@
+package apitokens
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/Simon-Martens/caveman/tools/pathmatch"
+	"github.com/Simon-Martens/caveman/tools/types"
+)
+
+// APIToken is a named, long-lived token for scripts and other machine clients.
+// It acts on behalf of its user, restricted by its scope:
+//
+//   - Permissions are the permissions of the user the token may use, "*" means
+//     all of them. Without permissions the token can only access routes that
+//     require no permission.
+//   - Paths are path patterns, see pathmatch. No paths means any path.
+//   - Methods are HTTP methods. No methods means any method.
+//
+// Only the digest of the token is stored, so the token is only known after Insert.
+type APIToken struct {
+	models.Record
+	ID          int64                   `db:"pk,id" json:"id"`
+	Name        string                  `db:"name" json:"name"`
+	Token       string                  `db:"-" json:"-"`
+	Hash        string                  `db:"token" json:"-"`
+	User        int64                   `db:"user_id" json:"user_id"`
+	Permissions types.JsonArray[string] `db:"permissions" json:"permissions"`
+	Paths       types.JsonArray[string] `db:"paths" json:"paths"`
+	Methods     types.JsonArray[string] `db:"methods" json:"methods"`
+	Expires     types.DateTime          `db:"expires" json:"expires"`
+	LastUsed    types.DateTime          `db:"last_used" json:"last_used"`
+}
+
+func (a APIToken) TableName() string {
+	return models.DEFAULT_API_TOKENS_TABLE
+}
+
+// Allows reports whether the scope of the token covers the request.
+func (a APIToken) Allows(method, path string) bool {
+	if len(a.Methods) > 0 && !slices.ContainsFunc(a.Methods, func(m string) bool {
+		return strings.EqualFold(m, method)
+	}) {
+		return false
+	}
+
+	if len(a.Paths) == 0 {
+		return true
+	}
+
+	for _, p := range a.Paths {
+		if pathmatch.Match(p, path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HasPermission reports whether the token may use the permission, if its user has it.
+func (a APIToken) HasPermission(permission string) bool {
+	return slices.Contains(a.Permissions, models.API_TOKEN_ALL_PERMISSIONS) || slices.Contains(a.Permissions, permission)
+}
@@ -0,0 +1,320 @@
+package apitokens
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Simon-Martens/caveman/db"
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/Simon-Martens/caveman/tools/pathmatch"
+	"github.com/Simon-Martens/caveman/tools/security"
+	"github.com/Simon-Martens/caveman/tools/types"
+	"github.com/pocketbase/dbx"
+)
+
+var ErrAPITokenNotFound = errors.New("api token not found")
+var ErrAPITokenExpired = errors.New("api token expired")
+var ErrInvalidName = errors.New("api token name is empty")
+var ErrInvalidScope = errors.New("api token scope invalid")
+
+type APITokenManager struct {
+	db      *db.DB
+	table   string
+	idfield string
+}
+
+func New(db *db.DB, tablename, usertable, idfield string) (*APITokenManager, error) {
+	if db == nil {
+		return nil, errors.New("db is nil")
+	}
+
+	if tablename == "" {
+		return nil, errors.New("table name is empty")
+	}
+
+	if usertable == "" || idfield == "" {
+		return nil, errors.New("user table or user id column name is empty")
+	}
+
+	s := &APITokenManager{
+		db:      db,
+		table:   tablename,
+		idfield: idfield,
+	}
+
+	if err := s.createTable(usertable); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *APITokenManager) createTable(usertable string) error {
+	ncdb := s.db.NonConcurrentDB()
+
+	tn := ncdb.QuoteTableName(s.table)
+	utn := ncdb.QuoteTableName(usertable)
+
+	q := ncdb.NewQuery(
+		"CREATE TABLE IF NOT EXISTS " +
+			tn +
+			" (" + s.idfield + " INTEGER PRIMARY KEY NOT NULL, " +
+			"name TEXT NOT NULL, " +
+			"token TEXT NOT NULL COLLATE BINARY, " +
+			"permissions TEXT DEFAULT '[]', " +
+			"paths TEXT DEFAULT '[]', " +
+			"methods TEXT DEFAULT '[]', " +
+			"created INTEGER DEFAULT 0, " +
+			"modified INTEGER DEFAULT 0, " +
+			"expires INTEGER DEFAULT 0, " +
+			"last_used INTEGER DEFAULT 0, " +
+			"user_id INTEGER NOT NULL, " +
+			"FOREIGN KEY(user_id) REFERENCES " + utn + "(" + s.idfield + "));",
+	)
+
+	_, err := q.Execute()
+	if err != nil {
+		return err
+	}
+
+	err = s.db.CreateUniqueIndex(s.table, "token")
+	if err != nil {
+		return err
+	}
+
+	return s.db.CreateIndex(s.table, "user_id")
+}
+
+// Insert creates an API token for the user. The scope is taken from at, see
+// APIToken. A dexp of 0 creates a token that never expires.
+func (s *APITokenManager) Insert(user int64, at *APIToken, dexp time.Duration) (*APIToken, error) {
+	if at == nil {
+		return nil, errors.New("at is nil")
+	}
+
+	n := APIToken{
+		Record:      models.NewRecord(),
+		Name:        strings.TrimSpace(at.Name),
+		User:        user,
+		Permissions: at.Permissions,
+		Paths:       at.Paths,
+		Methods:     at.Methods,
+	}
+
+	if n.Name == "" {
+		return nil, ErrInvalidName
+	}
+
+	if err := n.validate(); err != nil {
+		return nil, err
+	}
+
+	if dexp > 0 {
+		n.Expires, _ = n.Created.Add(dexp)
+	}
+
+	tok, err := security.CreateRandomSHA256Token()
+	if err != nil {
+		return nil, err
+	}
+
+	n.Token = models.API_TOKEN_PREFIX + tok
+	n.Hash = security.HashToken(n.Token)
+
+	db := s.db.NonConcurrentDB()
+	err = db.Model(&n).Insert()
+	if err != nil {
+		return nil, err
+	}
+
+	return &n, nil
+}
+
+// validate checks the path patterns and normalizes the methods.
+func (a *APIToken) validate() error {
+	for _, p := range a.Paths {
+		if _, err := pathmatch.Compile(p); err != nil {
+			return errors.Join(ErrInvalidScope, err)
+		}
+	}
+
+	for i, m := range a.Methods {
+		m = strings.ToUpper(strings.TrimSpace(m))
+		switch m {
+		case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+			http.MethodPatch, http.MethodDelete, http.MethodOptions:
+			a.Methods[i] = m
+		default:
+			return errors.Join(ErrInvalidScope, errors.New("unknown method "+m))
+		}
+	}
+
+	return nil
+}
+
+// SelectByToken returns the API token. Expired tokens are deleted.
+func (s *APITokenManager) SelectByToken(token string) (*APIToken, error) {
+	db := s.db.ConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	at := APIToken{}
+
+	err := db.NewQuery(
+		"SELECT * FROM " + tn + " WHERE token = {:id} LIMIT 1").
+		Bind(dbx.Params{"id": security.HashToken(token)}).
+		One(&at)
+
+	if err != nil {
+		return nil, ErrAPITokenNotFound
+	}
+
+	if !at.Expires.IsZero() && at.Expires.Time().Before(time.Now()) {
+		_ = s.Delete(at.ID)
+		return nil, ErrAPITokenExpired
+	}
+
+	at.Token = token
+	return &at, nil
+}
+
+func (s *APITokenManager) Select(id int64) (*APIToken, error) {
+	db := s.db.ConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	at := APIToken{}
+
+	err := db.NewQuery(
+		"SELECT * FROM " + tn + " WHERE id = {:id} LIMIT 1").
+		Bind(dbx.Params{"id": id}).
+		One(&at)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrAPITokenNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &at, nil
+}
+
+// SelectByUser returns the API tokens of the user, newest first.
+func (s *APITokenManager) SelectByUser(user int64) ([]*APIToken, error) {
+	db := s.db.ConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	ats := []*APIToken{}
+	err := db.NewQuery(
+		"SELECT * FROM " + tn + " WHERE user_id = {:user} ORDER BY created DESC").
+		Bind(dbx.Params{"user": user}).
+		All(&ats)
+	if err != nil {
+		return nil, err
+	}
+
+	return ats, nil
+}
+
+// SelectAll returns all API tokens, newest first.
+func (s *APITokenManager) SelectAll() ([]*APIToken, error) {
+	db := s.db.ConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	ats := []*APIToken{}
+	err := db.NewQuery(
+		"SELECT * FROM " + tn + " ORDER BY created DESC").
+		All(&ats)
+	if err != nil {
+		return nil, err
+	}
+
+	return ats, nil
+}
+
+// UpdateLastUsed records the use of the token.
+func (s *APITokenManager) UpdateLastUsed(at *APIToken) error {
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	now := types.NowDateTime()
+	_, err := db.NewQuery(
+		"UPDATE " + tn + " SET last_used = {:now} WHERE id = {:id}").
+		Bind(dbx.Params{"now": now, "id": at.ID}).
+		Execute()
+	if err != nil {
+		return err
+	}
+
+	at.LastUsed = now
+	return nil
+}
+
+// Delete revokes the API token.
+func (s *APITokenManager) Delete(id int64) error {
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	res, err := db.NewQuery(
+		"DELETE FROM " + tn + " WHERE id = {:id}").
+		Bind(dbx.Params{"id": id}).
+		Execute()
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrAPITokenNotFound
+	}
+
+	return nil
+}
+
+// DeleteByID revokes the API token, if it belongs to the user.
+func (s *APITokenManager) DeleteByID(user int64, id int64) error {
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	res, err := db.NewQuery(
+		"DELETE FROM " + tn + " WHERE id = {:id} AND user_id = {:user}").
+		Bind(dbx.Params{"id": id, "user": user}).
+		Execute()
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrAPITokenNotFound
+	}
+
+	return nil
+}
+
+// DeleteByUser revokes all API tokens of the user.
+func (s *APITokenManager) DeleteByUser(user int64) error {
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	_, err := db.NewQuery(
+		"DELETE FROM " + tn + " WHERE user_id = {:user}").
+		Bind(dbx.Params{"user": user}).
+		Execute()
+	return err
+}
+
+// DeleteExpired deletes all expired API tokens and returns how many were deleted.
+func (s *APITokenManager) DeleteExpired() (int64, error) {
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	res, err := db.NewQuery(
+		"DELETE FROM " + tn + " WHERE expires != 0 AND expires <= {:now}").
+		Bind(dbx.Params{"now": types.NowDateTime()}).
+		Execute()
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
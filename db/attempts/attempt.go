@@ -0,0 +1,48 @@
+package attempts
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/Simon-Martens/caveman/tools/types"
+)
+
+// Attempt counts the failed attempts of a key, eg. of an IP or an email, see
+// IPKey and EmailKey.
+type Attempt struct {
+	models.Record
+	ID           int64          `db:"pk,id" json:"-"`
+	Key          string         `db:"key" json:"key"`
+	Failures     int64          `db:"failures" json:"failures"`
+	LastFailure  types.DateTime `db:"last_failure" json:"last_failure"`
+	BlockedUntil types.DateTime `db:"blocked_until" json:"blocked_until"`
+	Locked       bool           `db:"locked" json:"locked"`
+}
+
+func (a Attempt) TableName() string {
+	return models.DEFAULT_ATTEMPTS_TABLE
+}
+
+// IsBlocked reports whether further attempts are blocked.
+func (a Attempt) IsBlocked() bool {
+	return !a.BlockedUntil.IsZero() && a.BlockedUntil.Time().After(time.Now())
+}
+
+// IPKey returns the key of the attempts of an IP.
+func IPKey(ip string) string {
+	return "ip:" + ip
+}
+
+// EmailKey returns the key of the attempts for an email. Emails are compared
+// case-insensitively, so the case can't be used to get around the limits.
+func EmailKey(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+// ChallengeKey returns the key of the login challenges an IP began, eg. of
+// passkey logins. They are counted apart from the failures of the IP, so
+// finished logins can reset them.
+func ChallengeKey(ip string) string {
+	return "challenge:" + ip
+}
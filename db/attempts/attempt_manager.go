@@ -0,0 +1,295 @@
+package attempts
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/Simon-Martens/caveman/db"
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/Simon-Martens/caveman/tools/types"
+	"github.com/pocketbase/dbx"
+)
+
+var ErrRateLimited = errors.New("too many failed attempts")
+var ErrLockedOut = errors.New("locked after too many failed attempts")
+
+// BlockedError is returned for blocked keys. It is ErrRateLimited, and if the
+// key is locked out, ErrLockedOut as well.
+type BlockedError struct {
+	Until  time.Time
+	Locked bool
+}
+
+func (e *BlockedError) Error() string {
+	if e.Locked {
+		return fmt.Sprintf("%v until %v", ErrLockedOut, e.Until)
+	}
+	return fmt.Sprintf("%v, blocked until %v", ErrRateLimited, e.Until)
+}
+
+func (e *BlockedError) Is(target error) bool {
+	return target == ErrRateLimited || e.Locked && target == ErrLockedOut
+}
+
+// RetryAfter returns the time until the block ends.
+func (e *BlockedError) RetryAfter() time.Duration {
+	return time.Until(e.Until)
+}
+
+// AttemptManager persists failed attempts, eg. logins, and blocks keys with too
+// many failures, see models.RateLimitSettings.
+type AttemptManager struct {
+	db      *db.DB
+	table   string
+	idfield string
+
+	limits atomic.Pointer[models.RateLimitSettings]
+}
+
+func New(db *db.DB, tablename, idfield string) (*AttemptManager, error) {
+	if db == nil {
+		return nil, errors.New("db is nil")
+	}
+
+	if tablename == "" {
+		return nil, errors.New("table name is empty")
+	}
+
+	if idfield == "" {
+		return nil, errors.New("id field name is empty")
+	}
+
+	s := &AttemptManager{
+		db:      db,
+		table:   tablename,
+		idfield: idfield,
+	}
+	s.SetLimits(models.RateLimitSettings{})
+
+	if err := s.createTable(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *AttemptManager) createTable() error {
+	ncdb := s.db.NonConcurrentDB()
+
+	tn := ncdb.QuoteTableName(s.table)
+
+	q := ncdb.NewQuery(
+		"CREATE TABLE IF NOT EXISTS " +
+			tn +
+			" (" + s.idfield + " INTEGER PRIMARY KEY, " +
+			"key TEXT NOT NULL, " +
+			"failures INTEGER DEFAULT 0, " +
+			"last_failure INTEGER DEFAULT 0, " +
+			"blocked_until INTEGER DEFAULT 0, " +
+			"locked INTEGER DEFAULT 0, " +
+			"created INTEGER DEFAULT 0, " +
+			"modified INTEGER DEFAULT 0);")
+
+	_, err := q.Execute()
+	if err != nil {
+		return err
+	}
+
+	return s.db.CreateUniqueIndex(s.table, "key")
+}
+
+// SetLimits sets the limits, unset values are replaced with the defaults.
+func (s *AttemptManager) SetLimits(limits models.RateLimitSettings) {
+	limits = limits.WithDefaults()
+	s.limits.Store(&limits)
+}
+
+// Limits returns the current limits.
+func (s *AttemptManager) Limits() models.RateLimitSettings {
+	return *s.limits.Load()
+}
+
+// Enabled reports whether failures are counted and keys are blocked.
+func (s *AttemptManager) Enabled() bool {
+	return !s.limits.Load().Disabled
+}
+
+func (s *AttemptManager) Select(key string) (*Attempt, error) {
+	db := s.db.ConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	a := Attempt{}
+	err := db.NewQuery(
+		"SELECT * FROM " + tn + " WHERE key = {:key} LIMIT 1").
+		Bind(dbx.Params{"key": key}).
+		One(&a)
+	if err != nil {
+		return nil, err
+	}
+
+	return &a, nil
+}
+
+// Check returns a BlockedError if any of the keys is blocked, with the block
+// that ends last. It is nil if no key is blocked or limits are disabled.
+func (s *AttemptManager) Check(keys ...string) error {
+	if !s.Enabled() || len(keys) == 0 {
+		return nil
+	}
+
+	db := s.db.ConcurrentDB()
+
+	blocked := []Attempt{}
+	err := db.Select("*").
+		From(s.table).
+		Where(dbx.In("key", toAny(keys)...)).
+		AndWhere(dbx.NewExp("blocked_until > {:now}", dbx.Params{"now": types.NowDateTime()})).
+		All(&blocked)
+	if err != nil {
+		return err
+	}
+
+	var berr *BlockedError
+	for _, a := range blocked {
+		if berr == nil {
+			berr = &BlockedError{}
+		}
+		if until := *a.BlockedUntil.Time(); until.After(berr.Until) {
+			berr.Until = until
+		}
+		berr.Locked = berr.Locked || a.Locked
+	}
+
+	if berr == nil {
+		return nil
+	}
+	return berr
+}
+
+// Fail counts a failed attempt for the key and blocks it, if it exceeds the free
+// attempts. With lockout, the key is locked once it reaches the lockout attempts.
+// Failures older than the window are forgotten.
+func (s *AttemptManager) Fail(key string, lockout bool) (*Attempt, error) {
+	if !s.Enabled() {
+		return nil, nil
+	}
+
+	limits := s.Limits()
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	now := types.NowDateTime()
+	forget, _ := now.Add(-time.Duration(limits.Window) * time.Second)
+
+	a := Attempt{}
+	err := db.NewQuery(
+		"INSERT INTO " + tn + " (key, failures, last_failure, created, modified) VALUES ({:key}, 1, {:now}, {:now}, {:now}) " +
+			"ON CONFLICT(key) DO UPDATE SET " +
+			"failures = CASE WHEN last_failure < {:forget} THEN 1 ELSE failures + 1 END, " +
+			"locked = CASE WHEN last_failure < {:forget} THEN 0 ELSE locked END, " +
+			"last_failure = {:now}, modified = {:now} " +
+			"RETURNING *").
+		Bind(dbx.Params{"key": key, "now": now, "forget": forget}).
+		One(&a)
+	if err != nil {
+		return nil, err
+	}
+
+	block, locked := block(limits, a.Failures, lockout)
+	if block <= 0 {
+		return &a, nil
+	}
+
+	until, _ := now.Add(block)
+	err = db.NewQuery(
+		"UPDATE " + tn + " SET blocked_until = MAX(blocked_until, {:until}), locked = locked OR {:locked} " +
+			"WHERE key = {:key} RETURNING *").
+		Bind(dbx.Params{"key": key, "until": until, "locked": locked}).
+		One(&a)
+	if err != nil {
+		return nil, err
+	}
+
+	return &a, nil
+}
+
+// Reset forgets the failures of the key and lifts its block.
+func (s *AttemptManager) Reset(key string) error {
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	_, err := db.NewQuery(
+		"DELETE FROM " + tn + " WHERE key = {:key}").
+		Bind(dbx.Params{"key": key}).
+		Execute()
+	return err
+}
+
+// DeleteExpired deletes the failures that are forgotten and not blocked anymore
+// and returns how many were deleted.
+func (s *AttemptManager) DeleteExpired() (int64, error) {
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	now := types.NowDateTime()
+	forget, _ := now.Add(-time.Duration(s.Limits().Window) * time.Second)
+
+	res, err := db.NewQuery(
+		"DELETE FROM " + tn + " WHERE last_failure < {:forget} AND blocked_until <= {:now}").
+		Bind(dbx.Params{"forget": forget, "now": now}).
+		Execute()
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+func (s *AttemptManager) Count() (int, error) {
+	db := s.db.ConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	c := models.Count{}
+
+	err := db.NewQuery(
+		"SELECT COUNT(*) AS count FROM " + tn).One(&c)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	return c.Count, nil
+}
+
+// block returns for how long a key with the failures is blocked and whether it
+// is locked out.
+func block(limits models.RateLimitSettings, failures int64, lockout bool) (time.Duration, bool) {
+	if lockout && limits.LockoutAttempts > 0 && failures >= int64(limits.LockoutAttempts) {
+		return time.Duration(limits.LockoutDuration) * time.Second, true
+	}
+
+	over := failures - int64(max(limits.FreeAttempts, 0))
+	if over <= 0 {
+		return 0, false
+	}
+
+	d := time.Duration(limits.Backoff) * time.Second
+	limit := time.Duration(limits.MaxBackoff) * time.Second
+	for i := int64(1); i < over && d < limit; i++ {
+		d *= 2
+	}
+
+	return min(d, limit), false
+}
+
+func toAny(keys []string) []any {
+	r := make([]any, len(keys))
+	for i, k := range keys {
+		r[i] = k
+	}
+	return r
+}
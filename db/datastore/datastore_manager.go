@@ -215,6 +215,45 @@ func (s *DataStoreManager) DeleteAll(key string) error {
 	return err
 }
 
+// Take deletes the latest revision of the key and returns it, so a value, eg. a
+// challenge, can only be taken once.
+func (s *DataStoreManager) Take(key string) (*DataStore, error) {
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	ds := &DataStore{}
+	err := db.NewQuery(
+		"DELETE FROM " + tn + " WHERE " + s.idfield + " = (" +
+			"SELECT " + s.idfield + " FROM " + tn + " WHERE key = {:key} ORDER BY modified DESC LIMIT 1) " +
+			"RETURNING *").
+		Bind(dbx.Params{"key": key}).
+		One(ds)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return ds, nil
+}
+
+// DeletePrefixOlderThan deletes the revisions of all keys with the prefix that
+// were modified before t and returns how many were deleted.
+func (s *DataStoreManager) DeletePrefixOlderThan(prefix string, t types.DateTime) (int64, error) {
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	res, err := db.NewQuery(
+		"DELETE FROM " + tn + " WHERE substr(key, 1, {:len}) = {:prefix} AND modified < {:modified}").
+		Bind(dbx.Params{"len": len(prefix), "prefix": prefix, "modified": t}).
+		Execute()
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
 func (s *DataStoreManager) DeleteOlderThan(unixtime int, key string) error {
 	db := s.db.NonConcurrentDB()
 
@@ -227,6 +266,30 @@ func (s *DataStoreManager) DeleteOlderThan(unixtime int, key string) error {
 	return err
 }
 
+// Prune deletes all but the latest retention revisions of every key and returns
+// how many were deleted.
+func (s *DataStoreManager) Prune(retention int) (int64, error) {
+	if retention < 1 {
+		return 0, errors.New("retention must be at least 1")
+	}
+
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	res, err := db.NewQuery(
+		"DELETE FROM " + tn + " WHERE " + s.idfield + " IN (" +
+			"SELECT " + s.idfield + " FROM (" +
+			"SELECT " + s.idfield + ", ROW_NUMBER() OVER (PARTITION BY key ORDER BY modified DESC, " + s.idfield + " DESC) AS rev " +
+			"FROM " + tn + ") WHERE rev > {:retention})").
+		Bind(dbx.Params{"retention": retention}).
+		Execute()
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
 func (s *DataStoreManager) Count() (int, error) {
 	db := s.db.ConcurrentDB()
 	tn := db.QuoteTableName(s.table)
@@ -0,0 +1,23 @@
+package identities
+
+import (
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/Simon-Martens/caveman/tools/types"
+)
+
+// Identity links the account of a user at an external provider to the user, see
+// package oauth2. Subject identifies the account at the provider, Email is the
+// email the provider reported on the last login.
+type Identity struct {
+	models.Record
+	ID       int64          `db:"pk,id" json:"id"`
+	User     int64          `db:"user_id" json:"-"`
+	Provider string         `db:"provider" json:"provider"`
+	Subject  string         `db:"subject" json:"-"`
+	Email    string         `db:"email" json:"email"`
+	LastUsed types.DateTime `db:"last_used" json:"last_used"`
+}
+
+func (i Identity) TableName() string {
+	return models.DEFAULT_IDENTITIES_TABLE
+}
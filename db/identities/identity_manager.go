@@ -0,0 +1,233 @@
+package identities
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/Simon-Martens/caveman/db"
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/Simon-Martens/caveman/tools/types"
+	"github.com/pocketbase/dbx"
+)
+
+var ErrIdentityNotFound = errors.New("identity not found")
+var ErrIdentityExists = errors.New("identity already linked")
+var ErrProviderLinked = errors.New("user already linked to the provider")
+
+type IdentityManager struct {
+	db      *db.DB
+	table   string
+	idfield string
+}
+
+func New(db *db.DB, tablename, usertable, idfield string) (*IdentityManager, error) {
+	if db == nil {
+		return nil, errors.New("db is nil")
+	}
+
+	if tablename == "" {
+		return nil, errors.New("table name is empty")
+	}
+
+	if usertable == "" || idfield == "" {
+		return nil, errors.New("user table or user id column name is empty")
+	}
+
+	s := &IdentityManager{
+		db:      db,
+		table:   tablename,
+		idfield: idfield,
+	}
+
+	if err := s.createTable(usertable); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// createTable creates the table of identities. A subject of a provider can be
+// linked to one user, and a user can be linked to one subject of every provider.
+func (s *IdentityManager) createTable(usertable string) error {
+	ncdb := s.db.NonConcurrentDB()
+
+	tn := ncdb.QuoteTableName(s.table)
+	utn := ncdb.QuoteTableName(usertable)
+
+	q := ncdb.NewQuery(
+		"CREATE TABLE IF NOT EXISTS " +
+			tn +
+			" (" + s.idfield + " INTEGER PRIMARY KEY NOT NULL, " +
+			"provider TEXT NOT NULL, " +
+			"subject TEXT NOT NULL COLLATE BINARY, " +
+			"email TEXT DEFAULT '', " +
+			"created INTEGER DEFAULT 0, " +
+			"modified INTEGER DEFAULT 0, " +
+			"last_used INTEGER DEFAULT 0, " +
+			"user_id INTEGER NOT NULL, " +
+			"UNIQUE(provider, subject), " +
+			"UNIQUE(user_id, provider), " +
+			"FOREIGN KEY(user_id) REFERENCES " + utn + "(" + s.idfield + "));",
+	)
+
+	_, err := q.Execute()
+	if err != nil {
+		return err
+	}
+
+	return s.db.CreateIndex(s.table, "user_id")
+}
+
+// Insert links the subject of the provider to the user. It fails with
+// ErrIdentityExists if the subject is linked already, and with ErrProviderLinked
+// if the user is linked to another subject of the provider.
+func (s *IdentityManager) Insert(user int64, provider, subject, email string) (*Identity, error) {
+	if provider == "" || subject == "" {
+		return nil, errors.New("provider or subject is empty")
+	}
+
+	if _, err := s.SelectBySubject(provider, subject); err == nil {
+		return nil, ErrIdentityExists
+	} else if err != ErrIdentityNotFound {
+		return nil, err
+	}
+
+	if _, err := s.SelectByProvider(user, provider); err == nil {
+		return nil, ErrProviderLinked
+	} else if err != ErrIdentityNotFound {
+		return nil, err
+	}
+
+	n := Identity{
+		Record:   models.NewRecord(),
+		User:     user,
+		Provider: provider,
+		Subject:  subject,
+		Email:    email,
+	}
+
+	db := s.db.NonConcurrentDB()
+	if err := db.Model(&n).Insert(); err != nil {
+		return nil, err
+	}
+
+	return &n, nil
+}
+
+// SelectBySubject returns the identity of the subject of the provider.
+func (s *IdentityManager) SelectBySubject(provider, subject string) (*Identity, error) {
+	return s.selectOne(
+		"provider = {:provider} AND subject = {:subject}",
+		dbx.Params{"provider": provider, "subject": subject})
+}
+
+// SelectByProvider returns the identity of the user at the provider.
+func (s *IdentityManager) SelectByProvider(user int64, provider string) (*Identity, error) {
+	return s.selectOne(
+		"user_id = {:user} AND provider = {:provider}",
+		dbx.Params{"user": user, "provider": provider})
+}
+
+func (s *IdentityManager) selectOne(where string, params dbx.Params) (*Identity, error) {
+	db := s.db.ConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	i := Identity{}
+	err := db.NewQuery(
+		"SELECT * FROM " + tn + " WHERE " + where + " LIMIT 1").
+		Bind(params).
+		One(&i)
+	if err == sql.ErrNoRows {
+		return nil, ErrIdentityNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &i, nil
+}
+
+// SelectByUser returns the identities of the user, ordered by provider.
+func (s *IdentityManager) SelectByUser(user int64) ([]*Identity, error) {
+	db := s.db.ConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	ids := []*Identity{}
+	err := db.NewQuery(
+		"SELECT * FROM " + tn + " WHERE user_id = {:user} ORDER BY provider").
+		Bind(dbx.Params{"user": user}).
+		All(&ids)
+	if err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// Use records a login with the identity and the email the provider reported.
+func (s *IdentityManager) Use(i *Identity, email string) error {
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	now := types.NowDateTime()
+	_, err := db.NewQuery(
+		"UPDATE " + tn + " SET email = {:email}, last_used = {:now}, modified = {:now} WHERE id = {:id}").
+		Bind(dbx.Params{"email": email, "now": now, "id": i.ID}).
+		Execute()
+	if err != nil {
+		return err
+	}
+
+	i.Email = email
+	i.LastUsed = now
+	i.Modified = now
+	return nil
+}
+
+// DeleteByID unlinks the identity, if it belongs to the user.
+func (s *IdentityManager) DeleteByID(user int64, id int64) error {
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	res, err := db.NewQuery(
+		"DELETE FROM " + tn + " WHERE id = {:id} AND user_id = {:user}").
+		Bind(dbx.Params{"id": id, "user": user}).
+		Execute()
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrIdentityNotFound
+	}
+
+	return nil
+}
+
+// DeleteByUser unlinks all identities of the user.
+func (s *IdentityManager) DeleteByUser(user int64) error {
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	_, err := db.NewQuery(
+		"DELETE FROM " + tn + " WHERE user_id = {:user}").
+		Bind(dbx.Params{"user": user}).
+		Execute()
+	return err
+}
+
+// Count returns the number of identities of all users.
+func (s *IdentityManager) Count() (int, error) {
+	db := s.db.ConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	c := models.Count{}
+	err := db.NewQuery(
+		"SELECT COUNT(*) AS count FROM " + tn).One(&c)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	return c.Count, nil
+}
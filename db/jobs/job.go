@@ -0,0 +1,35 @@
+package jobs
+
+import (
+	"time"
+
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/Simon-Martens/caveman/tools/types"
+)
+
+// Job is the persisted state of a scheduled job. The jobs themselves are
+// registered in code, see scheduler.Scheduler.
+type Job struct {
+	ID           int64          `db:"pk,id" json:"-"`
+	Name         string         `db:"name" json:"name"`
+	Spec         string         `db:"spec" json:"spec"`
+	LastRun      types.DateTime `db:"last_run" json:"last_run"`
+	NextRun      types.DateTime `db:"next_run" json:"next_run"`
+	LastError    string         `db:"last_error" json:"last_error"`
+	LastDuration int64          `db:"last_duration" json:"last_duration"` // milliseconds
+	RunningSince types.DateTime `db:"running_since" json:"running_since"`
+}
+
+func (j Job) TableName() string {
+	return models.DEFAULT_JOBS_TABLE
+}
+
+// IsRunning reports whether a run of the job holds the lock.
+func (j Job) IsRunning() bool {
+	return !j.RunningSince.IsZero()
+}
+
+// Duration returns the duration of the last run.
+func (j Job) Duration() time.Duration {
+	return time.Duration(j.LastDuration) * time.Millisecond
+}
@@ -0,0 +1,195 @@
+package jobs
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/Simon-Martens/caveman/db"
+	"github.com/Simon-Martens/caveman/tools/types"
+	"github.com/pocketbase/dbx"
+)
+
+var ErrJobNotFound = errors.New("job not found")
+
+// JobManager persists the state of scheduled jobs, so schedules survive restarts
+// and a job does not run twice at the same time, even across processes.
+type JobManager struct {
+	db      *db.DB
+	table   string
+	idfield string
+}
+
+func New(db *db.DB, tablename, idfield string) (*JobManager, error) {
+	if db == nil {
+		return nil, errors.New("db is nil")
+	}
+
+	if tablename == "" {
+		return nil, errors.New("table name is empty")
+	}
+
+	if idfield == "" {
+		return nil, errors.New("id field name is empty")
+	}
+
+	s := &JobManager{
+		db:      db,
+		table:   tablename,
+		idfield: idfield,
+	}
+
+	if err := s.createTable(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *JobManager) createTable() error {
+	ncdb := s.db.NonConcurrentDB()
+
+	tn := ncdb.QuoteTableName(s.table)
+
+	q := ncdb.NewQuery(
+		"CREATE TABLE IF NOT EXISTS " +
+			tn +
+			" (" + s.idfield + " INTEGER PRIMARY KEY, " +
+			"name TEXT NOT NULL, " +
+			"spec TEXT NOT NULL DEFAULT '', " +
+			"last_run INTEGER DEFAULT 0, " +
+			"next_run INTEGER DEFAULT 0, " +
+			"last_error TEXT NOT NULL DEFAULT '', " +
+			"last_duration INTEGER DEFAULT 0, " +
+			"running_since INTEGER DEFAULT 0);")
+
+	_, err := q.Execute()
+	if err != nil {
+		return err
+	}
+
+	return s.db.CreateUniqueIndex(s.table, "name")
+}
+
+// Ensure creates the record of a job if it does not exist and returns it.
+// A changed spec is saved and resets the next run.
+func (s *JobManager) Ensure(name, spec string) (*Job, error) {
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	_, err := db.NewQuery(
+		"INSERT INTO " + tn + " (name, spec) VALUES ({:name}, {:spec}) ON CONFLICT(name) DO UPDATE SET " +
+			"spec = excluded.spec, next_run = CASE WHEN spec = excluded.spec THEN next_run ELSE 0 END").
+		Bind(dbx.Params{"name": name, "spec": spec}).
+		Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Select(name)
+}
+
+func (s *JobManager) Select(name string) (*Job, error) {
+	db := s.db.ConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	j := Job{}
+	err := db.NewQuery(
+		"SELECT * FROM " + tn + " WHERE name = {:name} LIMIT 1").
+		Bind(dbx.Params{"name": name}).
+		One(&j)
+	if err == sql.ErrNoRows {
+		return nil, ErrJobNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &j, nil
+}
+
+// SelectAll returns the records of all jobs, ordered by name. Records of jobs
+// that are not registered anymore are included.
+func (s *JobManager) SelectAll() ([]Job, error) {
+	db := s.db.ConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	jobs := []Job{}
+	err := db.NewQuery(
+		"SELECT * FROM " + tn + " ORDER BY name").
+		All(&jobs)
+	if err != nil {
+		return nil, err
+	}
+
+	return jobs, nil
+}
+
+// SetNextRun saves the time of the next scheduled run.
+func (s *JobManager) SetNextRun(name string, next time.Time) error {
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	_, err := db.NewQuery(
+		"UPDATE " + tn + " SET next_run = {:next} WHERE name = {:name}").
+		Bind(dbx.Params{"name": name, "next": micro(next)}).
+		Execute()
+	return err
+}
+
+// Lock marks the job as running. It returns false if a run started less than
+// stale ago holds the lock. Locks older than stale are taken over, they are left
+// behind by crashed processes.
+func (s *JobManager) Lock(name string, stale time.Duration) (bool, error) {
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	now := types.NowDateTime()
+	before, _ := now.Add(-stale)
+
+	res, err := db.NewQuery(
+		"UPDATE " + tn + " SET running_since = {:now} WHERE name = {:name} AND " +
+			"(running_since = 0 OR running_since < {:before})").
+		Bind(dbx.Params{"name": name, "now": now, "before": before}).
+		Execute()
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+// Unlock releases the lock of the job and records the result of the run.
+func (s *JobManager) Unlock(name string, started time.Time, duration time.Duration, runerr error) error {
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	msg := ""
+	if runerr != nil {
+		msg = runerr.Error()
+	}
+
+	_, err := db.NewQuery(
+		"UPDATE " + tn + " SET running_since = 0, last_run = {:started}, last_error = {:error}, " +
+			"last_duration = {:duration} WHERE name = {:name}").
+		Bind(dbx.Params{
+			"name":     name,
+			"started":  micro(started),
+			"error":    msg,
+			"duration": duration.Milliseconds(),
+		}).
+		Execute()
+	return err
+}
+
+// micro returns t as stored by types.DateTime, the zero time is stored as 0.
+func micro(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMicro()
+}
@@ -0,0 +1,29 @@
+package passkeys
+
+import (
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/Simon-Martens/caveman/tools/types"
+)
+
+// Passkey is a WebAuthn credential of a user, see package webauthn. The
+// CredentialID is base64url encoded, PublicKey is the COSE_Key of the credential.
+// SignCount is the last signature counter of the authenticator, so cloned
+// authenticators can be detected. BackupEligible credentials are synced, eg. by
+// a password manager.
+type Passkey struct {
+	models.Record
+	ID             int64                   `db:"pk,id" json:"id"`
+	User           int64                   `db:"user_id" json:"-"`
+	Name           string                  `db:"name" json:"name"`
+	CredentialID   string                  `db:"credential_id" json:"credential_id"`
+	PublicKey      []byte                  `db:"public_key" json:"-"`
+	SignCount      int64                   `db:"sign_count" json:"-"`
+	AAGUID         string                  `db:"aaguid" json:"aaguid"`
+	Transports     types.JsonArray[string] `db:"transports" json:"transports"`
+	BackupEligible bool                    `db:"backup_eligible" json:"backup_eligible"`
+	LastUsed       types.DateTime          `db:"last_used" json:"last_used"`
+}
+
+func (p Passkey) TableName() string {
+	return models.DEFAULT_PASSKEYS_TABLE
+}
@@ -0,0 +1,233 @@
+package passkeys
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/Simon-Martens/caveman/db"
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/Simon-Martens/caveman/tools/types"
+	"github.com/pocketbase/dbx"
+)
+
+var ErrPasskeyNotFound = errors.New("passkey not found")
+var ErrPasskeyExists = errors.New("passkey already registered")
+var ErrSignCount = errors.New("passkey signature counter changed")
+
+type PasskeyManager struct {
+	db      *db.DB
+	table   string
+	idfield string
+}
+
+func New(db *db.DB, tablename, usertable, idfield string) (*PasskeyManager, error) {
+	if db == nil {
+		return nil, errors.New("db is nil")
+	}
+
+	if tablename == "" {
+		return nil, errors.New("table name is empty")
+	}
+
+	if usertable == "" || idfield == "" {
+		return nil, errors.New("user table or user id column name is empty")
+	}
+
+	s := &PasskeyManager{
+		db:      db,
+		table:   tablename,
+		idfield: idfield,
+	}
+
+	if err := s.createTable(usertable); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *PasskeyManager) createTable(usertable string) error {
+	ncdb := s.db.NonConcurrentDB()
+
+	tn := ncdb.QuoteTableName(s.table)
+	utn := ncdb.QuoteTableName(usertable)
+
+	q := ncdb.NewQuery(
+		"CREATE TABLE IF NOT EXISTS " +
+			tn +
+			" (" + s.idfield + " INTEGER PRIMARY KEY NOT NULL, " +
+			"name TEXT NOT NULL, " +
+			"credential_id TEXT NOT NULL COLLATE BINARY, " +
+			"public_key BLOB NOT NULL, " +
+			"sign_count INTEGER DEFAULT 0, " +
+			"aaguid TEXT DEFAULT '', " +
+			"transports TEXT DEFAULT '[]', " +
+			"backup_eligible BOOLEAN DEFAULT FALSE, " +
+			"created INTEGER DEFAULT 0, " +
+			"modified INTEGER DEFAULT 0, " +
+			"last_used INTEGER DEFAULT 0, " +
+			"user_id INTEGER NOT NULL, " +
+			"FOREIGN KEY(user_id) REFERENCES " + utn + "(" + s.idfield + "));",
+	)
+
+	_, err := q.Execute()
+	if err != nil {
+		return err
+	}
+
+	err = s.db.CreateUniqueIndex(s.table, "credential_id")
+	if err != nil {
+		return err
+	}
+
+	return s.db.CreateIndex(s.table, "user_id")
+}
+
+// Insert stores a new passkey of the user. Credential ids are unique, a
+// registered credential fails with ErrPasskeyExists.
+func (s *PasskeyManager) Insert(user int64, pk *Passkey) (*Passkey, error) {
+	if pk == nil {
+		return nil, errors.New("pk is nil")
+	}
+
+	if pk.CredentialID == "" || len(pk.PublicKey) == 0 {
+		return nil, errors.New("credential is empty")
+	}
+
+	n := *pk
+	n.Record = models.NewRecord()
+	n.ID = 0
+	n.User = user
+	n.Name = strings.TrimSpace(n.Name)
+	n.LastUsed = types.DateTime{}
+	if n.Transports == nil {
+		n.Transports = types.JsonArray[string]{}
+	}
+
+	if _, err := s.SelectByCredentialID(n.CredentialID); err == nil {
+		return nil, ErrPasskeyExists
+	} else if err != ErrPasskeyNotFound {
+		return nil, err
+	}
+
+	db := s.db.NonConcurrentDB()
+	if err := db.Model(&n).Insert(); err != nil {
+		return nil, err
+	}
+
+	return &n, nil
+}
+
+// SelectByCredentialID returns the passkey of the base64url encoded credential id.
+func (s *PasskeyManager) SelectByCredentialID(id string) (*Passkey, error) {
+	db := s.db.ConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	pk := Passkey{}
+	err := db.NewQuery(
+		"SELECT * FROM " + tn + " WHERE credential_id = {:id} LIMIT 1").
+		Bind(dbx.Params{"id": id}).
+		One(&pk)
+	if err == sql.ErrNoRows {
+		return nil, ErrPasskeyNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &pk, nil
+}
+
+// SelectByUser returns the passkeys of the user, newest first.
+func (s *PasskeyManager) SelectByUser(user int64) ([]*Passkey, error) {
+	db := s.db.ConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	pks := []*Passkey{}
+	err := db.NewQuery(
+		"SELECT * FROM " + tn + " WHERE user_id = {:user} ORDER BY created DESC").
+		Bind(dbx.Params{"user": user}).
+		All(&pks)
+	if err != nil {
+		return nil, err
+	}
+
+	return pks, nil
+}
+
+// Use records a login with the passkey and its new signature counter. It fails
+// with ErrSignCount if the counter was changed meanwhile, so a signature can't
+// be used by two concurrent logins.
+func (s *PasskeyManager) Use(pk *Passkey, count int64) error {
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	now := types.NowDateTime()
+	res, err := db.NewQuery(
+		"UPDATE " + tn + " SET sign_count = {:count}, last_used = {:now} " +
+			"WHERE id = {:id} AND sign_count = {:old}").
+		Bind(dbx.Params{"count": count, "now": now, "id": pk.ID, "old": pk.SignCount}).
+		Execute()
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrSignCount
+	}
+
+	pk.SignCount = count
+	pk.LastUsed = now
+	return nil
+}
+
+// DeleteByID removes the passkey, if it belongs to the user.
+func (s *PasskeyManager) DeleteByID(user int64, id int64) error {
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	res, err := db.NewQuery(
+		"DELETE FROM " + tn + " WHERE id = {:id} AND user_id = {:user}").
+		Bind(dbx.Params{"id": id, "user": user}).
+		Execute()
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrPasskeyNotFound
+	}
+
+	return nil
+}
+
+// DeleteByUser removes all passkeys of the user.
+func (s *PasskeyManager) DeleteByUser(user int64) error {
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	_, err := db.NewQuery(
+		"DELETE FROM " + tn + " WHERE user_id = {:user}").
+		Bind(dbx.Params{"user": user}).
+		Execute()
+	return err
+}
+
+// Count returns the number of passkeys of all users.
+func (s *PasskeyManager) Count() (int, error) {
+	db := s.db.ConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	c := models.Count{}
+	err := db.NewQuery(
+		"SELECT COUNT(*) AS count FROM " + tn).One(&c)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	return c.Count, nil
+}
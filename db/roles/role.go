@@ -0,0 +1,21 @@
+package roles
+
+// Role is a named set of permissions. The permissions granted to a role are
+// stored in the database, the roles themselves are registered in code.
+type Role struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// Permission names an action, that can be granted to roles.
+type Permission struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// Grant is a permission granted to a role.
+type Grant struct {
+	ID         int64  `db:"pk,id" json:"-"`
+	Role       string `db:"role" json:"role"`
+	Permission string `db:"permission" json:"permission"`
+}
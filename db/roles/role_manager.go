@@ -0,0 +1,287 @@
+package roles
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/Simon-Martens/caveman/db"
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/pocketbase/dbx"
+)
+
+// INFO: the admin role has every registered permission, it can't be changed by
+// granting or revoking permissions.
+var ErrRoleNotFound = errors.New("role not found")
+var ErrPermissionNotFound = errors.New("permission not found")
+var ErrRoleExists = errors.New("role already registered")
+var ErrPermissionExists = errors.New("permission already registered")
+var ErrAdminRole = errors.New("permissions of the admin role can't be changed")
+
+type RoleManager struct {
+	db      *db.DB
+	table   string
+	idfield string
+
+	mu          sync.RWMutex
+	roles       map[string]Role
+	permissions map[string]Permission
+}
+
+func New(db *db.DB, tablename, idfield string) (*RoleManager, error) {
+	if db == nil {
+		return nil, errors.New("db is nil")
+	}
+
+	if tablename == "" {
+		return nil, errors.New("table name is empty")
+	}
+
+	if idfield == "" {
+		return nil, errors.New("id field name is empty")
+	}
+
+	s := &RoleManager{
+		db:          db,
+		table:       tablename,
+		idfield:     idfield,
+		roles:       map[string]Role{},
+		permissions: map[string]Permission{},
+	}
+
+	if err := s.createTable(); err != nil {
+		return nil, err
+	}
+
+	for _, r := range DefaultRoles() {
+		_ = s.RegisterRole(r)
+	}
+
+	for _, p := range DefaultPermissions() {
+		_ = s.RegisterPermission(p)
+	}
+
+	return s, nil
+}
+
+// DefaultRoles returns the built-in roles.
+func DefaultRoles() []Role {
+	return []Role{
+		{Name: models.ROLE_ADMIN, Description: "Has all permissions."},
+		{Name: models.ROLE_USER, Description: "Default role of new users."},
+	}
+}
+
+// DefaultPermissions returns the built-in permissions.
+func DefaultPermissions() []Permission {
+	return []Permission{
+		{Name: models.PERMISSION_MANAGE_USERS, Description: "Create, change and delete users."},
+		{Name: models.PERMISSION_MANAGE_SETTINGS, Description: "Change the application settings."},
+	}
+}
+
+func (s *RoleManager) createTable() error {
+	ncdb := s.db.NonConcurrentDB()
+
+	tn := ncdb.QuoteTableName(s.table)
+
+	q := ncdb.NewQuery(
+		"CREATE TABLE IF NOT EXISTS " +
+			tn +
+			" (" + s.idfield + " INTEGER PRIMARY KEY, " +
+			"role TEXT NOT NULL, " +
+			"permission TEXT NOT NULL);")
+
+	_, err := q.Execute()
+	if err != nil {
+		return err
+	}
+
+	q = ncdb.NewQuery("CREATE UNIQUE INDEX IF NOT EXISTS " +
+		s.table +
+		"_role_permission_idx ON " +
+		tn +
+		" (role, permission);")
+
+	_, err = q.Execute()
+	return err
+}
+
+// RegisterRole makes a role known, so it can be assigned to users and be granted permissions.
+func (s *RoleManager) RegisterRole(r Role) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.roles[r.Name]; ok {
+		return ErrRoleExists
+	}
+
+	s.roles[r.Name] = r
+	return nil
+}
+
+// RegisterPermission makes a permission known, so it can be granted to roles.
+func (s *RoleManager) RegisterPermission(p Permission) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.permissions[p.Name]; ok {
+		return ErrPermissionExists
+	}
+
+	s.permissions[p.Name] = p
+	return nil
+}
+
+// Roles returns all registered roles, sorted by name.
+func (s *RoleManager) Roles() []Role {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	r := make([]Role, 0, len(s.roles))
+	for _, v := range s.roles {
+		r = append(r, v)
+	}
+
+	sort.Slice(r, func(i, j int) bool { return r[i].Name < r[j].Name })
+	return r
+}
+
+// Permissions returns all registered permissions, sorted by name.
+func (s *RoleManager) Permissions() []Permission {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p := make([]Permission, 0, len(s.permissions))
+	for _, v := range s.permissions {
+		p = append(p, v)
+	}
+
+	sort.Slice(p, func(i, j int) bool { return p[i].Name < p[j].Name })
+	return p
+}
+
+func (s *RoleManager) IsRole(role string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.roles[role]
+	return ok
+}
+
+func (s *RoleManager) IsPermission(permission string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.permissions[permission]
+	return ok
+}
+
+func (s *RoleManager) check(role, permission string) error {
+	if !s.IsRole(role) {
+		return ErrRoleNotFound
+	}
+
+	if !s.IsPermission(permission) {
+		return ErrPermissionNotFound
+	}
+
+	if role == models.ROLE_ADMIN {
+		return ErrAdminRole
+	}
+
+	return nil
+}
+
+// Grant grants the permission to the role. Granting a permission twice is not an error.
+func (s *RoleManager) Grant(role, permission string) error {
+	if err := s.check(role, permission); err != nil {
+		return err
+	}
+
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	_, err := db.
+		NewQuery("INSERT OR IGNORE INTO " + tn + " (role, permission) VALUES ({:role}, {:perm})").
+		Bind(dbx.Params{"role": role, "perm": permission}).
+		Execute()
+	return err
+}
+
+// Revoke removes the permission from the role.
+func (s *RoleManager) Revoke(role, permission string) error {
+	if err := s.check(role, permission); err != nil {
+		return err
+	}
+
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	_, err := db.
+		NewQuery("DELETE FROM " + tn + " WHERE role = {:role} AND permission = {:perm}").
+		Bind(dbx.Params{"role": role, "perm": permission}).
+		Execute()
+	return err
+}
+
+// Granted returns the names of the permissions granted to the role. Grants of
+// permissions that are not registered (anymore) are left out.
+func (s *RoleManager) Granted(role string) ([]string, error) {
+	if role == models.ROLE_ADMIN {
+		p := []string{}
+		for _, v := range s.Permissions() {
+			p = append(p, v.Name)
+		}
+		return p, nil
+	}
+
+	db := s.db.ConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	grants := []Grant{}
+	err := db.
+		NewQuery("SELECT * FROM " + tn + " WHERE role = {:role} ORDER BY permission").
+		Bind(dbx.Params{"role": role}).
+		All(&grants)
+	if err != nil {
+		return nil, err
+	}
+
+	p := []string{}
+	for _, g := range grants {
+		if s.IsPermission(g.Permission) {
+			p = append(p, g.Permission)
+		}
+	}
+
+	return p, nil
+}
+
+// Has reports whether the role has the permission.
+func (s *RoleManager) Has(role, permission string) (bool, error) {
+	if !s.IsRole(role) || !s.IsPermission(permission) {
+		return false, nil
+	}
+
+	if role == models.ROLE_ADMIN {
+		return true, nil
+	}
+
+	db := s.db.ConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	g := Grant{}
+	err := db.
+		NewQuery("SELECT * FROM " + tn + " WHERE role = {:role} AND permission = {:perm} LIMIT 1").
+		Bind(dbx.Params{"role": role, "perm": permission}).
+		One(&g)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,176 @@
+package sessions
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/Simon-Martens/caveman/db/datastore"
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/Simon-Martens/caveman/tools/security"
+	"github.com/Simon-Martens/caveman/tools/types"
+)
+
+const HMAC_KEY_LENGTH uint = 1024
+
+// Min. time between two reloads of the keys caused by failed validations.
+const hmacReloadInterval = time.Second
+
+// HMACKeys holds the secrets used to sign CSRF tokens. After a rotation the previous
+// key is still accepted for validation for a grace period, so tokens issued before
+// the rotation stay valid until they expire.
+type HMACKeys struct {
+	Current  []byte         `json:"current"`
+	Previous []byte         `json:"previous,omitempty"`
+	Rotated  types.DateTime `json:"rotated"`
+}
+
+func (k *HMACKeys) Key() string {
+	return models.DATASTORE_HMAC_KEY
+}
+
+// AcceptsPrevious reports whether the previous key is still within its grace period.
+func (k *HMACKeys) AcceptsPrevious(grace time.Duration) bool {
+	if len(k.Previous) == 0 || k.Rotated.IsZero() {
+		return false
+	}
+	return time.Since(*k.Rotated.Time()) <= grace
+}
+
+// UseDataStore persists the HMAC keys in the datastore, so tokens survive restarts
+// and can be validated by every process sharing the database. If the datastore
+// already holds keys, they replace the random keys created by New.
+func (s *SessionManager) UseDataStore(ds *datastore.DataStoreManager) error {
+	if ds == nil {
+		return errors.New("datastore manager is nil")
+	}
+
+	s.kmu.Lock()
+	s.kstore = ds
+	s.kmu.Unlock()
+
+	keys, err := s.loadHMACKeys()
+	if err == datastore.ErrNotFound {
+		if _, err := ds.Insert(s.hmacKeys()); err != nil {
+			return err
+		}
+
+		// Another process might have stored its keys at the same time. Everybody
+		// uses the latest keys, so we read them back.
+		keys, err = s.loadHMACKeys()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	s.setHMACKeys(keys)
+	return nil
+}
+
+// RotateHMACKey replaces the current key by a new random key. The old key is kept
+// as previous key and accepted until the tokens signed with it expire. Persisted
+// keys are read first, so the key demoted is the stored one, even if another
+// process rotated it.
+func (s *SessionManager) RotateHMACKey() error {
+	secret, err := security.CreateSecretArray(HMAC_KEY_LENGTH, 10)
+	if err != nil {
+		return err
+	}
+
+	stored, err := s.loadHMACKeys()
+	if err != nil {
+		return err
+	}
+
+	s.kmu.Lock()
+	defer s.kmu.Unlock()
+
+	previous := s.keys.Current
+	if stored != nil {
+		previous = stored.Current
+	}
+
+	keys := &HMACKeys{
+		Current:  secret,
+		Previous: previous,
+		Rotated:  types.NowDateTime(),
+	}
+
+	if s.kstore != nil {
+		if _, err := s.kstore.Insert(keys); err != nil {
+			return err
+		}
+	}
+
+	s.keys = keys
+	return nil
+}
+
+// ReloadHMACKeys reads the latest keys from the datastore, eg. after another
+// process rotated them. Does nothing if the keys are not persisted.
+func (s *SessionManager) ReloadHMACKeys() error {
+	keys, err := s.loadHMACKeys()
+	if err != nil {
+		return err
+	}
+
+	if keys != nil {
+		s.setHMACKeys(keys)
+	}
+	return nil
+}
+
+func (s *SessionManager) loadHMACKeys() (*HMACKeys, error) {
+	s.kmu.RLock()
+	ds := s.kstore
+	s.kmu.RUnlock()
+
+	if ds == nil {
+		return nil, nil
+	}
+
+	rec, err := ds.SelectLatest(models.DATASTORE_HMAC_KEY)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := &HMACKeys{}
+	if err := json.Unmarshal(rec.Data, keys); err != nil {
+		return nil, err
+	}
+
+	if len(keys.Current) == 0 {
+		return nil, errors.New("stored HMAC key is empty")
+	}
+
+	return keys, nil
+}
+
+func (s *SessionManager) reloadHMACKeysThrottled() (*HMACKeys, bool) {
+	s.kmu.Lock()
+	if s.kstore == nil || time.Since(s.kreload) < hmacReloadInterval {
+		s.kmu.Unlock()
+		return nil, false
+	}
+	s.kreload = time.Now()
+	s.kmu.Unlock()
+
+	if err := s.ReloadHMACKeys(); err != nil {
+		return nil, false
+	}
+
+	return s.hmacKeys(), true
+}
+
+func (s *SessionManager) hmacKeys() *HMACKeys {
+	s.kmu.RLock()
+	defer s.kmu.RUnlock()
+	return s.keys
+}
+
+func (s *SessionManager) setHMACKeys(keys *HMACKeys) {
+	s.kmu.Lock()
+	defer s.kmu.Unlock()
+	s.keys = keys
+}
@@ -3,15 +3,21 @@ package sessions
 import (
 	"encoding/base64"
 	"encoding/binary"
+	"time"
 
 	"github.com/Simon-Martens/caveman/models"
 	"github.com/Simon-Martens/caveman/tools/types"
+	"github.com/Simon-Martens/caveman/tools/useragent"
 )
 
+// Session is a login of a user. Only the digest of the session token is stored,
+// so the token is only known after Insert and Rotate, or if the session was
+// selected by it.
 type Session struct {
 	models.Record
 	ID          int64          `db:"pk,id"`
-	Session     string         `db:"session"`
+	Session     string         `db:"-"`
+	Hash        string         `db:"session"`
 	SessionData types.JsonMap  `db:"session_data"`
 	Expires     types.DateTime `db:"expires"`
 	IP          string         `db:"ip"`
@@ -23,8 +29,51 @@ func (s Session) TableName() string {
 	return models.DEFAULT_SESSIONS_TABLE
 }
 
+// Pending returns what a pending session waits for, eg. the second factor of a
+// login, see SessionManager.InsertPending. It is empty for sessions that are not
+// pending.
+func (s Session) Pending() string {
+	p, _ := s.SessionData[sessionPendingKey].(string)
+	return p
+}
+
+// Lifetime returns the time from the last renewal (or creation) until the session
+// expires, see SessionManager.Touch.
+func (s Session) Lifetime() time.Duration {
+	if s.Expires.IsZero() || s.Modified.IsZero() {
+		return 0
+	}
+	return s.Expires.Time().Sub(*s.Modified.Time())
+}
+
 func (s Session) PrimaryKey() string {
 	b := make([]byte, binary.MaxVarintLen64)
 	_ = binary.PutVarint(b, s.ID)
 	return base64.URLEncoding.WithPadding(base64.NoPadding).EncodeToString(b)
 }
+
+// SessionView is a session for display, eg. in a list of the active devices of a
+// user. It does not contain the session token.
+type SessionView struct {
+	ID      int64          `json:"id,string"`
+	Created types.DateTime `json:"created"`
+	Expires types.DateTime `json:"expires"`
+	IP      string         `json:"ip"`
+	Agent   string         `json:"agent"`
+	Current bool           `json:"current"`
+
+	useragent.UserAgent
+}
+
+// View returns the session for display. Current marks the session of the request.
+func (s Session) View(current bool) SessionView {
+	return SessionView{
+		ID:        s.ID,
+		Created:   s.Created,
+		Expires:   s.Expires,
+		IP:        s.IP,
+		Agent:     s.Agent,
+		Current:   current,
+		UserAgent: useragent.Parse(s.Agent),
+	}
+}
@@ -5,19 +5,32 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Simon-Martens/caveman/db"
+	"github.com/Simon-Martens/caveman/db/datastore"
 	"github.com/Simon-Martens/caveman/models"
 	"github.com/Simon-Martens/caveman/tools/lcg"
 	"github.com/Simon-Martens/caveman/tools/security"
+	"github.com/Simon-Martens/caveman/tools/types"
 	"github.com/pocketbase/dbx"
 )
 
 var ErrSessionExpired = errors.New("session expired")
 var ErrSessionNotFound = errors.New("session not found")
+var ErrSessionPending = errors.New("session pending")
+
+// Keys of the session data of pending sessions
+const (
+	sessionPendingKey = "pending"
+	sessionShortKey   = "short"
+)
 
 type SessionManager struct {
 	db      *db.DB
@@ -26,13 +39,20 @@ type SessionManager struct {
 
 	long_exp  int
 	short_exp int
+	csrf_exp  int
+
+	// Sliding expiration, see Touch. 0 disables it.
+	renew_interval atomic.Int64
 
-	HMACKey []byte
+	keys    *HMACKeys
+	kmu     sync.RWMutex
+	kstore  *datastore.DataStoreManager
+	kreload time.Time
 	lcg     *lcg.LCG
 	seed    uint64
 }
 
-func New(db *db.DB, tablename, usertable, idfield string, l_exp, s_exp int, lcg_seed uint64) (*SessionManager, error) {
+func New(db *db.DB, tablename, usertable, idfield string, l_exp, s_exp, csrf_exp int, lcg_seed uint64) (*SessionManager, error) {
 	if db == nil {
 		return nil, errors.New("db is nil")
 	}
@@ -45,8 +65,9 @@ func New(db *db.DB, tablename, usertable, idfield string, l_exp, s_exp int, lcg_
 		return nil, errors.New("user table or user id column name is empty")
 	}
 
-	// HMAC secret for CSRF token get lost if server is restarted
-	hmacs, err := security.CreateSecretArray(1024, 10)
+	// HMAC secret for CSRF tokens. It gets lost if the server is restarted,
+	// unless it is persisted with UseDataStore.
+	hmacs, err := security.CreateSecretArray(HMAC_KEY_LENGTH, 10)
 	if err != nil {
 		return nil, err
 	}
@@ -62,7 +83,8 @@ func New(db *db.DB, tablename, usertable, idfield string, l_exp, s_exp int, lcg_
 		table:     tablename,
 		long_exp:  l_exp,
 		short_exp: s_exp,
-		HMACKey:   hmacs,
+		csrf_exp:  csrf_exp,
+		keys:      &HMACKeys{Current: hmacs},
 		lcg:       lcg,
 	}
 
@@ -133,6 +155,7 @@ func (s *SessionManager) InsertEternal(user int64, agent string, ip string) (*Se
 	}
 
 	n.Session = tok
+	n.Hash = security.HashToken(tok)
 
 	db := s.db.NonConcurrentDB()
 	err = db.Model(&n).Insert()
@@ -167,6 +190,47 @@ func (s *SessionManager) Insert(user int64, short bool, agent string, ip string)
 	}
 
 	n.Session = tok
+	n.Hash = security.HashToken(tok)
+
+	db := s.db.NonConcurrentDB()
+	err = db.Model(&n).Insert()
+	if err != nil {
+		return nil, err
+	}
+
+	return &n, nil
+}
+
+// InsertPending creates a short-lived session that does not authenticate its
+// user, eg. after the password of a login that requires a second factor. stage
+// tells what the session waits for, see Session.Pending. Once that is done,
+// Upgrade turns it into a session, short or not.
+func (s *SessionManager) InsertPending(user int64, stage string, short bool, agent string, ip string) (*Session, error) {
+	if stage == "" {
+		return nil, errors.New("stage is empty")
+	}
+
+	n := Session{
+		Record: models.NewRecord(),
+		User:   user,
+		Agent:  agent,
+		IP:     ip,
+		ID:     int64(s.lcg.Next()),
+		SessionData: types.JsonMap{
+			sessionPendingKey: stage,
+			sessionShortKey:   short,
+		},
+	}
+
+	n.Expires, _ = n.Created.Add(time.Duration(models.DEFAULT_PENDING_SESSION_EXPIRATION) * time.Second)
+
+	tok, err := security.CreateRandomSHA512Token()
+	if err != nil {
+		return nil, err
+	}
+
+	n.Session = tok
+	n.Hash = security.HashToken(tok)
 
 	db := s.db.NonConcurrentDB()
 	err = db.Model(&n).Insert()
@@ -177,18 +241,245 @@ func (s *SessionManager) Insert(user int64, short bool, agent string, ip string)
 	return &n, nil
 }
 
+// Upgrade turns a pending session into a session with a new token and the
+// expiration of a short or long session, as requested by InsertPending. A pending
+// session can only be upgraded once, the old token is invalid afterwards.
+func (s *SessionManager) Upgrade(session *Session) (*Session, error) {
+	if session.Pending() == "" {
+		return nil, ErrSessionNotFound
+	}
+
+	short, _ := session.SessionData[sessionShortKey].(bool)
+	dexp := time.Duration(s.long_exp) * time.Second
+	if short {
+		dexp = time.Duration(s.short_exp) * time.Second
+	}
+
+	now := types.NowDateTime()
+	exp, err := now.Add(dexp)
+	if err != nil {
+		return nil, err
+	}
+
+	tok, err := security.CreateRandomSHA512Token()
+	if err != nil {
+		return nil, err
+	}
+
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	hash := security.HashToken(tok)
+
+	res, err := db.NewQuery(
+		"UPDATE " + tn + " SET session = {:new}, expires = {:exp}, modified = {:now}, session_data = {:data} " +
+			"WHERE id = {:id} AND session = {:old}").
+		Bind(dbx.Params{
+			"new":  hash,
+			"exp":  exp,
+			"now":  now,
+			"data": types.JsonMap{},
+			"id":   session.ID,
+			"old":  session.Hash,
+		}).
+		Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrSessionNotFound
+	}
+
+	n := *session
+	n.Session = tok
+	n.Hash = hash
+	n.Expires = exp
+	n.Modified = now
+	n.SessionData = types.JsonMap{}
+	return &n, nil
+}
+
+// UseSlidingExpiration enables sliding expiration: sessions in use are renewed
+// by Touch, at most once every interval seconds. An interval of 0 disables it.
+func (s *SessionManager) UseSlidingExpiration(interval int) {
+	s.renew_interval.Store(int64(interval))
+}
+
+// IsShort reports whether the session was created as a short session.
+func (s *SessionManager) IsShort(session *Session) bool {
+	return !session.Expires.IsZero() && session.Lifetime() <= time.Duration(s.short_exp)*time.Second
+}
+
+// Touch renews the session if sliding expiration is enabled and the session was
+// not renewed during the last interval. The session keeps its lifetime, so it
+// expires after the same time of inactivity as when it was created. Eternal
+// sessions are never renewed. It reports whether the session was renewed.
+func (s *SessionManager) Touch(session *Session) (bool, error) {
+	interval := time.Duration(s.renew_interval.Load()) * time.Second
+	if interval <= 0 || session.Expires.IsZero() || time.Since(*session.Modified.Time()) < interval {
+		return false, nil
+	}
+
+	now := types.NowDateTime()
+	exp, err := now.Add(session.Lifetime())
+	if err != nil {
+		return false, err
+	}
+
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	// Concurrent requests of the same session must renew it only once
+	res, err := db.NewQuery(
+		"UPDATE " + tn + " SET expires = {:exp}, modified = {:now} WHERE id = {:id} AND modified = {:mod}").
+		Bind(dbx.Params{"exp": exp, "now": now, "id": session.ID, "mod": session.Modified}).
+		Execute()
+	if err != nil {
+		return false, err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+
+	session.Expires = exp
+	session.Modified = now
+	return true, nil
+}
+
+// Rotate replaces the token of the session, eg. after the privileges of the user
+// changed, so a token an attacker planted or learned before is worthless.
+// The old token is invalid afterwards.
+func (s *SessionManager) Rotate(session *Session) (*Session, error) {
+	tok, err := security.CreateRandomSHA512Token()
+	if err != nil {
+		return nil, err
+	}
+
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	hash := security.HashToken(tok)
+
+	res, err := db.NewQuery(
+		"UPDATE " + tn + " SET session = {:new} WHERE id = {:id} AND session = {:old}").
+		Bind(dbx.Params{"new": hash, "id": session.ID, "old": session.Hash}).
+		Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrSessionNotFound
+	}
+
+	n := *session
+	n.Session = tok
+	n.Hash = hash
+	return &n, nil
+}
+
 func (s *SessionManager) DeleteBySession(session string) error {
+	return s.deleteByHash(security.HashToken(session))
+}
+
+func (s *SessionManager) deleteByHash(hash string) error {
 	db := s.db.NonConcurrentDB()
 	tn := db.QuoteTableName(s.table)
 
 	q := db.NewQuery(
 		"DELETE FROM " + tn + " WHERE session = {:id}").
-		Bind(dbx.Params{"id": session})
+		Bind(dbx.Params{"id": hash})
+
+	_, err := q.Execute()
+	return err
+}
+
+// DeleteByUser deletes all sessions of the user.
+func (s *SessionManager) DeleteByUser(user int64) error {
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	q := db.NewQuery(
+		"DELETE FROM " + tn + " WHERE user_id = {:user}").
+		Bind(dbx.Params{"user": user})
+
+	_, err := q.Execute()
+	return err
+}
+
+// DeleteByUserExcept deletes all sessions of the user, except the given one.
+func (s *SessionManager) DeleteByUserExcept(user int64, session string) error {
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	q := db.NewQuery(
+		"DELETE FROM " + tn + " WHERE user_id = {:user} AND session != {:session}").
+		Bind(dbx.Params{"user": user, "session": security.HashToken(session)})
 
 	_, err := q.Execute()
 	return err
 }
 
+// DeleteByID deletes the session with the given ID, if it belongs to the user.
+// This is for revoking sessions by ID, so the session token is never exposed.
+func (s *SessionManager) DeleteByID(user int64, id int64) error {
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	res, err := db.NewQuery(
+		"DELETE FROM " + tn + " WHERE id = {:id} AND user_id = {:user}").
+		Bind(dbx.Params{"id": id, "user": user}).
+		Execute()
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrSessionNotFound
+	}
+
+	return nil
+}
+
+// SelectByUser returns the sessions of the user that are not expired, newest first.
+func (s *SessionManager) SelectByUser(user int64) ([]*Session, error) {
+	db := s.db.ConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	se := []*Session{}
+	err := db.NewQuery(
+		"SELECT * FROM " + tn + " WHERE user_id = {:user} AND (expires = 0 OR expires > {:now}) ORDER BY created DESC").
+		Bind(dbx.Params{"user": user, "now": types.NowDateTime()}).
+		All(&se)
+	if err != nil {
+		return nil, err
+	}
+
+	return se, nil
+}
+
+// DeleteExpired deletes all expired sessions and returns how many were deleted.
+func (s *SessionManager) DeleteExpired() (int64, error) {
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	res, err := db.NewQuery(
+		"DELETE FROM " + tn + " WHERE expires != 0 AND expires <= {:now}").
+		Bind(dbx.Params{"now": types.NowDateTime()}).
+		Execute()
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
 func (s *SessionManager) SelectBySession(session string) (*Session, error) {
 	db := s.db.ConcurrentDB()
 	tn := db.QuoteTableName(s.table)
@@ -197,7 +488,7 @@ func (s *SessionManager) SelectBySession(session string) (*Session, error) {
 
 	err := db.NewQuery(
 		"SELECT * FROM " + tn + " WHERE session = {:id} LIMIT 1").
-		Bind(dbx.Params{"id": session}).
+		Bind(dbx.Params{"id": security.HashToken(session)}).
 		One(&se)
 
 	if err != nil {
@@ -205,10 +496,11 @@ func (s *SessionManager) SelectBySession(session string) (*Session, error) {
 	}
 
 	if !se.Expires.IsZero() && se.Expires.Time().Before(time.Now()) {
-		s.DeleteBySession(se.Session)
+		s.deleteByHash(se.Hash)
 		return nil, ErrSessionExpired
 	}
 
+	se.Session = session
 	return &se, nil
 }
 
@@ -229,18 +521,104 @@ func (s *SessionManager) Count() (int, error) {
 	return c.Count, nil
 }
 
+// CSRF tokens have the form <timestamp>.<mac>, where the HMAC covers the subject
+// the token is issued for and the timestamp. Tokens older than csrf_exp seconds
+// are rejected.
+
+// CreateCSRFToken creates a CSRF token bound to the given session.
 func (s *SessionManager) CreateCSRFToken(session *Session) string {
-	t := session.Session + ":" + session.Created.String() + ":" + strconv.FormatInt(session.User, 10)
-	mac := hmac.New(sha256.New, s.HMACKey)
-	mac.Write([]byte(t))
-	return base64.URLEncoding.WithPadding(base64.NoPadding).EncodeToString(mac.Sum(nil))
+	return s.createCSRFToken(csrfSessionSubject(session), time.Now())
 }
 
+// ValidateCSRFToken checks if the token was issued for the given session and is not expired.
 func (s *SessionManager) ValidateCSRFToken(session *Session, token string) bool {
-	t := session.Session + ":" + session.Created.String() + ":" + strconv.FormatInt(session.User, 10)
-	mac := hmac.New(sha256.New, s.HMACKey)
-	mac.Write([]byte(t))
-	expected := mac.Sum(nil)
-	actual, _ := base64.URLEncoding.WithPadding(base64.NoPadding).DecodeString(token)
-	return hmac.Equal(expected, actual)
+	return s.validateCSRFToken(csrfSessionSubject(session), token)
+}
+
+// CreateAnonymousCSRFToken creates a CSRF token for a visitor without a session.
+// The id must be a random, secret value that identifies the visitor, eg. stored in a cookie.
+func (s *SessionManager) CreateAnonymousCSRFToken(id string) string {
+	return s.createCSRFToken(csrfAnonymousSubject(id), time.Now())
+}
+
+// ValidateAnonymousCSRFToken checks if the token was issued for the visitor id and is not expired.
+func (s *SessionManager) ValidateAnonymousCSRFToken(id string, token string) bool {
+	if id == "" {
+		return false
+	}
+	return s.validateCSRFToken(csrfAnonymousSubject(id), token)
+}
+
+func (s *SessionManager) createCSRFToken(subject string, t time.Time) string {
+	ts := make([]byte, 8)
+	binary.BigEndian.PutUint64(ts, uint64(t.Unix()))
+
+	keys := s.hmacKeys()
+
+	enc := base64.URLEncoding.WithPadding(base64.NoPadding)
+	return enc.EncodeToString(ts) + "." + enc.EncodeToString(csrfMAC(keys.Current, subject, ts))
+}
+
+func (s *SessionManager) validateCSRFToken(subject string, token string) bool {
+	enc := base64.URLEncoding.WithPadding(base64.NoPadding)
+
+	t, m, found := strings.Cut(token, ".")
+	if !found {
+		return false
+	}
+
+	ts, err := enc.DecodeString(t)
+	if err != nil || len(ts) != 8 {
+		return false
+	}
+
+	actual, err := enc.DecodeString(m)
+	if err != nil {
+		return false
+	}
+
+	created := time.Unix(int64(binary.BigEndian.Uint64(ts)), 0)
+	age := time.Since(created)
+	if age < -time.Minute || age > time.Duration(s.csrf_exp)*time.Second {
+		return false
+	}
+
+	if s.checkCSRFMAC(s.hmacKeys(), subject, ts, actual) {
+		return true
+	}
+
+	// The token might have been created by another process with a newer key
+	if keys, ok := s.reloadHMACKeysThrottled(); ok {
+		return s.checkCSRFMAC(keys, subject, ts, actual)
+	}
+
+	return false
+}
+
+func (s *SessionManager) checkCSRFMAC(keys *HMACKeys, subject string, ts, actual []byte) bool {
+	if hmac.Equal(csrfMAC(keys.Current, subject, ts), actual) {
+		return true
+	}
+
+	if keys.AcceptsPrevious(time.Duration(s.csrf_exp) * time.Second) {
+		return hmac.Equal(csrfMAC(keys.Previous, subject, ts), actual)
+	}
+
+	return false
+}
+
+func csrfMAC(key []byte, subject string, ts []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(subject))
+	mac.Write([]byte(":"))
+	mac.Write(ts)
+	return mac.Sum(nil)
+}
+
+func csrfSessionSubject(session *Session) string {
+	return "s:" + session.Hash + ":" + session.Created.String() + ":" + strconv.FormatInt(session.User, 10)
+}
+
+func csrfAnonymousSubject(id string) string {
+	return "a:" + id
 }
@@ -0,0 +1,34 @@
+package twofactor
+
+import (
+	"github.com/Simon-Martens/caveman/models"
+)
+
+// TOTP is the authenticator of a user, see package totp. It is only used for
+// logins once it was confirmed with a valid code. LastCounter is the time step
+// of the last accepted code, so codes can't be used twice.
+type TOTP struct {
+	models.Record
+	ID          int64  `db:"pk,id" json:"-"`
+	User        int64  `db:"user_id" json:"-"`
+	Secret      string `db:"secret" json:"-"`
+	Confirmed   bool   `db:"confirmed" json:"confirmed"`
+	LastCounter int64  `db:"last_counter" json:"-"`
+}
+
+func (t TOTP) TableName() string {
+	return models.DEFAULT_TOTP_TABLE
+}
+
+// RecoveryCode is a single use code that replaces a TOTP code, eg. if the
+// authenticator is lost. Only the digest of the code is stored.
+type RecoveryCode struct {
+	models.Record
+	ID   int64  `db:"pk,id" json:"-"`
+	User int64  `db:"user_id" json:"-"`
+	Hash string `db:"code" json:"-"`
+}
+
+func (r RecoveryCode) TableName() string {
+	return models.DEFAULT_RECOVERY_CODES_TABLE
+}
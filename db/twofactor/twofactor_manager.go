@@ -0,0 +1,343 @@
+package twofactor
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/Simon-Martens/caveman/db"
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/Simon-Martens/caveman/tools/security"
+	"github.com/Simon-Martens/caveman/tools/totp"
+	"github.com/Simon-Martens/caveman/tools/types"
+	"github.com/pocketbase/dbx"
+)
+
+var ErrTOTPNotFound = errors.New("totp not found")
+var ErrTOTPConfirmed = errors.New("totp already confirmed")
+var ErrInvalidCode = errors.New("invalid code")
+
+// TwoFactorManager stores the authenticators and recovery codes of users.
+type TwoFactorManager struct {
+	db      *db.DB
+	table   string
+	rctable string
+	idfield string
+}
+
+func New(db *db.DB, tablename, rctablename, usertable, idfield string) (*TwoFactorManager, error) {
+	if db == nil {
+		return nil, errors.New("db is nil")
+	}
+
+	if tablename == "" || rctablename == "" {
+		return nil, errors.New("table name is empty")
+	}
+
+	if usertable == "" || idfield == "" {
+		return nil, errors.New("user table or user id column name is empty")
+	}
+
+	s := &TwoFactorManager{
+		db:      db,
+		table:   tablename,
+		rctable: rctablename,
+		idfield: idfield,
+	}
+
+	if err := s.createTables(usertable); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *TwoFactorManager) createTables(usertable string) error {
+	ncdb := s.db.NonConcurrentDB()
+
+	tn := ncdb.QuoteTableName(s.table)
+	rtn := ncdb.QuoteTableName(s.rctable)
+	utn := ncdb.QuoteTableName(usertable)
+
+	_, err := ncdb.NewQuery(
+		"CREATE TABLE IF NOT EXISTS " +
+			tn +
+			" (" + s.idfield + " INTEGER PRIMARY KEY NOT NULL, " +
+			"secret TEXT NOT NULL, " +
+			"confirmed BOOLEAN DEFAULT FALSE, " +
+			"last_counter INTEGER DEFAULT 0, " +
+			"created INTEGER DEFAULT 0, " +
+			"modified INTEGER DEFAULT 0, " +
+			"user_id INTEGER NOT NULL, " +
+			"FOREIGN KEY(user_id) REFERENCES " + utn + "(" + s.idfield + "));",
+	).Execute()
+	if err != nil {
+		return err
+	}
+
+	if err := s.db.CreateUniqueIndex(s.table, "user_id"); err != nil {
+		return err
+	}
+
+	_, err = ncdb.NewQuery(
+		"CREATE TABLE IF NOT EXISTS " +
+			rtn +
+			" (" + s.idfield + " INTEGER PRIMARY KEY NOT NULL, " +
+			"code TEXT NOT NULL COLLATE BINARY, " +
+			"created INTEGER DEFAULT 0, " +
+			"modified INTEGER DEFAULT 0, " +
+			"user_id INTEGER NOT NULL, " +
+			"FOREIGN KEY(user_id) REFERENCES " + utn + "(" + s.idfield + "));",
+	).Execute()
+	if err != nil {
+		return err
+	}
+
+	if err := s.db.CreateUniqueIndex(s.rctable, "code"); err != nil {
+		return err
+	}
+
+	return s.db.CreateIndex(s.rctable, "user_id")
+}
+
+// Select returns the authenticator of the user, confirmed or not.
+func (s *TwoFactorManager) Select(user int64) (*TOTP, error) {
+	db := s.db.ConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	t := TOTP{}
+	err := db.NewQuery(
+		"SELECT * FROM " + tn + " WHERE user_id = {:user} LIMIT 1").
+		Bind(dbx.Params{"user": user}).
+		One(&t)
+	if err == sql.ErrNoRows {
+		return nil, ErrTOTPNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// Setup creates a new, unconfirmed authenticator for the user. An unconfirmed
+// authenticator is replaced, a confirmed one must be deleted first.
+func (s *TwoFactorManager) Setup(user int64) (*TOTP, error) {
+	secret, err := totp.NewSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	n := TOTP{
+		Record: models.NewRecord(),
+		User:   user,
+		Secret: secret,
+	}
+
+	err = db.NewQuery(
+		"INSERT INTO " + tn + " (user_id, secret, confirmed, last_counter, created, modified) " +
+			"VALUES ({:user}, {:secret}, FALSE, 0, {:now}, {:now}) " +
+			"ON CONFLICT(user_id) DO UPDATE SET secret = excluded.secret, last_counter = 0, " +
+			"created = excluded.created, modified = excluded.modified WHERE confirmed = FALSE " +
+			"RETURNING *").
+		Bind(dbx.Params{"user": user, "secret": secret, "now": n.Created}).
+		One(&n)
+	if err == sql.ErrNoRows {
+		return nil, ErrTOTPConfirmed
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &n, nil
+}
+
+// Confirm confirms the unconfirmed authenticator of the user with a valid code.
+func (s *TwoFactorManager) Confirm(user int64, code string) error {
+	t, err := s.Select(user)
+	if err != nil {
+		return err
+	}
+
+	if t.Confirmed {
+		return ErrTOTPConfirmed
+	}
+
+	return s.accept(t, code, true)
+}
+
+// Verify checks the code against the confirmed authenticator of the user. Every
+// code is only accepted once.
+func (s *TwoFactorManager) Verify(user int64, code string) error {
+	t, err := s.Select(user)
+	if err != nil {
+		return err
+	}
+
+	if !t.Confirmed {
+		return ErrTOTPNotFound
+	}
+
+	return s.accept(t, code, false)
+}
+
+// accept validates the code and records its time step. The conditional UPDATE
+// makes sure concurrent requests can't use the same code twice.
+func (s *TwoFactorManager) accept(t *TOTP, code string, confirm bool) error {
+	counter, ok := totp.Validate(t.Secret, strings.TrimSpace(code), time.Now(), 1)
+	if !ok || counter <= t.LastCounter {
+		return ErrInvalidCode
+	}
+
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	res, err := db.NewQuery(
+		"UPDATE " + tn + " SET last_counter = {:counter}, confirmed = confirmed OR {:confirm}, modified = {:now} " +
+			"WHERE id = {:id} AND secret = {:secret} AND last_counter < {:counter}").
+		Bind(dbx.Params{
+			"counter": counter,
+			"confirm": confirm,
+			"now":     types.NowDateTime(),
+			"id":      t.ID,
+			"secret":  t.Secret,
+		}).
+		Execute()
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrInvalidCode
+	}
+
+	return nil
+}
+
+// GenerateRecoveryCodes replaces the recovery codes of the user with n new ones.
+// The codes are only known now, only their digests are stored.
+func (s *TwoFactorManager) GenerateRecoveryCodes(user int64, n int) ([]string, error) {
+	codes := make([]string, n)
+	for i := range codes {
+		c, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = c
+	}
+
+	err := s.db.NonConcurrentDB().Transactional(func(tx *dbx.Tx) error {
+		rtn := tx.QuoteSimpleTableName(s.rctable)
+
+		_, err := tx.NewQuery(
+			"DELETE FROM " + rtn + " WHERE user_id = {:user}").
+			Bind(dbx.Params{"user": user}).
+			Execute()
+		if err != nil {
+			return err
+		}
+
+		for _, c := range codes {
+			rc := RecoveryCode{
+				Record: models.NewRecord(),
+				User:   user,
+				Hash:   security.HashToken(normalizeRecoveryCode(c)),
+			}
+			if err := tx.Model(&rc).Insert(); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// UseRecoveryCode redeems a recovery code of the user. Every code works once.
+func (s *TwoFactorManager) UseRecoveryCode(user int64, code string) error {
+	db := s.db.NonConcurrentDB()
+	rtn := db.QuoteTableName(s.rctable)
+
+	res, err := db.NewQuery(
+		"DELETE FROM " + rtn + " WHERE user_id = {:user} AND code = {:code}").
+		Bind(dbx.Params{"user": user, "code": security.HashToken(normalizeRecoveryCode(code))}).
+		Execute()
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrInvalidCode
+	}
+
+	return nil
+}
+
+// CountRecoveryCodes returns how many recovery codes the user has left.
+func (s *TwoFactorManager) CountRecoveryCodes(user int64) (int, error) {
+	db := s.db.ConcurrentDB()
+	rtn := db.QuoteTableName(s.rctable)
+
+	c := models.Count{}
+	err := db.NewQuery(
+		"SELECT COUNT(*) AS count FROM " + rtn + " WHERE user_id = {:user}").
+		Bind(dbx.Params{"user": user}).
+		One(&c)
+	if err != nil {
+		return 0, err
+	}
+
+	return c.Count, nil
+}
+
+// Delete removes the authenticator and the recovery codes of the user.
+func (s *TwoFactorManager) Delete(user int64) error {
+	return s.db.NonConcurrentDB().Transactional(func(tx *dbx.Tx) error {
+		for _, table := range []string{s.table, s.rctable} {
+			_, err := tx.NewQuery(
+				"DELETE FROM " + tx.QuoteSimpleTableName(table) + " WHERE user_id = {:user}").
+				Bind(dbx.Params{"user": user}).
+				Execute()
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// newRecoveryCode returns a code like 4kq7m-x2p9d, easy to write down and type.
+// The alphabet is Crockford's base32, without letters that look like digits.
+func newRecoveryCode() (string, error) {
+	const alphabet = "0123456789abcdefghjkmnpqrstvwxyz"
+
+	b, err := security.CreateSecretArray(10, 3)
+	if err != nil {
+		return "", err
+	}
+
+	code := make([]byte, 0, 11)
+	for i, c := range b {
+		if i == 5 {
+			code = append(code, '-')
+		}
+		code = append(code, alphabet[c&31])
+	}
+
+	return string(code), nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
@@ -3,6 +3,7 @@ package users
 import (
 	"encoding/base64"
 	"encoding/binary"
+	"time"
 
 	"github.com/Simon-Martens/caveman/models"
 	"github.com/Simon-Martens/caveman/tools/types"
@@ -10,23 +11,31 @@ import (
 
 type User struct {
 	models.Record
-	ID       int64          `db:"pk,id"`
-	Name     string         `db:"name"`
-	Email    string         `db:"email"`
-	Password string         `db:"password"`
-	UserData types.JsonMap  `db:"user_data"`
-	Avatar   string         `db:"avatar"`
-	Expires  types.DateTime `db:"expires"`
-	LastSeen types.DateTime `db:"last_seen"`
-	Role     int            `db:"role"`
-	Active   bool           `db:"active"`
-	Verified bool           `db:"verified"`
+	ID       int64          `db:"pk,id" json:"id"`
+	Name     string         `db:"name" json:"name"`
+	Email    string         `db:"email" json:"email"`
+	Password string         `db:"password" json:"-"`
+	UserData types.JsonMap  `db:"user_data" json:"user_data"`
+	Avatar   string         `db:"avatar" json:"avatar"`
+	Expires  types.DateTime `db:"expires" json:"expires"`
+	LastSeen types.DateTime `db:"last_seen" json:"last_seen"`
+	Role     string         `db:"role" json:"role"`
+	Active   bool           `db:"active" json:"active"`
+	Verified bool           `db:"verified" json:"verified"`
+
+	// TwoFactor is set if the user has a confirmed authenticator, see twofactor.
+	TwoFactor bool `db:"two_factor" json:"two_factor"`
 }
 
 func (u User) TableName() string {
 	return models.DEFAULT_USERS_TABLE
 }
 
+// IsExpired reports whether the user has an expiration in the past.
+func (u User) IsExpired() bool {
+	return !u.Expires.IsZero() && u.Expires.Time().Before(time.Now())
+}
+
 func (s User) PrimaryKey() string {
 	b := make([]byte, binary.MaxVarintLen64)
 	_ = binary.PutVarint(b, s.ID)
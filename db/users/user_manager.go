@@ -3,23 +3,30 @@ package users
 import (
 	"database/sql"
 	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Simon-Martens/caveman/db"
+	"github.com/Simon-Martens/caveman/db/attempts"
 	"github.com/Simon-Martens/caveman/models"
 	"github.com/Simon-Martens/caveman/tools/lcg"
 	"github.com/Simon-Martens/caveman/tools/security"
 	"github.com/Simon-Martens/caveman/tools/types"
 	"github.com/pocketbase/dbx"
-	"golang.org/x/crypto/bcrypt"
 )
 
-// INFO: bcrypt has a size limit of 72 bytes for the password. This should be checked and handled.
-// Apple strong passwords contain 71 bits of entropy, we should be fine with this approach.
-// ALT: switch to argon2id, and save the salt along with the hash in the table.
+// INFO: passwords are hashed with argon2id and stored in the PHC string format.
+// Legacy bcrypt hashes are still accepted and upgraded on the next login.
 var ErrUserNotFound = errors.New("user not found")
 var ErrWrongPassword = errors.New("wrong password")
 var ErrHIDChanged = errors.New("HID is not allowed to be changed")
+var ErrUserNotVerified = errors.New("user not verified")
+var ErrUserInactive = errors.New("user deactivated")
+var ErrUserExpired = errors.New("user expired")
+var ErrSecondFactorRequired = errors.New("second factor required")
+var ErrSecondFactorSetupRequired = errors.New("second factor setup required")
 
 type UserManager struct {
 	db      *db.DB
@@ -28,6 +35,13 @@ type UserManager struct {
 
 	user_exp int
 	lcg      *lcg.LCG
+
+	hasher    security.PasswordHasher
+	dummyHash func() string
+
+	require_verified atomic.Bool
+	two_factor_roles atomic.Pointer[[]string]
+	attempts         atomic.Pointer[attempts.AttemptManager]
 }
 
 func New(db *db.DB, tablename, idfield string, user_exp int, lcg_seed uint64) (*UserManager, error) {
@@ -50,10 +64,13 @@ func New(db *db.DB, tablename, idfield string, user_exp int, lcg_seed uint64) (*
 	lcg := lcg.New(lcg_seed)
 
 	s := &UserManager{
-		db:    db,
-		table: tablename,
-		lcg:   lcg,
+		db:       db,
+		table:    tablename,
+		idfield:  idfield,
+		user_exp: user_exp,
+		lcg:      lcg,
 	}
+	s.SetPasswordHasher(security.DefaultPasswordHasher())
 
 	err := s.createTable(idfield)
 
@@ -83,13 +100,14 @@ func (s *UserManager) createTable(idfield string) error {
 			"user_data BLOB, " +
 			"avatar TEXT, " +
 			"password BLOB, " +
-			"role INTEGER DEFAULT 0, " +
+			"role TEXT DEFAULT '" + models.DEFAULT_ROLE + "', " +
 			"created INTEGER DEFAULT 0, " +
 			"modified INTEGER DEFAULT 0, " +
 			"expires INTEGER DEFAULT 0, " +
 			"last_seen INTEGER DEFAULT 0, " +
 			"active BOOLEAN DEFAULT TRUE, " +
-			"verified BOOLEAN DEFAULT FALSE);",
+			"verified BOOLEAN DEFAULT FALSE, " +
+			"two_factor BOOLEAN DEFAULT FALSE);",
 	)
 
 	_, err := q.Execute()
@@ -144,15 +162,161 @@ func (s *UserManager) SelectByEmail(email string) (*User, error) {
 	return &user, nil
 }
 
+// SetPasswordHasher replaces the hasher used for new passwords. Existing hashes
+// the hasher does not support can't be verified anymore.
+func (s *UserManager) SetPasswordHasher(hasher security.PasswordHasher) {
+	s.hasher = hasher
+	s.dummyHash = sync.OnceValue(func() string {
+		h, _ := hasher.Hash("dummy password")
+		return h
+	})
+}
+
+// RequireVerified makes CheckGetUser fail with ErrUserNotVerified for users that
+// did not verify their email.
+func (s *UserManager) RequireVerified(require bool) {
+	s.require_verified.Store(require)
+}
+
+// RequireTwoFactor makes a second factor mandatory for users with one of the
+// roles, see CheckGetUser.
+func (s *UserManager) RequireTwoFactor(roles []string) {
+	roles = slices.Clone(roles)
+	s.two_factor_roles.Store(&roles)
+}
+
+// IsTwoFactorRequired reports whether the role of the user requires a second factor.
+func (s *UserManager) IsTwoFactorRequired(user *User) bool {
+	roles := s.two_factor_roles.Load()
+	return roles != nil && slices.Contains(*roles, user.Role)
+}
+
+// UseAttempts limits failed logins with the attempt manager: CheckGetUser and
+// CheckGetUserFrom count wrong passwords and unknown emails, and fail with an
+// attempts.BlockedError for blocked emails and IPs. nil removes the limits.
+func (s *UserManager) UseAttempts(am *attempts.AttemptManager) {
+	s.attempts.Store(am)
+}
+
+// Unlock forgets the failed logins for the email and lifts its block or lockout.
+func (s *UserManager) Unlock(email string) error {
+	am := s.attempts.Load()
+	if am == nil {
+		return nil
+	}
+
+	return am.Reset(attempts.EmailKey(email))
+}
+
 func (s *UserManager) CheckPassword(user *User, pw string) error {
-	err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(pw))
-	return err
+	ok, err := s.hasher.Verify(user.Password, pw)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return ErrWrongPassword
+	}
+
+	return nil
+}
+
+// CheckAccount returns ErrUserInactive or ErrUserExpired if the user may not
+// authenticate, see [CheckGetUser].
+func (s *UserManager) CheckAccount(user *User) error {
+	if !user.Active {
+		return ErrUserInactive
+	}
+
+	if user.IsExpired() {
+		return ErrUserExpired
+	}
+
+	return nil
+}
+
+// CheckLogin is CheckAccount for logins: if verification is required, unverified
+// users fail with ErrUserNotVerified as well. Use it for logins without password,
+// see [CheckGetUser].
+func (s *UserManager) CheckLogin(user *User) error {
+	if err := s.CheckAccount(user); err != nil {
+		return err
+	}
+
+	if s.require_verified.Load() && !user.Verified {
+		return ErrUserNotVerified
+	}
+
+	return nil
 }
 
+// CheckGetUser returns the user with the given email, if the password matches.
+// Hashes created with an outdated algorithm or outdated parameters are replaced.
+// Deactivated and expired users fail with ErrUserInactive and ErrUserExpired. If
+// verification is required, unverified users fail with ErrUserNotVerified. These
+// are only checked after the password, so they do not leak which emails exist.
+// Failed logins are limited per email, see UseAttempts.
+//
+// Users with a second factor fail with ErrSecondFactorRequired, users without
+// one whose role requires it, with ErrSecondFactorSetupRequired. The login is
+// incomplete, but the password was right: the user is returned with these errors.
 func (s *UserManager) CheckGetUser(email string, pw string) (*User, error) {
+	return s.CheckGetUserFrom(email, pw, "")
+}
+
+// CheckGetUserFrom is CheckGetUser for a login from the IP, failed logins are
+// limited per email and per IP. Blocked logins fail before the password is hashed,
+// so they are cheap. A successful login resets the failures of the email, but
+// not those of the IP, so an attacker can't reset them with an account of their own.
+func (s *UserManager) CheckGetUserFrom(email string, pw string, ip string) (*User, error) {
+	am := s.attempts.Load()
+	if am == nil {
+		return s.checkGetUser(email, pw)
+	}
+
+	keys := []string{attempts.EmailKey(email)}
+	if ip != "" {
+		keys = append(keys, attempts.IPKey(ip))
+	}
+
+	if err := am.Check(keys...); err != nil {
+		return nil, err
+	}
+
+	// The failures of the email are only reset once the login is complete, or the
+	// password could be used to reset them between guesses of the second factor
+	user, err := s.checkGetUser(email, pw)
+	if err == ErrUserNotFound || err == ErrWrongPassword {
+		// Unknown emails are counted as well, so lockouts don't tell which exist
+		if _, ferr := am.Fail(keys[0], true); ferr != nil {
+			return nil, ferr
+		}
+		if ip != "" {
+			if _, ferr := am.Fail(keys[1], false); ferr != nil {
+				return nil, ferr
+			}
+		}
+		return nil, err
+	} else if err == ErrSecondFactorRequired || err == ErrSecondFactorSetupRequired {
+		return user, err
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := am.Reset(keys[0]); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (s *UserManager) checkGetUser(email string, pw string) (*User, error) {
 	user, err := s.SelectByEmail(email)
 
 	if user == nil || err == sql.ErrNoRows {
+		// We compare against a dummy hash, so the response time does not tell
+		// whether the user exists.
+		_, _ = s.hasher.Verify(s.dummyHash(), pw)
 		return nil, ErrUserNotFound
 	} else if err != nil {
 		return nil, err
@@ -163,21 +327,48 @@ func (s *UserManager) CheckGetUser(email string, pw string) (*User, error) {
 		return nil, ErrWrongPassword
 	}
 
+	if err := s.CheckLogin(user); err != nil {
+		return nil, err
+	}
+
+	if s.hasher.NeedsRehash(user.Password) {
+		// The login must not fail because of this, the hash is upgraded next time
+		if hpw, err := s.hasher.Hash(pw); err == nil {
+			if err := s.updatePassword(user.ID, hpw); err == nil {
+				user.Password = hpw
+			}
+		}
+	}
+
+	if user.TwoFactor {
+		return user, ErrSecondFactorRequired
+	}
+
+	if s.IsTwoFactorRequired(user) {
+		return user, ErrSecondFactorSetupRequired
+	}
+
 	return user, nil
 }
 
 func (s *UserManager) Insert(user *User, pw string) (*User, error) {
 	db := s.db.NonConcurrentDB()
-	hpw, err := bcrypt.GenerateFromPassword([]byte(pw), 12)
+	hpw, err := s.hasher.Hash(pw)
 	if err != nil {
 		return nil, err
 	}
-	user.Password = string(hpw)
+	user.Password = hpw
 	user.Record = models.NewRecord()
+	if user.Role == "" {
+		user.Role = models.DEFAULT_ROLE
+	}
 	user.ID = int64(s.lcg.Next())
 
-	pusexp := time.Duration(s.user_exp) * time.Second
-	user.Expires, _ = user.Created.Add(pusexp)
+	// A user expiration of 0 means users never expire
+	if s.user_exp > 0 {
+		pusexp := time.Duration(s.user_exp) * time.Second
+		user.Expires, _ = user.Created.Add(pusexp)
+	}
 
 	err = db.Model(user).Insert()
 
@@ -188,6 +379,118 @@ func (s *UserManager) Insert(user *User, pw string) (*User, error) {
 	return user, nil
 }
 
+// SetPassword hashes and stores a new password for the user.
+func (s *UserManager) SetPassword(user *User, pw string) error {
+	hpw, err := s.hasher.Hash(pw)
+	if err != nil {
+		return err
+	}
+
+	if err := s.updatePassword(user.ID, hpw); err != nil {
+		return err
+	}
+
+	user.Password = hpw
+	return nil
+}
+
+// SetVerified sets the verified flag of the user.
+func (s *UserManager) SetVerified(user *User, verified bool) error {
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	_, err := db.
+		NewQuery("UPDATE " + tn + " SET verified = {:v}, modified = {:mod} WHERE id = {:id}").
+		Bind(dbx.Params{"v": verified, "mod": types.NowDateTime(), "id": user.ID}).
+		Execute()
+	if err != nil {
+		return err
+	}
+
+	user.Verified = verified
+	return nil
+}
+
+// SetTwoFactor records whether the user has a confirmed second factor.
+func (s *UserManager) SetTwoFactor(user *User, enabled bool) error {
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	_, err := db.
+		NewQuery("UPDATE " + tn + " SET two_factor = {:v}, modified = {:mod} WHERE id = {:id}").
+		Bind(dbx.Params{"v": enabled, "mod": types.NowDateTime(), "id": user.ID}).
+		Execute()
+	if err != nil {
+		return err
+	}
+
+	user.TwoFactor = enabled
+	return nil
+}
+
+// SetActive activates or deactivates the user.
+func (s *UserManager) SetActive(user *User, active bool) error {
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	_, err := db.
+		NewQuery("UPDATE " + tn + " SET active = {:a}, modified = {:mod} WHERE id = {:id}").
+		Bind(dbx.Params{"a": active, "mod": types.NowDateTime(), "id": user.ID}).
+		Execute()
+	if err != nil {
+		return err
+	}
+
+	user.Active = active
+	return nil
+}
+
+// SetExpires sets the expiration of the user. A zero time means the user never expires.
+func (s *UserManager) SetExpires(user *User, expires types.DateTime) error {
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	_, err := db.
+		NewQuery("UPDATE " + tn + " SET expires = {:exp}, modified = {:mod} WHERE id = {:id}").
+		Bind(dbx.Params{"exp": expires, "mod": types.NowDateTime(), "id": user.ID}).
+		Execute()
+	if err != nil {
+		return err
+	}
+
+	user.Expires = expires
+	return nil
+}
+
+// SetEmail changes the email of the user. The new email is not verified.
+func (s *UserManager) SetEmail(user *User, email string) error {
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	_, err := db.
+		NewQuery("UPDATE " + tn + " SET email = {:mail}, verified = FALSE, modified = {:mod} WHERE id = {:id}").
+		Bind(dbx.Params{"mail": email, "mod": types.NowDateTime(), "id": user.ID}).
+		Execute()
+	if err != nil {
+		return err
+	}
+
+	user.Email = email
+	user.Verified = false
+	return nil
+}
+
+func (s *UserManager) updatePassword(id int64, hash string) error {
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	_, err := db.
+		NewQuery("UPDATE " + tn + " SET password = {:pw}, modified = {:mod} WHERE id = {:id}").
+		Bind(dbx.Params{"pw": hash, "mod": types.NowDateTime(), "id": id}).
+		Execute()
+	return err
+}
+
 func (s *UserManager) Update(user *User) error {
 	db := s.db.NonConcurrentDB()
 	user.Modified = types.NowDateTime()
@@ -195,6 +498,25 @@ func (s *UserManager) Update(user *User) error {
 	return err
 }
 
+// UpdateLastSeen sets the LastSeen time of the user to now. Only the last_seen column
+// is written, so this is safe to call on a user struct that is not up to date.
+func (s *UserManager) UpdateLastSeen(user *User) error {
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	now := types.NowDateTime()
+	_, err := db.
+		NewQuery("UPDATE " + tn + " SET last_seen = {:ls} WHERE id = {:id}").
+		Bind(dbx.Params{"ls": now, "id": user.ID}).
+		Execute()
+	if err != nil {
+		return err
+	}
+
+	user.LastSeen = now
+	return nil
+}
+
 func (s *UserManager) Delete(id int64) error {
 	db := s.db.NonConcurrentDB()
 	q := db.
@@ -222,13 +544,51 @@ func (s *UserManager) Count() (int, error) {
 	return c.Count, nil
 }
 
+// SetRole sets the role of the user. The role is not checked against the
+// registered roles, see roles.RoleManager.
+func (s *UserManager) SetRole(user *User, role string) error {
+	db := s.db.NonConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	_, err := db.
+		NewQuery("UPDATE " + tn + " SET role = {:role}, modified = {:mod} WHERE id = {:id}").
+		Bind(dbx.Params{"role": role, "mod": types.NowDateTime(), "id": user.ID}).
+		Execute()
+	if err != nil {
+		return err
+	}
+
+	user.Role = role
+	return nil
+}
+
+func (s *UserManager) CountByRole(role string) (int, error) {
+	db := s.db.ConcurrentDB()
+	tn := db.QuoteTableName(s.table)
+
+	c := models.Count{}
+
+	err := db.NewQuery(
+		"SELECT COUNT(*) AS count FROM " + tn + " WHERE role = {:role}").
+		Bind(dbx.Params{"role": role}).
+		One(&c)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	return c.Count, nil
+}
+
 func (s *UserManager) HasAdmins() (bool, error) {
 	db := s.db.ConcurrentDB()
 	tn := db.QuoteTableName(s.table)
 
 	user := User{}
 	err := db.
-		NewQuery("SELECT id, role FROM " + tn + " WHERE role = 3 LIMIT 1").
+		NewQuery("SELECT id, role FROM " + tn + " WHERE role = {:role} LIMIT 1").
+		Bind(dbx.Params{"role": models.ROLE_ADMIN}).
 		One(&user)
 
 	if err == sql.ErrNoRows {
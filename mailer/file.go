@@ -0,0 +1,40 @@
+package mailer
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// FileMailer writes every message as .eml file into a directory instead of
+// sending it. It is meant for development and tests.
+type FileMailer struct {
+	Dir string
+
+	count atomic.Int64
+}
+
+func NewFileMailer(dir string) *FileMailer {
+	return &FileMailer{Dir: dir}
+}
+
+func (f *FileMailer) Send(m *Message) error {
+	data, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(f.Dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	name := strconv.FormatInt(time.Now().UnixMicro(), 10) + "_" + strconv.FormatInt(f.count.Add(1), 10) + ".eml"
+	return os.WriteFile(filepath.Join(f.Dir, name), data, 0600)
+}
+
+// Files returns the paths of all written messages, oldest first.
+func (f *FileMailer) Files() ([]string, error) {
+	return filepath.Glob(filepath.Join(f.Dir, "*.eml"))
+}
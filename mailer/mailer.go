@@ -0,0 +1,174 @@
+// Package mailer sends emails. The Mailer interface has an SMTP implementation
+// for production and a file based implementation, that writes .eml files, for
+// development and tests.
+package mailer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/Simon-Martens/caveman/tools/security"
+)
+
+var ErrNoRecipients = errors.New("message has no recipients")
+var ErrNoSender = errors.New("message has no sender")
+
+type Mailer interface {
+	// Send sends the message.
+	Send(m *Message) error
+}
+
+// Message defines an email. At least one of Text or HTML must be set, if both
+// are set the message is sent as multipart/alternative.
+type Message struct {
+	From    mail.Address
+	To      []mail.Address
+	Cc      []mail.Address
+	Bcc     []mail.Address
+	Subject string
+	Text    string
+	HTML    string
+	Headers map[string]string
+}
+
+// Recipients returns the addresses of all recipients, including Bcc.
+func (m *Message) Recipients() []string {
+	r := []string{}
+	for _, l := range [][]mail.Address{m.To, m.Cc, m.Bcc} {
+		for _, a := range l {
+			r = append(r, a.Address)
+		}
+	}
+	return r
+}
+
+// Validate checks that the message can be sent.
+func (m *Message) Validate() error {
+	if m.From.Address == "" {
+		return ErrNoSender
+	}
+
+	if len(m.Recipients()) == 0 {
+		return ErrNoRecipients
+	}
+
+	return nil
+}
+
+// Bytes encodes the message in the RFC 5322 format. Bcc recipients are not
+// included in the headers.
+func (m *Message) Bytes() ([]byte, error) {
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+
+	id, err := security.CreateRandomSHA256Token()
+	if err != nil {
+		return nil, err
+	}
+
+	domain := "localhost"
+	if _, d, found := strings.Cut(m.From.Address, "@"); found {
+		domain = d
+	}
+
+	writeHeader(&b, "From", m.From.String())
+	if len(m.To) > 0 {
+		writeHeader(&b, "To", joinAddresses(m.To))
+	}
+	if len(m.Cc) > 0 {
+		writeHeader(&b, "Cc", joinAddresses(m.Cc))
+	}
+	writeHeader(&b, "Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	writeHeader(&b, "Date", time.Now().Format(time.RFC1123Z))
+	writeHeader(&b, "Message-ID", "<"+id+"@"+domain+">")
+	writeHeader(&b, "MIME-Version", "1.0")
+	for k, v := range m.Headers {
+		writeHeader(&b, k, mime.QEncoding.Encode("utf-8", v))
+	}
+
+	switch {
+	case m.Text != "" && m.HTML != "":
+		w := multipart.NewWriter(&b)
+		writeHeader(&b, "Content-Type", `multipart/alternative; boundary="`+w.Boundary()+`"`)
+		b.WriteString("\r\n")
+
+		if err := writePart(w, "text/plain", m.Text); err != nil {
+			return nil, err
+		}
+
+		if err := writePart(w, "text/html", m.HTML); err != nil {
+			return nil, err
+		}
+
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	case m.HTML != "":
+		if err := writeBody(&b, "text/html", m.HTML); err != nil {
+			return nil, err
+		}
+	default:
+		if err := writeBody(&b, "text/plain", m.Text); err != nil {
+			return nil, err
+		}
+	}
+
+	return b.Bytes(), nil
+}
+
+func writeHeader(b *bytes.Buffer, key, value string) {
+	b.WriteString(key + ": " + value + "\r\n")
+}
+
+func writeBody(b *bytes.Buffer, contentType, body string) error {
+	writeHeader(b, "Content-Type", contentType+"; charset=utf-8")
+	writeHeader(b, "Content-Transfer-Encoding", "quoted-printable")
+	b.WriteString("\r\n")
+
+	qp := quotedprintable.NewWriter(b)
+	if _, err := qp.Write([]byte(body)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+func writePart(w *multipart.Writer, contentType, body string) error {
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", contentType+"; charset=utf-8")
+	h.Set("Content-Transfer-Encoding", "quoted-printable")
+
+	pw, err := w.CreatePart(h)
+	if err != nil {
+		return err
+	}
+
+	qp := quotedprintable.NewWriter(pw)
+	if _, err := qp.Write([]byte(body)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+func joinAddresses(addrs []mail.Address) string {
+	s := make([]string, len(addrs))
+	for i, a := range addrs {
+		s[i] = a.String()
+	}
+	return strings.Join(s, ", ")
+}
+
+// String returns a short description of the message for logs.
+func (m *Message) String() string {
+	return fmt.Sprintf("%q to %v", m.Subject, m.Recipients())
+}
@@ -0,0 +1,121 @@
+package mailer_test
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Simon-Martens/caveman/mailer"
+)
+
+func TestFileMailer(t *testing.T) {
+	fm := mailer.NewFileMailer(t.TempDir())
+
+	tmpl := &mailer.Template{
+		Subject: "Hello {{ .Name | title }}",
+		Text:    "Visit {{ .Link }}",
+		HTML:    `<a href="{{ .Link }}">{{ .Name }}</a>`,
+	}
+
+	data := map[string]string{"Name": "jürgen <j>", "Link": "http://localhost/?a=1&b=2"}
+	msg, err := tmpl.Render(
+		mail.Address{Name: "Caveman", Address: "noreply@localhost"},
+		mail.Address{Address: "user@test.com"},
+		data,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Bcc = []mail.Address{{Address: "hidden@test.com"}}
+
+	if err := fm.Send(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := fm.Files()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 {
+		t.Fatalf("Expected one mail, got %d", len(files))
+	}
+
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	m, err := mail.ReadMessage(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if subject != "Hello Jürgen <J>" {
+		t.Fatalf("Unexpected subject %q", subject)
+	}
+
+	if m.Header.Get("To") != "<user@test.com>" {
+		t.Fatalf("Unexpected recipient %q", m.Header.Get("To"))
+	}
+
+	if m.Header.Get("Bcc") != "" {
+		t.Fatal("Bcc must not be written to the headers")
+	}
+
+	mt, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil || mt != "multipart/alternative" {
+		t.Fatalf("Expected a multipart/alternative message, got %q", mt)
+	}
+
+	parts := map[string]string{}
+	r := multipart.NewReader(m.Body, params["boundary"])
+	for {
+		p, err := r.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := io.ReadAll(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ct, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		parts[ct] = string(b)
+	}
+
+	if parts["text/plain"] != "Visit http://localhost/?a=1&b=2" {
+		t.Fatalf("Unexpected text part %q", parts["text/plain"])
+	}
+
+	if !strings.Contains(parts["text/html"], "jürgen &lt;j&gt;") {
+		t.Fatalf("Expected the HTML part to be escaped, got %q", parts["text/html"])
+	}
+}
+
+func TestMessageValidation(t *testing.T) {
+	msg := &mailer.Message{Subject: "Test", Text: "Test"}
+
+	if _, err := msg.Bytes(); err != mailer.ErrNoSender {
+		t.Fatalf("Expected ErrNoSender, got %v", err)
+	}
+
+	msg.From = mail.Address{Address: "noreply@localhost"}
+	if _, err := msg.Bytes(); err != mailer.ErrNoRecipients {
+		t.Fatalf("Expected ErrNoRecipients, got %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+package mailer
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/smtp"
+	"strconv"
+
+	"github.com/Simon-Martens/caveman/models"
+)
+
+// SMTPMailer sends messages through an SMTP server. With TLS the connection is
+// encrypted from the start (usually port 465), otherwise STARTTLS is used if
+// the server supports it.
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	TLS      bool
+}
+
+// NewSMTPMailer creates an SMTPMailer from the SMTP settings.
+func NewSMTPMailer(sets models.SMTPSettings) *SMTPMailer {
+	return &SMTPMailer{
+		Host:     sets.Host,
+		Port:     sets.Port,
+		Username: sets.Username,
+		Password: sets.Password,
+		TLS:      sets.TLS,
+	}
+}
+
+func (s *SMTPMailer) Send(m *Message) error {
+	data, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+
+	if s.Host == "" {
+		return errors.New("smtp host is empty")
+	}
+
+	addr := net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+	tc := &tls.Config{ServerName: s.Host}
+
+	var c *smtp.Client
+	if s.TLS {
+		conn, err := tls.Dial("tcp", addr, tc)
+		if err != nil {
+			return err
+		}
+
+		c, err = smtp.NewClient(conn, s.Host)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+	} else {
+		c, err = smtp.Dial(addr)
+		if err != nil {
+			return err
+		}
+
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(tc); err != nil {
+				c.Close()
+				return err
+			}
+		}
+	}
+	defer c.Close()
+
+	if s.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password, s.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(m.From.Address); err != nil {
+		return err
+	}
+
+	for _, r := range m.Recipients() {
+		if err := c.Rcpt(r); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
@@ -0,0 +1,66 @@
+package mailer
+
+import (
+	htemplate "html/template"
+	"net/mail"
+	"strings"
+	"text/template"
+
+	"github.com/Masterminds/sprig/v3"
+)
+
+// Template defines a message template. All parts are go templates that can use
+// the (hermetic) sprig functions. HTML is optional.
+type Template struct {
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Render renders the template with the given data into a new message.
+func (t *Template) Render(from mail.Address, to mail.Address, data any) (*Message, error) {
+	subject, err := renderText(t.Subject, data)
+	if err != nil {
+		return nil, err
+	}
+
+	text, err := renderText(t.Text, data)
+	if err != nil {
+		return nil, err
+	}
+
+	html := ""
+	if t.HTML != "" {
+		var b strings.Builder
+		tmpl, err := htemplate.New("html").Funcs(sprig.HermeticHtmlFuncMap()).Parse(t.HTML)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := tmpl.Execute(&b, data); err != nil {
+			return nil, err
+		}
+		html = b.String()
+	}
+
+	return &Message{
+		From:    from,
+		To:      []mail.Address{to},
+		Subject: strings.TrimSpace(subject),
+		Text:    text,
+		HTML:    html,
+	}, nil
+}
+
+func renderText(s string, data any) (string, error) {
+	var b strings.Builder
+	tmpl, err := template.New("text").Funcs(sprig.HermeticTxtFuncMap()).Parse(s)
+	if err != nil {
+		return "", err
+	}
+
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
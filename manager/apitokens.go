@@ -0,0 +1,30 @@
+package manager
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Simon-Martens/caveman/db/apitokens"
+	"github.com/Simon-Martens/caveman/models"
+)
+
+// CreateAPIToken creates an API token for the user, see
+// [apitokens.APITokenManager.Insert]. The permissions of the scope must be
+// registered, see roles.RoleManager.
+func (a *Manager) CreateAPIToken(user int64, at *apitokens.APIToken, dexp time.Duration) (*apitokens.APIToken, error) {
+	if dexp < 0 {
+		return nil, ErrInvalidDuration
+	}
+
+	for _, p := range at.Permissions {
+		if p != models.API_TOKEN_ALL_PERMISSIONS && !a.roles.IsPermission(p) {
+			return nil, fmt.Errorf("%w: unknown permission %q", apitokens.ErrInvalidScope, p)
+		}
+	}
+
+	if _, err := a.users.Select(user); err != nil {
+		return nil, err
+	}
+
+	return a.apitoks.Insert(user, at, dexp)
+}
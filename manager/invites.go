@@ -0,0 +1,125 @@
+package manager
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Simon-Martens/caveman/db/accesstokens"
+	"github.com/Simon-Martens/caveman/db/roles"
+	"github.com/Simon-Martens/caveman/db/users"
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/Simon-Martens/caveman/tools/types"
+)
+
+var ErrInviteInvalid = errors.New("invite invalid or expired")
+var ErrInviteEmail = errors.New("email missing or not the email of the invite")
+var ErrInviteEmailTaken = errors.New("email already registered")
+
+// invitePath scopes the access tokens of invites, so they can't be used for
+// anything else.
+const invitePath = "/invite"
+
+// CreateInvite creates an invite to register with the role, as an access token
+// with the given number of uses. A duration of 0 selects
+// DEFAULT_INVITE_EXPIRATION. The creator is the user that invites, or 0, eg.
+// for invites from the command line.
+//
+// If email is not empty, the invite can only be accepted with this email, and
+// the user is registered as verified, since the inviter vouches for the address.
+// Invites without email can be accepted with any email, eg. with several uses
+// for a team.
+func (a *Manager) CreateInvite(creator int64, email, role string, uses int64, d time.Duration) (*accesstokens.AccessToken, error) {
+	if role == "" {
+		role = models.DEFAULT_ROLE
+	}
+
+	if !a.roles.IsRole(role) {
+		return nil, roles.ErrRoleNotFound
+	}
+
+	if d < 0 {
+		return nil, ErrInvalidDuration
+	} else if d == 0 {
+		d = time.Duration(models.DEFAULT_INVITE_EXPIRATION) * time.Second
+	}
+
+	if uses < 1 {
+		uses = 1
+	}
+
+	email = strings.TrimSpace(email)
+	if email != "" {
+		if _, err := a.users.SelectByEmail(email); err == nil {
+			return nil, ErrInviteEmailTaken
+		} else if err != sql.ErrNoRows {
+			return nil, err
+		}
+	}
+
+	return a.tokens.InsertScoped(creator, uses, invitePath, []string{http.MethodPost}, d, types.JsonMap{
+		"email": email,
+		"role":  role,
+	})
+}
+
+// AcceptInvite registers the user with the password, using up one use of the
+// invite. The role of the user is the role of the invite. Invites that don't
+// exist, are expired or used up fail with ErrInviteInvalid. If the user can't be
+// registered, eg. because the email was registered in the meantime, the use is
+// given back. Like FinishOAuth2, the user is returned with
+// ErrSecondFactorSetupRequired if the role requires a second factor.
+func (a *Manager) AcceptInvite(token string, user *users.User, pw string) (*users.User, error) {
+	at, err := a.tokens.SelectByAccessToken(token, http.MethodPost, invitePath)
+	if err != nil {
+		return nil, ErrInviteInvalid
+	}
+
+	user, err = a.acceptInvite(at, user, pw)
+	if err != nil && err != ErrInviteInvalid {
+		if rerr := a.tokens.Restore(at); rerr != nil {
+			return nil, errors.Join(err, rerr)
+		}
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+
+	if a.users.IsTwoFactorRequired(user) {
+		return user, users.ErrSecondFactorSetupRequired
+	}
+
+	return user, nil
+}
+
+// acceptInvite registers the user of the redeemed invite.
+func (a *Manager) acceptInvite(at *accesstokens.AccessToken, user *users.User, pw string) (*users.User, error) {
+	email, _ := at.TokenData["email"].(string)
+	role, _ := at.TokenData["role"].(string)
+	if role == "" {
+		return nil, ErrInviteInvalid
+	}
+
+	if email != "" {
+		if user.Email != "" && !strings.EqualFold(user.Email, email) {
+			return nil, ErrInviteEmail
+		}
+		user.Email = email
+		user.Verified = true
+	} else if user.Email == "" {
+		return nil, ErrInviteEmail
+	}
+
+	if _, err := a.users.SelectByEmail(user.Email); err == nil {
+		return nil, ErrInviteEmailTaken
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	user.Role = role
+	user.Active = true
+
+	return a.users.Insert(user, pw)
+}
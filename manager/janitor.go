@@ -0,0 +1,64 @@
+package manager
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Simon-Martens/caveman/models"
+)
+
+// PurgeResult counts the rows deleted by Purge.
+type PurgeResult struct {
+	Sessions   int64
+	Tokens     int64
+	APITokens  int64
+	Attempts   int64
+	Challenges int64
+	Revisions  int64
+}
+
+// Purge deletes expired sessions, expired or used up access tokens, expired API
+// tokens, forgotten failed attempts, expired passkey challenges and all but the
+// latest retention revisions of every datastore key. It continues on errors and
+// returns them joined.
+func (a *Manager) Purge(retention int) (PurgeResult, error) {
+	r := PurgeResult{}
+	var errs []error
+	var err error
+
+	if r.Sessions, err = a.sessions.DeleteExpired(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if r.Tokens, err = a.tokens.DeleteExpired(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if r.APITokens, err = a.apitoks.DeleteExpired(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if r.Attempts, err = a.attempts.DeleteExpired(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if r.Challenges, err = a.purgePasskeyChallenges(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if r.Revisions, err = a.state.Prune(retention); err != nil {
+		errs = append(errs, err)
+	}
+
+	return r, errors.Join(errs...)
+}
+
+// janitor is the built-in job that runs Purge, see models.DEFAULT_JANITOR_SCHEDULE.
+func (a *Manager) janitor(ctx context.Context) error {
+	r, err := a.Purge(models.DEFAULT_DATASTORE_RETENTION)
+	if r.Sessions > 0 || r.Tokens > 0 || r.APITokens > 0 || r.Attempts > 0 || r.Challenges > 0 || r.Revisions > 0 {
+		a.Logger().Info("Janitor purged expired data", "sessions", r.Sessions, "tokens", r.Tokens, "api_tokens", r.APITokens, "attempts", r.Attempts, "challenges", r.Challenges, "revisions", r.Revisions)
+	}
+
+	return err
+}
@@ -0,0 +1,18 @@
+package manager
+
+import (
+	"context"
+
+	"github.com/Simon-Martens/caveman/scheduler"
+)
+
+// RegisterJob registers a recurring job, see scheduler.Parse for the spec.
+// Register jobs before the scheduler starts, so the cli sees them too.
+func (a *Manager) RegisterJob(name, spec string, f scheduler.Func) error {
+	return a.sched.Register(name, spec, f)
+}
+
+// RunJob runs a registered job now and returns its error.
+func (a *Manager) RunJob(ctx context.Context, name string) error {
+	return a.sched.Run(ctx, name)
+}
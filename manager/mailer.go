@@ -0,0 +1,47 @@
+package manager
+
+import (
+	"net/mail"
+	"path/filepath"
+
+	"github.com/Simon-Martens/caveman/mailer"
+	"github.com/Simon-Martens/caveman/models"
+)
+
+// Mailer returns the mailer of the application. Unless set with SetMailer, it
+// is created from the current settings: an SMTP mailer if SMTP is enabled,
+// otherwise a file mailer writing into the mails dir in the data dir.
+func (a *Manager) Mailer() mailer.Mailer {
+	if a.mailer != nil {
+		return a.mailer
+	}
+
+	if sets := a.CMSettings(); sets != nil && sets.SMTP.Enabled {
+		return mailer.NewSMTPMailer(sets.SMTP)
+	}
+
+	return mailer.NewFileMailer(filepath.Join(a.dataDir, models.DEFAULT_MAILS_DIR))
+}
+
+// SetMailer overrides the mailer from the settings; nil restores the default.
+func (a *Manager) SetMailer(m mailer.Mailer) {
+	a.mailer = m
+}
+
+// Sender returns the address outgoing mails are sent from.
+func (a *Manager) Sender() mail.Address {
+	sets := a.CMSettings()
+	if sets == nil {
+		return mail.Address{}
+	}
+	return mail.Address{Name: sets.SenderName, Address: sets.SenderAddress}
+}
+
+// SendTemplate renders the template with data and sends it to the given address.
+func (a *Manager) SendTemplate(t *mailer.Template, to mail.Address, data any) error {
+	m, err := t.Render(a.Sender(), to, data)
+	if err != nil {
+		return err
+	}
+	return a.Mailer().Send(m)
+}
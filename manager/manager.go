@@ -6,27 +6,49 @@ import (
 	"log/slog"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 
 	"github.com/Simon-Martens/caveman/db"
 	"github.com/Simon-Martens/caveman/db/accesstokens"
+	"github.com/Simon-Martens/caveman/db/apitokens"
+	"github.com/Simon-Martens/caveman/db/attempts"
 	"github.com/Simon-Martens/caveman/db/datastore"
+	"github.com/Simon-Martens/caveman/db/identities"
+	"github.com/Simon-Martens/caveman/db/jobs"
+	"github.com/Simon-Martens/caveman/db/passkeys"
+	"github.com/Simon-Martens/caveman/db/roles"
 	"github.com/Simon-Martens/caveman/db/sessions"
+	"github.com/Simon-Martens/caveman/db/twofactor"
 	"github.com/Simon-Martens/caveman/db/users"
+	"github.com/Simon-Martens/caveman/mailer"
 	"github.com/Simon-Martens/caveman/models"
+	"github.com/Simon-Martens/caveman/scheduler"
 	"github.com/Simon-Martens/caveman/tools/security"
 )
 
 type Manager struct {
-	cm_settings *models.Settings
+	cm_settings atomic.Pointer[models.Settings]
 	cm_db       *db.DB
 
-	state *datastore.DataStoreManager
+	state   *datastore.DataStoreManager
+	setup   atomic.Int64
+	setupMu sync.Mutex     // serializes Setup
+	bg      sync.WaitGroup // background work, see Go
 
-	DB       *db.DB
 	logger   *slog.Logger
 	users    *users.UserManager
 	sessions *sessions.SessionManager
 	tokens   *accesstokens.AccessTokenManager
+	apitoks  *apitokens.APITokenManager
+	attempts *attempts.AttemptManager
+	twofac   *twofactor.TwoFactorManager
+	passkeys *passkeys.PasskeyManager
+	idents   *identities.IdentityManager
+	roles    *roles.RoleManager
+	mailer   mailer.Mailer
+	jobs     *jobs.JobManager
+	sched    *scheduler.Scheduler
 
 	// These settings depend on startup settings, the settings above are read from the database
 	isDev   bool
@@ -38,7 +60,12 @@ func New(sets models.Config) *Manager {
 	app := &Manager{
 		dataDir: sets.DataDir,
 		isDev:   sets.Dev,
+		sched:   scheduler.New(),
 	}
+
+	// Jobs are registered in code, so they outlive Bootstrap and Terminate
+	_ = app.sched.Register(models.DEFAULT_JANITOR_JOB, models.DEFAULT_JANITOR_SCHEDULE, app.janitor)
+
 	return app
 }
 
@@ -98,6 +125,7 @@ func (a *Manager) Bootstrap() error {
 		models.DEFAULT_ID_FIELD,
 		models.DEFAULT_LONG_SESSION_EXPIRATION,
 		models.DEFAULT_SHORT_SESSION_EXPIRATION,
+		models.DEFAULT_CSRF_EXPIRATION,
 		models.DEFAULT_LONG_RESOURCE_SESSION_EXPIRATION,
 		models.DEFAULT_SHORT_RESOURCE_SESSION_EXPIRATION,
 		models.DEFAULT_USER_EXPIRATION,
@@ -105,6 +133,15 @@ func (a *Manager) Bootstrap() error {
 		return err
 	}
 
+	if err := a.InitJobs(a.cm_db, models.DEFAULT_JOBS_TABLE, models.DEFAULT_ID_FIELD); err != nil {
+		return err
+	}
+
+	// Every command may write, so the tables must be migrated before any of them runs
+	if err := a.RunMigrations(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -120,73 +157,58 @@ func (a *Manager) BootstrapSettings(db *db.DB, tn, idf, key string) error {
 	return nil
 }
 
-func (a *Manager) BootstrapAuth(db *db.DB, tnu, tnat, tns, idf string, lseexp, sseexp, lrsexp, srsexp, uexp int) error {
-	if err := a.InitUsers(db, tnu, idf, uexp, a.cm_settings); err != nil {
+func (a *Manager) BootstrapAuth(db *db.DB, tnu, tnat, tns, idf string, lseexp, sseexp, csrfexp, lrsexp, srsexp, uexp int) error {
+	if err := a.InitUsers(db, tnu, idf, uexp, a.CMSettings()); err != nil {
 		return err
 	}
 
-	if err := a.InitTokens(db, tnat, tns, idf, lrsexp, srsexp); err != nil {
+	if err := a.InitTokens(db, tnat, tnu, idf, lrsexp, srsexp, a.CMSettings()); err != nil {
 		return err
 	}
 
-	if err := a.InitSessions(db, tns, tnu, idf, lseexp, sseexp, a.cm_settings); err != nil {
+	if err := a.InitSessions(db, tns, tnu, idf, lseexp, sseexp, csrfexp, a.CMSettings()); err != nil {
 		return err
 	}
 
-	return nil
-}
+	if err := a.InitRoles(db, models.DEFAULT_ROLES_TABLE, idf); err != nil {
+		return err
+	}
+
+	if err := a.InitAPITokens(db, models.DEFAULT_API_TOKENS_TABLE, tnu, idf); err != nil {
+		return err
+	}
+
+	if err := a.InitAttempts(db, models.DEFAULT_ATTEMPTS_TABLE, idf, a.CMSettings()); err != nil {
+		return err
+	}
+
+	if err := a.InitTwoFactor(db, models.DEFAULT_TOTP_TABLE, models.DEFAULT_RECOVERY_CODES_TABLE, tnu, idf); err != nil {
+		return err
+	}
+
+	if err := a.InitPasskeys(db, models.DEFAULT_PASSKEYS_TABLE, tnu, idf); err != nil {
+		return err
+	}
+
+	if err := a.InitIdentities(db, models.DEFAULT_IDENTITIES_TABLE, tnu, idf); err != nil {
+		return err
+	}
 
-func (a *Manager) Terminate() error {
-	// 	if a.db != nil {
-	// 		if err := a.db.Close(); err != nil {
-	// 			return err
-	// 		}
-	// 	}
-	//
-	// 	if a.logger != nil {
-	//
-	// 	}
-	//
-	// 	return nil
-
-	// TODO:
 	return nil
 }
 
-func (a *Manager) RefreshSetupState() int {
-	return 0
-	// hasAdmins, err := db.HasAdmins(a.papp.Dao())
-	//
-	// if err != nil {
-	// 	panic("Could not get the number of admins. " + err.Error())
-	// }
-	//
-	// if !hasAdmins {
-	// 	a.store.Set(STORE_KEY_SETUP_STATE, 1)
-	// 	return 1
-	// }
-	//
-	// hasSettings, err := db.HasSettings(a.papp.Dao())
-	//
-	// if err != nil {
-	// 	panic("Could not get the number of settings. " + err.Error())
-	// }
-	//
-	// if !hasSettings {
-	// 	a.store.Set(STORE_KEY_SETUP_STATE, 2)
-	// 	return 2
-	// }
-	//
-	// a.store.Set(STORE_KEY_SETUP_STATE, 3)
-	// return 3
+// Terminate releases all resources held by the manager, it is the counterpart to
+// Bootstrap. After Terminate the manager must be bootstrapped again before use.
+func (a *Manager) Terminate() error {
+	return a.ResetBootstrapState()
 }
 
 func (a *Manager) IsBootstrapped() bool {
-	return a.IsUsersBootstrapped() && a.IsSettingsBootstrapped() && a.IsStateBootstrapped()
+	return a.IsUsersBootstrapped() && a.IsSettingsBootstrapped() && a.IsStateBootstrapped() && a.jobs != nil
 }
 
 func (a *Manager) IsUsersBootstrapped() bool {
-	return a.users != nil && a.sessions != nil && a.tokens != nil
+	return a.users != nil && a.sessions != nil && a.tokens != nil && a.roles != nil && a.apitoks != nil && a.attempts != nil && a.twofac != nil && a.passkeys != nil && a.idents != nil
 }
 
 func (a *Manager) IsStateBootstrapped() bool {
@@ -194,16 +216,29 @@ func (a *Manager) IsStateBootstrapped() bool {
 }
 
 func (a *Manager) IsSettingsBootstrapped() bool {
-	return a.cm_settings != nil
+	return a.CMSettings() != nil
 }
 
 func (a *Manager) ResetBootstrapState() error {
+	// Background work and jobs use the db, so they must finish first
+	a.bg.Wait()
+	a.sched.Stop()
+	_ = a.sched.UseStore(nil)
+
 	a.logger = nil
 
 	a.sessions = nil
 	a.users = nil
 	a.state = nil
 	a.tokens = nil
+	a.apitoks = nil
+	a.attempts = nil
+	a.twofac = nil
+	a.passkeys = nil
+	a.idents = nil
+	a.roles = nil
+	a.jobs = nil
+	a.cm_settings.Store(nil)
 
 	// We do this last since it can err
 	// TODO: close all dbs
@@ -211,11 +246,22 @@ func (a *Manager) ResetBootstrapState() error {
 		if err := a.cm_db.Close(); err != nil {
 			return err
 		}
+		a.cm_db = nil
 	}
 
 	return nil
 }
 
+// Go runs f in the background, eg. to send a mail after responding. Terminate
+// waits for f to return, so f may use the managers.
+func (a *Manager) Go(f func()) {
+	a.bg.Add(1)
+	go func() {
+		defer a.bg.Done()
+		f()
+	}()
+}
+
 // Logger returns the default app logger.
 //
 // If the application is not bootstrapped yet, fallbacks to slog.Default().
@@ -231,6 +277,11 @@ func (app *Manager) IsDev() bool {
 	return app.isDev
 }
 
+// DB returns the main database of the application.
+func (app *Manager) DB() *db.DB {
+	return app.cm_db
+}
+
 func (app *Manager) Sessions() *sessions.SessionManager {
 	return app.sessions
 }
@@ -239,12 +290,55 @@ func (app *Manager) Users() *users.UserManager {
 	return app.users
 }
 
+func (app *Manager) Tokens() *accesstokens.AccessTokenManager {
+	return app.tokens
+}
+
+func (app *Manager) APITokens() *apitokens.APITokenManager {
+	return app.apitoks
+}
+
+func (app *Manager) Attempts() *attempts.AttemptManager {
+	return app.attempts
+}
+
+func (app *Manager) TwoFactor() *twofactor.TwoFactorManager {
+	return app.twofac
+}
+
+func (app *Manager) Passkeys() *passkeys.PasskeyManager {
+	return app.passkeys
+}
+
+func (app *Manager) Identities() *identities.IdentityManager {
+	return app.idents
+}
+
+func (app *Manager) DataStore() *datastore.DataStoreManager {
+	return app.state
+}
+
+func (app *Manager) Roles() *roles.RoleManager {
+	return app.roles
+}
+
+func (app *Manager) Jobs() *jobs.JobManager {
+	return app.jobs
+}
+
+// Scheduler returns the job scheduler. Jobs can be registered before Bootstrap.
+func (app *Manager) Scheduler() *scheduler.Scheduler {
+	return app.sched
+}
+
 func (app *Manager) DataDir() string {
 	return app.dataDir
 }
 
+// CMSettings returns the current settings. They are replaced, not changed, by
+// UpdateSettings, so the returned settings must not be modified.
 func (a *Manager) CMSettings() *models.Settings {
-	return a.cm_settings
+	return a.cm_settings.Load()
 }
 
 // INFO: every init function must make sure of it's own dependencies
@@ -290,7 +384,7 @@ func (a *Manager) InitSettings(dsm *datastore.DataStoreManager, key string) erro
 		if err != nil {
 			return err
 		}
-	} else {
+	} else if err != nil {
 		return err
 	}
 
@@ -299,21 +393,30 @@ func (a *Manager) InitSettings(dsm *datastore.DataStoreManager, key string) erro
 		return err
 	}
 
-	a.cm_settings = sets
+	a.cm_settings.Store(sets)
 	return nil
 }
 
-func (a *Manager) InitSessions(db *db.DB, stn, utn, idfield string, lsessexp, ssessexp int, sets *models.Settings) error {
+func (a *Manager) InitSessions(db *db.DB, stn, utn, idfield string, lsessexp, ssessexp, csrfexp int, sets *models.Settings) error {
 	if sets == nil || db == nil {
 		return errors.New("settings or db is nil")
 	}
 	if sets.SessionSeed == 0 {
 		sets.SessionSeed = security.GenRandomUIntNotPrime()
 	}
-	sm, err := sessions.New(db, stn, utn, idfield, lsessexp, ssessexp, sets.SessionSeed)
+	sm, err := sessions.New(db, stn, utn, idfield, lsessexp, ssessexp, csrfexp, sets.SessionSeed)
 	if err != nil {
 		return err
 	}
+
+	// Persist the CSRF secret, so tokens stay valid across restarts and processes
+	if a.state == nil {
+		return errors.New("datastore manager is nil")
+	}
+	if err := sm.UseDataStore(a.state); err != nil {
+		return err
+	}
+	sm.UseSlidingExpiration(sets.SessionRenewInterval)
 	a.sessions = sm
 	return nil
 }
@@ -329,15 +432,99 @@ func (a *Manager) InitUsers(db *db.DB, utn, idfield string, uexp int, sets *mode
 	if err != nil {
 		return err
 	}
+	um.RequireVerified(sets.RequireVerification)
+	um.RequireTwoFactor(sets.TwoFactorRoles)
 	a.users = um
 	return nil
 }
 
-func (a *Manager) InitTokens(db *db.DB, atn, utn, idfield string, lressexp, sressexp int) error {
+// InitAttempts limits failed logins of the users manager, so it must be initialized first.
+func (a *Manager) InitAttempts(db *db.DB, tn, idfield string, sets *models.Settings) error {
+	if sets == nil || db == nil {
+		return errors.New("settings or db is nil")
+	}
+	if a.users == nil {
+		return errors.New("users manager is nil")
+	}
+	am, err := attempts.New(db, tn, idfield)
+	if err != nil {
+		return err
+	}
+	am.SetLimits(sets.RateLimit)
+	a.users.UseAttempts(am)
+	a.attempts = am
+	return nil
+}
+
+func (a *Manager) InitTwoFactor(db *db.DB, tn, rctn, utn, idfield string) error {
+	tf, err := twofactor.New(db, tn, rctn, utn, idfield)
+	if err != nil {
+		return err
+	}
+	a.twofac = tf
+	return nil
+}
+
+func (a *Manager) InitPasskeys(db *db.DB, tn, utn, idfield string) error {
+	pm, err := passkeys.New(db, tn, utn, idfield)
+	if err != nil {
+		return err
+	}
+	a.passkeys = pm
+	return nil
+}
+
+func (a *Manager) InitIdentities(db *db.DB, tn, utn, idfield string) error {
+	im, err := identities.New(db, tn, utn, idfield)
+	if err != nil {
+		return err
+	}
+	a.idents = im
+	return nil
+}
+
+func (a *Manager) InitTokens(db *db.DB, atn, utn, idfield string, lressexp, sressexp int, sets *models.Settings) error {
+	if sets == nil || db == nil {
+		return errors.New("settings or db is nil")
+	}
 	tm, err := accesstokens.New(db, atn, utn, idfield, lressexp, sressexp)
 	if err != nil {
 		return err
 	}
+	tm.CountProbes(sets.CountTokenProbes)
 	a.tokens = tm
 	return nil
 }
+
+func (a *Manager) InitAPITokens(db *db.DB, atn, utn, idfield string) error {
+	am, err := apitokens.New(db, atn, utn, idfield)
+	if err != nil {
+		return err
+	}
+	a.apitoks = am
+	return nil
+}
+
+func (a *Manager) InitRoles(db *db.DB, tn, idfield string) error {
+	rm, err := roles.New(db, tn, idfield)
+	if err != nil {
+		return err
+	}
+	a.roles = rm
+	return nil
+}
+
+func (a *Manager) InitJobs(db *db.DB, tn, idfield string) error {
+	jm, err := jobs.New(db, tn, idfield)
+	if err != nil {
+		return err
+	}
+
+	a.sched.UseLogger(a.Logger())
+	if err := a.sched.UseStore(jm); err != nil {
+		return err
+	}
+
+	a.jobs = jm
+	return nil
+}
@@ -0,0 +1,38 @@
+package manager
+
+import (
+	"github.com/Simon-Martens/caveman/migrations"
+	"github.com/Simon-Martens/caveman/tools/migration"
+	"github.com/pocketbase/dbx"
+)
+
+type migrationsConnection struct {
+	DB             *dbx.DB
+	MigrationsList migration.MigrationsList
+}
+
+// RunMigrations applies all pending migrations to the application databases and
+// refreshes the setup state, since migrations may change it. Bootstrap runs it,
+// so it only needs to be called for migrations registered after Bootstrap.
+func (a *Manager) RunMigrations() error {
+	connections := []migrationsConnection{
+		{
+			DB:             a.DB().NonConcurrentDB(),
+			MigrationsList: migrations.AppMigrations,
+		},
+	}
+
+	for _, c := range connections {
+		runner, err := migration.NewRunner(c.DB, c.MigrationsList)
+		if err != nil {
+			return err
+		}
+
+		if _, err := runner.Up(); err != nil {
+			return err
+		}
+	}
+
+	_, err := a.RefreshSetupState()
+	return err
+}
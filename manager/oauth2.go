@@ -0,0 +1,223 @@
+package manager
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Simon-Martens/caveman/auth/oauth2"
+	"github.com/Simon-Martens/caveman/db/identities"
+	"github.com/Simon-Martens/caveman/db/users"
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/Simon-Martens/caveman/tools/security"
+	"github.com/Simon-Martens/caveman/tools/types"
+)
+
+var ErrOAuth2State = errors.New("oauth2 state invalid or expired")
+var ErrOAuth2Invalid = errors.New("oauth2 login invalid")
+var ErrOAuth2NoAccount = errors.New("no account linked to the identity")
+
+// OAuth2Login is the result of a login with a provider, see FinishOAuth2. Next is
+// the path given to BeginOAuth2. Link is set if the identity was linked to the
+// user of BeginOAuth2, which is no login. Linked is set if the identity was newly
+// linked to the user, Registered if the user was registered.
+type OAuth2Login struct {
+	User       *users.User
+	Identity   *identities.Identity
+	Claims     *oauth2.Claims
+	Next       string
+	Link       bool
+	Linked     bool
+	Registered bool
+}
+
+// oauth2StatePath scopes the access tokens of the state to the provider, so they
+// can't be used for anything else.
+func oauth2StatePath(p *oauth2.Provider) string {
+	return "/oauth2/" + p.Name
+}
+
+func oauth2Expiration() time.Duration {
+	return time.Duration(models.DEFAULT_OAUTH2_STATE_EXPIRATION) * time.Second
+}
+
+// BeginOAuth2 starts a login with the provider and returns the URL the user is
+// sent to, and the state. If user is not nil, the identity at the provider is
+// linked to the user instead. The state is a single use access token of the
+// user, or without creator for logins. It holds the nonce and the PKCE verifier,
+// so neither leaves the server, and next.
+func (a *Manager) BeginOAuth2(ctx context.Context, p *oauth2.Provider, redirect string, user *users.User, next string) (string, string, error) {
+	verifier, err := oauth2.NewVerifier()
+	if err != nil {
+		return "", "", err
+	}
+
+	nonce, err := security.CreateRandomSHA256Token()
+	if err != nil {
+		return "", "", err
+	}
+
+	var creator int64
+	if user != nil {
+		creator = user.ID
+	}
+
+	at, err := a.tokens.InsertScoped(creator, 1, oauth2StatePath(p), []string{http.MethodGet}, oauth2Expiration(), types.JsonMap{
+		"nonce":    nonce,
+		"verifier": verifier,
+		"next":     next,
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	u, err := p.AuthCodeURL(ctx, redirect, at.Token, nonce, verifier)
+	if err != nil {
+		return "", "", err
+	}
+
+	return u, at.Token, nil
+}
+
+// FinishOAuth2 redeems the code the provider redirected back with. The state
+// must have been issued by BeginOAuth2 for the provider, otherwise it fails with
+// ErrOAuth2State. States of links must be redeemed by the same user, current.
+// Codes and ID tokens that don't verify fail with ErrOAuth2Invalid, joined with
+// the error of package oauth2.
+//
+// Identities of logins without linked user are handled by the registration rules
+// of the provider: they are linked to the user with the same email, or a user is
+// registered. Otherwise the login fails with ErrOAuth2NoAccount. The user must
+// pass [users.UserManager.CheckLogin]. Like [users.UserManager.CheckGetUser], the
+// login is returned with ErrSecondFactorRequired or ErrSecondFactorSetupRequired
+// if the user needs a second factor.
+func (a *Manager) FinishOAuth2(ctx context.Context, p *oauth2.Provider, redirect, state, code string, current *users.User) (*OAuth2Login, error) {
+	at, err := a.tokens.SelectByAccessToken(state, http.MethodGet, oauth2StatePath(p))
+	if err != nil {
+		return nil, ErrOAuth2State
+	}
+
+	if at.Creator != 0 && (current == nil || current.ID != at.Creator) {
+		return nil, ErrOAuth2State
+	}
+
+	nonce, _ := at.TokenData["nonce"].(string)
+	verifier, _ := at.TokenData["verifier"].(string)
+	next, _ := at.TokenData["next"].(string)
+	if nonce == "" || verifier == "" {
+		return nil, ErrOAuth2State
+	}
+
+	claims, err := p.Login(ctx, redirect, code, verifier, nonce)
+	if err != nil {
+		return nil, errors.Join(ErrOAuth2Invalid, err)
+	}
+
+	login := &OAuth2Login{Claims: claims, Next: next}
+
+	if at.Creator != 0 {
+		login.User = current
+		login.Link = true
+		login.Identity, login.Linked, err = a.linkIdentity(p, current, claims)
+		if err != nil {
+			return nil, err
+		}
+		return login, nil
+	}
+
+	login.Identity, err = a.idents.SelectBySubject(p.Name, claims.Subject)
+	if err == identities.ErrIdentityNotFound {
+		login.User, login.Registered, err = a.oauth2User(p, claims)
+		if err != nil {
+			return nil, err
+		}
+
+		login.Identity, login.Linked, err = a.linkIdentity(p, login.User, claims)
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	} else {
+		if login.User, err = a.users.Select(login.Identity.User); err != nil {
+			return nil, err
+		}
+
+		if err := a.idents.Use(login.Identity, claims.Email); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := a.users.CheckLogin(login.User); err != nil {
+		return nil, err
+	}
+
+	if login.User.TwoFactor {
+		return login, users.ErrSecondFactorRequired
+	}
+
+	if a.users.IsTwoFactorRequired(login.User) {
+		return login, users.ErrSecondFactorSetupRequired
+	}
+
+	return login, nil
+}
+
+// linkIdentity links the subject of the claims to the user and reports whether
+// it was not linked before. Linking the same identity again is not an error.
+func (a *Manager) linkIdentity(p *oauth2.Provider, user *users.User, claims *oauth2.Claims) (*identities.Identity, bool, error) {
+	if i, err := a.idents.SelectBySubject(p.Name, claims.Subject); err == nil && i.User == user.ID {
+		return i, false, a.idents.Use(i, claims.Email)
+	}
+
+	i, err := a.idents.Insert(user.ID, p.Name, claims.Subject, claims.Email)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return i, true, a.idents.Use(i, claims.Email)
+}
+
+// oauth2User returns the user for claims without linked identity, following the
+// registration rules of the provider. It reports whether the user was registered.
+func (a *Manager) oauth2User(p *oauth2.Provider, claims *oauth2.Claims) (*users.User, bool, error) {
+	if claims.Email == "" {
+		return nil, false, ErrOAuth2NoAccount
+	}
+
+	user, err := a.users.SelectByEmail(claims.Email)
+	if err == nil {
+		if p.Registration.Links(claims) {
+			return user, false, nil
+		}
+		return nil, false, ErrOAuth2NoAccount
+	} else if err != sql.ErrNoRows {
+		return nil, false, err
+	}
+
+	if !p.Registration.Allows(claims) {
+		return nil, false, ErrOAuth2NoAccount
+	}
+
+	// The user logs in with the provider, the password can be set with a reset
+	pw, err := security.CreateRandomSHA256Token()
+	if err != nil {
+		return nil, false, err
+	}
+
+	user, err = a.users.Insert(&users.User{
+		Name:     strings.TrimSpace(claims.Name),
+		Email:    claims.Email,
+		Role:     p.Registration.Role,
+		Active:   true,
+		Verified: true,
+	}, pw)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return user, true, nil
+}
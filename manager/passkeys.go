@@ -0,0 +1,213 @@
+package manager
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Simon-Martens/caveman/db/datastore"
+	"github.com/Simon-Martens/caveman/db/passkeys"
+	"github.com/Simon-Martens/caveman/db/users"
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/Simon-Martens/caveman/tools/security"
+	"github.com/Simon-Martens/caveman/tools/types"
+	"github.com/Simon-Martens/caveman/tools/webauthn"
+)
+
+var ErrPasskeyChallenge = errors.New("passkey challenge invalid or expired")
+var ErrPasskeyInvalid = errors.New("passkey invalid")
+
+// passkeyRegistrationPath scopes the access tokens of registration challenges,
+// so they can't be used for anything else.
+const passkeyRegistrationPath = "/passkeys/register"
+
+// passkeyChallenge is the datastore value of a login challenge. The key is the
+// digest of the challenge, see BeginPasskeyLogin.
+type passkeyChallenge struct {
+	key     string
+	Expires types.DateTime `json:"expires"`
+}
+
+func (c passkeyChallenge) Key() string {
+	return c.key
+}
+
+func passkeyChallengeKey(challenge []byte) string {
+	return models.DATASTORE_PASSKEY_CHALLENGE_PREFIX + security.HashToken(string(challenge))
+}
+
+// UserHandle returns the user handle of the passkeys of the user, the user id.
+func UserHandle(user *users.User) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(user.ID))
+}
+
+func passkeyExpiration() time.Duration {
+	return time.Duration(models.DEFAULT_PASSKEY_CHALLENGE_EXPIRATION) * time.Second
+}
+
+// BeginPasskeyRegistration starts the registration of a passkey for the user.
+// The challenge is a single use access token of the user. Passkeys of the user
+// are excluded, so an authenticator can't be registered twice.
+func (a *Manager) BeginPasskeyRegistration(rp webauthn.RelyingParty, user *users.User) (*webauthn.CreationOptions, error) {
+	pks, err := a.passkeys.SelectByUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	exclude := make([][]byte, 0, len(pks))
+	for _, pk := range pks {
+		if id, err := base64.RawURLEncoding.DecodeString(pk.CredentialID); err == nil {
+			exclude = append(exclude, id)
+		}
+	}
+
+	at, err := a.tokens.InsertScoped(user.ID, 1, passkeyRegistrationPath, []string{http.MethodPost}, passkeyExpiration(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	name := user.Name
+	if name == "" {
+		name = user.Email
+	}
+
+	rp.Timeout = passkeyExpiration()
+	return rp.CreationOptions([]byte(at.Token), webauthn.UserEntity{
+		ID:          UserHandle(user),
+		Name:        user.Email,
+		DisplayName: name,
+	}, exclude), nil
+}
+
+// FinishPasskeyRegistration verifies the response of the authenticator and stores
+// the new passkey of the user. The challenge must have been issued to the user by
+// BeginPasskeyRegistration, otherwise it fails with ErrPasskeyChallenge. Invalid
+// responses fail with ErrPasskeyInvalid, joined with the error of package webauthn.
+func (a *Manager) FinishPasskeyRegistration(rp webauthn.RelyingParty, user *users.User, name string, resp *webauthn.RegistrationResponse) (*passkeys.Passkey, error) {
+	challenge, err := webauthn.Challenge(resp.Response.ClientDataJSON)
+	if err != nil {
+		return nil, ErrPasskeyChallenge
+	}
+
+	at, err := a.tokens.SelectByAccessToken(string(challenge), http.MethodPost, passkeyRegistrationPath)
+	if err != nil || at.Creator != user.ID {
+		return nil, ErrPasskeyChallenge
+	}
+
+	cred, err := rp.VerifyRegistration(challenge, resp, false)
+	if err != nil {
+		return nil, errors.Join(ErrPasskeyInvalid, err)
+	}
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = "Passkey"
+	}
+
+	return a.passkeys.Insert(user.ID, &passkeys.Passkey{
+		Name:           name,
+		CredentialID:   webauthn.Bytes(cred.ID).String(),
+		PublicKey:      cred.PublicKey,
+		SignCount:      int64(cred.SignCount),
+		AAGUID:         hex.EncodeToString(cred.AAGUID),
+		Transports:     cred.Transports,
+		BackupEligible: cred.BackupEligible,
+	})
+}
+
+// BeginPasskeyLogin starts a login with a passkey. The user is not known before
+// the authenticator answered, so the challenge is stored in the datastore.
+func (a *Manager) BeginPasskeyLogin(rp webauthn.RelyingParty) (*webauthn.RequestOptions, error) {
+	tok, err := security.CreateRandomSHA256Token()
+	if err != nil {
+		return nil, err
+	}
+
+	challenge := []byte(tok)
+	now := types.NowDateTime()
+	c := passkeyChallenge{key: passkeyChallengeKey(challenge)}
+	if c.Expires, err = now.Add(passkeyExpiration()); err != nil {
+		return nil, err
+	}
+
+	if _, err := a.state.Insert(c); err != nil {
+		return nil, err
+	}
+
+	rp.Timeout = passkeyExpiration()
+	return rp.RequestOptions(challenge, nil), nil
+}
+
+// FinishPasskeyLogin verifies the response of the authenticator and returns the
+// user of the passkey. Every challenge of BeginPasskeyLogin works once, others
+// fail with ErrPasskeyChallenge. Invalid responses fail with ErrPasskeyInvalid.
+// The user must pass [users.UserManager.CheckLogin]. Passkeys verify the user,
+// so no second factor is needed.
+func (a *Manager) FinishPasskeyLogin(rp webauthn.RelyingParty, resp *webauthn.AssertionResponse) (*users.User, *passkeys.Passkey, error) {
+	challenge, err := webauthn.Challenge(resp.Response.ClientDataJSON)
+	if err != nil {
+		return nil, nil, ErrPasskeyChallenge
+	}
+
+	ds, err := a.state.Take(passkeyChallengeKey(challenge))
+	if err == datastore.ErrNotFound {
+		return nil, nil, ErrPasskeyChallenge
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	c := passkeyChallenge{}
+	if err := json.Unmarshal(ds.Data, &c); err != nil || c.Expires.Time().Before(time.Now()) {
+		return nil, nil, ErrPasskeyChallenge
+	}
+
+	pk, err := a.passkeys.SelectByCredentialID(webauthn.Bytes(resp.RawID).String())
+	if err == passkeys.ErrPasskeyNotFound {
+		return nil, nil, ErrPasskeyInvalid
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	user, err := a.users.Select(pk.User)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(resp.Response.UserHandle) > 0 && !bytes.Equal(resp.Response.UserHandle, UserHandle(user)) {
+		return nil, nil, ErrPasskeyInvalid
+	}
+
+	count, err := rp.VerifyAssertion(challenge, resp, pk.PublicKey, uint32(pk.SignCount))
+	if err != nil {
+		return nil, nil, errors.Join(ErrPasskeyInvalid, err)
+	}
+
+	if err := a.passkeys.Use(pk, int64(count)); err == passkeys.ErrSignCount {
+		return nil, nil, errors.Join(ErrPasskeyInvalid, err)
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	if err := a.users.CheckLogin(user); err != nil {
+		return nil, nil, err
+	}
+
+	return user, pk, nil
+}
+
+// purgePasskeyChallenges deletes the login challenges that expired.
+func (a *Manager) purgePasskeyChallenges() (int64, error) {
+	now := types.NowDateTime()
+	t, err := now.Add(-passkeyExpiration())
+	if err != nil {
+		return 0, err
+	}
+
+	return a.state.DeletePrefixOlderThan(models.DATASTORE_PASSKEY_CHALLENGE_PREFIX, t)
+}
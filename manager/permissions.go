@@ -0,0 +1,21 @@
+package manager
+
+import (
+	"github.com/Simon-Martens/caveman/db/users"
+)
+
+// Can reports whether the user's role has the permission. Errors are logged and
+// deny the permission.
+func (a *Manager) Can(user *users.User, permission string) bool {
+	if user == nil {
+		return false
+	}
+
+	ok, err := a.roles.Has(user.Role, permission)
+	if err != nil {
+		a.Logger().Error("Failed to check permission", "user", user.ID, "permission", permission, "error", err)
+		return false
+	}
+
+	return ok
+}
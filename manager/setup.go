@@ -0,0 +1,138 @@
+package manager
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/Simon-Martens/caveman/db/datastore"
+	"github.com/Simon-Martens/caveman/db/users"
+	"github.com/Simon-Martens/caveman/models"
+)
+
+var ErrSetupDone = errors.New("setup is already done")
+var ErrSettingsInvalid = errors.New("settings invalid: name and url are required")
+
+// SetupState returns the cached setup state, see [RefreshSetupState].
+func (a *Manager) SetupState() int {
+	return int(a.setup.Load())
+}
+
+// IsSetUp reports whether the setup is done, based on the cached setup state.
+func (a *Manager) IsSetUp() bool {
+	return a.SetupState() == models.SETUP_STATE_DONE
+}
+
+// RefreshSetupState checks if there are admins and valid settings and caches the
+// resulting state, in memory and in the datastore under STORE_KEY_SETUP_STATE.
+func (a *Manager) RefreshSetupState() (int, error) {
+	hasAdmins, err := a.users.HasAdmins()
+	if err != nil {
+		return 0, err
+	}
+
+	state := models.SETUP_STATE_DONE
+	if !hasAdmins {
+		state = models.SETUP_STATE_NO_ADMIN
+	} else if !hasSettings(a.CMSettings()) {
+		state = models.SETUP_STATE_NO_SETTINGS
+	}
+
+	stored := &models.SetupState{}
+	s, err := a.state.SelectLatest(models.STORE_KEY_SETUP_STATE)
+	if err == nil {
+		err = json.Unmarshal(s.Data, stored)
+	}
+	if err != nil && err != datastore.ErrNotFound {
+		return 0, err
+	}
+
+	if stored.State != state {
+		if _, err := a.state.Insert(&models.SetupState{State: state}); err != nil {
+			return 0, err
+		}
+	}
+
+	a.setup.Store(int64(state))
+	return state, nil
+}
+
+// Setup creates the first admin and saves the settings. It fails with
+// ErrSetupDone if an admin exists already. Setups are serialized, so concurrent
+// setups create one admin. The settings are saved first: if the admin can't be
+// created, the setup is still incomplete and can be repeated.
+func (a *Manager) Setup(admin *users.User, password string, sets *models.Settings) (*users.User, error) {
+	a.setupMu.Lock()
+	defer a.setupMu.Unlock()
+
+	state, err := a.RefreshSetupState()
+	if err != nil {
+		return nil, err
+	}
+
+	if state != models.SETUP_STATE_NO_ADMIN {
+		return nil, ErrSetupDone
+	}
+
+	n := *a.CMSettings()
+	n.Name = sets.Name
+	n.URL = sets.URL
+	n.Contact = sets.Contact
+	n.Icon = sets.Icon
+	if sets.Desc != "" {
+		n.Desc = sets.Desc
+	}
+
+	if !hasSettings(&n) {
+		return nil, ErrSettingsInvalid
+	}
+
+	if err := a.UpdateSettings(&n); err != nil {
+		return nil, err
+	}
+
+	admin.Role = models.ROLE_ADMIN
+	admin.Active = true
+	admin.Verified = true
+
+	admin, err = a.users.Insert(admin, password)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := a.RefreshSetupState(); err != nil {
+		return nil, err
+	}
+
+	return admin, nil
+}
+
+// UpdateSettings stores a new revision of the settings and makes it the current one.
+func (a *Manager) UpdateSettings(sets *models.Settings) error {
+	if sets == nil {
+		return errors.New("settings are nil")
+	}
+
+	if _, err := a.state.Insert(sets); err != nil {
+		return err
+	}
+
+	a.cm_settings.Store(sets)
+	if a.users != nil {
+		a.users.RequireVerified(sets.RequireVerification)
+		a.users.RequireTwoFactor(sets.TwoFactorRoles)
+	}
+	if a.sessions != nil {
+		a.sessions.UseSlidingExpiration(sets.SessionRenewInterval)
+	}
+	if a.tokens != nil {
+		a.tokens.CountProbes(sets.CountTokenProbes)
+	}
+	if a.attempts != nil {
+		a.attempts.SetLimits(sets.RateLimit)
+	}
+	return nil
+}
+
+func hasSettings(sets *models.Settings) bool {
+	return sets != nil && sets.Name != "" && sets.URL != ""
+}
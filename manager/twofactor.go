@@ -0,0 +1,183 @@
+package manager
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/Simon-Martens/caveman/db/attempts"
+	"github.com/Simon-Martens/caveman/db/sessions"
+	"github.com/Simon-Martens/caveman/db/twofactor"
+	"github.com/Simon-Martens/caveman/db/users"
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/Simon-Martens/caveman/tools/totp"
+)
+
+var ErrTwoFactorRequired = errors.New("the role of the user requires a second factor")
+var ErrTwoFactorDisabled = errors.New("the user has no second factor")
+
+// Stages of pending login sessions, see sessions.Session.Pending.
+const (
+	PendingSecondFactor = "second_factor"
+	PendingSetup        = "second_factor_setup"
+)
+
+var totpCode = regexp.MustCompile(`^[0-9]{6}$`)
+
+// StartPendingLogin creates the pending session of a login that needs a second
+// factor, for the error of [users.UserManager.CheckGetUser]. Other errors are
+// returned as they are.
+func (a *Manager) StartPendingLogin(user *users.User, cause error, short bool, agent, ip string) (*sessions.Session, error) {
+	var stage string
+	switch cause {
+	case users.ErrSecondFactorRequired:
+		stage = PendingSecondFactor
+	case users.ErrSecondFactorSetupRequired:
+		stage = PendingSetup
+	default:
+		return nil, cause
+	}
+
+	return a.sessions.InsertPending(user.ID, stage, short, agent, ip)
+}
+
+// AuthenticatePending returns the pending session and its user, if the session
+// waits for stage. Like Authenticate, sessions of deactivated or expired users
+// are deleted.
+func (a *Manager) AuthenticatePending(token, stage string) (*sessions.Session, *users.User, error) {
+	session, err := a.sessions.SelectBySession(token)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if session.Pending() != stage {
+		return nil, nil, sessions.ErrSessionNotFound
+	}
+
+	user, err := a.users.Select(session.User)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := a.users.CheckAccount(user); err != nil {
+		if derr := a.sessions.DeleteByUser(user.ID); derr != nil {
+			return nil, nil, derr
+		}
+		return nil, nil, err
+	}
+
+	return session, user, nil
+}
+
+// CompletePendingLogin upgrades the pending session once the second factor was
+// checked or set up. Failed logins of the user are forgotten only now.
+func (a *Manager) CompletePendingLogin(session *sessions.Session, user *users.User) (*sessions.Session, error) {
+	n, err := a.sessions.Upgrade(session)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.users.Unlock(user.Email); err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+// VerifySecondFactor checks a code of the authenticator or a recovery code of
+// the user. Wrong codes count as failed logins of the user and fail with
+// twofactor.ErrInvalidCode, blocked users fail with an attempts.BlockedError.
+func (a *Manager) VerifySecondFactor(user *users.User, code string) error {
+	if !user.TwoFactor {
+		return ErrTwoFactorDisabled
+	}
+
+	key := attempts.EmailKey(user.Email)
+	if err := a.attempts.Check(key); err != nil {
+		return err
+	}
+
+	code = strings.TrimSpace(code)
+
+	var err error
+	if totpCode.MatchString(code) {
+		err = a.twofac.Verify(user.ID, code)
+	} else {
+		err = a.twofac.UseRecoveryCode(user.ID, code)
+	}
+
+	if err == twofactor.ErrInvalidCode || err == twofactor.ErrTOTPNotFound {
+		if _, ferr := a.attempts.Fail(key, true); ferr != nil {
+			return ferr
+		}
+		return twofactor.ErrInvalidCode
+	}
+
+	return err
+}
+
+// SetupTOTP creates a new authenticator for the user and returns it with its
+// provisioning URI, which authenticator apps read from a QR code. It must be
+// confirmed with EnableTOTP. Users with a second factor must disable it first.
+func (a *Manager) SetupTOTP(user *users.User) (*twofactor.TOTP, string, error) {
+	if user.TwoFactor {
+		return nil, "", twofactor.ErrTOTPConfirmed
+	}
+
+	t, err := a.twofac.Setup(user.ID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	issuer := ""
+	if sets := a.CMSettings(); sets != nil {
+		issuer = sets.Name
+	}
+
+	return t, totp.URI(issuer, user.Email, t.Secret), nil
+}
+
+// EnableTOTP confirms the authenticator of the user with a valid code, which
+// enables the second factor. It returns new recovery codes, which are only
+// known now.
+func (a *Manager) EnableTOTP(user *users.User, code string) ([]string, error) {
+	if err := a.twofac.Confirm(user.ID, code); err != nil {
+		return nil, err
+	}
+
+	if err := a.users.SetTwoFactor(user, true); err != nil {
+		return nil, err
+	}
+
+	return a.twofac.GenerateRecoveryCodes(user.ID, models.DEFAULT_RECOVERY_CODES)
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the user.
+func (a *Manager) RegenerateRecoveryCodes(user *users.User) ([]string, error) {
+	if !user.TwoFactor {
+		return nil, ErrTwoFactorDisabled
+	}
+
+	return a.twofac.GenerateRecoveryCodes(user.ID, models.DEFAULT_RECOVERY_CODES)
+}
+
+// DisableTOTP removes the second factor of the user, unless the role of the user
+// requires it.
+func (a *Manager) DisableTOTP(user *users.User) error {
+	if a.users.IsTwoFactorRequired(user) {
+		return ErrTwoFactorRequired
+	}
+
+	return a.ResetTwoFactor(user)
+}
+
+// ResetTwoFactor removes the second factor of the user, eg. by an admin after
+// the user lost the authenticator and the recovery codes. If the role requires a
+// second factor, the user has to set up a new one at the next login.
+func (a *Manager) ResetTwoFactor(user *users.User) error {
+	if err := a.twofac.Delete(user.ID); err != nil {
+		return err
+	}
+
+	return a.users.SetTwoFactor(user, false)
+}
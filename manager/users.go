@@ -0,0 +1,149 @@
+package manager
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Simon-Martens/caveman/db/apitokens"
+	"github.com/Simon-Martens/caveman/db/roles"
+	"github.com/Simon-Martens/caveman/db/sessions"
+	"github.com/Simon-Martens/caveman/db/users"
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/Simon-Martens/caveman/tools/types"
+)
+
+var ErrInvalidDuration = errors.New("duration must be positive")
+var ErrLastAdmin = errors.New("the last admin can't be demoted")
+
+// Authenticate returns the session and its user. Sessions of deactivated or
+// expired users are deleted and fail with the error of [users.UserManager.CheckAccount].
+// Pending sessions fail with sessions.ErrSessionPending, see AuthenticatePending.
+func (a *Manager) Authenticate(token string) (*sessions.Session, *users.User, error) {
+	session, err := a.sessions.SelectBySession(token)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if session.Pending() != "" {
+		return nil, nil, sessions.ErrSessionPending
+	}
+
+	user, err := a.users.Select(session.User)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := a.users.CheckAccount(user); err != nil {
+		if derr := a.sessions.DeleteByUser(user.ID); derr != nil {
+			return nil, nil, derr
+		}
+		return nil, nil, err
+	}
+
+	return session, user, nil
+}
+
+// AuthenticateAPIToken returns the API token and its user. Tokens of deactivated
+// or expired users fail with the error of [users.UserManager.CheckAccount], but
+// are kept, so they work again once the account is reactivated.
+//
+// The last use of the token is recorded at most once every
+// DEFAULT_LAST_SEEN_INTERVAL seconds.
+func (a *Manager) AuthenticateAPIToken(token string) (*apitokens.APIToken, *users.User, error) {
+	at, err := a.apitoks.SelectByToken(token)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user, err := a.users.Select(at.User)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := a.users.CheckAccount(user); err != nil {
+		return nil, nil, err
+	}
+
+	interval := time.Duration(models.DEFAULT_LAST_SEEN_INTERVAL) * time.Second
+	if at.LastUsed.IsZero() || time.Since(*at.LastUsed.Time()) > interval {
+		if err := a.apitoks.UpdateLastUsed(at); err != nil {
+			a.Logger().Error("Failed to update last use of API token", "token", at.ID, "error", err)
+		}
+	}
+
+	return at, user, nil
+}
+
+// ChangeRole sets the role of the user. Since the privileges of the user change,
+// all sessions of the user are ended, except current, which gets a new token.
+// The new current session is returned; it is nil if current is nil or belongs
+// to another user.
+func (a *Manager) ChangeRole(user *users.User, role string, current *sessions.Session) (*sessions.Session, error) {
+	if !a.roles.IsRole(role) {
+		return nil, roles.ErrRoleNotFound
+	}
+
+	if user.Role == models.ROLE_ADMIN && role != models.ROLE_ADMIN {
+		c, err := a.users.CountByRole(models.ROLE_ADMIN)
+		if err != nil {
+			return nil, err
+		}
+
+		if c < 2 {
+			return nil, ErrLastAdmin
+		}
+	}
+
+	if err := a.users.SetRole(user, role); err != nil {
+		return nil, err
+	}
+
+	if current == nil || current.User != user.ID {
+		return nil, a.sessions.DeleteByUser(user.ID)
+	}
+
+	if err := a.sessions.DeleteByUserExcept(user.ID, current.Session); err != nil {
+		return nil, err
+	}
+
+	return a.sessions.Rotate(current)
+}
+
+// DeactivateUser deactivates the user and ends all sessions of the user.
+func (a *Manager) DeactivateUser(user *users.User) error {
+	if err := a.users.SetActive(user, false); err != nil {
+		return err
+	}
+
+	return a.sessions.DeleteByUser(user.ID)
+}
+
+// ActivateUser reactivates a deactivated user.
+func (a *Manager) ActivateUser(user *users.User) error {
+	return a.users.SetActive(user, true)
+}
+
+// ExtendUser moves the expiration of the user by d. The expiration of already
+// expired users is moved from now.
+func (a *Manager) ExtendUser(user *users.User, d time.Duration) error {
+	if d <= 0 {
+		return ErrInvalidDuration
+	}
+
+	// Users without an expiration never expire
+	if user.Expires.IsZero() {
+		return nil
+	}
+
+	from := user.Expires
+	if user.IsExpired() {
+		from = types.NowDateTime()
+	}
+
+	exp, err := from.Add(d)
+	if err != nil {
+		return err
+	}
+
+	return a.users.SetExpires(user, exp)
+}
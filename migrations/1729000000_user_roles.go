@@ -0,0 +1,29 @@
+package migrations
+
+import (
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/pocketbase/dbx"
+)
+
+// Users had integer roles, where 3 was the admin role. This maps them onto the
+// named roles; all other integers become the default role.
+func init() {
+	Register(func(db dbx.Builder) error {
+		tn := db.QuoteSimpleTableName(models.DEFAULT_USERS_TABLE)
+
+		_, err := db.NewQuery(
+			"UPDATE " + tn + " SET role = CASE WHEN CAST(role AS INTEGER) >= 3 THEN {:admin} ELSE {:user} END " +
+				"WHERE typeof(role) = 'integer' OR role GLOB '[0-9]*' OR role IS NULL OR role = ''").
+			Bind(dbx.Params{"admin": models.ROLE_ADMIN, "user": models.DEFAULT_ROLE}).
+			Execute()
+		return err
+	}, func(db dbx.Builder) error {
+		tn := db.QuoteSimpleTableName(models.DEFAULT_USERS_TABLE)
+
+		_, err := db.NewQuery(
+			"UPDATE " + tn + " SET role = CASE WHEN role = {:admin} THEN 3 ELSE 0 END").
+			Bind(dbx.Params{"admin": models.ROLE_ADMIN}).
+			Execute()
+		return err
+	})
+}
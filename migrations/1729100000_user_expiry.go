@@ -0,0 +1,23 @@
+package migrations
+
+import (
+	"time"
+
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/pocketbase/dbx"
+)
+
+// The user expiration was never set, so users were created with expires = created,
+// which now means they are expired. This gives them the default expiration.
+func init() {
+	Register(func(db dbx.Builder) error {
+		tn := db.QuoteSimpleTableName(models.DEFAULT_USERS_TABLE)
+		exp := (time.Duration(models.DEFAULT_USER_EXPIRATION) * time.Second).Microseconds()
+
+		_, err := db.NewQuery(
+			"UPDATE " + tn + " SET expires = created + {:exp} WHERE expires = created").
+			Bind(dbx.Params{"exp": exp}).
+			Execute()
+		return err
+	}, nil)
+}
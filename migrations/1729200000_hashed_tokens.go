@@ -0,0 +1,65 @@
+package migrations
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/Simon-Martens/caveman/tools/security"
+	"github.com/pocketbase/dbx"
+)
+
+// Sessions and access tokens were stored in plain text. This replaces them with
+// their digest, so the tokens held by clients stay valid. There is no way back.
+// Tokens are base64 encoded, so values that are hex digests already are kept.
+func init() {
+	Register(func(db dbx.Builder) error {
+		if err := hashTokens(db, models.DEFAULT_SESSIONS_TABLE, "session"); err != nil {
+			return err
+		}
+
+		return hashTokens(db, models.DEFAULT_ACCESS_TOKENS_TABLE, "token")
+	}, nil)
+}
+
+func hashTokens(db dbx.Builder, table, column string) error {
+	tn := db.QuoteSimpleTableName(table)
+
+	rows := []struct {
+		ID    int64  `db:"id"`
+		Token string `db:"token"`
+	}{}
+
+	err := db.NewQuery(
+		"SELECT " + models.DEFAULT_ID_FIELD + " AS id, " + column + " AS token FROM " + tn).
+		All(&rows)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range rows {
+		if isDigest(r.Token) {
+			continue
+		}
+
+		_, err := db.NewQuery(
+			"UPDATE " + tn + " SET " + column + " = {:hash} WHERE " + models.DEFAULT_ID_FIELD + " = {:id}").
+			Bind(dbx.Params{"hash": security.HashToken(r.Token), "id": r.ID}).
+			Execute()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isDigest reports whether s is a hex encoded SHA-256 digest, see HashToken.
+func isDigest(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
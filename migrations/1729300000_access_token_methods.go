@@ -0,0 +1,26 @@
+package migrations
+
+import (
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/pocketbase/dbx"
+)
+
+// Access tokens can be restricted to HTTP methods. Tables created before lack the
+// column; tables created since have it already.
+func init() {
+	Register(func(db dbx.Builder) error {
+		tn := db.QuoteSimpleTableName(models.DEFAULT_ACCESS_TOKENS_TABLE)
+
+		c := models.Count{}
+		err := db.NewQuery(
+			"SELECT COUNT(*) AS count FROM pragma_table_info({:table}) WHERE name = 'methods'").
+			Bind(dbx.Params{"table": models.DEFAULT_ACCESS_TOKENS_TABLE}).
+			One(&c)
+		if err != nil || c.Count > 0 {
+			return err
+		}
+
+		_, err = db.NewQuery("ALTER TABLE " + tn + " ADD COLUMN methods TEXT DEFAULT '[]'").Execute()
+		return err
+	}, nil)
+}
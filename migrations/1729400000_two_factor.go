@@ -0,0 +1,13 @@
+package migrations
+
+import (
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/pocketbase/dbx"
+)
+
+// Users record whether they have a second factor, see twofactor.
+func init() {
+	Register(func(db dbx.Builder) error {
+		return addColumn(db, models.DEFAULT_USERS_TABLE, "two_factor", "BOOLEAN DEFAULT FALSE")
+	}, nil)
+}
@@ -0,0 +1,57 @@
+package migrations
+
+import (
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/pocketbase/dbx"
+)
+
+// Access tokens can be created before a login, eg. for the state of an OAuth2
+// login, so their creator is optional. SQLite can't drop the NOT NULL constraint
+// of a column, so tables created before are rebuilt.
+func init() {
+	Register(func(db dbx.Builder) error {
+		c := models.Count{}
+		err := db.NewQuery(
+			"SELECT COUNT(*) AS count FROM pragma_table_info({:table}) WHERE name = 'creator_id' AND \"notnull\" = 1").
+			Bind(dbx.Params{"table": models.DEFAULT_ACCESS_TOKENS_TABLE}).
+			One(&c)
+		if err != nil || c.Count == 0 {
+			return err
+		}
+
+		table := models.DEFAULT_ACCESS_TOKENS_TABLE
+		id := models.DEFAULT_ID_FIELD
+		tn := db.QuoteSimpleTableName(table)
+		tmp := db.QuoteSimpleTableName(table + "_new")
+		utn := db.QuoteSimpleTableName(models.DEFAULT_USERS_TABLE)
+		columns := id + ", token, token_data, path, methods, created, uses, modified, expires, creator_id"
+
+		queries := []string{
+			"CREATE TABLE " + tmp + " (" + id + " INTEGER PRIMARY KEY NOT NULL, " +
+				"token TOKEN NOT NULL COLLATE BINARY, " +
+				"token_data TEXT, " +
+				"path STRING NOT NULL, " +
+				"methods TEXT DEFAULT '[]', " +
+				"created INTEGER DEFAULT 0, " +
+				"uses INTEGER DEFAULT 99999999, " +
+				"modified INTEGER DEFAULT 0, " +
+				"expires INTEGER DEFAULT 0, " +
+				"creator_id INTEGER, " +
+				"FOREIGN KEY(creator_id) REFERENCES " + utn + "(" + id + "));",
+			"INSERT INTO " + tmp + " (" + columns + ") SELECT " + columns + " FROM " + tn,
+			"DROP TABLE " + tn,
+			"ALTER TABLE " + tmp + " RENAME TO " + db.QuoteSimpleTableName(table),
+			"CREATE UNIQUE INDEX IF NOT EXISTS " + table + "_token_idx ON " + tn + " (token)",
+			"CREATE INDEX IF NOT EXISTS " + table + "_creator_id_idx ON " + tn + " (creator_id)",
+			"CREATE INDEX IF NOT EXISTS " + table + "_path_idx ON " + tn + " (path)",
+		}
+
+		for _, q := range queries {
+			if _, err := db.NewQuery(q).Execute(); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}, nil)
+}
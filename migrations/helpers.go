@@ -0,0 +1,24 @@
+package migrations
+
+import (
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/pocketbase/dbx"
+)
+
+// addColumn adds the column to the table, unless the table has it already, eg.
+// because the table was created after the column was introduced.
+func addColumn(db dbx.Builder, table, column, definition string) error {
+	c := models.Count{}
+	err := db.NewQuery(
+		"SELECT COUNT(*) AS count FROM pragma_table_info({:table}) WHERE name = {:column}").
+		Bind(dbx.Params{"table": table, "column": column}).
+		One(&c)
+	if err != nil || c.Count > 0 {
+		return err
+	}
+
+	_, err = db.NewQuery(
+		"ALTER TABLE " + db.QuoteSimpleTableName(table) + " ADD COLUMN " + db.QuoteSimpleColumnName(column) + " " + definition).
+		Execute()
+	return err
+}
@@ -3,8 +3,8 @@ package models
 import "github.com/Simon-Martens/caveman/tools/types"
 
 type Record struct {
-	Created  types.DateTime `db:"created"`
-	Modified types.DateTime `db:"modified"`
+	Created  types.DateTime `db:"created" json:"created"`
+	Modified types.DateTime `db:"modified" json:"modified"`
 }
 
 func NewRecord() Record {
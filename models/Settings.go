@@ -10,6 +10,32 @@ type Settings struct {
 	Edition string `json:"edition"`
 	Contact string `json:"contact"`
 
+	// Registration enables self-registration of new users.
+	Registration bool `json:"registration"`
+
+	// RequireVerification blocks users from logging in until they verified their email.
+	RequireVerification bool `json:"require_verification"`
+
+	// SessionRenewInterval enables sliding session expiration: sessions in use are
+	// renewed at most once every SessionRenewInterval seconds. 0 disables it.
+	SessionRenewInterval int `json:"session_renew_interval"`
+
+	// CountTokenProbes makes presenting an access token for a method or path it
+	// is not valid for use up one of its uses. Otherwise the token is left as is.
+	CountTokenProbes bool `json:"count_token_probes"`
+
+	// TwoFactorRoles are the roles that require a second factor. Users with these
+	// roles without one have to set it up during their next login.
+	TwoFactorRoles []string `json:"two_factor_roles"`
+
+	// RateLimit throttles failed logins, it is enabled unless disabled.
+	RateLimit RateLimitSettings `json:"rate_limit"`
+
+	// Outgoing mail. If SMTP is not enabled, mails are written to the data dir.
+	SenderName    string       `json:"sender_name"`
+	SenderAddress string       `json:"sender_address"`
+	SMTP          SMTPSettings `json:"smtp"`
+
 	UserSeed    uint64 `json:"user_seed"`
 	SessionSeed uint64 `json:"session_seed"`
 }
@@ -20,14 +46,77 @@ func (s *Settings) Key() string {
 
 func DefaultSettings() *Settings {
 	return &Settings{
-		URL:         "http://localhost:8080",
+		URL:           "http://localhost:8080",
+		SenderName:    "Caveman",
+		SenderAddress: "noreply@localhost",
+		SMTP: SMTPSettings{
+			Host: "localhost",
+			Port: 587,
+		},
 		UserSeed:    security.GenRandomUIntNotPrime(),
 		SessionSeed: security.GenRandomUIntNotPrime(),
 	}
 }
 
+// RateLimitSettings limit failed attempts per IP and per email. After FreeAttempts
+// failures, further attempts are blocked for Backoff seconds, doubling with every
+// failure up to MaxBackoff. After LockoutAttempts failures of an email the account
+// is locked for LockoutDuration seconds. Failures are forgotten Window seconds
+// after the last one. Unset values are replaced with the defaults, a negative
+// LockoutAttempts disables the lockout.
+type RateLimitSettings struct {
+	Disabled        bool `json:"disabled"`
+	FreeAttempts    int  `json:"free_attempts"`
+	Backoff         int  `json:"backoff"`
+	MaxBackoff      int  `json:"max_backoff"`
+	LockoutAttempts int  `json:"lockout_attempts"`
+	LockoutDuration int  `json:"lockout_duration"`
+	Window          int  `json:"window"`
+}
+
+// WithDefaults returns the settings with unset values replaced by the defaults.
+func (r RateLimitSettings) WithDefaults() RateLimitSettings {
+	def := func(v *int, d int) {
+		if *v == 0 {
+			*v = d
+		}
+	}
+
+	def(&r.FreeAttempts, DEFAULT_LOGIN_FREE_ATTEMPTS)
+	def(&r.Backoff, DEFAULT_LOGIN_BACKOFF)
+	def(&r.MaxBackoff, DEFAULT_LOGIN_MAX_BACKOFF)
+	def(&r.LockoutAttempts, DEFAULT_LOGIN_LOCKOUT_ATTEMPTS)
+	def(&r.LockoutDuration, DEFAULT_LOGIN_LOCKOUT_DURATION)
+	def(&r.Window, DEFAULT_LOGIN_FAILURE_WINDOW)
+	return r
+}
+
+type SMTPSettings struct {
+	Enabled  bool   `json:"enabled"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	TLS      bool   `json:"tls"`
+}
+
 type Config struct {
 	*Settings
 	Dev     bool   `json:"dev"`
 	DataDir string `json:"data"`
+
+	// HTTP server settings. These are startup settings, they are not stored in the DB.
+	// If CertFile and KeyFile are set, the server is started with TLS.
+	// Timeouts are given in seconds.
+	Address         string `json:"address"`
+	CertFile        string `json:"cert_file"`
+	KeyFile         string `json:"key_file"`
+	ReadTimeout     int    `json:"read_timeout"`
+	WriteTimeout    int    `json:"write_timeout"`
+	IdleTimeout     int    `json:"idle_timeout"`
+	ShutdownTimeout int    `json:"shutdown_timeout"`
+
+	// TrustedProxies are the IPs or CIDR ranges of reverse proxies. Only requests
+	// from these proxies may set the client IP with X-Forwarded-For.
+	TrustedProxies []string `json:"trusted_proxies"`
 }
@@ -0,0 +1,17 @@
+package models
+
+// The setup states of an application. While there is no admin, the application
+// only serves the setup routes.
+const (
+	SETUP_STATE_NO_ADMIN    int = 1
+	SETUP_STATE_NO_SETTINGS int = 2
+	SETUP_STATE_DONE        int = 3
+)
+
+type SetupState struct {
+	State int `json:"state"`
+}
+
+func (s *SetupState) Key() string {
+	return STORE_KEY_SETUP_STATE
+}
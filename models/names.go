@@ -7,6 +7,10 @@ var (
 	VERSION                       = "0.1.0"
 	STORE_KEY_SETUP_STATE         = "setup"
 	DATASTORE_SETTINGS_KEY string = "sets"
+	DATASTORE_HMAC_KEY     string = "hmac"
+
+	// Prefix of the keys of passkey login challenges, see manager.BeginPasskeyLogin
+	DATASTORE_PASSKEY_CHALLENGE_PREFIX string = "passkey:"
 
 	DEFAULT_DATA_MAX_OPEN_CONNS int = 120
 	DEFAULT_DATA_MAX_IDLE_CONNS int = 20
@@ -15,6 +19,7 @@ var (
 
 	DEFAULT_LOCAL_STORAGE_DIR string = "storage"
 	DEFAULT_BACKUPS_DIR       string = "backups"
+	DEFAULT_MAILS_DIR         string = "mails"
 
 	// NOTE: true for dev purposes
 	DEFAULT_DEV_MODE      bool   = true
@@ -24,12 +29,20 @@ var (
 	DEFAULT_LOGS_FILE     string = "logs.db"
 	DEFAULT_USER_FILE     string = "data.db"
 
-	DEFAULT_SESSIONS_TABLE      string = "__sessions"
-	DEFAULT_ACCESS_TOKENS_TABLE string = "__access_tokens"
-	DEFAULT_USERS_TABLE         string = "__users"
-	DEFAULT_MIGRATIONS_TABLE    string = "__migrations"
-	DEFAULT_DATASTORE_TABLE     string = "__datastore"
-	DEFAULT_ID_FIELD            string = "id"
+	DEFAULT_SESSIONS_TABLE       string = "__sessions"
+	DEFAULT_ACCESS_TOKENS_TABLE  string = "__access_tokens"
+	DEFAULT_USERS_TABLE          string = "__users"
+	DEFAULT_MIGRATIONS_TABLE     string = "__migrations"
+	DEFAULT_DATASTORE_TABLE      string = "__datastore"
+	DEFAULT_ROLES_TABLE          string = "__role_permissions"
+	DEFAULT_JOBS_TABLE           string = "__jobs"
+	DEFAULT_API_TOKENS_TABLE     string = "__api_tokens"
+	DEFAULT_ATTEMPTS_TABLE       string = "__attempts"
+	DEFAULT_TOTP_TABLE           string = "__totp"
+	DEFAULT_RECOVERY_CODES_TABLE string = "__recovery_codes"
+	DEFAULT_PASSKEYS_TABLE       string = "__passkeys"
+	DEFAULT_IDENTITIES_TABLE     string = "__identities"
+	DEFAULT_ID_FIELD             string = "id"
 
 	DEFAULT_USER_EXPIRATION          int = 60 * 60 * 24 * (365 * 10) // ~10 years
 	DEFAULT_SHORT_SESSION_EXPIRATION int = 60 * 60 * 2               // 2 hours
@@ -38,4 +51,53 @@ var (
 
 	DEFAULT_LONG_RESOURCE_SESSION_EXPIRATION  int = 60 * 60 * 24 * 7 // 7 days
 	DEFAULT_SHORT_RESOURCE_SESSION_EXPIRATION int = 60 * 60 * 6      // 6 hours
+	DEFAULT_VERIFICATION_EXPIRATION           int = 60 * 60 * 24 * 3 // 3 days
+	DEFAULT_PASSWORD_RESET_EXPIRATION         int = 60 * 60          // 1 hour
+	DEFAULT_MAIL_COOLDOWN                     int = 60 * 5           // 5 minutes between two reset or verification mails
+	DEFAULT_PENDING_SESSION_EXPIRATION        int = 60 * 5           // 5 minutes, to enter the second factor
+	DEFAULT_PASSKEY_CHALLENGE_EXPIRATION      int = 60 * 5           // 5 minutes, to use the authenticator
+	DEFAULT_OAUTH2_STATE_EXPIRATION           int = 60 * 10          // 10 minutes, to log in at the provider
+	DEFAULT_INVITE_EXPIRATION                 int = 60 * 60 * 24 * 7 // 7 days, to accept an invite
+
+	DEFAULT_HTTP_ADDRESS          string = "127.0.0.1:8080"
+	DEFAULT_HTTP_READ_TIMEOUT     int    = 30  // seconds
+	DEFAULT_HTTP_WRITE_TIMEOUT    int    = 60  // seconds
+	DEFAULT_HTTP_IDLE_TIMEOUT     int    = 120 // seconds
+	DEFAULT_HTTP_SHUTDOWN_TIMEOUT int    = 10  // seconds
+
+	DEFAULT_SESSION_COOKIE_NAME string = "cm_session"
+	DEFAULT_LAST_SEEN_INTERVAL  int    = 60 // seconds, min. time between two LastSeen updates of a user
+
+	DEFAULT_CSRF_COOKIE_NAME string = "cm_csrf"
+	DEFAULT_CSRF_HEADER      string = "X-CSRF-Token"
+	DEFAULT_CSRF_FORM_FIELD  string = "csrf_token"
+
+	// Binds the state of an OAuth2 login to the browser that started it
+	DEFAULT_OAUTH2_COOKIE_NAME string = "cm_oauth2"
+
+	DEFAULT_MIN_PASSWORD_LENGTH int = 8
+	DEFAULT_RECOVERY_CODES      int = 10 // per user, for logins without the authenticator
+
+	// Limits for failed logins, see RateLimitSettings
+	DEFAULT_LOGIN_FREE_ATTEMPTS    int = 5
+	DEFAULT_LOGIN_BACKOFF          int = 1      // seconds
+	DEFAULT_LOGIN_MAX_BACKOFF      int = 60 * 5 // 5 minutes
+	DEFAULT_LOGIN_LOCKOUT_ATTEMPTS int = 20
+	DEFAULT_LOGIN_LOCKOUT_DURATION int = 60 * 15 // 15 minutes
+	DEFAULT_LOGIN_FAILURE_WINDOW   int = 60 * 60 // 1 hour
+
+	API_TOKEN_PREFIX          string = "cm_" // makes API tokens recognizable, eg. for secret scanners
+	API_TOKEN_ALL_PERMISSIONS string = "*"   // grants an API token all permissions of its user
+
+	DEFAULT_JANITOR_SCHEDULE    string = "@hourly"
+	DEFAULT_JANITOR_JOB         string = "janitor"
+	DEFAULT_DATASTORE_RETENTION int    = 20      // revisions kept per datastore key
+	DEFAULT_JOB_TIMEOUT         int    = 60 * 60 // 1 hour, runs are cancelled after and their locks are stale
+
+	// Built-in roles and permissions, apps can register more, see roles.RoleManager
+	ROLE_ADMIN                 string = "admin"
+	ROLE_USER                  string = "user"
+	DEFAULT_ROLE               string = ROLE_USER
+	PERMISSION_MANAGE_USERS    string = "users.manage"
+	PERMISSION_MANAGE_SETTINGS string = "settings.manage"
 )
@@ -0,0 +1,232 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidSpec = errors.New("invalid schedule")
+
+// Schedule returns the time of the next run after t. The zero time means that
+// the schedule never runs again.
+type Schedule interface {
+	Next(t time.Time) time.Time
+}
+
+// Parse parses a schedule. Supported are
+//
+//   - cron expressions with five fields: minute, hour, day of month, month and
+//     day of week. Fields may be *, values, ranges (1-5), steps (*/15, 1-30/2)
+//     and comma separated lists of these. Months and weekdays may be given
+//     by their english three letter names. Sunday is 0 or 7.
+//   - the macros @yearly (or @annually), @monthly, @weekly, @daily (or
+//     @midnight) and @hourly.
+//   - @every <duration>, eg. @every 90s, see time.ParseDuration.
+//
+// Like in cron, if both day of month and day of week are restricted, a day
+// matches if either matches.
+func Parse(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+
+	if d, ok := strings.CutPrefix(spec, "@every "); ok {
+		dur, err := time.ParseDuration(strings.TrimSpace(d))
+		if err != nil || dur < time.Second {
+			return nil, fmt.Errorf("%w: %q: the interval must be at least a second", ErrInvalidSpec, spec)
+		}
+		return Every(dur), nil
+	}
+
+	switch spec {
+	case "@yearly", "@annually":
+		spec = "0 0 1 1 *"
+	case "@monthly":
+		spec = "0 0 1 * *"
+	case "@weekly":
+		spec = "0 0 * * 0"
+	case "@daily", "@midnight":
+		spec = "0 0 * * *"
+	case "@hourly":
+		spec = "0 * * * *"
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%w: %q: expected 5 fields", ErrInvalidSpec, spec)
+	}
+
+	c := &Cron{}
+	var err error
+
+	if c.minute, err = parseField(fields[0], minutes); err != nil {
+		return nil, fmt.Errorf("%w: %q: minute: %w", ErrInvalidSpec, spec, err)
+	}
+
+	if c.hour, err = parseField(fields[1], hours); err != nil {
+		return nil, fmt.Errorf("%w: %q: hour: %w", ErrInvalidSpec, spec, err)
+	}
+
+	if c.dom, err = parseField(fields[2], doms); err != nil {
+		return nil, fmt.Errorf("%w: %q: day of month: %w", ErrInvalidSpec, spec, err)
+	}
+
+	if c.month, err = parseField(fields[3], months); err != nil {
+		return nil, fmt.Errorf("%w: %q: month: %w", ErrInvalidSpec, spec, err)
+	}
+
+	if c.dow, err = parseField(fields[4], dows); err != nil {
+		return nil, fmt.Errorf("%w: %q: day of week: %w", ErrInvalidSpec, spec, err)
+	}
+
+	// Sunday may be given as 7
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+
+	c.anyDom = strings.HasPrefix(fields[2], "*")
+	c.anyDow = strings.HasPrefix(fields[4], "*")
+
+	return c, nil
+}
+
+// Every is a schedule that runs in a fixed interval, counted from the last run.
+type Every time.Duration
+
+func (e Every) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(e))
+}
+
+// Cron is a schedule parsed from a cron expression, see Parse. Every field is a
+// bit set of the matching values.
+type Cron struct {
+	minute, hour, dom, month, dow uint64
+	anyDom, anyDow                bool
+}
+
+// Next returns the first matching minute after t, in the location of t.
+func (c *Cron) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+
+	// Impossible expressions, eg. the 30th of February, never match. After some
+	// years we know.
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if !c.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = t.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
+
+func (c *Cron) matchDay(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+
+	if !c.anyDom && !c.anyDow {
+		return dom || dow
+	}
+
+	return dom && dow
+}
+
+type bounds struct {
+	min, max int
+	names    map[string]int
+}
+
+var (
+	minutes = bounds{0, 59, nil}
+	hours   = bounds{0, 23, nil}
+	doms    = bounds{1, 31, nil}
+	months  = bounds{1, 12, map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	dows = bounds{0, 7, map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+func parseField(field string, b bounds) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(field, ",") {
+		r, step, hasStep := strings.Cut(part, "/")
+
+		n := 1
+		if hasStep {
+			var err error
+			n, err = strconv.Atoi(step)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step %q", step)
+			}
+		}
+
+		var lo, hi int
+		if r == "*" {
+			lo, hi = b.min, b.max
+		} else {
+			l, h, isRange := strings.Cut(r, "-")
+
+			var err error
+			if lo, err = parseValue(l, b); err != nil {
+				return 0, err
+			}
+
+			hi = lo
+			if isRange {
+				if hi, err = parseValue(h, b); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				// 5/10 means from 5 to the end, every 10
+				hi = b.max
+			}
+
+			if hi < lo {
+				return 0, fmt.Errorf("invalid range %q", r)
+			}
+		}
+
+		for i := lo; i <= hi; i += n {
+			bits |= 1 << uint(i)
+		}
+	}
+
+	return bits, nil
+}
+
+func parseValue(s string, b bounds) (int, error) {
+	if v, ok := b.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+
+	v, err := strconv.Atoi(s)
+	if err != nil || v < b.min || v > b.max {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+
+	return v, nil
+}
@@ -0,0 +1,75 @@
+package scheduler_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Simon-Martens/caveman/scheduler"
+)
+
+func TestParseNext(t *testing.T) {
+	// Wednesday
+	from := time.Date(2024, time.May, 15, 10, 17, 30, 0, time.UTC)
+
+	scenarios := []struct {
+		spec     string
+		expected time.Time
+	}{
+		{"* * * * *", time.Date(2024, time.May, 15, 10, 18, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, time.May, 15, 10, 30, 0, 0, time.UTC)},
+		{"5,10 * * * *", time.Date(2024, time.May, 15, 11, 5, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", time.Date(2024, time.May, 15, 13, 0, 0, 0, time.UTC)},
+		{"30 2 * * *", time.Date(2024, time.May, 16, 2, 30, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2024, time.June, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * mon", time.Date(2024, time.May, 20, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, time.May, 19, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 feb *", time.Date(2028, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		// Day of month or day of week, if both are restricted
+		{"0 0 20 * fri", time.Date(2024, time.May, 17, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, time.May, 15, 11, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, time.May, 16, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2024, time.May, 19, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"@every 90s", from.Add(90 * time.Second)},
+		// Never
+		{"0 0 30 feb *", time.Time{}},
+	}
+
+	for _, s := range scenarios {
+		schedule, err := scheduler.Parse(s.spec)
+		if err != nil {
+			t.Errorf("(%s) Unexpected error %v", s.spec, err)
+			continue
+		}
+
+		if next := schedule.Next(from); !next.Equal(s.expected) {
+			t.Errorf("(%s) Expected %v, got %v", s.spec, s.expected, next)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	scenarios := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"10-5 * * * *",
+		"a * * * *",
+		"@every 1ms",
+		"@every soon",
+		"@sometimes",
+	}
+
+	for _, spec := range scenarios {
+		if _, err := scheduler.Parse(spec); !errors.Is(err, scheduler.ErrInvalidSpec) {
+			t.Errorf("(%q) Expected ErrInvalidSpec, got %v", spec, err)
+		}
+	}
+}
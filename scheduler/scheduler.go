@@ -0,0 +1,377 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Simon-Martens/caveman/db/jobs"
+	"github.com/Simon-Martens/caveman/models"
+)
+
+var ErrJobExists = errors.New("job already registered")
+var ErrJobNotFound = errors.New("job not registered")
+var ErrJobRunning = errors.New("job is already running")
+var ErrNoStore = errors.New("scheduler has no job store")
+var ErrStarted = errors.New("scheduler already started")
+
+// Func is the work of a job. The context is cancelled when the job times out or
+// the scheduler is stopped.
+type Func func(ctx context.Context) error
+
+// Job is a registered job.
+type Job struct {
+	Name string
+	// Spec is the schedule of the job, see Parse.
+	Spec string
+	// Timeout cancels the context of a run. A run holds the lock of the job at
+	// most this long, so a crashed process does not block the job forever.
+	// 0 means models.DEFAULT_JOB_TIMEOUT.
+	Timeout time.Duration
+	Func    Func
+}
+
+type entry struct {
+	Job
+	schedule Schedule
+	next     time.Time
+	running  bool
+}
+
+// Scheduler runs registered jobs on their schedule. The state of the jobs is
+// persisted with a jobs.JobManager: a run that was due while no scheduler was
+// running is made up for once on Start, and a job never runs twice at the same
+// time, even if triggered from another process.
+type Scheduler struct {
+	mu      sync.Mutex
+	jobs    map[string]*entry
+	store   *jobs.JobManager
+	logger  *slog.Logger
+	wake    chan struct{}
+	cancel  context.CancelFunc
+	running sync.WaitGroup
+}
+
+func New() *Scheduler {
+	return &Scheduler{
+		jobs:   map[string]*entry{},
+		logger: slog.Default(),
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// Register registers a job with the default timeout.
+func (s *Scheduler) Register(name, spec string, f Func) error {
+	return s.Add(Job{Name: name, Spec: spec, Func: f})
+}
+
+// Add registers a job. Jobs can be added before and after Start.
+func (s *Scheduler) Add(job Job) error {
+	if job.Name == "" || job.Func == nil {
+		return errors.New("job name or func is empty")
+	}
+
+	schedule, err := Parse(job.Spec)
+	if err != nil {
+		return err
+	}
+
+	if job.Timeout <= 0 {
+		job.Timeout = time.Duration(models.DEFAULT_JOB_TIMEOUT) * time.Second
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.jobs[job.Name]; ok {
+		return ErrJobExists
+	}
+
+	e := &entry{Job: job, schedule: schedule}
+
+	if s.store != nil {
+		if err := s.load(e, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	s.jobs[job.Name] = e
+	s.notify()
+
+	return nil
+}
+
+// UseStore sets the store of the job states and creates the records of the
+// registered jobs. nil detaches the store, the scheduler must be stopped then.
+func (s *Scheduler) UseStore(store *jobs.JobManager) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if store == nil {
+		s.store = nil
+		return nil
+	}
+
+	s.store = store
+
+	now := time.Now()
+	for _, e := range s.jobs {
+		if err := s.load(e, now); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UseLogger sets the logger for failed and skipped runs.
+func (s *Scheduler) UseLogger(logger *slog.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.logger = logger
+}
+
+// load reads the next run of the job from the store. s.mu must be held.
+func (s *Scheduler) load(e *entry, now time.Time) error {
+	rec, err := s.store.Ensure(e.Name, e.Spec)
+	if err != nil {
+		return err
+	}
+
+	if !rec.NextRun.IsZero() {
+		e.next = *rec.NextRun.Time()
+		return nil
+	}
+
+	e.next = e.schedule.Next(now)
+	return s.store.SetNextRun(e.Name, e.next)
+}
+
+// notify wakes up the loop, so it sees new jobs.
+func (s *Scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start runs the jobs on their schedule in the background, until Stop is called.
+func (s *Scheduler) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.store == nil {
+		return ErrNoStore
+	}
+
+	if s.cancel != nil {
+		return ErrStarted
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+
+	s.running.Add(1)
+	go s.loop(ctx)
+
+	return nil
+}
+
+// Stop stops the scheduler and waits for running jobs, their context is cancelled.
+func (s *Scheduler) Stop() {
+	s.mu.Lock()
+	cancel := s.cancel
+	s.cancel = nil
+	s.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+
+	s.running.Wait()
+}
+
+// IsStarted reports whether the scheduler runs jobs in the background.
+func (s *Scheduler) IsStarted() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.cancel != nil
+}
+
+func (s *Scheduler) loop(ctx context.Context) {
+	defer s.running.Done()
+
+	for {
+		now := time.Now()
+		due := []*entry{}
+		next := time.Time{}
+
+		s.mu.Lock()
+		store := s.store
+		logger := s.logger
+		for _, e := range s.jobs {
+			if e.next.IsZero() {
+				continue
+			}
+
+			if !e.next.After(now) {
+				due = append(due, e)
+				e.next = e.schedule.Next(now)
+			}
+
+			if !e.next.IsZero() && (next.IsZero() || e.next.Before(next)) {
+				next = e.next
+			}
+		}
+		s.mu.Unlock()
+
+		for _, e := range due {
+			if store != nil {
+				if err := store.SetNextRun(e.Name, e.next); err != nil {
+					logger.Error("Failed to save the next run of a job", "job", e.Name, "error", err)
+				}
+			}
+
+			s.running.Add(1)
+			go func(e *entry) {
+				defer s.running.Done()
+
+				err := s.run(ctx, e)
+				if errors.Is(err, ErrJobRunning) {
+					logger.Info("Skipped job, the previous run is not done", "job", e.Name)
+				} else if err != nil {
+					logger.Error("Job failed", "job", e.Name, "error", err)
+				}
+			}(e)
+		}
+
+		var timer *time.Timer
+		var fire <-chan time.Time
+		if !next.IsZero() {
+			timer = time.NewTimer(time.Until(next))
+			fire = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-s.wake:
+		case <-fire:
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// Run runs a job now, independent of its schedule, and returns its error. It
+// returns ErrJobRunning if the job is already running.
+func (s *Scheduler) Run(ctx context.Context, name string) error {
+	s.mu.Lock()
+	e, ok := s.jobs[name]
+	s.mu.Unlock()
+
+	if !ok {
+		return ErrJobNotFound
+	}
+
+	return s.run(ctx, e)
+}
+
+func (s *Scheduler) run(ctx context.Context, e *entry) error {
+	s.mu.Lock()
+	store := s.store
+	if store == nil {
+		s.mu.Unlock()
+		return ErrNoStore
+	}
+
+	if e.running {
+		s.mu.Unlock()
+		return ErrJobRunning
+	}
+
+	e.running = true
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		e.running = false
+		s.mu.Unlock()
+	}()
+
+	// The lock in the store prevents overlaps with other processes
+	ok, err := store.Lock(e.Name, e.Timeout)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return ErrJobRunning
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, e.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	err = call(ctx, e.Func)
+
+	if uerr := store.Unlock(e.Name, start, time.Since(start), err); uerr != nil {
+		return errors.Join(err, uerr)
+	}
+
+	return err
+}
+
+// call calls f and turns a panic into an error, so a job can't crash the app.
+func call(ctx context.Context, f Func) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+
+	return f(ctx)
+}
+
+// Jobs returns the state of the registered jobs, ordered by name.
+func (s *Scheduler) Jobs() ([]jobs.Job, error) {
+	s.mu.Lock()
+	store := s.store
+	names := make([]string, 0, len(s.jobs))
+	specs := map[string]string{}
+	for name, e := range s.jobs {
+		names = append(names, name)
+		specs[name] = e.Spec
+	}
+	s.mu.Unlock()
+
+	sort.Strings(names)
+
+	res := make([]jobs.Job, 0, len(names))
+	for _, name := range names {
+		if store == nil {
+			res = append(res, jobs.Job{Name: name, Spec: specs[name]})
+			continue
+		}
+
+		rec, err := store.Select(name)
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, *rec)
+	}
+
+	return res, nil
+}
@@ -1,9 +1,15 @@
 package test
 
 import (
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/Simon-Martens/caveman/db/accesstokens"
+	"github.com/Simon-Martens/caveman/migrations"
+	"github.com/Simon-Martens/caveman/models"
 )
 
 func TestAccessTokenManager(t *testing.T) {
@@ -35,7 +41,7 @@ func TestAccessTokenManager(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	at_rec, err := d.ATM.SelectByAccessToken(at.Token, "/")
+	at_rec, err := d.ATM.SelectByAccessToken(at.Token, http.MethodGet, "/")
 	if err != nil || at_rec == nil {
 		t.Fatal(err)
 	}
@@ -49,7 +55,7 @@ func TestAccessTokenManager(t *testing.T) {
 		t.Fatal("err: ", err, " c: ", c)
 	}
 
-	at_rec, err = d.ATM.SelectByAccessToken(at.Token, "/")
+	at_rec, err = d.ATM.SelectByAccessToken(at.Token, http.MethodGet, "/")
 	if err == nil || at_rec != nil {
 		t.Fatal("We cannot select a token that has been used up")
 	}
@@ -82,9 +88,315 @@ func TestAccessTokenManager(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	iat_rec, err := d.ATM.SelectByAccessToken(iat.Token, "/")
+	iat_rec, err := d.ATM.SelectByAccessToken(iat.Token, http.MethodGet, "/")
 	if err != nil || iat_rec == nil {
 		t.Fatal(err)
 	}
 
 }
+
+func TestAccessTokenScope(t *testing.T) {
+	Clean()
+	d := TestNewDatabaseEnv(t)
+	defer d.Close()
+
+	u, err := d.UM.Insert(&TestSuperAdmin, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.ATM.InsertScoped(u.ID, 1, "files/**", nil, time.Hour, nil); err != accesstokens.PathInvalid {
+		t.Fatal("Expected PathInvalid, got", err)
+	}
+
+	if _, err := d.ATM.InsertScoped(u.ID, 1, "/files/**", []string{"FETCH"}, time.Hour, nil); err != accesstokens.MethodInvalid {
+		t.Fatal("Expected MethodInvalid, got", err)
+	}
+
+	// A share link for a folder and its files
+	at, err := d.ATM.InsertScoped(u.ID, 2, "/files/:folder/**", []string{"get", "head"}, time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	probes := []struct {
+		method string
+		path   string
+	}{
+		{http.MethodPost, "/files/docs/a.pdf"},
+		{http.MethodGet, "/admin"},
+		{http.MethodGet, "/files"},
+		{http.MethodGet, "/files/docs/../../admin"},
+	}
+
+	// Probes neither consume nor destroy the token
+	for _, p := range probes {
+		if _, err := d.ATM.SelectByAccessToken(at.Token, p.method, p.path); err != accesstokens.ErrAccessTokenInvalidPath {
+			t.Errorf("(%s %s) Expected ErrAccessTokenInvalidPath, got %v", p.method, p.path, err)
+		}
+	}
+
+	rec, err := d.ATM.SelectByAccessToken(at.Token, http.MethodGet, "/files/docs/2024/a.pdf")
+	if err != nil || rec.ID != at.ID || rec.Uses != 1 || rec.Token != at.Token {
+		t.Fatal("Expected the token to be valid for the file", rec, err)
+	}
+
+	if _, err := d.ATM.SelectByAccessToken(at.Token, http.MethodHead, "/files/docs"); err != nil {
+		t.Fatal("Expected the token to be valid for the folder", err)
+	}
+
+	if _, err := d.ATM.SelectByAccessToken(at.Token, http.MethodGet, "/files/docs"); err != accesstokens.ErrAccessTokenReused {
+		t.Fatal("Expected ErrAccessTokenReused, got", err)
+	}
+
+	// Counted probes use the token up
+	d.ATM.CountProbes(true)
+
+	at, err = d.ATM.InsertScoped(u.ID, 2, "/files/**", nil, time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 2 {
+		if _, err := d.ATM.SelectByAccessToken(at.Token, http.MethodGet, "/admin"); err != accesstokens.ErrAccessTokenInvalidPath {
+			t.Fatal("Expected ErrAccessTokenInvalidPath, got", err)
+		}
+	}
+
+	if _, err := d.ATM.SelectByAccessToken(at.Token, http.MethodGet, "/files/a.pdf"); err != accesstokens.ErrAccessTokenReused {
+		t.Fatal("Expected the token to be used up by the probes, got", err)
+	}
+
+	// Expired tokens are reported as such, on any path
+	at, err = d.ATM.InsertWithDuration(u.ID, 1, "/files/**", -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.ATM.SelectByAccessToken(at.Token, http.MethodGet, "/admin"); err != accesstokens.ErrAccessTokenExpired {
+		t.Fatal("Expected ErrAccessTokenExpired, got", err)
+	}
+
+	// Tables created before methods were added get the column
+	db := d.DB.NonConcurrentDB()
+	if _, err := db.NewQuery("ALTER TABLE " + db.QuoteTableName(models.DEFAULT_ACCESS_TOKENS_TABLE) + " DROP COLUMN methods").Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range migrations.AppMigrations.Items() {
+		if m.File == "1729300000_access_token_methods.go" {
+			for range 2 {
+				if err := m.Up(db); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+
+	if _, err := d.ATM.InsertScoped(u.ID, 1, "/files/**", []string{http.MethodGet}, time.Hour, nil); err != nil {
+		t.Fatal("Expected the methods column after the migration, got", err)
+	}
+}
+
+func TestAccessTokenRestore(t *testing.T) {
+	Clean()
+	d := TestNewDatabaseEnv(t)
+	defer d.Close()
+
+	u, err := d.UM.Insert(&TestSuperAdmin, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	at, err := d.ATM.Insert(u.ID, 1, "/invite", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec, err := d.ATM.SelectByAccessToken(at.Token, http.MethodPost, "/invite")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.ATM.Restore(rec); err != nil || rec.Uses != 1 {
+		t.Fatal("Expected the use to be given back", rec, err)
+	}
+
+	if rec, err = d.ATM.SelectByAccessToken(at.Token, http.MethodPost, "/invite"); err != nil {
+		t.Fatal("Expected the restored AT to be valid, got", err)
+	}
+
+	// Used up ATs may be purged before the use is given back
+	if _, err := d.ATM.DeleteExpired(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.ATM.Restore(rec); err != accesstokens.ErrAccessTokenNotFound {
+		t.Fatal("Expected ErrAccessTokenNotFound, got", err)
+	}
+}
+
+func TestAccessTokenThrottled(t *testing.T) {
+	Clean()
+	d := TestNewDatabaseEnv(t)
+	defer d.Close()
+
+	u, err := d.UM.Insert(&TestSuperAdmin, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Concurrent requests create one AT
+	const n = 16
+	var wg sync.WaitGroup
+	var ok, throttled atomic.Int64
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := d.ATM.InsertThrottled(u.ID, 1, "/reset", time.Hour, time.Minute, nil)
+			if err == nil {
+				ok.Add(1)
+			} else if err == accesstokens.ErrAccessTokenThrottled {
+				throttled.Add(1)
+			} else {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if ok.Load() != 1 || throttled.Load() != n-1 {
+		t.Fatal("Expected one AT, got", ok.Load(), throttled.Load())
+	}
+
+	// Other paths are not throttled, used up ATs don't count
+	at, err := d.ATM.InsertThrottled(u.ID, 1, "/verify", time.Hour, time.Minute, nil)
+	if err != nil || at.ID == 0 {
+		t.Fatal("Expected an AT for another path", at, err)
+	}
+
+	if _, err := d.ATM.SelectByAccessToken(at.Token, http.MethodPost, "/verify"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.ATM.InsertThrottled(u.ID, 1, "/verify", time.Hour, time.Minute, nil); err != nil {
+		t.Fatal("Expected used up ATs not to throttle, got", err)
+	}
+}
+
+func TestAccessTokenConcurrentUse(t *testing.T) {
+	Clean()
+	d := TestNewDatabaseEnv(t)
+	defer d.Close()
+
+	// Query logging slows the goroutines down, which makes a race less likely
+	d.DB.DisconnectLogger()
+
+	u, err := d.UM.Insert(&TestSuperAdmin, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, uses := range []int64{1, 1, 1, 1, 1, 5, 5, 5, 5, 5} {
+		at, err := d.ATM.Insert(u.ID, uses, "/race", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		const n = 32
+		var wg sync.WaitGroup
+		var ok, reused atomic.Int64
+		start := make(chan struct{})
+
+		for range n {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+
+				_, err := d.ATM.SelectByAccessToken(at.Token, http.MethodGet, "/race")
+				switch err {
+				case nil:
+					ok.Add(1)
+				case accesstokens.ErrAccessTokenReused, accesstokens.ErrAccessTokenNotFound:
+					reused.Add(1)
+				default:
+					t.Error(err)
+				}
+			}()
+		}
+
+		close(start)
+		wg.Wait()
+
+		if ok.Load() != uses || reused.Load() != n-uses {
+			t.Fatalf("Expected a token with %d uses to be redeemed %d times, got %d (%d rejected)", uses, uses, ok.Load(), reused.Load())
+		}
+	}
+}
+
+func TestAnonymousAccessTokens(t *testing.T) {
+	Clean()
+	d := TestNewDatabaseEnv(t)
+	defer d.Close()
+
+	u, err := d.UM.Insert(&TestSuperAdmin, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	at, err := d.ATM.InsertScoped(0, 2, "/oauth2/test", []string{http.MethodGet}, time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a, err := d.ATM.SelectByAccessToken(at.Token, http.MethodGet, "/oauth2/test"); err != nil || a.Creator != 0 {
+		t.Fatal("Expected an AT without creator", a, err)
+	}
+
+	// Tables created before creators were optional are rebuilt
+	db := d.DB.NonConcurrentDB()
+	tn := db.QuoteTableName(models.DEFAULT_ACCESS_TOKENS_TABLE)
+	queries := []string{
+		"DROP TABLE " + tn,
+		"CREATE TABLE " + tn + " (id INTEGER PRIMARY KEY NOT NULL, token TOKEN NOT NULL COLLATE BINARY, " +
+			"token_data TEXT, path STRING NOT NULL, methods TEXT DEFAULT '[]', created INTEGER DEFAULT 0, " +
+			"uses INTEGER DEFAULT 99999999, modified INTEGER DEFAULT 0, expires INTEGER DEFAULT 0, " +
+			"creator_id INTEGER NOT NULL, FOREIGN KEY(creator_id) REFERENCES " +
+			db.QuoteTableName(models.DEFAULT_USERS_TABLE) + "(id));",
+	}
+
+	for _, q := range queries {
+		if _, err := db.NewQuery(q).Execute(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	old, err := d.ATM.Insert(u.ID, 1, "/files", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.ATM.InsertScoped(0, 1, "/oauth2/test", nil, time.Hour, nil); err == nil {
+		t.Fatal("Expected the old table to require a creator")
+	}
+
+	for _, m := range migrations.AppMigrations.Items() {
+		if m.File == "1729500000_anonymous_access_tokens.go" {
+			for range 2 {
+				if err := m.Up(db); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+
+	if a, err := d.ATM.SelectByAccessToken(old.Token, http.MethodGet, "/files"); err != nil || a.Creator != u.ID {
+		t.Fatal("Expected the ATs to be kept by the migration", a, err)
+	}
+
+	if _, err := d.ATM.InsertScoped(0, 1, "/oauth2/test", nil, time.Hour, nil); err != nil {
+		t.Fatal("Expected ATs without creator after the migration, got", err)
+	}
+}
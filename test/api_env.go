@@ -0,0 +1,160 @@
+package test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Simon-Martens/caveman/apis"
+	"github.com/Simon-Martens/caveman/db/users"
+	"github.com/Simon-Martens/caveman/mailer"
+	"github.com/Simon-Martens/caveman/manager"
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/labstack/echo/v4"
+)
+
+// ApiEnv is a bootstrapped manager with the default router. The client keeps
+// the cookies of the responses and sends valid CSRF tokens, like a browser would.
+// Headers are sent with every request.
+type ApiEnv struct {
+	T       *testing.T
+	App     *manager.Manager
+	E       *echo.Echo
+	Config  apis.ServeConfig
+	Cookies map[string]string
+	Headers map[string]string
+	Mails   chan *mailer.Message
+}
+
+// chanMailer hands sent messages to the test. Messages are dropped if the
+// channel is full, so handlers never block on tests that don't read them.
+type chanMailer chan *mailer.Message
+
+func (m chanMailer) Send(msg *mailer.Message) error {
+	select {
+	case m <- msg:
+	default:
+	}
+	return nil
+}
+
+// TestNewApiEnv creates a new ApiEnv. The given functions can change the
+// config before the router is initialized.
+func TestNewApiEnv(t *testing.T, configure ...func(*apis.ServeConfig)) *ApiEnv {
+	app := TestNewManager(t)
+	mails := make(chan *mailer.Message, 16)
+	app.SetMailer(chanMailer(mails))
+
+	config := apis.NewServeConfig(models.Config{})
+	for _, f := range configure {
+		f(&config)
+	}
+
+	e, err := apis.InitApi(app, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := &ApiEnv{T: t, App: app, E: e, Config: config, Cookies: map[string]string{}, Headers: map[string]string{}, Mails: mails}
+
+	// Get an anonymous CSRF cookie
+	env.Request(http.MethodGet, "/api/health", "", "")
+
+	return env
+}
+
+var TestAdmin = users.User{
+	Name:  "Mr. Admin",
+	Email: "admin@test.com",
+}
+
+// SetUp finishes the setup with TestAdmin, so all routes are served.
+func (env *ApiEnv) SetUp() *users.User {
+	admin := TestAdmin
+	user, err := env.App.Setup(&admin, "password", &models.Settings{
+		Name: "Test",
+		URL:  "http://localhost:8080",
+	})
+	if err != nil {
+		env.T.Fatal(err)
+	}
+
+	return user
+}
+
+// CSRFToken returns a valid CSRF token for the current cookies.
+func (env *ApiEnv) CSRFToken() string {
+	if s, ok := env.Cookies[env.Config.Cookie.Name]; ok {
+		// Pending sessions don't authenticate, they get anonymous tokens
+		session, err := env.App.Sessions().SelectBySession(s)
+		if err == nil && session.Pending() == "" {
+			return env.App.Sessions().CreateCSRFToken(session)
+		}
+	}
+
+	return env.App.Sessions().CreateAnonymousCSRFToken(env.Cookies[env.Config.CSRF.Cookie.Name])
+}
+
+// Request sends a request with the given content type and body and returns the response.
+func (env *ApiEnv) Request(method, path, contentType, body string) *httptest.ResponseRecorder {
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+
+	req := httptest.NewRequest(method, path, r)
+	if contentType != "" {
+		req.Header.Set(echo.HeaderContentType, contentType)
+	}
+
+	for k, v := range env.Headers {
+		req.Header.Set(k, v)
+	}
+
+	if method != http.MethodGet {
+		req.Header.Set(env.Config.CSRF.Header, env.CSRFToken())
+	}
+
+	for k, v := range env.Cookies {
+		req.AddCookie(&http.Cookie{Name: k, Value: v})
+	}
+
+	rec := httptest.NewRecorder()
+	env.E.ServeHTTP(rec, req)
+
+	for _, ck := range rec.Result().Cookies() {
+		if ck.MaxAge < 0 {
+			delete(env.Cookies, ck.Name)
+		} else {
+			env.Cookies[ck.Name] = ck.Value
+		}
+	}
+
+	return rec
+}
+
+// Mail waits for the next sent message.
+func (env *ApiEnv) Mail() *mailer.Message {
+	select {
+	case m := <-env.Mails:
+		return m
+	case <-time.After(time.Second):
+		env.T.Fatal("Expected a mail to be sent")
+		return nil
+	}
+}
+
+func (env *ApiEnv) JSON(method, path, body string) *httptest.ResponseRecorder {
+	return env.Request(method, path, echo.MIMEApplicationJSON, body)
+}
+
+func (env *ApiEnv) Form(method, path, body string) *httptest.ResponseRecorder {
+	return env.Request(method, path, echo.MIMEApplicationForm, body)
+}
+
+func (env *ApiEnv) Close() {
+	env.App.Terminate()
+}
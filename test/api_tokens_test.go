@@ -0,0 +1,225 @@
+package test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Simon-Martens/caveman/db/apitokens"
+	"github.com/Simon-Martens/caveman/db/users"
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/Simon-Martens/caveman/tools/security"
+	"github.com/labstack/echo/v4"
+	"github.com/pocketbase/dbx"
+)
+
+func TestAPITokenManager(t *testing.T) {
+	Clean()
+	app := TestNewManager(t)
+	defer app.Terminate()
+
+	user, err := app.Users().Insert(&users.User{Email: "user@test.com", Active: true}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := []struct {
+		at       apitokens.APIToken
+		expected error
+	}{
+		{apitokens.APIToken{Name: " "}, apitokens.ErrInvalidName},
+		{apitokens.APIToken{Name: "ci", Paths: []string{"reports/**"}}, apitokens.ErrInvalidScope},
+		{apitokens.APIToken{Name: "ci", Methods: []string{"FETCH"}}, apitokens.ErrInvalidScope},
+		{apitokens.APIToken{Name: "ci", Permissions: []string{"unknown"}}, apitokens.ErrInvalidScope},
+	}
+
+	for i, s := range invalid {
+		if _, err := app.CreateAPIToken(user.ID, &s.at, 0); !errors.Is(err, s.expected) {
+			t.Errorf("(%d) Expected %v, got %v", i, s.expected, err)
+		}
+	}
+
+	at, err := app.CreateAPIToken(user.ID, &apitokens.APIToken{
+		Name:        "ci",
+		Permissions: []string{models.PERMISSION_MANAGE_USERS},
+		Paths:       []string{"/api/reports/**"},
+		Methods:     []string{"get"},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(at.Token, models.API_TOKEN_PREFIX) || at.Hash != security.HashToken(at.Token) || !at.Expires.IsZero() {
+		t.Fatalf("Unexpected token %+v", at)
+	}
+
+	if !at.Allows(http.MethodGet, "/api/reports/2024/05") || at.Allows(http.MethodPost, "/api/reports/1") || at.Allows(http.MethodGet, "/api/users") {
+		t.Fatal("Expected the scope to restrict paths and methods")
+	}
+
+	if !at.HasPermission(models.PERMISSION_MANAGE_USERS) || at.HasPermission(models.PERMISSION_MANAGE_SETTINGS) {
+		t.Fatal("Expected the scope to restrict permissions")
+	}
+
+	// Authentication records the last use
+	found, u, err := app.AuthenticateAPIToken(at.Token)
+	if err != nil || found.ID != at.ID || u.ID != user.ID || found.LastUsed.IsZero() {
+		t.Fatal("Expected the token to authenticate the user", found, err)
+	}
+
+	if _, _, err := app.AuthenticateAPIToken(at.Hash); !errors.Is(err, apitokens.ErrAPITokenNotFound) {
+		t.Fatal("Expected the digest to be rejected, got", err)
+	}
+
+	list, err := app.APITokens().SelectByUser(user.ID)
+	if err != nil || len(list) != 1 || list[0].Name != "ci" || list[0].Methods[0] != http.MethodGet || list[0].Token != "" {
+		t.Fatal("Unexpected token list", list, err)
+	}
+
+	// Tokens of deactivated users are rejected, but kept
+	if err := app.DeactivateUser(user); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := app.AuthenticateAPIToken(at.Token); !errors.Is(err, users.ErrUserInactive) {
+		t.Fatal("Expected ErrUserInactive, got", err)
+	}
+
+	if err := app.ActivateUser(user); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := app.AuthenticateAPIToken(at.Token); err != nil {
+		t.Fatal("Expected the token to work after reactivation, got", err)
+	}
+
+	// Expiration
+	short, err := app.CreateAPIToken(user.ID, &apitokens.APIToken{Name: "short"}, time.Hour)
+	if err != nil || short.Expires.IsZero() {
+		t.Fatal("Expected an expiring token", short, err)
+	}
+
+	db := app.DB().NonConcurrentDB()
+	_, err = db.NewQuery("UPDATE " + db.QuoteTableName(models.DEFAULT_API_TOKENS_TABLE) + " SET expires = 1 WHERE id = {:id}").
+		Bind(dbx.Params{"id": short.ID}).
+		Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := app.Purge(models.DEFAULT_DATASTORE_RETENTION)
+	if err != nil || r.APITokens != 1 {
+		t.Fatal("Expected the janitor to purge the expired token", r, err)
+	}
+
+	// Revocation
+	if err := app.APITokens().DeleteByID(user.ID+1, at.ID); !errors.Is(err, apitokens.ErrAPITokenNotFound) {
+		t.Fatal("Expected tokens of other users not to be revoked, got", err)
+	}
+
+	if err := app.APITokens().DeleteByID(user.ID, at.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := app.AuthenticateAPIToken(at.Token); !errors.Is(err, apitokens.ErrAPITokenNotFound) {
+		t.Fatal("Expected the revoked token to be rejected, got", err)
+	}
+}
+
+func TestAPITokenApi(t *testing.T) {
+	Clean()
+	env := TestNewApiEnv(t)
+	defer env.Close()
+	admin := env.SetUp()
+
+	user, err := env.App.Users().Insert(&users.User{Email: "user@test.com", Active: true}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := "/api/users/" + strconv.FormatInt(user.ID, 10)
+
+	readonly, err := env.App.CreateAPIToken(admin.ID, &apitokens.APIToken{
+		Name:        "monitoring",
+		Permissions: []string{models.PERMISSION_MANAGE_USERS},
+		Paths:       []string{"/api/users/:id/sessions", "/api/auth/**"},
+		Methods:     []string{http.MethodGet},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := env.App.CreateAPIToken(admin.ID, &apitokens.APIToken{
+		Name:        "admin",
+		Permissions: []string{models.API_TOKEN_ALL_PERMISSIONS},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	none, err := env.App.CreateAPIToken(admin.ID, &apitokens.APIToken{Name: "none"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bearer := func(method, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		rec := httptest.NewRecorder()
+		env.E.ServeHTTP(rec, req)
+		return rec
+	}
+
+	scenarios := []struct {
+		name     string
+		method   string
+		path     string
+		token    string
+		expected int
+	}{
+		{"in scope", http.MethodGet, path + "/sessions", readonly.Token, http.StatusOK},
+		{"wrong method", http.MethodDelete, path + "/sessions", readonly.Token, http.StatusForbidden},
+		{"wrong path", http.MethodGet, "/api/health", readonly.Token, http.StatusForbidden},
+		{"invalid token", http.MethodGet, path + "/sessions", "cm_invalid", http.StatusUnauthorized},
+		{"session only route", http.MethodGet, "/api/auth/sessions", readonly.Token, http.StatusUnauthorized},
+		{"no permission", http.MethodGet, path + "/sessions", none.Token, http.StatusForbidden},
+		// No CSRF token needed
+		{"unsafe method", http.MethodPost, path + "/deactivate", all.Token, http.StatusOK},
+	}
+
+	for _, s := range scenarios {
+		if rec := bearer(s.method, s.path, s.token); rec.Code != s.expected {
+			t.Errorf("(%s) Expected %d, got %d: %s", s.name, s.expected, rec.Code, rec.Body.String())
+		}
+	}
+
+	if u, _ := env.App.Users().Select(user.ID); u.Active {
+		t.Fatal("Expected the user to be deactivated by API token")
+	}
+
+	// Demoted users lose the permissions of their tokens
+	if _, err := env.App.Users().Insert(&users.User{Email: "admin2@test.com", Active: true, Role: models.ROLE_ADMIN}, "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := env.App.ChangeRole(admin, models.ROLE_USER, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := bearer(http.MethodPost, path+"/activate", all.Token); rec.Code != http.StatusForbidden {
+		t.Fatal("Expected 403 after the demotion, got", rec.Code)
+	}
+
+	// Revoked tokens are rejected
+	if err := env.App.APITokens().Delete(readonly.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := bearer(http.MethodGet, path+"/sessions", readonly.Token); rec.Code != http.StatusUnauthorized {
+		t.Fatal("Expected 401 for a revoked token, got", rec.Code)
+	}
+}
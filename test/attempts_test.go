@@ -0,0 +1,284 @@
+package test
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Simon-Martens/caveman/apis"
+	"github.com/Simon-Martens/caveman/db/attempts"
+	"github.com/Simon-Martens/caveman/db/users"
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/labstack/echo/v4"
+	"github.com/pocketbase/dbx"
+)
+
+func TestLoginRateLimit(t *testing.T) {
+	Clean()
+	app := TestNewManager(t)
+	defer app.Terminate()
+
+	user, err := app.Users().Insert(&users.User{Email: "user@test.com", Active: true}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limits := models.RateLimitSettings{
+		FreeAttempts:    2,
+		Backoff:         60,
+		MaxBackoff:      100,
+		LockoutAttempts: 5,
+		LockoutDuration: 900,
+	}
+	app.Attempts().SetLimits(limits)
+
+	db := app.DB().NonConcurrentDB()
+	tn := db.QuoteTableName(models.DEFAULT_ATTEMPTS_TABLE)
+
+	// unblock simulates waiting for the block to end
+	unblock := func() {
+		t.Helper()
+		if _, err := db.NewQuery("UPDATE " + tn + " SET blocked_until = 0").Execute(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	blocked := func(key string) time.Duration {
+		t.Helper()
+		a, err := app.Attempts().Select(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !a.IsBlocked() {
+			return 0
+		}
+		return time.Until(*a.BlockedUntil.Time()).Round(time.Second)
+	}
+
+	email := attempts.EmailKey("USER@test.com ")
+
+	for range 2 {
+		if _, err := app.Users().CheckGetUserFrom(user.Email, "wrong", "10.0.0.1"); err != users.ErrWrongPassword {
+			t.Fatal("Expected ErrWrongPassword, got", err)
+		}
+	}
+
+	if d := blocked(email); d != 0 {
+		t.Fatal("Expected the free attempts not to be blocked, got", d)
+	}
+
+	// Exponential backoff, up to the max
+	for i, expected := range []time.Duration{60 * time.Second, 100 * time.Second} {
+		if _, err := app.Users().CheckGetUserFrom(user.Email, "wrong", "10.0.0.1"); err != users.ErrWrongPassword {
+			t.Fatal("Expected ErrWrongPassword, got", err)
+		}
+
+		if d := blocked(email); d != expected {
+			t.Fatalf("(%d) Expected a block of %v, got %v", i, expected, d)
+		}
+
+		// Blocked logins fail, even with the right password
+		_, err := app.Users().CheckGetUserFrom(user.Email, "password", "10.0.0.2")
+		var berr *attempts.BlockedError
+		if !errors.As(err, &berr) || berr.Locked || berr.RetryAfter() <= 0 {
+			t.Fatal("Expected a BlockedError, got", err)
+		}
+
+		unblock()
+	}
+
+	// Lockout, which survives a restart
+	if _, err := app.Users().CheckGetUser(user.Email, "wrong"); err != users.ErrWrongPassword {
+		t.Fatal("Expected ErrWrongPassword, got", err)
+	}
+
+	if err := app.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.Bootstrap(); err != nil {
+		t.Fatal(err)
+	}
+	app.Attempts().SetLimits(limits)
+	db = app.DB().NonConcurrentDB()
+
+	if _, err := app.Users().CheckGetUser(user.Email, "password"); !errors.Is(err, attempts.ErrLockedOut) {
+		t.Fatal("Expected ErrLockedOut, got", err)
+	}
+
+	if d := blocked(email); d != 900*time.Second {
+		t.Fatal("Expected a lockout of 900s, got", d)
+	}
+
+	// Unknown emails are limited as well
+	for range 3 {
+		if _, err := app.Users().CheckGetUserFrom("nobody@test.com", "wrong", "10.0.0.3"); err != users.ErrUserNotFound {
+			t.Fatal("Expected ErrUserNotFound, got", err)
+		}
+	}
+
+	if _, err := app.Users().CheckGetUserFrom("nobody@test.com", "wrong", "10.0.0.4"); !errors.Is(err, attempts.ErrRateLimited) {
+		t.Fatal("Expected ErrRateLimited, got", err)
+	}
+
+	// The IP is blocked for all emails
+	if _, err := app.Users().CheckGetUserFrom("other@test.com", "wrong", "10.0.0.3"); !errors.Is(err, attempts.ErrRateLimited) {
+		t.Fatal("Expected ErrRateLimited for the IP, got", err)
+	}
+
+	// Unlocking resets the email, a login resets it as well
+	if err := app.Users().Unlock(user.Email); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := app.Users().CheckGetUserFrom(user.Email, "wrong", "10.0.0.5"); err != users.ErrWrongPassword {
+		t.Fatal("Expected ErrWrongPassword, got", err)
+	}
+
+	if _, err := app.Users().CheckGetUserFrom(user.Email, "password", "10.0.0.5"); err != nil {
+		t.Fatal("Expected the login to work after unlocking, got", err)
+	}
+
+	if _, err := app.Attempts().Select(email); err == nil {
+		t.Fatal("Expected the failures of the email to be reset after a login")
+	}
+
+	if a, err := app.Attempts().Select(attempts.IPKey("10.0.0.5")); err != nil || a.Failures != 1 {
+		t.Fatal("Expected the failures of the IP to be kept after a login", a, err)
+	}
+
+	// Failures are forgotten after the window
+	old := time.Now().Add(-time.Duration(models.DEFAULT_LOGIN_FAILURE_WINDOW+1) * time.Second).UnixMicro()
+	_, err = db.NewQuery("UPDATE " + tn + " SET last_failure = {:old}, blocked_until = 0").
+		Bind(dbx.Params{"old": old}).
+		Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := app.Attempts().Fail(attempts.IPKey("10.0.0.3"), false)
+	if err != nil || a.Failures != 1 || a.IsBlocked() {
+		t.Fatal("Expected the failures to start over", a, err)
+	}
+
+	r, err := app.Purge(models.DEFAULT_DATASTORE_RETENTION)
+	if err != nil || r.Attempts != 3 {
+		t.Fatal("Expected the janitor to purge the forgotten failures", r, err)
+	}
+
+	// Disabled limits
+	app.Attempts().SetLimits(models.RateLimitSettings{Disabled: true, FreeAttempts: 1})
+	for range 3 {
+		if _, err := app.Users().CheckGetUser(user.Email, "wrong"); err != users.ErrWrongPassword {
+			t.Fatal("Expected ErrWrongPassword, got", err)
+		}
+	}
+
+	if _, err := app.Users().CheckGetUser(user.Email, "password"); err != nil {
+		t.Fatal("Expected no limits when disabled, got", err)
+	}
+}
+
+func TestRateLimitApi(t *testing.T) {
+	Clean()
+	env := TestNewApiEnv(t)
+	defer env.Close()
+	env.SetUp()
+
+	env.App.Attempts().SetLimits(models.RateLimitSettings{FreeAttempts: 2, Backoff: 30})
+
+	for range 3 {
+		rec := env.JSON(http.MethodPost, "/api/auth/login", `{"email":"admin@test.com","password":"wrongpassword"}`)
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatal("Expected 401, got", rec.Code)
+		}
+	}
+
+	rec := env.JSON(http.MethodPost, "/api/auth/login", `{"email":"admin@test.com","password":"password"}`)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "30" {
+		t.Fatal("Expected 429 with Retry-After, got", rec.Code, rec.Header().Get("Retry-After"), rec.Body.String())
+	}
+
+	// Unlocking the user does not unblock the IP
+	if err := env.App.Users().Unlock("admin@test.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	rec = env.JSON(http.MethodPost, "/api/auth/login", `{"email":"admin@test.com","password":"password"}`)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatal("Expected the IP to stay blocked, got", rec.Code)
+	}
+
+	if err := env.App.Attempts().Reset(attempts.IPKey("192.0.2.1")); err != nil {
+		t.Fatal(err)
+	}
+
+	rec = env.JSON(http.MethodPost, "/api/auth/login", `{"email":"admin@test.com","password":"password"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatal("Expected the login to work, got", rec.Code, rec.Body.String())
+	}
+
+	// Token guessing counts against the IP
+	for range 3 {
+		rec := env.JSON(http.MethodPost, "/api/auth/verify", `{"token":"guess"}`)
+		if rec.Code != http.StatusBadRequest {
+			t.Fatal("Expected 400, got", rec.Code)
+		}
+	}
+
+	rec = env.JSON(http.MethodPost, "/api/auth/verify", `{"token":"guess"}`)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatal("Expected 429, got", rec.Code, rec.Body.String())
+	}
+
+	// Spoofed client IPs don't escape the limit
+	for _, h := range []string{echo.HeaderXForwardedFor, echo.HeaderXRealIP} {
+		env.Headers = map[string]string{h: "203.0.113.7"}
+		rec = env.JSON(http.MethodPost, "/api/auth/verify", `{"token":"guess"}`)
+		if rec.Code != http.StatusTooManyRequests {
+			t.Fatal("Expected the spoofed IP to be ignored, got", h, rec.Code)
+		}
+	}
+
+	if _, err := env.App.Attempts().Select(attempts.IPKey("203.0.113.7")); err == nil {
+		t.Fatal("Expected no attempts of the spoofed IP")
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	Clean()
+
+	app := TestNewManager(t)
+	_, err := apis.InitApi(app, apis.ServeConfig{TrustedProxies: []string{"proxy"}})
+	app.Terminate()
+	if err == nil {
+		t.Fatal("Expected invalid proxies to fail")
+	}
+
+	// Test requests come from 192.0.2.1
+	env := TestNewApiEnv(t, func(config *apis.ServeConfig) {
+		config.TrustedProxies = []string{"192.0.2.1"}
+	})
+	defer env.Close()
+	env.SetUp()
+
+	env.App.Attempts().SetLimits(models.RateLimitSettings{FreeAttempts: 2, Backoff: 30})
+	env.Headers[echo.HeaderXForwardedFor] = "203.0.113.7"
+
+	for range 3 {
+		env.JSON(http.MethodPost, "/api/auth/verify", `{"token":"guess"}`)
+	}
+
+	if rec := env.JSON(http.MethodPost, "/api/auth/verify", `{"token":"guess"}`); rec.Code != http.StatusTooManyRequests {
+		t.Fatal("Expected 429, got", rec.Code)
+	}
+
+	if err := env.App.Attempts().Check(attempts.IPKey("203.0.113.7")); err == nil {
+		t.Fatal("Expected the forwarded IP to be blocked")
+	}
+
+	if err := env.App.Attempts().Check(attempts.IPKey("192.0.2.1")); err != nil {
+		t.Fatal("Expected the proxy not to be blocked, got", err)
+	}
+}
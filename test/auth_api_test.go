@@ -0,0 +1,106 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Simon-Martens/caveman/apis"
+	"github.com/Simon-Martens/caveman/db/users"
+)
+
+func TestAuthApi(t *testing.T) {
+	Clean()
+	env := TestNewApiEnv(t)
+	defer env.Close()
+	env.SetUp()
+
+	_, err := env.App.Users().Insert(&users.User{
+		Name:   "Mr. Login",
+		Email:  "login@test.com",
+		Active: true,
+	}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Unknown users and wrong passwords are indistinguishable
+	for _, body := range []string{
+		`{"email":"nobody@test.com","password":"password"}`,
+		`{"email":"login@test.com","password":"wrongpassword"}`,
+	} {
+		rec := env.JSON(http.MethodPost, "/api/auth/login", body)
+		apiErr := apis.ApiError{}
+		_ = json.Unmarshal(rec.Body.Bytes(), &apiErr)
+		if rec.Code != http.StatusUnauthorized || apiErr.Code != apis.ErrCodeInvalidCredentials {
+			t.Fatal("Expected invalid credentials, got", rec.Code, rec.Body.String())
+		}
+	}
+
+	rec := env.JSON(http.MethodPost, "/api/auth/login", `{"email":"login@test.com","password":"password","remember":true}`)
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "password") {
+		t.Fatal("Expected successful login, got", rec.Code, rec.Body.String())
+	}
+
+	token := env.Cookies[env.Config.Cookie.Name]
+	if token == "" {
+		t.Fatal("Expected a session cookie")
+	}
+
+	rec = env.JSON(http.MethodPost, "/api/auth/logout", "")
+	if rec.Code != http.StatusNoContent {
+		t.Fatal("Expected successful logout, got", rec.Code, rec.Body.String())
+	}
+
+	if _, err := env.App.Sessions().SelectBySession(token); err == nil {
+		t.Fatal("Session should be deleted on logout")
+	}
+
+	// Form variant
+	rec = env.Form(http.MethodPost, "/login", "email=login%40test.com&password=wrongpassword")
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/login?error="+apis.ErrCodeInvalidCredentials {
+		t.Fatal("Expected redirect to the login page, got", rec.Code, rec.Header().Get("Location"))
+	}
+
+	rec = env.Form(http.MethodPost, "/login", "email=login%40test.com&password=password&next=%2F%2Fevil.com")
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/" {
+		t.Fatal("Expected redirect to /, got", rec.Code, rec.Header().Get("Location"))
+	}
+
+	if env.Cookies[env.Config.Cookie.Name] == "" {
+		t.Fatal("Expected a session cookie")
+	}
+
+	rec = env.Form(http.MethodPost, "/logout", "")
+	if rec.Code != http.StatusSeeOther || env.Cookies[env.Config.Cookie.Name] != "" {
+		t.Fatal("Expected logout, got", rec.Code)
+	}
+
+	// Registration is opt-in
+	rec = env.JSON(http.MethodPost, "/api/auth/register", `{"name":"New","email":"new@test.com","password":"password"}`)
+	if rec.Code != http.StatusForbidden {
+		t.Fatal("Expected registration to be disabled, got", rec.Code)
+	}
+
+	sets := *env.App.CMSettings()
+	sets.Registration = true
+	if err := env.App.UpdateSettings(&sets); err != nil {
+		t.Fatal(err)
+	}
+
+	rec = env.JSON(http.MethodPost, "/api/auth/register", `{"name":"New","email":"new@test.com","password":"short"}`)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), apis.ErrCodeInvalidPassword) {
+		t.Fatal("Expected short password to be rejected, got", rec.Code, rec.Body.String())
+	}
+
+	rec = env.JSON(http.MethodPost, "/api/auth/register", `{"name":"New","email":"new@test.com","password":"password"}`)
+	if rec.Code != http.StatusOK || env.Cookies[env.Config.Cookie.Name] == "" {
+		t.Fatal("Expected registration and login, got", rec.Code, rec.Body.String())
+	}
+
+	rec = env.JSON(http.MethodPost, "/api/auth/register", `{"name":"New","email":"login@test.com","password":"password"}`)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), apis.ErrCodeRegistrationFailed) {
+		t.Fatal("Expected registration of a taken email to fail, got", rec.Code, rec.Body.String())
+	}
+}
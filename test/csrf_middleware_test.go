@@ -0,0 +1,81 @@
+package test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/Simon-Martens/caveman/apis"
+	"github.com/labstack/echo/v4"
+)
+
+func TestCSRFMiddleware(t *testing.T) {
+	Clean()
+	app := TestNewManager(t)
+	defer app.Terminate()
+
+	config := apis.DefaultCSRFConfig(true)
+
+	e := echo.New()
+	e.Use(apis.LoadSession(app, apis.DefaultCookieConfig(true)))
+	e.Use(apis.CSRF(app, config))
+	e.GET("/form", func(c echo.Context) error {
+		return c.HTML(http.StatusOK, string(apis.CSRFField(c)))
+	})
+	e.POST("/form", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+
+	// Anonymous visitors get an id cookie and a token bound to it
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/form", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), config.FormField) {
+		t.Fatal("Expected a form with a CSRF field, got", rec.Code, rec.Body.String())
+	}
+
+	var anon *http.Cookie
+	for _, ck := range rec.Result().Cookies() {
+		if ck.Name == config.Cookie.Name {
+			anon = ck
+		}
+	}
+	if anon == nil {
+		t.Fatal("Expected an anonymous CSRF cookie")
+	}
+
+	token := app.Sessions().CreateAnonymousCSRFToken(anon.Value)
+
+	post := func(header, field string) int {
+		form := url.Values{}
+		if field != "" {
+			form.Set(config.FormField, field)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/form", strings.NewReader(form.Encode()))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		if header != "" {
+			req.Header.Set(config.Header, header)
+		}
+		req.AddCookie(&http.Cookie{Name: anon.Name, Value: anon.Value})
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := post("", ""); code != http.StatusForbidden {
+		t.Fatal("Expected 403 without a token, got", code)
+	}
+
+	if code := post("", "invalid"); code != http.StatusForbidden {
+		t.Fatal("Expected 403 with an invalid token, got", code)
+	}
+
+	if code := post(token, ""); code != http.StatusOK {
+		t.Fatal("Expected 200 with a header token, got", code)
+	}
+
+	if code := post("", token); code != http.StatusOK {
+		t.Fatal("Expected 200 with a form token, got", code)
+	}
+}
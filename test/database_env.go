@@ -8,8 +8,10 @@ import (
 	"github.com/Simon-Martens/caveman/db"
 	"github.com/Simon-Martens/caveman/db/accesstokens"
 	"github.com/Simon-Martens/caveman/db/datastore"
+	"github.com/Simon-Martens/caveman/db/roles"
 	"github.com/Simon-Martens/caveman/db/sessions"
 	"github.com/Simon-Martens/caveman/db/users"
+	"github.com/Simon-Martens/caveman/manager"
 	"github.com/Simon-Martens/caveman/models"
 	"github.com/Simon-Martens/caveman/tools/security"
 )
@@ -20,6 +22,7 @@ type DatabaseEnv struct {
 	SM  *sessions.SessionManager
 	ATM *accesstokens.AccessTokenManager
 	DSM *datastore.DataStoreManager
+	RM  *roles.RoleManager
 }
 
 func TestNewDatabaseEnv(T *testing.T) *DatabaseEnv {
@@ -45,6 +48,7 @@ func TestNewDatabaseEnv(T *testing.T) *DatabaseEnv {
 		models.DEFAULT_ID_FIELD,
 		models.DEFAULT_LONG_SESSION_EXPIRATION,
 		models.DEFAULT_SHORT_SESSION_EXPIRATION,
+		models.DEFAULT_CSRF_EXPIRATION,
 		security.GenRandomUIntNotPrime(),
 	)
 	if err != nil {
@@ -68,7 +72,24 @@ func TestNewDatabaseEnv(T *testing.T) *DatabaseEnv {
 		T.Fatal(err)
 	}
 
-	return &DatabaseEnv{db, um, sm, atm, ds}
+	rm, err := roles.New(db,
+		models.DEFAULT_ROLES_TABLE,
+		models.DEFAULT_ID_FIELD)
+	if err != nil {
+		T.Fatal(err)
+	}
+
+	return &DatabaseEnv{db, um, sm, atm, ds, rm}
+}
+
+// TestNewManager returns a bootstrapped manager using the test data dir.
+func TestNewManager(T *testing.T) *manager.Manager {
+	app := manager.New(models.Config{DataDir: models.DEFAULT_TEST_DATA_DIR})
+	if err := app.Bootstrap(); err != nil {
+		T.Fatal(err)
+	}
+
+	return app
 }
 
 func Path() string {
@@ -0,0 +1,223 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Simon-Martens/caveman/apis"
+	"github.com/Simon-Martens/caveman/db/roles"
+	"github.com/Simon-Martens/caveman/db/users"
+	"github.com/Simon-Martens/caveman/manager"
+	"github.com/Simon-Martens/caveman/models"
+)
+
+func TestInvites(t *testing.T) {
+	Clean()
+	app := TestNewManager(t)
+	defer app.Terminate()
+
+	admin, err := app.Users().Insert(&users.User{Email: "admin@test.com", Role: models.ROLE_ADMIN, Active: true}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := app.CreateInvite(admin.ID, "", "unknown", 1, 0); err != roles.ErrRoleNotFound {
+		t.Fatal("Expected ErrRoleNotFound, got", err)
+	}
+
+	if _, err := app.CreateInvite(admin.ID, "admin@test.com", "", 1, 0); err != manager.ErrInviteEmailTaken {
+		t.Fatal("Expected ErrInviteEmailTaken, got", err)
+	}
+
+	if _, err := app.CreateInvite(admin.ID, "", "", 1, -time.Hour); err != manager.ErrInvalidDuration {
+		t.Fatal("Expected ErrInvalidDuration, got", err)
+	}
+
+	// Invites to an email
+	at, err := app.CreateInvite(admin.ID, "new@test.com", models.ROLE_ADMIN, 1, 0)
+	if err != nil || at.Creator != admin.ID || at.Uses != 1 {
+		t.Fatal("Expected an invite", at, err)
+	}
+
+	if time.Until(*at.Expires.Time()) < time.Duration(models.DEFAULT_INVITE_EXPIRATION-60)*time.Second {
+		t.Fatal("Expected the default expiration, got", at.Expires)
+	}
+
+	// Failed registrations give the use back
+	if _, err := app.AcceptInvite(at.Token, &users.User{Email: "other@test.com"}, "password"); err != manager.ErrInviteEmail {
+		t.Fatal("Expected ErrInviteEmail, got", err)
+	}
+
+	user, err := app.AcceptInvite(at.Token, &users.User{Name: "New"}, "password")
+	if err != nil || user.Email != "new@test.com" || user.Role != models.ROLE_ADMIN || !user.Verified || !user.Active || user.Name != "New" {
+		t.Fatalf("Expected the invited user, got %+v %v", user, err)
+	}
+
+	if _, err := app.Users().CheckGetUser("new@test.com", "password"); err != nil {
+		t.Fatal("Expected the user to log in with the password, got", err)
+	}
+
+	if _, err := app.AcceptInvite(at.Token, &users.User{}, "password"); err != manager.ErrInviteInvalid {
+		t.Fatal("Expected used invites to be invalid, got", err)
+	}
+
+	// The email of the invite was registered in the meantime
+	at, err = app.CreateInvite(admin.ID, "late@test.com", "", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := app.Users().Insert(&users.User{Email: "late@test.com", Active: true}, "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	for range 2 {
+		if _, err := app.AcceptInvite(at.Token, &users.User{}, "password"); err != manager.ErrInviteEmailTaken {
+			t.Fatal("Expected ErrInviteEmailTaken without using the invite up, got", err)
+		}
+	}
+
+	// Invites without email, from the command line
+	at, err = app.CreateInvite(0, "", "", 2, time.Hour)
+	if err != nil || at.Creator != 0 {
+		t.Fatal("Expected an invite without creator", at, err)
+	}
+
+	if _, err := app.AcceptInvite(at.Token, &users.User{Email: "new@test.com"}, "password"); err != manager.ErrInviteEmailTaken {
+		t.Fatal("Expected ErrInviteEmailTaken, got", err)
+	}
+
+	if _, err := app.AcceptInvite(at.Token, &users.User{}, "password"); err != manager.ErrInviteEmail {
+		t.Fatal("Expected invites without email to need one, got", err)
+	}
+
+	app.Users().RequireTwoFactor([]string{models.ROLE_USER})
+	user, err = app.AcceptInvite(at.Token, &users.User{Email: "team@test.com"}, "password")
+	if err != users.ErrSecondFactorSetupRequired || user.Role != models.ROLE_USER || user.Verified {
+		t.Fatal("Expected ErrSecondFactorSetupRequired, got", err)
+	}
+
+	if _, err := app.AcceptInvite(at.Token, &users.User{Email: "last@test.com"}, "password"); err != users.ErrSecondFactorSetupRequired {
+		t.Fatal("Expected the second use of the invite, got", err)
+	}
+
+	if _, err := app.AcceptInvite(at.Token, &users.User{Email: "other@test.com"}, "password"); err != manager.ErrInviteInvalid {
+		t.Fatal("Expected the invite to be used up, got", err)
+	}
+
+	// Invites are no other tokens
+	if _, err := app.Tokens().SelectByAccessToken(at.Token, http.MethodPost, "/reset"); err == nil {
+		t.Fatal("Expected the invite not to be valid for other paths")
+	}
+}
+
+func TestInvitesApi(t *testing.T) {
+	Clean()
+	env := TestNewApiEnv(t)
+	defer env.Close()
+	env.SetUp()
+
+	// Registration is disabled, invites work anyway
+	if env.App.CMSettings().Registration {
+		t.Fatal("Expected registration to be disabled")
+	}
+
+	if rec := env.JSON(http.MethodPost, "/api/auth/invites", `{}`); rec.Code != http.StatusUnauthorized {
+		t.Fatal("Expected invites to need a user, got", rec.Code)
+	}
+
+	if rec := env.JSON(http.MethodPost, "/api/auth/login", `{"email":"admin@test.com","password":"password"}`); rec.Code != http.StatusOK {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+
+	if rec := env.JSON(http.MethodPost, "/api/auth/invites", `{"email":"invalid"}`); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), apis.ErrCodeInvalidEmail) {
+		t.Fatal("Expected invalid_email, got", rec.Code, rec.Body.String())
+	}
+
+	if rec := env.JSON(http.MethodPost, "/api/auth/invites", `{"role":"unknown"}`); rec.Code != http.StatusBadRequest {
+		t.Fatal("Expected unknown roles to be rejected, got", rec.Code)
+	}
+
+	if rec := env.JSON(http.MethodPost, "/api/auth/invites", `{"email":"admin@test.com"}`); rec.Code != http.StatusConflict {
+		t.Fatal("Expected registered emails to be rejected, got", rec.Code)
+	}
+
+	invite := func(body string) (string, string) {
+		t.Helper()
+		rec := env.JSON(http.MethodPost, "/api/auth/invites", body)
+		res := struct {
+			Token string `json:"token"`
+			Link  string `json:"link"`
+			Role  string `json:"role"`
+		}{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); rec.Code != http.StatusCreated || err != nil || res.Token == "" {
+			t.Fatal("Expected an invite", rec.Code, rec.Body.String())
+		}
+		return res.Token, res.Link
+	}
+
+	// Invites to an email are mailed
+	token, link := invite(`{"email":"new@test.com"}`)
+	if link != "http://localhost:8080/invite?token="+url.QueryEscape(token) {
+		t.Fatal("Unexpected link", link)
+	}
+
+	if m := env.Mail(); len(m.To) != 1 || m.To[0].Address != "new@test.com" || !strings.Contains(m.Text, link) {
+		t.Fatal("Expected the invite to be mailed", m)
+	}
+
+	if rec := env.JSON(http.MethodPost, "/api/auth/logout", ""); rec.Code != http.StatusNoContent {
+		t.Fatal(rec.Code)
+	}
+
+	// The invite is kept if the request is invalid
+	if rec := env.JSON(http.MethodPost, "/api/auth/invite", `{"token":"`+token+`","password":"short"}`); !strings.Contains(rec.Body.String(), apis.ErrCodeInvalidPassword) {
+		t.Fatal("Expected invalid_password, got", rec.Code, rec.Body.String())
+	}
+
+	rec := env.JSON(http.MethodPost, "/api/auth/invite", `{"token":"`+token+`","name":"New","password":"password"}`)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"email":"new@test.com"`) {
+		t.Fatal("Expected the user to be registered, got", rec.Code, rec.Body.String())
+	}
+
+	if _, ok := env.Cookies[env.Config.Cookie.Name]; !ok {
+		t.Fatal("Expected the invited user to be logged in")
+	}
+
+	// Used invites, with the form
+	rec = env.Form(http.MethodPost, "/invite", url.Values{"token": {token}, "password": {"password"}}.Encode())
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/invite?token="+url.QueryEscape(token)+"&error=invalid_token" {
+		t.Fatal("Expected invalid_token, got", rec.Code, rec.Header().Get("Location"))
+	}
+
+	// Users that may manage users, but are no admins, can't invite admins
+	if err := env.App.Roles().Grant(models.ROLE_USER, models.PERMISSION_MANAGE_USERS); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := env.JSON(http.MethodPost, "/api/auth/invites", `{"role":"admin"}`); rec.Code != http.StatusForbidden {
+		t.Fatal("Expected admin invites to need an admin, got", rec.Code)
+	}
+
+	token, _ = invite(`{"uses":2}`)
+
+	// Invites without email verify the email, roles that require a second factor set it up
+	env.App.Users().RequireTwoFactor([]string{models.ROLE_USER})
+	rec = env.Form(http.MethodPost, "/invite", url.Values{"token": {token}, "email": {"team@test.com"}, "password": {"password"}}.Encode())
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/login/2fa?setup=1" {
+		t.Fatal("Expected the second factor setup, got", rec.Code, rec.Header().Get("Location"))
+	}
+
+	if m := env.Mail(); m.To[0].Address != "team@test.com" || !strings.Contains(m.Text, "/verify?token=") {
+		t.Fatal("Expected a verification mail", m)
+	}
+
+	user, err := env.App.Users().SelectByEmail("team@test.com")
+	if err != nil || user.Verified || user.Role != models.ROLE_USER {
+		t.Fatal("Expected an unverified user", user, err)
+	}
+}
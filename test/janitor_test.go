@@ -0,0 +1,115 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Simon-Martens/caveman/db/accesstokens"
+	"github.com/Simon-Martens/caveman/db/users"
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/pocketbase/dbx"
+)
+
+func TestJanitor(t *testing.T) {
+	Clean()
+	app := TestNewManager(t)
+	defer app.Terminate()
+
+	user, err := app.Users().Insert(&users.User{Email: "user@test.com", Active: true}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sessions: one expired, one valid
+	expired, err := app.Sessions().Insert(user.ID, true, "Agent", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid, err := app.Sessions().Insert(user.ID, false, "Agent", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := app.DB().NonConcurrentDB()
+	_, err = db.NewQuery("UPDATE " + db.QuoteTableName(models.DEFAULT_SESSIONS_TABLE) + " SET expires = 1 WHERE id = {:id}").
+		Bind(dbx.Params{"id": expired.ID}).
+		Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Tokens: one expired, one used up, one valid
+	if _, err := app.Tokens().InsertWithDuration(user.ID, 1, "/expired", -time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	usedup, err := app.Tokens().Insert(user.ID, 1, "/used", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := app.Tokens().SelectByAccessToken(usedup.Token, http.MethodGet, "/used"); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := app.Tokens().Insert(user.ID, 1, "/valid", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Revisions: 5 of the test key, the settings have one or more
+	for i := range 5 {
+		if _, err := app.DataStore().Insert(&DataStoreTestData{Thing: string(rune('a' + i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := app.Purge(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Sessions != 1 || r.Tokens != 2 || r.Revisions < 3 {
+		t.Fatalf("Unexpected purge result %+v", r)
+	}
+
+	if _, err := app.Sessions().SelectBySession(valid.Session); err != nil {
+		t.Fatal("Expected the valid session to survive", err)
+	}
+
+	if _, err := app.Tokens().SelectByAccessToken(usedup.Token, http.MethodGet, "/used"); err != accesstokens.ErrAccessTokenNotFound {
+		t.Fatal("Expected the used up token to be deleted, got", err)
+	}
+
+	if _, err := app.Tokens().SelectByAccessToken(token.Token, http.MethodGet, "/valid"); err != nil {
+		t.Fatal("Expected the valid token to survive", err)
+	}
+
+	revs, err := app.DataStore().SelectAll(DataStoreTestData{}.Key())
+	if err != nil || len(revs) != 2 {
+		t.Fatal("Expected 2 revisions to be kept, got", len(revs), err)
+	}
+
+	latest := DataStoreTestData{}
+	if err := json.Unmarshal(revs[0].Data, &latest); err != nil || latest.Thing != "e" {
+		t.Fatal("Expected the latest revision to be kept, got", latest.Thing, err)
+	}
+
+	if _, err := app.DataStore().SelectLatest(models.DATASTORE_SETTINGS_KEY); err != nil {
+		t.Fatal("Expected the settings to survive", err)
+	}
+
+	// The janitor is a built-in job
+	if err := app.RunJob(context.Background(), models.DEFAULT_JANITOR_JOB); err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := app.Jobs().Select(models.DEFAULT_JANITOR_JOB)
+	if err != nil || job.LastRun.IsZero() || job.LastError != "" {
+		t.Fatalf("Expected the janitor run to be recorded, got %+v %v", job, err)
+	}
+}
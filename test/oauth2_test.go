@@ -0,0 +1,329 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Simon-Martens/caveman/apis"
+	"github.com/Simon-Martens/caveman/auth/oauth2"
+	"github.com/Simon-Martens/caveman/auth/oauth2/oidctest"
+	"github.com/Simon-Martens/caveman/db/attempts"
+	"github.com/Simon-Martens/caveman/db/identities"
+	"github.com/Simon-Martens/caveman/db/users"
+	"github.com/Simon-Martens/caveman/manager"
+	"github.com/Simon-Martens/caveman/models"
+)
+
+const oauth2Redirect = "http://localhost:8080/api/auth/oauth2/test/callback"
+
+func TestOAuth2(t *testing.T) {
+	Clean()
+	app := TestNewManager(t)
+	defer app.Terminate()
+
+	s := oidctest.New("client", "secret")
+	defer s.Close()
+
+	p := &oauth2.Provider{Name: "test", Issuer: s.Issuer(), ClientID: s.ClientID, ClientSecret: s.ClientSecret}
+	ctx := context.Background()
+
+	user, err := app.Users().Insert(&users.User{Email: "user@test.com", Active: true}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	begin := func(user *users.User) (string, string) {
+		t.Helper()
+		u, state, err := app.BeginOAuth2(ctx, p, oauth2Redirect, user, "/next")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		code, st, err := s.Authorize(u)
+		if err != nil || st != state {
+			t.Fatal("Expected the state to be sent back", st, state, err)
+		}
+		return code, state
+	}
+
+	finish := func(user, current *users.User) (*manager.OAuth2Login, error) {
+		t.Helper()
+		code, state := begin(user)
+		return app.FinishOAuth2(ctx, p, oauth2Redirect, state, code, current)
+	}
+
+	// Unknown identities need the registration rules
+	s.Login(oidctest.User{Subject: "1", Name: "New User", Email: "new@test.com", EmailVerified: true})
+	if _, err := finish(nil, nil); err != manager.ErrOAuth2NoAccount {
+		t.Fatal("Expected ErrOAuth2NoAccount, got", err)
+	}
+
+	p.Registration = oauth2.Registration{Enabled: true, Role: models.ROLE_ADMIN, Domains: []string{"other.com"}}
+	if _, err := finish(nil, nil); err != manager.ErrOAuth2NoAccount {
+		t.Fatal("Expected other domains to be rejected, got", err)
+	}
+
+	p.Registration.Domains = []string{"test.com"}
+	login, err := finish(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !login.Registered || !login.Linked || login.Link || login.Next != "/next" || login.User.Email != "new@test.com" ||
+		login.User.Name != "New User" || login.User.Role != models.ROLE_ADMIN || !login.User.Verified {
+		t.Fatalf("Unexpected login %+v %+v", login, login.User)
+	}
+
+	registered := login.User
+	if login.Identity.User != registered.ID || login.Identity.Provider != "test" || login.Identity.Subject != "1" {
+		t.Fatalf("Unexpected identity %+v", login.Identity)
+	}
+
+	// Linked identities log in
+	login, err = finish(nil, nil)
+	if err != nil || login.Registered || login.Linked || login.User.ID != registered.ID || login.Identity.LastUsed.IsZero() {
+		t.Fatal("Expected the linked user to log in", login, err)
+	}
+
+	// States work once, for the provider they were issued for
+	code, state := begin(nil)
+	if _, err := app.FinishOAuth2(ctx, p, oauth2Redirect, state, code, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := app.FinishOAuth2(ctx, p, oauth2Redirect, state, code, nil); err != manager.ErrOAuth2State {
+		t.Fatal("Expected the used state to be rejected, got", err)
+	}
+
+	code, state = begin(nil)
+	other := &oauth2.Provider{Name: "other", Issuer: s.Issuer(), ClientID: s.ClientID, ClientSecret: s.ClientSecret}
+	if _, err := app.FinishOAuth2(ctx, other, oauth2Redirect, state, code, nil); err != manager.ErrOAuth2State {
+		t.Fatal("Expected the state of another provider to be rejected, got", err)
+	}
+
+	// ID tokens must match the nonce of the state
+	s.ModifyClaims(func(c map[string]any) { c["nonce"] = "other" })
+	if _, err := finish(nil, nil); !errors.Is(err, manager.ErrOAuth2Invalid) || !errors.Is(err, oauth2.ErrNonceMismatch) {
+		t.Fatal("Expected ErrOAuth2Invalid, got", err)
+	}
+	s.ModifyClaims(nil)
+
+	// Emails of existing users are only linked if the provider allows it
+	s.Login(oidctest.User{Subject: "2", Email: "user@test.com", EmailVerified: true})
+	if _, err := finish(nil, nil); err != manager.ErrOAuth2NoAccount {
+		t.Fatal("Expected ErrOAuth2NoAccount, got", err)
+	}
+
+	p.Registration.LinkByEmail = true
+	s.Login(oidctest.User{Subject: "2", Email: "user@test.com"})
+	if _, err := finish(nil, nil); err != manager.ErrOAuth2NoAccount {
+		t.Fatal("Expected unverified emails not to be linked, got", err)
+	}
+
+	s.Login(oidctest.User{Subject: "2", Email: "user@test.com", EmailVerified: true})
+	login, err = finish(nil, nil)
+	if err != nil || login.Registered || !login.Linked || login.User.ID != user.ID {
+		t.Fatal("Expected the identity to be linked by email", login, err)
+	}
+
+	if _, err := app.Identities().Insert(user.ID, "test", "3", ""); err != identities.ErrProviderLinked {
+		t.Fatal("Expected ErrProviderLinked, got", err)
+	}
+
+	if err := app.Identities().DeleteByID(registered.ID, login.Identity.ID); err != identities.ErrIdentityNotFound {
+		t.Fatal("Expected identities of other users not to be unlinked, got", err)
+	}
+
+	if err := app.Identities().DeleteByID(user.ID, login.Identity.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Links need the state of the user
+	p.Registration = oauth2.Registration{}
+	if _, err := finish(user, nil); err != manager.ErrOAuth2State {
+		t.Fatal("Expected links to need the user, got", err)
+	}
+
+	if _, err := finish(user, registered); err != manager.ErrOAuth2State {
+		t.Fatal("Expected links to need the same user, got", err)
+	}
+
+	login, err = finish(user, user)
+	if err != nil || !login.Link || !login.Linked || login.User.ID != user.ID || login.Identity.Subject != "2" {
+		t.Fatal("Expected the identity to be linked", login, err)
+	}
+
+	s.Login(oidctest.User{Subject: "1", Email: "new@test.com", EmailVerified: true})
+	if _, err := finish(registered, registered); err != nil {
+		t.Fatal("Expected linking the same identity again to work, got", err)
+	}
+
+	if _, err := finish(user, user); err != identities.ErrIdentityExists {
+		t.Fatal("Expected ErrIdentityExists, got", err)
+	}
+
+	// Logins are checked like password logins
+	if err := app.DeactivateUser(registered); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := finish(nil, nil); err != users.ErrUserInactive {
+		t.Fatal("Expected ErrUserInactive, got", err)
+	}
+
+	if err := app.ActivateUser(registered); err != nil {
+		t.Fatal(err)
+	}
+
+	app.Users().RequireTwoFactor([]string{models.ROLE_ADMIN})
+	if login, err := finish(nil, nil); err != users.ErrSecondFactorSetupRequired || login.User.ID != registered.ID {
+		t.Fatal("Expected ErrSecondFactorSetupRequired, got", err)
+	}
+
+	ids, err := app.Identities().SelectByUser(registered.ID)
+	if err != nil || len(ids) != 1 {
+		t.Fatal("Expected one identity", ids, err)
+	}
+}
+
+func TestOAuth2Api(t *testing.T) {
+	Clean()
+
+	s := oidctest.New("client", "secret")
+	defer s.Close()
+
+	env := TestNewApiEnv(t, func(config *apis.ServeConfig) {
+		config.Auth.Providers = []*oauth2.Provider{{
+			Name:         "test",
+			DisplayName:  "Test Provider",
+			Issuer:       s.Issuer(),
+			ClientID:     s.ClientID,
+			ClientSecret: s.ClientSecret,
+			Registration: oauth2.Registration{Enabled: true},
+		}}
+	})
+	defer env.Close()
+	env.SetUp()
+
+	rec := env.JSON(http.MethodGet, "/api/auth/oauth2", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"display_name":"Test Provider"`) {
+		t.Fatal("Expected the providers to be listed", rec.Code, rec.Body.String())
+	}
+
+	if rec := env.JSON(http.MethodGet, "/api/auth/oauth2/unknown", ""); rec.Code != http.StatusNotFound {
+		t.Fatal("Expected 404, got", rec.Code)
+	}
+
+	// authorize starts the flow and returns the callback of the provider
+	authorize := func(rec interface{ Result() *http.Response }) string {
+		t.Helper()
+		res := rec.Result()
+		if res.StatusCode != http.StatusSeeOther || env.Cookies[models.DEFAULT_OAUTH2_COOKIE_NAME] == "" {
+			t.Fatal("Expected a redirect to the provider, got", res.StatusCode)
+		}
+
+		code, state, err := s.Authorize(res.Header.Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return "/api/auth/oauth2/test/callback?" + url.Values{"code": {code}, "state": {state}}.Encode()
+	}
+
+	s.Login(oidctest.User{Subject: "1", Email: "new@test.com", EmailVerified: true})
+	callback := authorize(env.JSON(http.MethodGet, "/api/auth/oauth2/test?next=/home", ""))
+
+	// The state is bound to the browser
+	state := env.Cookies[models.DEFAULT_OAUTH2_COOKIE_NAME]
+	delete(env.Cookies, models.DEFAULT_OAUTH2_COOKIE_NAME)
+	if rec := env.JSON(http.MethodGet, callback, ""); rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/login?error=invalid_token" {
+		t.Fatal("Expected the callback to need the cookie, got", rec.Code, rec.Header().Get("Location"))
+	}
+
+	env.Cookies[models.DEFAULT_OAUTH2_COOKIE_NAME] = state
+	if rec := env.JSON(http.MethodGet, callback, ""); rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/home" {
+		t.Fatal("Expected the login to redirect to next, got", rec.Code, rec.Header().Get("Location"))
+	}
+
+	if _, ok := env.Cookies[models.DEFAULT_OAUTH2_COOKIE_NAME]; ok {
+		t.Fatal("Expected the state cookie to be removed")
+	}
+
+	// Like passkey logins, finished logins forget the challenges of the IP
+	if _, err := env.App.Attempts().Select(attempts.ChallengeKey("192.0.2.1")); err == nil {
+		t.Fatal("Expected the challenges to be reset by the login")
+	}
+
+	rec = env.JSON(http.MethodGet, "/api/auth/identities", "")
+	list := struct {
+		Identities []identities.Identity `json:"identities"`
+	}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); rec.Code != http.StatusOK || err != nil || len(list.Identities) != 1 || list.Identities[0].Email != "new@test.com" {
+		t.Fatal("Expected the identity of the new user", rec.Code, rec.Body.String())
+	}
+
+	if strings.Contains(rec.Body.String(), "subject") {
+		t.Fatal("Expected the subject not to be listed")
+	}
+
+	// Link another identity to the admin
+	if rec := env.JSON(http.MethodPost, "/api/auth/login", `{"email":"admin@test.com","password":"password"}`); rec.Code != http.StatusOK {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+
+	s.Login(oidctest.User{Subject: "2", Email: "other@test.com"})
+	callback = authorize(env.Form(http.MethodPost, "/api/auth/oauth2/test/link", ""))
+	if rec := env.JSON(http.MethodGet, callback, ""); rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/identities" {
+		t.Fatal("Expected the link to redirect to the identities, got", rec.Code, rec.Header().Get("Location"))
+	}
+
+	rec = env.JSON(http.MethodGet, "/api/auth/identities", "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil || len(list.Identities) != 1 || list.Identities[0].Email != "other@test.com" {
+		t.Fatal("Expected the linked identity", rec.Body.String())
+	}
+
+	// Identities of other users can't be linked
+	s.Login(oidctest.User{Subject: "1", Email: "new@test.com", EmailVerified: true})
+	callback = authorize(env.Form(http.MethodPost, "/api/auth/oauth2/test/link", ""))
+	if rec := env.JSON(http.MethodGet, callback, ""); rec.Header().Get("Location") != "/identities?error=identity_linked" {
+		t.Fatal("Expected identity_linked, got", rec.Code, rec.Header().Get("Location"))
+	}
+
+	// Tampered codes
+	s.Login(oidctest.User{Subject: "2"})
+	callback = authorize(env.Form(http.MethodPost, "/api/auth/oauth2/test/link", ""))
+	if rec := env.JSON(http.MethodGet, strings.Replace(callback, "code=", "code=x", 1), ""); rec.Header().Get("Location") != "/identities?error=invalid_credentials" {
+		t.Fatal("Expected invalid_credentials, got", rec.Code, rec.Header().Get("Location"))
+	}
+
+	path := "/api/auth/identities/" + strconv.FormatInt(list.Identities[0].ID, 10)
+	if rec := env.JSON(http.MethodDelete, path, ""); rec.Code != http.StatusNoContent {
+		t.Fatal("Expected the identity to be unlinked, got", rec.Code)
+	}
+
+	if rec := env.JSON(http.MethodDelete, path, ""); rec.Code != http.StatusNotFound {
+		t.Fatal("Expected 404, got", rec.Code)
+	}
+
+	// Unknown identities are registered by the rules of the provider
+	if rec := env.JSON(http.MethodPost, "/api/auth/logout", ""); rec.Code != http.StatusNoContent {
+		t.Fatal(rec.Code)
+	}
+
+	s.Login(oidctest.User{Subject: "3", Email: "unverified@test.com"})
+	callback = authorize(env.JSON(http.MethodGet, "/api/auth/oauth2/test", ""))
+	if rec := env.JSON(http.MethodGet, callback, ""); rec.Header().Get("Location") != "/login?error=no_account" {
+		t.Fatal("Expected no_account, got", rec.Code, rec.Header().Get("Location"))
+	}
+
+	if _, err := env.App.Users().SelectByEmail("unverified@test.com"); err == nil {
+		t.Fatal("Expected no user to be registered")
+	}
+
+}
@@ -0,0 +1,308 @@
+package test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Simon-Martens/caveman/db/attempts"
+	"github.com/Simon-Martens/caveman/db/passkeys"
+	"github.com/Simon-Martens/caveman/db/users"
+	"github.com/Simon-Martens/caveman/manager"
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/Simon-Martens/caveman/tools/webauthn"
+	"github.com/Simon-Martens/caveman/tools/webauthn/webauthntest"
+)
+
+func TestPasskeys(t *testing.T) {
+	Clean()
+	app := TestNewManager(t)
+	defer app.Terminate()
+
+	user, err := app.Users().Insert(&users.User{Email: "user@test.com", Active: true}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := app.Users().Insert(&users.User{Email: "other@test.com", Active: true}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rp := webauthn.RelyingParty{ID: "localhost", Name: "Test", Origins: []string{"http://localhost:8080"}}
+	auth := webauthntest.New(rp.ID, rp.Origins[0])
+
+	// Registration
+	opts, err := app.BeginPasskeyRegistration(rp, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg, err := webauthntest.New(rp.ID, rp.Origins[0]).Create(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := app.FinishPasskeyRegistration(rp, other, "", reg); err != manager.ErrPasskeyChallenge {
+		t.Fatal("Expected challenges of other users to be rejected, got", err)
+	}
+
+	opts, err = app.BeginPasskeyRegistration(rp, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg, err = webauthntest.New(rp.ID, rp.Origins[0]).Create(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pk, err := app.FinishPasskeyRegistration(rp, user, " Laptop ", reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pk.Name != "Laptop" || pk.User != user.ID || pk.CredentialID != reg.ID || len(pk.PublicKey) == 0 {
+		t.Fatalf("Unexpected passkey %+v", pk)
+	}
+
+	if _, err := app.FinishPasskeyRegistration(rp, user, "", reg); err != manager.ErrPasskeyChallenge {
+		t.Fatal("Expected the used challenge to be rejected, got", err)
+	}
+
+	// Register the authenticator of the test
+	opts, err = app.BeginPasskeyRegistration(rp, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(opts.ExcludeCredentials) != 1 || opts.ExcludeCredentials[0].ID.String() != pk.CredentialID {
+		t.Fatal("Expected the passkeys of the user to be excluded", opts.ExcludeCredentials)
+	}
+
+	reg, err = auth.Create(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pk, err = app.FinishPasskeyRegistration(rp, user, "", reg); err != nil || pk.Name != "Passkey" {
+		t.Fatal("Expected the passkey to be registered", pk, err)
+	}
+
+	opts, err = app.BeginPasskeyRegistration(rp, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := auth.Create(opts); err != webauthntest.ErrCredentialExcluded {
+		t.Fatal("Expected the authenticator not to register twice, got", err)
+	}
+
+	// Login
+	login := func() *webauthn.AssertionResponse {
+		t.Helper()
+		opts, err := app.BeginPasskeyLogin(rp)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := auth.Get(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := login()
+	u, used, err := app.FinishPasskeyLogin(rp, resp)
+	if err != nil || u.ID != user.ID || used.ID != pk.ID || used.SignCount != 1 || used.LastUsed.IsZero() {
+		t.Fatal("Expected the passkey to log in the user", u, used, err)
+	}
+
+	if _, _, err := app.FinishPasskeyLogin(rp, resp); err != manager.ErrPasskeyChallenge {
+		t.Fatal("Expected the used challenge to be rejected, got", err)
+	}
+
+	// Cloned authenticators don't increase the counter
+	auth.Credentials()[0].SignCount = 0
+	if _, _, err := app.FinishPasskeyLogin(rp, login()); !errors.Is(err, manager.ErrPasskeyInvalid) || !errors.Is(err, webauthn.ErrSignCount) {
+		t.Fatal("Expected ErrSignCount, got", err)
+	}
+	auth.Credentials()[0].SignCount = 10
+
+	// Logins are checked like password logins
+	if err := app.DeactivateUser(user); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := app.FinishPasskeyLogin(rp, login()); err != users.ErrUserInactive {
+		t.Fatal("Expected ErrUserInactive, got", err)
+	}
+
+	if err := app.ActivateUser(user); err != nil {
+		t.Fatal(err)
+	}
+
+	// Expired challenges are purged
+	opts2, err := app.BeginPasskeyLogin(rp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := app.DB().NonConcurrentDB()
+	if _, err := db.NewQuery("UPDATE " + db.QuoteTableName(models.DEFAULT_DATASTORE_TABLE) + " SET modified = 1 WHERE key LIKE 'passkey:%'").Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := app.Purge(models.DEFAULT_DATASTORE_RETENTION)
+	if err != nil || r.Challenges != 1 {
+		t.Fatal("Expected the janitor to purge the challenge", r, err)
+	}
+
+	expired, err := auth.Get(opts2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := app.FinishPasskeyLogin(rp, expired); err != manager.ErrPasskeyChallenge {
+		t.Fatal("Expected the expired challenge to be rejected, got", err)
+	}
+
+	// Removal
+	if err := app.Passkeys().DeleteByID(other.ID, pk.ID); err != passkeys.ErrPasskeyNotFound {
+		t.Fatal("Expected passkeys of other users not to be removed, got", err)
+	}
+
+	if err := app.Passkeys().DeleteByID(user.ID, pk.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := app.FinishPasskeyLogin(rp, login()); err != manager.ErrPasskeyInvalid {
+		t.Fatal("Expected the removed passkey to be rejected, got", err)
+	}
+}
+
+func TestPasskeysApi(t *testing.T) {
+	Clean()
+	env := TestNewApiEnv(t)
+	defer env.Close()
+	env.SetUp()
+
+	// The relying party is derived from the URL setting
+	auth := webauthntest.New("localhost", "http://localhost:8080")
+
+	if rec := env.JSON(http.MethodPost, "/api/auth/passkeys/register/begin", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatal("Expected the registration to require a session, got", rec.Code)
+	}
+
+	if rec := env.JSON(http.MethodPost, "/api/auth/login", `{"email":"admin@test.com","password":"password"}`); rec.Code != http.StatusOK {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+
+	rec := env.JSON(http.MethodPost, "/api/auth/passkeys/register/begin", "")
+	creation := struct {
+		PublicKey webauthn.CreationOptions `json:"publicKey"`
+	}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &creation); rec.Code != http.StatusOK || err != nil {
+		t.Fatal("Expected creation options, got", rec.Code, rec.Body.String())
+	}
+
+	if creation.PublicKey.RP.ID != "localhost" || creation.PublicKey.RP.Name != "Test" || creation.PublicKey.User.Name != "admin@test.com" {
+		t.Fatalf("Unexpected creation options %+v", creation.PublicKey)
+	}
+
+	reg, err := auth.Create(&creation.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := json.Marshal(map[string]any{"name": "Laptop", "credential": reg})
+	if rec := env.JSON(http.MethodPost, "/api/auth/passkeys/register", string(body)); rec.Code != http.StatusOK {
+		t.Fatal("Expected the passkey to be registered, got", rec.Code, rec.Body.String())
+	}
+
+	rec = env.JSON(http.MethodGet, "/api/auth/passkeys", "")
+	list := struct {
+		Passkeys []passkeys.Passkey `json:"passkeys"`
+	}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil || len(list.Passkeys) != 1 || list.Passkeys[0].Name != "Laptop" {
+		t.Fatal("Expected the passkey to be listed", rec.Body.String())
+	}
+
+	if strings.Contains(rec.Body.String(), "public_key") {
+		t.Fatal("Expected the public key not to be listed")
+	}
+
+	// Login without password
+	if rec := env.JSON(http.MethodPost, "/api/auth/logout", ""); rec.Code != http.StatusNoContent {
+		t.Fatal(rec.Code)
+	}
+
+	login := func() string {
+		t.Helper()
+		rec := env.JSON(http.MethodPost, "/api/auth/passkeys/login/begin", "")
+		request := struct {
+			PublicKey webauthn.RequestOptions `json:"publicKey"`
+		}{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &request); rec.Code != http.StatusOK || err != nil {
+			t.Fatal("Expected request options, got", rec.Code, rec.Body.String())
+		}
+
+		resp, err := auth.Get(&request.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, _ := json.Marshal(map[string]any{"credential": resp, "remember": true})
+		return string(body)
+	}
+
+	body2 := login()
+	if rec := env.JSON(http.MethodPost, "/api/auth/passkeys/login", body2); rec.Code != http.StatusOK {
+		t.Fatal("Expected the passkey login to work, got", rec.Code, rec.Body.String())
+	}
+
+	if rec := env.JSON(http.MethodGet, "/api/auth/sessions", ""); rec.Code != http.StatusOK {
+		t.Fatal("Expected a session, got", rec.Code)
+	}
+
+	if rec := env.JSON(http.MethodPost, "/api/auth/passkeys/login", body2); rec.Code != http.StatusBadRequest {
+		t.Fatal("Expected the replay to be rejected, got", rec.Code)
+	}
+
+	// Finished logins forget the challenges, unfinished ones are limited per IP
+	if _, err := env.App.Attempts().Select(attempts.ChallengeKey("192.0.2.1")); err == nil {
+		t.Fatal("Expected the challenges to be reset by the login")
+	}
+
+	for range models.DEFAULT_LOGIN_FREE_ATTEMPTS + 1 {
+		if rec := env.JSON(http.MethodPost, "/api/auth/passkeys/login/begin", ""); rec.Code != http.StatusOK {
+			t.Fatal("Expected request options, got", rec.Code)
+		}
+	}
+
+	if rec := env.JSON(http.MethodPost, "/api/auth/passkeys/login/begin", ""); rec.Code != http.StatusTooManyRequests {
+		t.Fatal("Expected unfinished logins to be limited, got", rec.Code)
+	}
+
+	if err := env.App.Attempts().Reset(attempts.ChallengeKey("192.0.2.1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Removed passkeys can't log in
+	path := "/api/auth/passkeys/" + strconv.FormatInt(list.Passkeys[0].ID, 10)
+	if rec := env.JSON(http.MethodDelete, path, ""); rec.Code != http.StatusNoContent {
+		t.Fatal("Expected the passkey to be removed, got", rec.Code)
+	}
+
+	if rec := env.JSON(http.MethodDelete, path, ""); rec.Code != http.StatusNotFound {
+		t.Fatal("Expected 404, got", rec.Code)
+	}
+
+	if rec := env.JSON(http.MethodPost, "/api/auth/passkeys/login", login()); rec.Code != http.StatusUnauthorized {
+		t.Fatal("Expected the removed passkey to be rejected, got", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,148 @@
+package test
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Simon-Martens/caveman/apis"
+	"github.com/Simon-Martens/caveman/db/users"
+)
+
+func TestPasswordApi(t *testing.T) {
+	Clean()
+	links := make(chan string, 1)
+	env := TestNewApiEnv(t, func(config *apis.ServeConfig) {
+		config.Auth.SendPasswordReset = func(user *users.User, link string) error {
+			links <- link
+			return nil
+		}
+	})
+	defer env.Close()
+	user := env.SetUp()
+
+	// Another device of the user
+	other, err := env.App.Sessions().Insert(user.ID, false, "Other", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Password change of a logged in user
+	rec := env.JSON(http.MethodPost, "/api/auth/login", `{"email":"admin@test.com","password":"password"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatal("Expected successful login, got", rec.Code)
+	}
+
+	rec = env.JSON(http.MethodPost, "/api/auth/password", `{"old_password":"wrongpassword","password":"newpassword"}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatal("Expected wrong old password to fail, got", rec.Code)
+	}
+
+	old := env.Cookies[env.Config.Cookie.Name]
+	rec = env.JSON(http.MethodPost, "/api/auth/password", `{"old_password":"password","password":"newpassword"}`)
+	if rec.Code != http.StatusNoContent {
+		t.Fatal("Expected password change, got", rec.Code, rec.Body.String())
+	}
+
+	if env.Cookies[env.Config.Cookie.Name] == old {
+		t.Fatal("Expected the session token to be rotated on password change")
+	}
+
+	if _, err := env.App.Sessions().SelectBySession(other.Session); err == nil {
+		t.Fatal("Other sessions should be deleted on password change")
+	}
+
+	if _, err := env.App.Sessions().SelectBySession(env.Cookies[env.Config.Cookie.Name]); err != nil {
+		t.Fatal("The current session should survive a password change")
+	}
+
+	if _, err := env.App.Users().CheckGetUser(user.Email, "newpassword"); err != nil {
+		t.Fatal("Expected the new password to work", err)
+	}
+
+	// Password reset, the response doesn't tell if the user exists
+	rec = env.JSON(http.MethodPost, "/api/auth/forgot", `{"email":"nobody@test.com"}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatal("Expected accepted, got", rec.Code, rec.Body.String())
+	}
+
+	rec = env.JSON(http.MethodPost, "/api/auth/forgot", `{"email":"admin@test.com"}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatal("Expected accepted, got", rec.Code, rec.Body.String())
+	}
+
+	var link string
+	select {
+	case link = <-links:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a reset link to be sent")
+	}
+
+	u, err := url.Parse(link)
+	if err != nil || u.Path != env.Config.Auth.ResetPage {
+		t.Fatal("Unexpected reset link", link)
+	}
+	token := u.Query().Get("token")
+
+	// One link per cooldown, so the form can't flood the mailbox
+	rec = env.JSON(http.MethodPost, "/api/auth/forgot", `{"email":"admin@test.com"}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatal("Expected accepted, got", rec.Code, rec.Body.String())
+	}
+
+	select {
+	case <-links:
+		t.Fatal("Expected no second reset link within the cooldown")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	rec = env.JSON(http.MethodPost, "/api/auth/reset", `{"token":"`+token+`","password":"short"}`)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), apis.ErrCodeInvalidPassword) {
+		t.Fatal("Expected short password to fail, got", rec.Code, rec.Body.String())
+	}
+
+	rec = env.JSON(http.MethodPost, "/api/auth/reset", `{"token":"`+token+`","password":"resetpassword"}`)
+	if rec.Code != http.StatusNoContent {
+		t.Fatal("Expected password reset, got", rec.Code, rec.Body.String())
+	}
+
+	if _, err := env.App.Users().CheckGetUser(user.Email, "resetpassword"); err != nil {
+		t.Fatal("Expected the reset password to work", err)
+	}
+
+	if _, ok := env.Cookies[env.Config.Cookie.Name]; ok {
+		t.Fatal("All sessions should be deleted on password reset")
+	}
+
+	rec = env.JSON(http.MethodPost, "/api/auth/reset", `{"token":"`+token+`","password":"anotherpassword"}`)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), apis.ErrCodeInvalidToken) {
+		t.Fatal("Expected the reset token to be single use, got", rec.Code, rec.Body.String())
+	}
+}
+
+func TestPasswordResetTerminate(t *testing.T) {
+	Clean()
+	var sent atomic.Bool
+	env := TestNewApiEnv(t, func(config *apis.ServeConfig) {
+		config.Auth.SendPasswordReset = func(user *users.User, link string) error {
+			time.Sleep(100 * time.Millisecond)
+			sent.Store(true)
+			return nil
+		}
+	})
+	env.SetUp()
+
+	rec := env.JSON(http.MethodPost, "/api/auth/forgot", `{"email":"admin@test.com"}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatal("Expected accepted, got", rec.Code, rec.Body.String())
+	}
+
+	// Links are sent in the background, the manager waits for them
+	env.Close()
+	if !sent.Load() {
+		t.Fatal("Expected the reset link to be sent before the manager terminated")
+	}
+}
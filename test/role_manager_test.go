@@ -0,0 +1,131 @@
+package test
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/Simon-Martens/caveman/db/roles"
+	"github.com/Simon-Martens/caveman/db/users"
+	"github.com/Simon-Martens/caveman/migrations"
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/pocketbase/dbx"
+)
+
+func TestRoleManager(t *testing.T) {
+	Clean()
+	dbenv := TestNewDatabaseEnv(t)
+	defer dbenv.Close()
+	rm := dbenv.RM
+
+	if !rm.IsRole(models.ROLE_ADMIN) || !rm.IsRole(models.ROLE_USER) {
+		t.Fatal("Expected the built-in roles to be registered")
+	}
+
+	if err := rm.RegisterRole(roles.Role{Name: models.ROLE_USER}); err != roles.ErrRoleExists {
+		t.Fatal("Expected ErrRoleExists, got", err)
+	}
+
+	if err := rm.RegisterRole(roles.Role{Name: "editor"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rm.RegisterPermission(roles.Permission{Name: "posts.edit"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rm.Grant("editor", "posts.delete"); err != roles.ErrPermissionNotFound {
+		t.Fatal("Expected ErrPermissionNotFound, got", err)
+	}
+
+	if err := rm.Grant("nobody", "posts.edit"); err != roles.ErrRoleNotFound {
+		t.Fatal("Expected ErrRoleNotFound, got", err)
+	}
+
+	if err := rm.Grant(models.ROLE_ADMIN, "posts.edit"); err != roles.ErrAdminRole {
+		t.Fatal("Expected ErrAdminRole, got", err)
+	}
+
+	for range 2 {
+		if err := rm.Grant("editor", "posts.edit"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if ok, err := rm.Has("editor", "posts.edit"); !ok || err != nil {
+		t.Fatal("Expected editor to have posts.edit", err)
+	}
+
+	if ok, _ := rm.Has(models.ROLE_USER, "posts.edit"); ok {
+		t.Fatal("Expected user not to have posts.edit")
+	}
+
+	if ok, _ := rm.Has(models.ROLE_ADMIN, "posts.edit"); !ok {
+		t.Fatal("Expected admin to have every permission")
+	}
+
+	granted, err := rm.Granted("editor")
+	if err != nil || !slices.Equal(granted, []string{"posts.edit"}) {
+		t.Fatal("Unexpected grants", granted, err)
+	}
+
+	if err := rm.Revoke("editor", "posts.edit"); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, _ := rm.Has("editor", "posts.edit"); ok {
+		t.Fatal("Expected the permission to be revoked")
+	}
+}
+
+func TestUserRolesMigration(t *testing.T) {
+	Clean()
+	app := TestNewManager(t)
+	defer app.Terminate()
+
+	admin, err := app.Users().Insert(&users.User{Email: "admin@test.com"}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := app.Users().Insert(&users.User{Email: "user@test.com"}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Roles as they were stored before
+	db := app.DB().NonConcurrentDB()
+	tn := db.QuoteTableName(models.DEFAULT_USERS_TABLE)
+	for id, role := range map[int64]int{admin.ID: 3, user.ID: 1} {
+		_, err := db.NewQuery("UPDATE " + tn + " SET role = {:role} WHERE id = {:id}").
+			Bind(dbx.Params{"role": role, "id": id}).
+			Execute()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, m := range migrations.AppMigrations.Items() {
+		if m.File == "1729000000_user_roles.go" {
+			if err := m.Up(db); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	admin, err = app.Users().Select(admin.ID)
+	if err != nil || admin.Role != models.ROLE_ADMIN {
+		t.Fatal("Expected role 3 to become admin, got", admin.Role, err)
+	}
+
+	if u, _ := app.Users().Select(user.ID); u.Role != models.ROLE_USER {
+		t.Fatal("Expected role 1 to become user, got", u.Role)
+	}
+
+	if ok, err := app.Users().HasAdmins(); !ok || err != nil {
+		t.Fatal("Expected the migrated admin to be found", err)
+	}
+
+	if !app.Can(admin, models.PERMISSION_MANAGE_SETTINGS) {
+		t.Fatal("Expected admins to have every permission")
+	}
+}
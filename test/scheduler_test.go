@@ -0,0 +1,227 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/Simon-Martens/caveman/scheduler"
+	"github.com/pocketbase/dbx"
+)
+
+func TestScheduler(t *testing.T) {
+	Clean()
+	app := TestNewManager(t)
+	defer app.Terminate()
+
+	var runs atomic.Int64
+	if err := app.RegisterJob("count", "0 3 * * *", func(ctx context.Context) error {
+		runs.Add(1)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.RegisterJob("count", "* * * * *", func(ctx context.Context) error { return nil }); !errors.Is(err, scheduler.ErrJobExists) {
+		t.Fatal("Expected ErrJobExists, got", err)
+	}
+
+	if err := app.RegisterJob("invalid", "* * *", func(ctx context.Context) error { return nil }); !errors.Is(err, scheduler.ErrInvalidSpec) {
+		t.Fatal("Expected ErrInvalidSpec, got", err)
+	}
+
+	if err := app.RunJob(context.Background(), "unknown"); !errors.Is(err, scheduler.ErrJobNotFound) {
+		t.Fatal("Expected ErrJobNotFound, got", err)
+	}
+
+	// The next run is persisted on registration
+	job, err := app.Jobs().Select("count")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if job.NextRun.IsZero() || job.NextRun.Time().Hour() != 3 || !job.LastRun.IsZero() {
+		t.Fatalf("Unexpected job state %+v", job)
+	}
+
+	// Manual runs don't change the schedule
+	if err := app.RunJob(context.Background(), "count"); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := app.Jobs().Select("count")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if runs.Load() != 1 || after.LastRun.IsZero() || after.IsRunning() || after.NextRun.Int() != job.NextRun.Int() {
+		t.Fatalf("Unexpected job state after run %+v", after)
+	}
+
+	// A run that was due while the app was down is made up for on start
+	db := app.DB().NonConcurrentDB()
+	_, err = db.NewQuery("UPDATE " + db.QuoteTableName(models.DEFAULT_JOBS_TABLE) + " SET next_run = 1 WHERE name = 'count'").
+		Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.Bootstrap(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.Scheduler().Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool { return runs.Load() == 2 })
+	app.Scheduler().Stop()
+
+	after, err = app.Jobs().Select("count")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !after.NextRun.Time().After(time.Now()) {
+		t.Fatal("Expected the next run to be rescheduled, got", after.NextRun)
+	}
+
+	// The janitor is built-in
+	list, err := app.Scheduler().Jobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list) != 2 || list[0].Name != "count" || list[1].Name != models.DEFAULT_JANITOR_JOB {
+		t.Fatalf("Unexpected jobs %+v", list)
+	}
+}
+
+func TestSchedulerErrors(t *testing.T) {
+	Clean()
+	app := TestNewManager(t)
+	defer app.Terminate()
+
+	if err := app.RegisterJob("fail", "@daily", func(ctx context.Context) error {
+		return errors.New("disk full")
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.RegisterJob("panic", "@daily", func(ctx context.Context) error {
+		panic("oops")
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.RunJob(context.Background(), "fail"); err == nil || err.Error() != "disk full" {
+		t.Fatal("Expected the job error, got", err)
+	}
+
+	job, err := app.Jobs().Select("fail")
+	if err != nil || job.LastError != "disk full" || job.IsRunning() {
+		t.Fatalf("Expected the error to be recorded, got %+v %v", job, err)
+	}
+
+	if err := app.RunJob(context.Background(), "panic"); err == nil {
+		t.Fatal("Expected the panic to be returned as error")
+	}
+
+	job, err = app.Jobs().Select("panic")
+	if err != nil || job.LastError == "" || job.IsRunning() {
+		t.Fatalf("Expected the panic to be recorded, got %+v %v", job, err)
+	}
+}
+
+func TestSchedulerOverlap(t *testing.T) {
+	Clean()
+	app := TestNewManager(t)
+	defer app.Terminate()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	if err := app.Scheduler().Add(scheduler.Job{
+		Name:    "slow",
+		Spec:    "@daily",
+		Timeout: time.Minute,
+		Func: func(ctx context.Context) error {
+			close(started)
+			<-release
+			return nil
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- app.RunJob(context.Background(), "slow")
+	}()
+
+	<-started
+
+	if err := app.RunJob(context.Background(), "slow"); !errors.Is(err, scheduler.ErrJobRunning) {
+		t.Fatal("Expected ErrJobRunning, got", err)
+	}
+
+	// Another process, sharing the database
+	other := scheduler.New()
+	if err := other.Add(scheduler.Job{
+		Name:    "slow",
+		Spec:    "@daily",
+		Timeout: time.Minute,
+		Func:    func(ctx context.Context) error { return nil },
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := other.UseStore(app.Jobs()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := other.Run(context.Background(), "slow"); !errors.Is(err, scheduler.ErrJobRunning) {
+		t.Fatal("Expected ErrJobRunning from the other process, got", err)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := other.Run(context.Background(), "slow"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Locks of crashed processes are taken over after the timeout
+	db := app.DB().NonConcurrentDB()
+	_, err := db.NewQuery("UPDATE " + db.QuoteTableName(models.DEFAULT_JOBS_TABLE) + " SET running_since = {:since} WHERE name = 'slow'").
+		Bind(dbx.Params{"since": time.Now().Add(-2 * time.Minute).UnixMicro()}).
+		Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := other.Run(context.Background(), "slow"); err != nil {
+		t.Fatal("Expected the stale lock to be taken over, got", err)
+	}
+}
+
+func waitFor(t *testing.T, f func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !f() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
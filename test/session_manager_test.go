@@ -1,9 +1,17 @@
 package test
 
 import (
+	"net/http"
 	"testing"
+	"time"
 
 	"github.com/Simon-Martens/caveman/db/sessions"
+	"github.com/Simon-Martens/caveman/db/users"
+	"github.com/Simon-Martens/caveman/migrations"
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/Simon-Martens/caveman/tools/security"
+	"github.com/Simon-Martens/caveman/tools/types"
+	"github.com/pocketbase/dbx"
 )
 
 func TestSessionManager(t *testing.T) {
@@ -56,6 +64,15 @@ func TestSessionManager(t *testing.T) {
 		t.Fatal("CSRF Token is valid for another session")
 	}
 
+	acsrf := dbenv.SM.CreateAnonymousCSRFToken("visitor")
+	if !dbenv.SM.ValidateAnonymousCSRFToken("visitor", acsrf) {
+		t.Fatal("Anonymous CSRF Token is invalid")
+	}
+
+	if dbenv.SM.ValidateAnonymousCSRFToken("another visitor", acsrf) || dbenv.SM.ValidateCSRFToken(sess, acsrf) {
+		t.Fatal("Anonymous CSRF Token is valid for another visitor")
+	}
+
 	// TODO: session expiration test
 	sess3, err := dbenv.SM.InsertEternal(sess.User, "User-Agent", "127.0.0.1")
 	if err != nil {
@@ -83,3 +100,304 @@ func TestSessionManager(t *testing.T) {
 
 	dbenv.Close()
 }
+
+func TestCSRFTokenExpiration(t *testing.T) {
+	Clean()
+	dbenv := TestNewDatabaseEnv(t)
+
+	sm, err := sessions.New(dbenv.DB,
+		models.DEFAULT_SESSIONS_TABLE,
+		models.DEFAULT_USERS_TABLE,
+		models.DEFAULT_ID_FIELD,
+		models.DEFAULT_LONG_SESSION_EXPIRATION,
+		models.DEFAULT_SHORT_SESSION_EXPIRATION,
+		1,
+		0,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	csrf := sm.CreateAnonymousCSRFToken("visitor")
+	if !sm.ValidateAnonymousCSRFToken("visitor", csrf) {
+		t.Fatal("CSRF Token is invalid")
+	}
+
+	time.Sleep(2100 * time.Millisecond)
+
+	if sm.ValidateAnonymousCSRFToken("visitor", csrf) {
+		t.Fatal("CSRF Token should be expired")
+	}
+
+	dbenv.Close()
+}
+
+func TestHMACKeyPersistence(t *testing.T) {
+	Clean()
+	dbenv := TestNewDatabaseEnv(t)
+
+	newSM := func() *sessions.SessionManager {
+		sm, err := sessions.New(dbenv.DB,
+			models.DEFAULT_SESSIONS_TABLE,
+			models.DEFAULT_USERS_TABLE,
+			models.DEFAULT_ID_FIELD,
+			models.DEFAULT_LONG_SESSION_EXPIRATION,
+			models.DEFAULT_SHORT_SESSION_EXPIRATION,
+			models.DEFAULT_CSRF_EXPIRATION,
+			0,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := sm.UseDataStore(dbenv.DSM); err != nil {
+			t.Fatal(err)
+		}
+
+		return sm
+	}
+
+	// Two processes, or one process before and after a restart
+	sm1 := newSM()
+	sm2 := newSM()
+
+	csrf := sm1.CreateAnonymousCSRFToken("visitor")
+	if !sm2.ValidateAnonymousCSRFToken("visitor", csrf) {
+		t.Fatal("CSRF Token should be valid after a restart")
+	}
+
+	if err := sm1.RotateHMACKey(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !sm1.ValidateAnonymousCSRFToken("visitor", csrf) {
+		t.Fatal("CSRF Token of the previous key should be valid in the grace period")
+	}
+
+	// sm2 does not know the new key yet and must reload it
+	rotated := sm1.CreateAnonymousCSRFToken("visitor")
+	if !sm2.ValidateAnonymousCSRFToken("visitor", rotated) {
+		t.Fatal("CSRF Token of the rotated key should be valid in another process")
+	}
+
+	if err := sm1.RotateHMACKey(); err != nil {
+		t.Fatal(err)
+	}
+
+	if sm1.ValidateAnonymousCSRFToken("visitor", csrf) {
+		t.Fatal("CSRF Token of a key rotated out twice should be invalid")
+	}
+
+	// sm2 has a stale key and must demote the key sm1 rotated to
+	current := sm1.CreateAnonymousCSRFToken("visitor")
+	if err := sm2.RotateHMACKey(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !sm2.ValidateAnonymousCSRFToken("visitor", current) {
+		t.Fatal("CSRF Token of the stored key should be valid after a rotation by another process")
+	}
+
+	dbenv.Close()
+}
+
+func TestSlidingExpiration(t *testing.T) {
+	Clean()
+	dbenv := TestNewDatabaseEnv(t)
+	defer dbenv.Close()
+
+	user, err := dbenv.UM.Insert(&TestSuperAdmin, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sess, err := dbenv.SM.Insert(user.ID, true, "User-Agent", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !dbenv.SM.IsShort(sess) {
+		t.Fatal("Expected a short session")
+	}
+
+	if renewed, err := dbenv.SM.Touch(sess); renewed || err != nil {
+		t.Fatal("Sessions must not be renewed without sliding expiration", err)
+	}
+
+	dbenv.SM.UseSlidingExpiration(60)
+
+	// The session was used 10 minutes ago for the last time
+	lifetime := sess.Lifetime()
+	db := dbenv.DB.NonConcurrentDB()
+	past := types.NowDateTime()
+	past, _ = past.Add(-10 * time.Minute)
+	exp, _ := past.Add(lifetime)
+	_, err = db.NewQuery("UPDATE " + db.QuoteTableName(models.DEFAULT_SESSIONS_TABLE) + " SET modified = {:mod}, expires = {:exp} WHERE id = {:id}").
+		Bind(dbx.Params{"mod": past, "exp": exp, "id": sess.ID}).
+		Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sess, err = dbenv.SM.SelectBySession(sess.Session)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two requests of the same session at once
+	other := *sess
+	if renewed, err := dbenv.SM.Touch(sess); !renewed || err != nil {
+		t.Fatal("Expected the session to be renewed", err)
+	}
+
+	if renewed, _ := dbenv.SM.Touch(&other); renewed {
+		t.Fatal("Expected the session to be renewed only once")
+	}
+
+	if time.Until(*sess.Expires.Time()) < lifetime-time.Minute || sess.Lifetime() != lifetime {
+		t.Fatal("Expected the session to keep its lifetime, got", sess.Lifetime())
+	}
+
+	if renewed, _ := dbenv.SM.Touch(sess); renewed {
+		t.Fatal("Expected no renewal within the interval")
+	}
+
+	selected, err := dbenv.SM.SelectBySession(sess.Session)
+	if err != nil || selected.Expires.Int() != sess.Expires.Int() {
+		t.Fatal("Expected the renewal to be stored", err)
+	}
+}
+
+func TestSessionRotation(t *testing.T) {
+	Clean()
+	dbenv := TestNewDatabaseEnv(t)
+	defer dbenv.Close()
+
+	user, err := dbenv.UM.Insert(&TestSuperAdmin, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sess, err := dbenv.SM.Insert(user.ID, false, "User-Agent", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := dbenv.SM.Rotate(sess)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rotated.ID != sess.ID || rotated.Session == sess.Session || rotated.Expires.Int() != sess.Expires.Int() {
+		t.Fatal("Expected the same session with a new token")
+	}
+
+	if _, err := dbenv.SM.SelectBySession(sess.Session); err == nil {
+		t.Fatal("Expected the old token to be invalid")
+	}
+
+	if _, err := dbenv.SM.SelectBySession(rotated.Session); err != nil {
+		t.Fatal("Expected the new token to be valid", err)
+	}
+
+	if _, err := dbenv.SM.Rotate(sess); err != sessions.ErrSessionNotFound {
+		t.Fatal("Expected an old token not to be rotated again, got", err)
+	}
+}
+
+func TestTokensHashedAtRest(t *testing.T) {
+	Clean()
+	app := TestNewManager(t)
+	defer app.Terminate()
+
+	user, err := app.Users().Insert(&users.User{Email: "user@test.com", Active: true}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sess, err := app.Sessions().Insert(user.ID, true, "Agent", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	at, err := app.Tokens().Insert(user.ID, 2, "/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the digests are stored
+	db := app.DB().NonConcurrentDB()
+	stored := struct {
+		Value string `db:"value"`
+	}{}
+
+	err = db.NewQuery("SELECT session AS value FROM " + db.QuoteTableName(models.DEFAULT_SESSIONS_TABLE) + " WHERE id = {:id}").
+		Bind(dbx.Params{"id": sess.ID}).
+		One(&stored)
+	if err != nil || stored.Value != security.HashToken(sess.Session) || stored.Value == sess.Session {
+		t.Fatal("Expected the session digest to be stored, got", stored.Value, err)
+	}
+
+	err = db.NewQuery("SELECT token AS value FROM " + db.QuoteTableName(models.DEFAULT_ACCESS_TOKENS_TABLE) + " WHERE id = {:id}").
+		Bind(dbx.Params{"id": at.ID}).
+		One(&stored)
+	if err != nil || stored.Value != security.HashToken(at.Token) || stored.Value == at.Token {
+		t.Fatal("Expected the access token digest to be stored, got", stored.Value, err)
+	}
+
+	// The stored digest is no valid token
+	if _, err := app.Sessions().SelectBySession(sess.Hash); err != sessions.ErrSessionNotFound {
+		t.Fatal("Expected the digest to be rejected, got", err)
+	}
+
+	s, err := app.Sessions().SelectBySession(sess.Session)
+	if err != nil || s.ID != sess.ID || s.Session != sess.Session {
+		t.Fatal("Expected the session to be found by its token", s, err)
+	}
+
+	// Tokens stored in plain text before are rehashed by the migration, digests
+	// are kept, so the migration may run on tokens created before it ran
+	plain, err := app.Sessions().Insert(user.ID, true, "Agent", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range []struct {
+		table, column, token string
+		id                   int64
+	}{
+		{models.DEFAULT_SESSIONS_TABLE, "session", plain.Session, plain.ID},
+		{models.DEFAULT_ACCESS_TOKENS_TABLE, "token", at.Token, at.ID},
+	} {
+		_, err = db.NewQuery("UPDATE " + db.QuoteTableName(r.table) + " SET " + r.column + " = {:token} WHERE id = {:id}").
+			Bind(dbx.Params{"token": r.token, "id": r.id}).
+			Execute()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := app.Sessions().SelectBySession(plain.Session); err != sessions.ErrSessionNotFound {
+		t.Fatal("Expected plain text sessions not to be found before the migration, got", err)
+	}
+
+	for _, m := range migrations.AppMigrations.Items() {
+		if m.File == "1729200000_hashed_tokens.go" {
+			for range 2 {
+				if err := m.Up(db); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+
+	for _, token := range []string{plain.Session, sess.Session} {
+		if _, err := app.Sessions().SelectBySession(token); err != nil {
+			t.Fatal("Expected the session to be found after the migration", err)
+		}
+	}
+
+	if _, err := app.Tokens().SelectByAccessToken(at.Token, http.MethodGet, "/"); err != nil {
+		t.Fatal("Expected the access token to be found after the migration", err)
+	}
+}
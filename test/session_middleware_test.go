@@ -0,0 +1,122 @@
+package test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Simon-Martens/caveman/apis"
+	"github.com/Simon-Martens/caveman/db/users"
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/labstack/echo/v4"
+)
+
+func TestSessionMiddleware(t *testing.T) {
+	Clean()
+	app := TestNewManager(t)
+	defer app.Terminate()
+
+	user, err := app.Users().Insert(&users.User{
+		Name:   "Mr. Middleware",
+		Email:  "middleware@test.com",
+		Role:   models.ROLE_USER,
+		Active: true,
+	}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sess, err := app.Sessions().Insert(user.ID, false, "User-Agent", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := apis.DefaultCookieConfig(true)
+
+	e := echo.New()
+	e.Use(apis.LoadSession(app, config))
+	e.GET("/me", func(c echo.Context) error {
+		return c.String(http.StatusOK, apis.GetUser(c).Email)
+	}, apis.RequireAuth())
+	e.GET("/admin", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	}, apis.RequireRole(models.ROLE_ADMIN))
+	e.GET("/users", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	}, apis.RequirePermission(app, models.PERMISSION_MANAGE_USERS))
+
+	request := func(path, cookie string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: config.Name, Value: cookie})
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := request("/me", "")
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatal("Expected 401 without a session, got", rec.Code)
+	}
+
+	rec = request("/me", sess.Session)
+	if rec.Code != http.StatusOK || rec.Body.String() != user.Email {
+		t.Fatal("Expected the user of the session, got", rec.Code, rec.Body.String())
+	}
+
+	seen, err := app.Users().Select(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if seen.LastSeen.IsZero() {
+		t.Fatal("LastSeen should have been updated")
+	}
+
+	rec = request("/admin", sess.Session)
+	if rec.Code != http.StatusForbidden {
+		t.Fatal("Expected 403 for a user with another role, got", rec.Code)
+	}
+
+	rec = request("/users", sess.Session)
+	if rec.Code != http.StatusForbidden {
+		t.Fatal("Expected 403 for a user without the permission, got", rec.Code)
+	}
+
+	if err := app.Roles().Grant(models.ROLE_USER, models.PERMISSION_MANAGE_USERS); err != nil {
+		t.Fatal(err)
+	}
+
+	rec = request("/users", sess.Session)
+	if rec.Code != http.StatusOK {
+		t.Fatal("Expected 200 after the permission was granted, got", rec.Code)
+	}
+
+	rec = request("/me", "invalid")
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatal("Expected 401 for an invalid session, got", rec.Code)
+	}
+
+	cleared := rec.Result().Cookies()
+	if len(cleared) != 1 || cleared[0].MaxAge >= 0 {
+		t.Fatal("Invalid session cookie should be cleared")
+	}
+
+	// Short sessions get a browser session cookie, long sessions a persistent one
+	rec = httptest.NewRecorder()
+	c := e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+	apis.SetSessionCookie(c, config, sess, true)
+	ck := rec.Result().Cookies()[0]
+	if !ck.Expires.IsZero() || !ck.HttpOnly || !ck.Secure {
+		t.Fatal("Short session cookie is wrong: ", ck)
+	}
+
+	rec = httptest.NewRecorder()
+	c = e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+	apis.SetSessionCookie(c, config, sess, false)
+	ck = rec.Result().Cookies()[0]
+	if ck.Expires.IsZero() || ck.MaxAge <= 0 {
+		t.Fatal("Long session cookie is wrong: ", ck)
+	}
+}
@@ -0,0 +1,131 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/Simon-Martens/caveman/db/sessions"
+	"github.com/Simon-Martens/caveman/db/users"
+)
+
+const testAgent = "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0"
+
+func listSessions(env *ApiEnv, path string) []sessions.SessionView {
+	rec := env.Request(http.MethodGet, path, "", "")
+	if rec.Code != http.StatusOK {
+		env.T.Fatal("Expected the sessions, got", rec.Code, rec.Body.String())
+	}
+
+	res := struct {
+		Sessions []sessions.SessionView `json:"sessions"`
+	}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		env.T.Fatal(err)
+	}
+
+	return res.Sessions
+}
+
+func TestSessionsApi(t *testing.T) {
+	Clean()
+	env := TestNewApiEnv(t)
+	defer env.Close()
+	admin := env.SetUp()
+
+	user, err := env.App.Users().Insert(&users.User{Email: "user@test.com", Active: true}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var others []*sessions.Session
+	for range 2 {
+		s, err := env.App.Sessions().Insert(user.ID, false, testAgent, "127.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		others = append(others, s)
+	}
+
+	rec := env.JSON(http.MethodPost, "/api/auth/login", `{"email":"user@test.com","password":"password"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatal("Expected login, got", rec.Code, rec.Body.String())
+	}
+
+	list := listSessions(env, "/api/auth/sessions")
+	if len(list) != 3 {
+		t.Fatal("Expected 3 sessions, got", len(list))
+	}
+
+	current := 0
+	for _, s := range list {
+		if s.Current {
+			current++
+		} else if s.Browser != "Firefox" || s.OS != "Linux" || s.IP != "127.0.0.1" {
+			t.Fatal("Expected the parsed user agent, got", s)
+		}
+	}
+
+	if current != 1 {
+		t.Fatal("Expected exactly one current session, got", current)
+	}
+
+	// Sessions of other users can't be revoked
+	adminSession, err := env.App.Sessions().Insert(admin.ID, false, testAgent, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec = env.Request(http.MethodDelete, "/api/auth/sessions/"+strconv.FormatInt(adminSession.ID, 10), "", "")
+	if rec.Code != http.StatusNotFound {
+		t.Fatal("Expected 404 for the session of another user, got", rec.Code)
+	}
+
+	rec = env.Request(http.MethodDelete, "/api/auth/sessions/"+strconv.FormatInt(others[0].ID, 10), "", "")
+	if rec.Code != http.StatusNoContent {
+		t.Fatal("Expected the session to be revoked, got", rec.Code, rec.Body.String())
+	}
+
+	if _, err := env.App.Sessions().SelectBySession(others[0].Session); err == nil {
+		t.Fatal("Expected the session to be deleted")
+	}
+
+	// Log out everywhere else
+	rec = env.Request(http.MethodDelete, "/api/auth/sessions", "", "")
+	if rec.Code != http.StatusNoContent {
+		t.Fatal("Expected the other sessions to be revoked, got", rec.Code, rec.Body.String())
+	}
+
+	list = listSessions(env, "/api/auth/sessions")
+	if len(list) != 1 || !list[0].Current {
+		t.Fatal("Expected only the current session to remain, got", list)
+	}
+
+	// Revoking the current session is a logout
+	rec = env.Form(http.MethodPost, "/sessions", "id="+strconv.FormatInt(list[0].ID, 10))
+	if rec.Code != http.StatusSeeOther || env.Cookies[env.Config.Cookie.Name] != "" {
+		t.Fatal("Expected a logout, got", rec.Code, rec.Header().Get("Location"))
+	}
+
+	// Admins can do the same for any user
+	env.Cookies[env.Config.Cookie.Name] = adminSession.Session
+	s, err := env.App.Sessions().Insert(user.ID, false, testAgent, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := "/api/users/" + strconv.FormatInt(user.ID, 10) + "/sessions"
+	if list := listSessions(env, path); len(list) != 1 || list[0].ID != s.ID || list[0].Current {
+		t.Fatal("Expected the session of the user, got", list)
+	}
+
+	rec = env.Request(http.MethodDelete, path, "", "")
+	if rec.Code != http.StatusNoContent {
+		t.Fatal("Expected the sessions to be revoked, got", rec.Code, rec.Body.String())
+	}
+
+	if list := listSessions(env, path); len(list) != 0 {
+		t.Fatal("Expected no sessions, got", list)
+	}
+}
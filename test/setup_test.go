@@ -0,0 +1,108 @@
+package test
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Simon-Martens/caveman/apis"
+	"github.com/Simon-Martens/caveman/db/users"
+	"github.com/Simon-Martens/caveman/manager"
+	"github.com/Simon-Martens/caveman/models"
+)
+
+func TestSetup(t *testing.T) {
+	Clean()
+	env := TestNewApiEnv(t)
+	defer env.Close()
+
+	if env.App.SetupState() != models.SETUP_STATE_NO_ADMIN {
+		t.Fatal("Expected setup state NO_ADMIN, got", env.App.SetupState())
+	}
+
+	rec := env.JSON(http.MethodPost, "/api/auth/login", `{"email":"admin@test.com","password":"password"}`)
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), apis.ErrCodeSetupRequired) {
+		t.Fatal("Expected routes to be blocked before setup, got", rec.Code, rec.Body.String())
+	}
+
+	rec = env.Request(http.MethodGet, "/setup", "", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), models.DEFAULT_CSRF_FORM_FIELD) {
+		t.Fatal("Expected the setup page, got", rec.Code)
+	}
+
+	rec = env.JSON(http.MethodPost, "/api/setup", `{"admin_name":"Admin","admin_email":"admin@test.com","password":"password","url":"http://localhost"}`)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), apis.ErrCodeInvalidSettings) {
+		t.Fatal("Expected setup without app name to fail, got", rec.Code, rec.Body.String())
+	}
+
+	if ok, _ := env.App.Users().HasAdmins(); ok {
+		t.Fatal("A failed setup should not create an admin")
+	}
+
+	rec = env.JSON(http.MethodPost, "/api/setup", `{"admin_name":"Admin","admin_email":"admin@test.com","password":"password","name":"App","url":"http://localhost","contact":"me"}`)
+	if rec.Code != http.StatusOK || env.Cookies[env.Config.Cookie.Name] == "" {
+		t.Fatal("Expected successful setup and login, got", rec.Code, rec.Body.String())
+	}
+
+	if env.App.SetupState() != models.SETUP_STATE_DONE {
+		t.Fatal("Expected setup state DONE, got", env.App.SetupState())
+	}
+
+	if env.App.CMSettings().Name != "App" || env.App.CMSettings().Contact != "me" {
+		t.Fatal("Settings were not saved", env.App.CMSettings())
+	}
+
+	// The state is cached in the datastore and survives restarts
+	if err := env.App.Bootstrap(); err != nil {
+		t.Fatal(err)
+	}
+
+	if env.App.SetupState() != models.SETUP_STATE_DONE || env.App.CMSettings().Name != "App" {
+		t.Fatal("Expected setup state DONE after restart, got", env.App.SetupState())
+	}
+
+	rec = env.JSON(http.MethodPost, "/api/setup", `{"admin_name":"Admin","admin_email":"admin2@test.com","password":"password","name":"App","url":"http://localhost"}`)
+	if rec.Code != http.StatusForbidden {
+		t.Fatal("Expected a second setup to fail, got", rec.Code, rec.Body.String())
+	}
+
+	rec = env.Request(http.MethodGet, "/setup", "", "")
+	if rec.Code != http.StatusNotFound {
+		t.Fatal("Expected no setup page after setup, got", rec.Code)
+	}
+}
+
+func TestConcurrentSetup(t *testing.T) {
+	Clean()
+	app := TestNewManager(t)
+	defer app.Terminate()
+
+	const n = 8
+	var wg sync.WaitGroup
+	var ok atomic.Int64
+
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			admin := users.User{Email: "admin" + strconv.Itoa(i) + "@test.com"}
+			_, err := app.Setup(&admin, "password", &models.Settings{Name: "App", URL: "http://localhost"})
+			switch err {
+			case nil:
+				ok.Add(1)
+			case manager.ErrSetupDone:
+			default:
+				t.Error(err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if c, err := app.Users().Count(); ok.Load() != 1 || c != 1 || err != nil {
+		t.Fatalf("Expected one setup to create one admin, got %d setups and %d admins", ok.Load(), c)
+	}
+}
@@ -0,0 +1,284 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Simon-Martens/caveman/apis"
+	"github.com/Simon-Martens/caveman/db/attempts"
+	"github.com/Simon-Martens/caveman/db/twofactor"
+	"github.com/Simon-Martens/caveman/db/users"
+	"github.com/Simon-Martens/caveman/manager"
+	"github.com/Simon-Martens/caveman/migrations"
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/Simon-Martens/caveman/tools/totp"
+)
+
+// totpCode returns the code of the secret for the time step counter.
+func totpCode(t *testing.T, secret string, counter int64) string {
+	t.Helper()
+	c, err := totp.Code(secret, counter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestTwoFactor(t *testing.T) {
+	Clean()
+	app := TestNewManager(t)
+	defer app.Terminate()
+
+	user, err := app.Users().Insert(&users.User{Email: "user@test.com", Active: true}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tf, uri, err := app.SetupTOTP(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(uri, "otpauth://totp/") || !strings.Contains(uri, "secret="+tf.Secret) || tf.Confirmed {
+		t.Fatal("Unexpected authenticator", tf, uri)
+	}
+
+	// Unconfirmed authenticators are not used for logins
+	if _, err := app.Users().CheckGetUser(user.Email, "password"); err != nil {
+		t.Fatal("Expected the login to work without confirmation, got", err)
+	}
+
+	if _, err := app.EnableTOTP(user, "000000"); err != twofactor.ErrInvalidCode {
+		t.Fatal("Expected ErrInvalidCode, got", err)
+	}
+
+	counter := totp.Counter(time.Now())
+	codes, err := app.EnableTOTP(user, totpCode(t, tf.Secret, counter))
+	if err != nil || len(codes) != models.DEFAULT_RECOVERY_CODES || !user.TwoFactor {
+		t.Fatal("Expected the second factor to be enabled", codes, err)
+	}
+
+	if _, _, err := app.SetupTOTP(user); err != twofactor.ErrTOTPConfirmed {
+		t.Fatal("Expected ErrTOTPConfirmed, got", err)
+	}
+
+	u, err := app.Users().CheckGetUser(user.Email, "password")
+	if err != users.ErrSecondFactorRequired || u == nil || u.ID != user.ID {
+		t.Fatal("Expected ErrSecondFactorRequired with the user, got", u, err)
+	}
+
+	// Codes are accepted once, the confirmation used one already
+	if err := app.VerifySecondFactor(u, totpCode(t, tf.Secret, counter)); err != twofactor.ErrInvalidCode {
+		t.Fatal("Expected the code to be rejected, got", err)
+	}
+
+	email := attempts.EmailKey(user.Email)
+	if a, err := app.Attempts().Select(email); err != nil || a.Failures != 1 {
+		t.Fatal("Expected the wrong code to count as failed login", a, err)
+	}
+
+	if err := app.VerifySecondFactor(u, totpCode(t, tf.Secret, counter+1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.VerifySecondFactor(u, totpCode(t, tf.Secret, counter+1)); err != twofactor.ErrInvalidCode {
+		t.Fatal("Expected the replayed code to be rejected, got", err)
+	}
+
+	// Recovery codes are single use, case and dashes don't matter
+	recovery := strings.ToUpper(strings.ReplaceAll(codes[0], "-", ""))
+	if err := app.VerifySecondFactor(u, recovery); err != nil {
+		t.Fatal("Expected the recovery code to work, got", err)
+	}
+
+	if err := app.VerifySecondFactor(u, codes[0]); err != twofactor.ErrInvalidCode {
+		t.Fatal("Expected the used recovery code to be rejected, got", err)
+	}
+
+	if n, err := app.TwoFactor().CountRecoveryCodes(user.ID); err != nil || n != models.DEFAULT_RECOVERY_CODES-1 {
+		t.Fatal("Expected one recovery code to be used", n, err)
+	}
+
+	renewed, err := app.RegenerateRecoveryCodes(user)
+	if err != nil || len(renewed) != models.DEFAULT_RECOVERY_CODES {
+		t.Fatal(renewed, err)
+	}
+
+	if err := app.VerifySecondFactor(u, codes[1]); err != twofactor.ErrInvalidCode {
+		t.Fatal("Expected old recovery codes to be replaced, got", err)
+	}
+
+	// Roles can require a second factor
+	app.Users().RequireTwoFactor([]string{models.ROLE_USER})
+
+	if err := app.DisableTOTP(user); err != manager.ErrTwoFactorRequired {
+		t.Fatal("Expected ErrTwoFactorRequired, got", err)
+	}
+
+	if err := app.ResetTwoFactor(user); err != nil || user.TwoFactor {
+		t.Fatal("Expected the second factor to be removed", err)
+	}
+
+	if _, err := app.Users().CheckGetUser(user.Email, "password"); err != users.ErrSecondFactorSetupRequired {
+		t.Fatal("Expected ErrSecondFactorSetupRequired, got", err)
+	}
+
+	if _, err := app.TwoFactor().Select(user.ID); err != twofactor.ErrTOTPNotFound {
+		t.Fatal("Expected the authenticator to be deleted, got", err)
+	}
+
+	app.Users().RequireTwoFactor(nil)
+	if _, err := app.Users().CheckGetUser(user.Email, "password"); err != nil {
+		t.Fatal("Expected the login to work without the requirement, got", err)
+	}
+
+	// Tables created before two factor authentication get the column
+	db := app.DB().NonConcurrentDB()
+	if _, err := db.NewQuery("ALTER TABLE " + db.QuoteTableName(models.DEFAULT_USERS_TABLE) + " DROP COLUMN two_factor").Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range migrations.AppMigrations.Items() {
+		if m.File == "1729400000_two_factor.go" {
+			for range 2 {
+				if err := m.Up(db); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+
+	if err := app.Users().SetTwoFactor(user, true); err != nil {
+		t.Fatal("Expected the two_factor column after the migration, got", err)
+	}
+}
+
+func TestTwoFactorApi(t *testing.T) {
+	Clean()
+	env := TestNewApiEnv(t)
+	defer env.Close()
+	env.SetUp()
+
+	login := func() map[string]any {
+		t.Helper()
+		rec := env.JSON(http.MethodPost, "/api/auth/login", `{"email":"admin@test.com","password":"password"}`)
+		res := map[string]any{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		res["status"] = rec.Code
+		return res
+	}
+
+	// Admins must set up a second factor, the pending session can do that
+	env.App.Users().RequireTwoFactor([]string{models.ROLE_ADMIN})
+
+	if res := login(); res["status"] != http.StatusAccepted || res["second_factor"] != manager.PendingSetup {
+		t.Fatal("Expected a pending login for the setup, got", res)
+	}
+
+	// Pending sessions don't authenticate
+	if rec := env.JSON(http.MethodGet, "/api/auth/sessions", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatal("Expected 401 with a pending session, got", rec.Code)
+	}
+
+	if rec := env.JSON(http.MethodPost, "/api/auth/2fa", `{"code":"123456"}`); rec.Code != http.StatusUnauthorized {
+		t.Fatal("Expected 401 for the wrong stage, got", rec.Code)
+	}
+
+	rec := env.JSON(http.MethodPost, "/api/auth/2fa/setup", "")
+	if rec.Code != http.StatusOK {
+		t.Fatal("Expected the setup to work, got", rec.Code, rec.Body.String())
+	}
+
+	setup := struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &setup); err != nil || setup.Secret == "" || !strings.Contains(setup.URI, "issuer=Test") {
+		t.Fatal("Unexpected setup", rec.Body.String(), err)
+	}
+
+	counter := totp.Counter(time.Now())
+	rec = env.JSON(http.MethodPost, "/api/auth/2fa/enable", `{"code":"`+totpCode(t, setup.Secret, counter)+`"}`)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "recovery_codes") {
+		t.Fatal("Expected the second factor to be enabled, got", rec.Code, rec.Body.String())
+	}
+
+	// The pending session was upgraded
+	if rec := env.JSON(http.MethodGet, "/api/auth/2fa", ""); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"enabled":true`) {
+		t.Fatal("Expected a session with the second factor, got", rec.Code, rec.Body.String())
+	}
+
+	if rec := env.JSON(http.MethodPost, "/api/auth/2fa/disable", `{"password":"password"}`); rec.Code != http.StatusForbidden {
+		t.Fatal("Expected the required second factor not to be disabled, got", rec.Code)
+	}
+
+	// A new login needs a code
+	if res := login(); res["status"] != http.StatusAccepted || res["second_factor"] != manager.PendingSecondFactor {
+		t.Fatal("Expected a pending login, got", res)
+	}
+
+	if rec := env.JSON(http.MethodPost, "/api/auth/2fa", `{"code":"`+totpCode(t, setup.Secret, counter)+`"}`); rec.Code != http.StatusUnauthorized {
+		t.Fatal("Expected the used code to be rejected, got", rec.Code)
+	}
+
+	if rec := env.JSON(http.MethodPost, "/api/auth/2fa", `{"code":"`+totpCode(t, setup.Secret, counter+1)+`"}`); rec.Code != http.StatusOK {
+		t.Fatal("Expected the login to complete, got", rec.Code, rec.Body.String())
+	}
+
+	if rec := env.JSON(http.MethodGet, "/api/auth/sessions", ""); rec.Code != http.StatusOK {
+		t.Fatal("Expected an authenticated session, got", rec.Code)
+	}
+
+	// Forms continue on the two factor page, a recovery code completes the login
+	rec = env.Form(http.MethodPost, "/api/auth/2fa/recovery", "password=password")
+	codes := struct {
+		Codes []string `json:"recovery_codes"`
+	}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &codes); rec.Code != http.StatusOK || err != nil || len(codes.Codes) == 0 {
+		t.Fatal("Expected new recovery codes, got", rec.Code, rec.Body.String())
+	}
+
+	rec = env.Form(http.MethodPost, env.Config.Auth.LoginPage, "email=admin@test.com&password=password&next=/dashboard")
+	if loc := rec.Header().Get("Location"); rec.Code != http.StatusSeeOther || loc != env.Config.Auth.TwoFactorPage+"?next=%2Fdashboard" {
+		t.Fatal("Expected a redirect to the two factor page, got", rec.Code, loc)
+	}
+
+	rec = env.Form(http.MethodPost, env.Config.Auth.TwoFactorPage, "code=wrong&next=/dashboard")
+	if loc := rec.Header().Get("Location"); loc != env.Config.Auth.TwoFactorPage+"?error="+apis.ErrCodeInvalidCredentials {
+		t.Fatal("Expected a redirect back with an error, got", rec.Code, loc)
+	}
+
+	rec = env.Form(http.MethodPost, env.Config.Auth.TwoFactorPage, "code="+codes.Codes[0]+"&next=/dashboard")
+	if loc := rec.Header().Get("Location"); rec.Code != http.StatusSeeOther || loc != "/dashboard" {
+		t.Fatal("Expected the login to complete, got", rec.Code, loc)
+	}
+
+	// Admins reset lost second factors
+	user, err := env.App.Users().Insert(&users.User{Email: "user@test.com", Active: true}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tf, _, err := env.App.SetupTOTP(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := env.App.EnableTOTP(user, totpCode(t, tf.Secret, counter)); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := env.JSON(http.MethodDelete, "/api/users/"+strconv.FormatInt(user.ID, 10)+"/2fa", ""); rec.Code != http.StatusOK {
+		t.Fatal("Expected the second factor to be reset, got", rec.Code, rec.Body.String())
+	}
+
+	if _, err := env.App.Users().CheckGetUser(user.Email, "password"); err != nil {
+		t.Fatal("Expected the login to work without second factor, got", err)
+	}
+}
@@ -1,15 +1,18 @@
 package test
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/Simon-Martens/caveman/db/users"
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/Simon-Martens/caveman/tools/security"
 )
 
 var TestSuperAdmin = users.User{
 	Name:     "Mr. Test",
 	Email:    "superadmin@test.com",
-	Role:     3,
+	Role:     models.ROLE_ADMIN,
 	Active:   true,
 	Verified: true,
 }
@@ -50,7 +53,7 @@ func TestUserManager(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if us.Name != TestSuperAdmin.Name || us.Email != TestSuperAdmin.Email || us.Role != 3 || us.Active != true || us.Verified != true {
+	if us.Name != TestSuperAdmin.Name || us.Email != TestSuperAdmin.Email || us.Role != models.ROLE_ADMIN || us.Active != true || us.Verified != true {
 		t.Fatal("User data is not correct")
 	}
 
@@ -60,7 +63,7 @@ func TestUserManager(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if us.Name != TestSuperAdmin.Name || us.Email != TestSuperAdmin.Email || us.Role != 3 || us.Active != true || us.Verified != true {
+	if us.Name != TestSuperAdmin.Name || us.Email != TestSuperAdmin.Email || us.Role != models.ROLE_ADMIN || us.Active != true || us.Verified != true {
 		t.Fatal("User data is not correct")
 	}
 
@@ -84,6 +87,32 @@ func TestUserManager(t *testing.T) {
 		t.Fatal("User data is not correct")
 	}
 
+	if !strings.HasPrefix(us.Password, "$argon2id$") {
+		t.Fatal("Password should be hashed with argon2id")
+	}
+
+	// Legacy bcrypt hashes are upgraded on login
+	legacy, err := (&security.BcryptHasher{Cost: 4}).Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	us.Password = legacy
+	err = dbenv.UM.Update(us)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	us, err = dbenv.UM.CheckGetUser(TestSuperAdmin.Email, "password")
+	if err != nil || us == nil {
+		t.Fatal(err)
+	}
+
+	us, err = dbenv.UM.Select(us.ID)
+	if err != nil || !strings.HasPrefix(us.Password, "$argon2id$") {
+		t.Fatal("Legacy password hash should have been upgraded", err)
+	}
+
 	wus, err := dbenv.UM.CheckGetUser(TestSuperAdmin.Email, "wrongpassword")
 	if err == nil || wus != nil {
 		t.Fatal(err)
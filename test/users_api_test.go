@@ -0,0 +1,188 @@
+package test
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Simon-Martens/caveman/apis"
+	"github.com/Simon-Martens/caveman/db/users"
+	"github.com/Simon-Martens/caveman/models"
+	"github.com/Simon-Martens/caveman/tools/types"
+)
+
+func TestUsersApi(t *testing.T) {
+	Clean()
+	env := TestNewApiEnv(t)
+	defer env.Close()
+	env.SetUp()
+
+	user, err := env.App.Users().Insert(&users.User{Email: "user@test.com", Active: true}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user.Expires.Time().Sub(*user.Created.Time()) != time.Duration(models.DEFAULT_USER_EXPIRATION)*time.Second {
+		t.Fatal("Expected the default user expiration, got", user.Expires, user.Created)
+	}
+
+	path := "/api/users/" + strconv.FormatInt(user.ID, 10)
+	login := `{"email":"user@test.com","password":"password"}`
+
+	// Users can't manage users
+	rec := env.JSON(http.MethodPost, "/api/auth/login", login)
+	if rec.Code != http.StatusOK {
+		t.Fatal("Expected login, got", rec.Code, rec.Body.String())
+	}
+	session := env.Cookies[env.Config.Cookie.Name]
+
+	rec = env.JSON(http.MethodPost, path+"/deactivate", "")
+	if rec.Code != http.StatusForbidden {
+		t.Fatal("Expected 403 for a user, got", rec.Code)
+	}
+
+	rec = env.JSON(http.MethodPost, "/api/auth/login", `{"email":"admin@test.com","password":"password"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatal("Expected login, got", rec.Code, rec.Body.String())
+	}
+
+	// Deactivation ends all sessions and blocks the login
+	rec = env.JSON(http.MethodPost, path+"/deactivate", "")
+	if rec.Code != http.StatusOK {
+		t.Fatal("Expected deactivation, got", rec.Code, rec.Body.String())
+	}
+
+	if _, err := env.App.Sessions().SelectBySession(session); err == nil {
+		t.Fatal("Expected the sessions of the user to be deleted")
+	}
+
+	if _, err := env.App.Users().CheckGetUser(user.Email, "password"); err != users.ErrUserInactive {
+		t.Fatal("Expected ErrUserInactive, got", err)
+	}
+
+	if _, err := env.App.Users().CheckGetUser(user.Email, "wrongpassword"); err != users.ErrWrongPassword {
+		t.Fatal("Expected ErrWrongPassword, got", err)
+	}
+
+	admin := env.Cookies[env.Config.Cookie.Name]
+	rec = env.JSON(http.MethodPost, "/api/auth/login", login)
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), apis.ErrCodeAccountInactive) {
+		t.Fatal("Expected login of a deactivated user to fail, got", rec.Code, rec.Body.String())
+	}
+
+	rec = env.JSON(http.MethodPost, path+"/activate", "")
+	if rec.Code != http.StatusOK {
+		t.Fatal("Expected activation, got", rec.Code, rec.Body.String())
+	}
+
+	// Sessions of expired users are rejected and deleted
+	session2, err := env.App.Sessions().Insert(user.ID, false, "Agent", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := env.App.Users().SetExpires(user, types.NowDateTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := env.App.Authenticate(session2.Session); err != users.ErrUserExpired {
+		t.Fatal("Expected ErrUserExpired, got", err)
+	}
+
+	if _, err := env.App.Sessions().SelectBySession(session2.Session); err == nil {
+		t.Fatal("Expected the sessions of an expired user to be deleted")
+	}
+
+	rec = env.JSON(http.MethodPost, "/api/auth/login", login)
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), apis.ErrCodeAccountExpired) {
+		t.Fatal("Expected login of an expired user to fail, got", rec.Code, rec.Body.String())
+	}
+
+	env.Cookies[env.Config.Cookie.Name] = admin
+	rec = env.JSON(http.MethodPost, path+"/extend", `{"seconds":0}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatal("Expected an invalid extension to fail, got", rec.Code)
+	}
+
+	rec = env.JSON(http.MethodPost, path+"/extend", `{"seconds":3600}`)
+	if rec.Code != http.StatusOK {
+		t.Fatal("Expected extension, got", rec.Code, rec.Body.String())
+	}
+
+	rec = env.JSON(http.MethodPost, "/api/auth/login", login)
+	if rec.Code != http.StatusOK {
+		t.Fatal("Expected login of an extended user, got", rec.Code, rec.Body.String())
+	}
+
+	rec = env.JSON(http.MethodPost, "/api/users/1/activate", "")
+	if rec.Code != http.StatusForbidden {
+		t.Fatal("Expected 403 for a user, got", rec.Code)
+	}
+}
+
+func TestRoleApi(t *testing.T) {
+	Clean()
+	env := TestNewApiEnv(t)
+	defer env.Close()
+	admin := env.SetUp()
+
+	user, err := env.App.Users().Insert(&users.User{Email: "user@test.com", Active: true}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userSession, err := env.App.Sessions().Insert(user.ID, false, "Agent", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := env.JSON(http.MethodPost, "/api/auth/login", `{"email":"admin@test.com","password":"password"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatal("Expected login, got", rec.Code, rec.Body.String())
+	}
+
+	userPath := "/api/users/" + strconv.FormatInt(user.ID, 10) + "/role"
+	adminPath := "/api/users/" + strconv.FormatInt(admin.ID, 10) + "/role"
+
+	rec = env.JSON(http.MethodPost, userPath, `{"role":"nobody"}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatal("Expected an unknown role to fail, got", rec.Code)
+	}
+
+	rec = env.JSON(http.MethodPost, adminPath, `{"role":"user"}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatal("Expected the last admin not to be demoted, got", rec.Code, rec.Body.String())
+	}
+
+	// The sessions of a user with new privileges are ended
+	rec = env.JSON(http.MethodPost, userPath, `{"role":"admin"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatal("Expected the role change, got", rec.Code, rec.Body.String())
+	}
+
+	if _, err := env.App.Sessions().SelectBySession(userSession.Session); err == nil {
+		t.Fatal("Expected the sessions of the user to be ended")
+	}
+
+	// The own session is rotated
+	old := env.Cookies[env.Config.Cookie.Name]
+	rec = env.JSON(http.MethodPost, adminPath, `{"role":"user"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatal("Expected the role change, got", rec.Code, rec.Body.String())
+	}
+
+	if env.Cookies[env.Config.Cookie.Name] == old {
+		t.Fatal("Expected the session token to be rotated")
+	}
+
+	if _, err := env.App.Sessions().SelectBySession(old); err == nil {
+		t.Fatal("Expected the old session token to be invalid")
+	}
+
+	rec = env.JSON(http.MethodPost, adminPath, `{"role":"admin"}`)
+	if rec.Code != http.StatusForbidden {
+		t.Fatal("Expected users not to make themselves admins, got", rec.Code)
+	}
+}
@@ -0,0 +1,129 @@
+package test
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Simon-Martens/caveman/apis"
+)
+
+// verifyToken returns the token of the verification link in the next mail.
+func verifyToken(env *ApiEnv) string {
+	m := env.Mail()
+	i := strings.Index(m.Text, "http")
+	if i < 0 {
+		env.T.Fatal("Expected a link in the mail", m.Text)
+	}
+
+	u, err := url.Parse(strings.Fields(m.Text[i:])[0])
+	if err != nil || u.Path != env.Config.Auth.VerifyPage {
+		env.T.Fatal("Unexpected verification link", m.Text)
+	}
+
+	return u.Query().Get("token")
+}
+
+func TestVerifyApi(t *testing.T) {
+	Clean()
+	env := TestNewApiEnv(t)
+	defer env.Close()
+	env.SetUp()
+
+	sets := *env.App.CMSettings()
+	sets.Registration = true
+	sets.RequireVerification = true
+	if err := env.App.UpdateSettings(&sets); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unverified users neither get a session on registration nor can log in
+	rec := env.JSON(http.MethodPost, "/api/auth/register", `{"name":"New","email":"new@test.com","password":"password"}`)
+	if rec.Code != http.StatusOK || env.Cookies[env.Config.Cookie.Name] != "" {
+		t.Fatal("Expected registration without a session, got", rec.Code, rec.Body.String())
+	}
+
+	token := verifyToken(env)
+
+	// The link was just sent, resending waits for the cooldown
+	rec = env.JSON(http.MethodPost, "/api/auth/verify/resend", `{"email":"new@test.com"}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatal("Expected accepted, got", rec.Code, rec.Body.String())
+	}
+
+	select {
+	case <-env.Mails:
+		t.Fatal("Expected no second verification mail within the cooldown")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	rec = env.JSON(http.MethodPost, "/api/auth/login", `{"email":"new@test.com","password":"password"}`)
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), apis.ErrCodeNotVerified) {
+		t.Fatal("Expected login of an unverified user to fail, got", rec.Code, rec.Body.String())
+	}
+
+	// The verification status is only told for the right password
+	rec = env.JSON(http.MethodPost, "/api/auth/login", `{"email":"new@test.com","password":"wrongpassword"}`)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatal("Expected invalid credentials, got", rec.Code, rec.Body.String())
+	}
+
+	rec = env.JSON(http.MethodPost, "/api/auth/verify", `{"token":"`+token+`"}`)
+	if rec.Code != http.StatusNoContent {
+		t.Fatal("Expected verification, got", rec.Code, rec.Body.String())
+	}
+
+	rec = env.JSON(http.MethodPost, "/api/auth/verify", `{"token":"`+token+`"}`)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), apis.ErrCodeInvalidToken) {
+		t.Fatal("Expected the verification token to be single use, got", rec.Code, rec.Body.String())
+	}
+
+	rec = env.JSON(http.MethodPost, "/api/auth/login", `{"email":"new@test.com","password":"password"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatal("Expected login of a verified user, got", rec.Code, rec.Body.String())
+	}
+
+	// A changed email must be verified again, links to the old address are invalid
+	rec = env.JSON(http.MethodPost, "/api/auth/verify/resend", `{"email":"new@test.com"}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatal("Expected accepted, got", rec.Code, rec.Body.String())
+	}
+
+	rec = env.JSON(http.MethodPost, "/api/auth/email", `{"email":"changed@test.com","password":"wrongpassword"}`)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), apis.ErrCodeInvalidCredentials) {
+		t.Fatal("Expected email change with a wrong password to fail, got", rec.Code, rec.Body.String())
+	}
+
+	rec = env.JSON(http.MethodPost, "/api/auth/email", `{"email":"changed@test.com","password":"password"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatal("Expected email change, got", rec.Code, rec.Body.String())
+	}
+
+	token = verifyToken(env)
+
+	user, err := env.App.Users().SelectByEmail("changed@test.com")
+	if err != nil || user.Verified {
+		t.Fatal("Expected the changed email to be unverified", err)
+	}
+
+	stale, err := env.App.Tokens().InsertWithData(user.ID, 1, env.Config.Auth.VerifyPage, time.Hour, map[string]any{"email": "new@test.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec = env.Form(http.MethodPost, "/verify", "token="+stale.Token)
+	if rec.Code != http.StatusSeeOther || !strings.Contains(rec.Header().Get("Location"), "error="+apis.ErrCodeInvalidToken) {
+		t.Fatal("Expected a link to the old address to fail, got", rec.Code, rec.Header().Get("Location"))
+	}
+
+	rec = env.Form(http.MethodPost, "/verify", "token="+token)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/login?verified=1" {
+		t.Fatal("Expected verification, got", rec.Code, rec.Header().Get("Location"))
+	}
+
+	if user, err := env.App.Users().Select(user.ID); err != nil || !user.Verified {
+		t.Fatal("Expected the changed email to be verified", err)
+	}
+}
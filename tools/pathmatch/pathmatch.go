@@ -0,0 +1,130 @@
+// Package pathmatch matches URL paths against patterns, eg. to restrict tokens to
+// parts of an app. Patterns are matched segment by segment:
+//
+//   - a literal segment matches itself
+//   - :name matches any segment and captures it as parameter name
+//   - a segment with glob characters is matched with path.Match, so * matches
+//     any segment and *.pdf any segment ending in .pdf
+//   - ** as the last segment matches the rest of the path, including nothing,
+//     which makes the pattern a prefix: /files/** matches /files and /files/a/b
+package pathmatch
+
+import (
+	"errors"
+	"path"
+	"strings"
+)
+
+var ErrInvalidPattern = errors.New("invalid path pattern")
+
+// Pattern is a compiled path pattern, see Compile.
+type Pattern struct {
+	raw      string
+	segments []string
+	prefix   bool
+}
+
+// Compile checks and compiles a pattern. Patterns must be absolute.
+func Compile(pattern string) (*Pattern, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, ErrInvalidPattern
+	}
+
+	p := &Pattern{raw: pattern, segments: split(pattern)}
+
+	for i, s := range p.segments {
+		if s == "**" {
+			if i != len(p.segments)-1 {
+				return nil, ErrInvalidPattern
+			}
+			p.prefix = true
+			p.segments = p.segments[:i]
+			break
+		}
+
+		if strings.HasPrefix(s, ":") && len(s) == 1 {
+			return nil, ErrInvalidPattern
+		}
+
+		if _, err := path.Match(s, ""); err != nil {
+			return nil, ErrInvalidPattern
+		}
+	}
+
+	return p, nil
+}
+
+// MustCompile is like Compile but panics if the pattern is invalid.
+func MustCompile(pattern string) *Pattern {
+	p, err := Compile(pattern)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// Match reports whether the pattern matches the path.
+func Match(pattern, p string) bool {
+	c, err := Compile(pattern)
+	if err != nil {
+		return false
+	}
+	return c.Match(p)
+}
+
+func (p *Pattern) String() string {
+	return p.raw
+}
+
+// Match reports whether the pattern matches the path.
+func (p *Pattern) Match(pth string) bool {
+	_, ok := p.Params(pth)
+	return ok
+}
+
+// Params matches the path and returns the captured parameters. The map is nil if
+// the pattern has no parameters.
+func (p *Pattern) Params(pth string) (map[string]string, bool) {
+	if !isClean(pth) {
+		return nil, false
+	}
+
+	segments := split(pth)
+	if len(segments) < len(p.segments) || !p.prefix && len(segments) != len(p.segments) {
+		return nil, false
+	}
+
+	var params map[string]string
+	for i, s := range p.segments {
+		if name, ok := strings.CutPrefix(s, ":"); ok {
+			if params == nil {
+				params = map[string]string{}
+			}
+			params[name] = segments[i]
+			continue
+		}
+
+		if ok, _ := path.Match(s, segments[i]); !ok {
+			return nil, false
+		}
+	}
+
+	return params, true
+}
+
+// isClean reports whether the path is absolute and has no empty, . or .. segments,
+// which would sneak past a prefix, eg. /files/../admin. A trailing slash is fine.
+func isClean(p string) bool {
+	if p == "/" {
+		return true
+	}
+	return strings.HasPrefix(p, "/") && path.Clean(p) == strings.TrimSuffix(p, "/")
+}
+
+func split(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return []string{}
+	}
+	return strings.Split(p, "/")
+}
@@ -0,0 +1,60 @@
+package pathmatch_test
+
+import (
+	"testing"
+
+	"github.com/Simon-Martens/caveman/tools/pathmatch"
+)
+
+func TestMatch(t *testing.T) {
+	scenarios := []struct {
+		pattern  string
+		path     string
+		expected bool
+	}{
+		{"/", "/", true},
+		{"/", "/a", false},
+		{"/api/reports", "/api/reports", true},
+		{"/api/reports", "/api/reports/", true},
+		{"/api/reports", "/api/reports/1", false},
+		{"/api/reports", "/api/report", false},
+		{"/api/*/export", "/api/reports/export", true},
+		{"/api/*/export", "/api/reports/1/export", false},
+		{"/files/*.pdf", "/files/a.pdf", true},
+		{"/files/*.pdf", "/files/a.txt", false},
+		{"/files/**", "/files", true},
+		{"/files/**", "/files/a", true},
+		{"/files/**", "/files/a/b/c", true},
+		{"/files/**", "/filesystem", false},
+		{"/files/**", "/files/../admin", false},
+		{"/files/**", "/files//a", false},
+		{"/**", "/anything/at/all", true},
+		{"/users/:id", "/users/42", true},
+		{"/users/:id", "/users", false},
+		{"/users/:id/**", "/users/42/files/a", true},
+		// Invalid patterns never match
+		{"files/**", "/files/a", false},
+		{"/files/**/a", "/files/b/a", false},
+		{"/files/[", "/files/[", false},
+		{"/users/:", "/users/1", false},
+	}
+
+	for _, s := range scenarios {
+		if r := pathmatch.Match(s.pattern, s.path); r != s.expected {
+			t.Errorf("(%s, %s) Expected %v, got %v", s.pattern, s.path, s.expected, r)
+		}
+	}
+}
+
+func TestParams(t *testing.T) {
+	p := pathmatch.MustCompile("/users/:user/files/:file/**")
+
+	params, ok := p.Params("/users/42/files/report.pdf/versions/1")
+	if !ok || params["user"] != "42" || params["file"] != "report.pdf" || len(params) != 2 {
+		t.Fatal("Unexpected params", params, ok)
+	}
+
+	if params, ok := pathmatch.MustCompile("/files/**").Params("/files/a"); !ok || params != nil {
+		t.Fatal("Expected no params", params, ok)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"crypto/sha512"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"math/big"
 	mrand "math/rand"
@@ -79,3 +80,11 @@ func CreateRandomSHA512Token() (string, error) {
 	bas := base64.URLEncoding.WithPadding(base64.NoPadding).EncodeToString(hash[:])
 	return bas, nil
 }
+
+// HashToken returns the hex encoded SHA-256 digest of a token, to store and look up
+// tokens without storing them. The tokens are random, so they need no salt or
+// slow hash: the digest is deterministic and can be indexed.
+func HashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
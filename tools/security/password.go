@@ -0,0 +1,240 @@
+package security
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hashes are stored in the PHC string format, which encodes the algorithm
+// and its parameters along with the salt and the hash:
+//
+//	$argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+//
+// Legacy bcrypt hashes ($2a$, $2b$, $2y$) use their own, similar format.
+
+var ErrHashUnsupported = errors.New("unsupported password hash")
+var ErrHashMalformed = errors.New("malformed password hash")
+
+// bcrypt only uses the first 72 bytes of a password.
+const bcryptMaxLength = 72
+
+type PasswordHasher interface {
+	// Hash returns the encoded hash of the password.
+	Hash(password string) (string, error)
+
+	// Verify reports whether the password matches the encoded hash.
+	// An error is returned if the hash can not be handled by the hasher.
+	Verify(encoded string, password string) (bool, error)
+
+	// Supports reports whether the hasher can verify the encoded hash.
+	Supports(encoded string) bool
+
+	// NeedsRehash reports whether the encoded hash was created with other
+	// parameters than the ones currently configured.
+	NeedsRehash(encoded string) bool
+}
+
+// DefaultPasswordHasher hashes new passwords with argon2id and still verifies
+// legacy bcrypt hashes, which are reported as in need of a rehash.
+func DefaultPasswordHasher() PasswordHasher {
+	return NewMultiHasher(DefaultArgon2idHasher(), &BcryptHasher{Cost: 12})
+}
+
+// Argon2idHasher hashes passwords using argon2id. Memory is given in KiB.
+type Argon2idHasher struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+func DefaultArgon2idHasher() *Argon2idHasher {
+	return &Argon2idHasher{
+		Memory:      64 * 1024,
+		Iterations:  3,
+		Parallelism: 2,
+		SaltLength:  16,
+		KeyLength:   32,
+	}
+}
+
+func (h *Argon2idHasher) Hash(password string) (string, error) {
+	salt, err := CreateSecretArray(uint(h.SaltLength), 3)
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.Iterations, h.Memory, h.Parallelism, h.KeyLength)
+
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		h.Memory,
+		h.Iterations,
+		h.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (h *Argon2idHasher) Verify(encoded string, password string) (bool, error) {
+	p, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	other := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (h *Argon2idHasher) Supports(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+func (h *Argon2idHasher) NeedsRehash(encoded string) bool {
+	p, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+
+	return p.Memory != h.Memory ||
+		p.Iterations != h.Iterations ||
+		p.Parallelism != h.Parallelism ||
+		uint32(len(salt)) != h.SaltLength ||
+		uint32(len(key)) != h.KeyLength
+}
+
+func decodeArgon2id(encoded string) (*Argon2idHasher, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, nil, nil, ErrHashUnsupported
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return nil, nil, nil, ErrHashMalformed
+	}
+
+	if version != argon2.Version {
+		return nil, nil, nil, ErrHashUnsupported
+	}
+
+	p := &Argon2idHasher{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return nil, nil, nil, ErrHashMalformed
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, ErrHashMalformed
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return nil, nil, nil, ErrHashMalformed
+	}
+
+	return p, salt, key, nil
+}
+
+// BcryptHasher hashes passwords using bcrypt. Passwords longer than 72 bytes are
+// rejected instead of being truncated.
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h *BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (h *BcryptHasher) Verify(encoded string, password string) (bool, error) {
+	if !h.Supports(encoded) {
+		return false, ErrHashUnsupported
+	}
+
+	// bcrypt would silently compare only the first 72 bytes
+	if len(password) > bcryptMaxLength {
+		return false, nil
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (h *BcryptHasher) Supports(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") ||
+		strings.HasPrefix(encoded, "$2b$") ||
+		strings.HasPrefix(encoded, "$2y$")
+}
+
+func (h *BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.Cost
+}
+
+// MultiHasher hashes with the primary hasher and verifies hashes of all hashers.
+// Hashes not created by the primary hasher always need a rehash.
+type MultiHasher struct {
+	primary PasswordHasher
+	others  []PasswordHasher
+}
+
+func NewMultiHasher(primary PasswordHasher, others ...PasswordHasher) *MultiHasher {
+	return &MultiHasher{primary: primary, others: others}
+}
+
+func (h *MultiHasher) Hash(password string) (string, error) {
+	return h.primary.Hash(password)
+}
+
+func (h *MultiHasher) Verify(encoded string, password string) (bool, error) {
+	if h.primary.Supports(encoded) {
+		return h.primary.Verify(encoded, password)
+	}
+
+	for _, o := range h.others {
+		if o.Supports(encoded) {
+			return o.Verify(encoded, password)
+		}
+	}
+
+	return false, ErrHashUnsupported
+}
+
+func (h *MultiHasher) Supports(encoded string) bool {
+	if h.primary.Supports(encoded) {
+		return true
+	}
+
+	for _, o := range h.others {
+		if o.Supports(encoded) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (h *MultiHasher) NeedsRehash(encoded string) bool {
+	if !h.primary.Supports(encoded) {
+		return true
+	}
+	return h.primary.NeedsRehash(encoded)
+}
@@ -0,0 +1,107 @@
+package security_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Simon-Martens/caveman/tools/security"
+)
+
+func TestArgon2idHasher(t *testing.T) {
+	h := security.DefaultArgon2idHasher()
+
+	hash, err := h.Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=65536,t=3,p=2$") {
+		t.Fatalf("Expected a PHC encoded argon2id hash, got %q", hash)
+	}
+
+	if ok, err := h.Verify(hash, "password"); !ok || err != nil {
+		t.Fatal("Expected the password to match", err)
+	}
+
+	if ok, _ := h.Verify(hash, "wrongpassword"); ok {
+		t.Fatal("Expected a wrong password not to match")
+	}
+
+	if h.NeedsRehash(hash) {
+		t.Fatal("Expected no rehash with the same parameters")
+	}
+
+	stronger := security.DefaultArgon2idHasher()
+	stronger.Iterations = 4
+	if !stronger.NeedsRehash(hash) {
+		t.Fatal("Expected a rehash with other parameters")
+	}
+
+	// Passwords are not truncated
+	long := strings.Repeat("a", 100)
+	hash, err = h.Hash(long)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, _ := h.Verify(hash, long[:72]); ok {
+		t.Fatal("Expected a truncated password not to match")
+	}
+
+	scenarios := []string{
+		"",
+		"$argon2id$",
+		"$argon2i$v=19$m=65536,t=3,p=2$c2FsdA$aGFzaA",
+		"$argon2id$v=18$m=65536,t=3,p=2$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=x,t=3,p=2$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=65536,t=3,p=2$c2FsdA$",
+	}
+
+	for i, s := range scenarios {
+		if ok, err := h.Verify(s, "password"); ok || err == nil {
+			t.Errorf("(%d) Expected an error for the hash %q", i, s)
+		}
+	}
+}
+
+func TestMultiHasher(t *testing.T) {
+	bc := &security.BcryptHasher{Cost: 4}
+	h := security.NewMultiHasher(security.DefaultArgon2idHasher(), bc)
+
+	legacy, err := bc.Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := h.Verify(legacy, "password"); !ok || err != nil {
+		t.Fatal("Expected the legacy hash to match", err)
+	}
+
+	if !h.NeedsRehash(legacy) {
+		t.Fatal("Expected the legacy hash to need a rehash")
+	}
+
+	// bcrypt ignores everything after 72 bytes, we don't
+	long := strings.Repeat("a", 72)
+	legacy, err = bc.Hash(long)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, _ := h.Verify(legacy, long+"b"); ok {
+		t.Fatal("Expected a password longer than 72 bytes not to match a bcrypt hash")
+	}
+
+	hash, err := h.Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(hash, "$argon2id$") || h.NeedsRehash(hash) {
+		t.Fatalf("Expected an up to date argon2id hash, got %q", hash)
+	}
+
+	if _, err := h.Verify("$unknown$hash", "password"); err != security.ErrHashUnsupported {
+		t.Fatal("Expected unsupported hashes to fail, got", err)
+	}
+}
@@ -0,0 +1,120 @@
+// Package totp implements time-based one-time passwords (RFC 6238) the way
+// authenticator apps expect them: HMAC-SHA1, 6 digits and 30 second steps.
+// Secrets are base32 encoded without padding.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Simon-Martens/caveman/tools/security"
+)
+
+const (
+	Digits     = 6
+	Period     = 30 // seconds
+	SecretSize = 20 // bytes, the size of a SHA-1 digest as recommended by RFC 4226
+)
+
+var ErrInvalidSecret = errors.New("invalid totp secret")
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewSecret returns a new random secret.
+func NewSecret() (string, error) {
+	b, err := security.CreateSecretArray(SecretSize, 3)
+	if err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(b), nil
+}
+
+// Counter returns the time step of t.
+func Counter(t time.Time) int64 {
+	return t.Unix() / Period
+}
+
+// Code returns the code of the secret for the time step.
+func Code(secret string, counter int64) (string, error) {
+	key, err := decode(secret)
+	if err != nil {
+		return "", err
+	}
+	return code(key, counter), nil
+}
+
+// Validate checks the code against the time steps of t, skew steps before and
+// after it, to allow for clock drift. It returns the time step the code is valid
+// for, so callers can reject codes that were used before.
+func Validate(secret, c string, t time.Time, skew int) (int64, bool) {
+	key, err := decode(secret)
+	if err != nil || len(c) != Digits {
+		return 0, false
+	}
+
+	now := Counter(t)
+	for i := -int64(skew); i <= int64(skew); i++ {
+		if subtle.ConstantTimeCompare([]byte(code(key, now+i)), []byte(c)) == 1 {
+			return now + i, true
+		}
+	}
+
+	return 0, false
+}
+
+// URI returns the otpauth:// provisioning URI of the secret, which authenticator
+// apps read from a QR code. The issuer is shown as the name of the account.
+func URI(issuer, account, secret string) string {
+	label := url.PathEscape(account)
+	if issuer != "" {
+		label = url.PathEscape(issuer) + ":" + label
+	}
+
+	q := url.Values{}
+	q.Set("secret", secret)
+	if issuer != "" {
+		q.Set("issuer", issuer)
+	}
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(Digits))
+	q.Set("period", fmt.Sprint(Period))
+
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+func decode(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	key, err := encoding.DecodeString(strings.TrimRight(secret, "="))
+	if err != nil || len(key) == 0 {
+		return nil, ErrInvalidSecret
+	}
+	return key, nil
+}
+
+// code is the HOTP value (RFC 4226) of the counter.
+func code(key []byte, counter int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for range Digits {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", Digits, value%mod)
+}
@@ -0,0 +1,94 @@
+package totp_test
+
+import (
+	"encoding/base32"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Simon-Martens/caveman/tools/totp"
+)
+
+// The SHA-1 test vectors of RFC 6238, truncated to 6 digits.
+func TestCode(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+	scenarios := []struct {
+		unix     int64
+		expected string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, s := range scenarios {
+		code, err := totp.Code(secret, totp.Counter(time.Unix(s.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if code != s.expected {
+			t.Errorf("(%d) Expected %s, got %s", s.unix, s.expected, code)
+		}
+	}
+
+	if _, err := totp.Code("not base32!", 1); err != totp.ErrInvalidSecret {
+		t.Fatal("Expected ErrInvalidSecret, got", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := totp.NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1700000000, 0)
+	counter := totp.Counter(now)
+
+	scenarios := []struct {
+		counter  int64
+		expected bool
+	}{
+		{counter, true},
+		{counter - 1, true},
+		{counter + 1, true},
+		{counter - 2, false},
+		{counter + 2, false},
+	}
+
+	for _, s := range scenarios {
+		code, err := totp.Code(secret, s.counter)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c, ok := totp.Validate(secret, code, now, 1)
+		if ok != s.expected || ok && c != s.counter {
+			t.Errorf("(%d) Expected %v, got %v for step %d", s.counter-counter, s.expected, ok, c)
+		}
+	}
+
+	if _, ok := totp.Validate(secret, "12345", now, 1); ok {
+		t.Fatal("Expected codes of the wrong length to be invalid")
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := totp.URI("Caveman App", "user@test.com", "JBSWY3DPEHPK3PXP")
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := u.Query()
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/Caveman App:user@test.com" ||
+		q.Get("secret") != "JBSWY3DPEHPK3PXP" || q.Get("issuer") != "Caveman App" || q.Get("digits") != "6" {
+		t.Fatal("Unexpected URI", uri)
+	}
+}
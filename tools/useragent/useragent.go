@@ -0,0 +1,119 @@
+// Package useragent extracts browser, operating system and device type from
+// User-Agent headers for display, eg. in a list of active sessions. It does not
+// try to be exhaustive, unknown agents are reported as such.
+package useragent
+
+import (
+	"strings"
+)
+
+const (
+	DeviceDesktop = "desktop"
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+	DeviceBot     = "bot"
+	Unknown       = "unknown"
+)
+
+type UserAgent struct {
+	Browser string `json:"browser"`
+	Version string `json:"version"`
+	OS      string `json:"os"`
+	Device  string `json:"device"`
+}
+
+// browsers are checked in order, so agents that contain the tokens of other
+// browsers (eg. every Chromium based browser contains "Chrome/") come first.
+var browsers = []struct {
+	token string
+	name  string
+}{
+	{"Edg/", "Edge"},
+	{"EdgA/", "Edge"},
+	{"EdgiOS/", "Edge"},
+	{"OPR/", "Opera"},
+	{"SamsungBrowser/", "Samsung Internet"},
+	{"Vivaldi/", "Vivaldi"},
+	{"FxiOS/", "Firefox"},
+	{"Firefox/", "Firefox"},
+	{"CriOS/", "Chrome"},
+	{"Chromium/", "Chromium"},
+	{"Chrome/", "Chrome"},
+	{"Version/", "Safari"},
+	{"curl/", "curl"},
+	{"Wget/", "Wget"},
+}
+
+var systems = []struct {
+	token string
+	name  string
+}{
+	{"Windows", "Windows"},
+	{"Android", "Android"},
+	{"iPhone", "iOS"},
+	{"iPad", "iPadOS"},
+	{"CrOS", "ChromeOS"},
+	{"Mac OS X", "macOS"},
+	{"Macintosh", "macOS"},
+	{"Linux", "Linux"},
+	{"FreeBSD", "FreeBSD"},
+}
+
+// Parse parses a User-Agent header.
+func Parse(ua string) UserAgent {
+	r := UserAgent{Browser: Unknown, OS: Unknown, Device: Unknown}
+	if strings.TrimSpace(ua) == "" {
+		return r
+	}
+
+	for _, b := range browsers {
+		if i := strings.Index(ua, b.token); i >= 0 {
+			r.Browser = b.name
+			r.Version = majorVersion(ua[i+len(b.token):])
+			break
+		}
+	}
+
+	for _, s := range systems {
+		if strings.Contains(ua, s.token) {
+			r.OS = s.name
+			break
+		}
+	}
+
+	lua := strings.ToLower(ua)
+	switch {
+	case strings.Contains(lua, "bot") || strings.Contains(lua, "spider") || strings.Contains(lua, "crawl"):
+		r.Device = DeviceBot
+	case strings.Contains(ua, "iPad") || strings.Contains(ua, "Tablet") || (r.OS == "Android" && !strings.Contains(ua, "Mobile")):
+		r.Device = DeviceTablet
+	case strings.Contains(ua, "Mobi") || strings.Contains(ua, "iPhone"):
+		r.Device = DeviceMobile
+	case r.OS != Unknown:
+		r.Device = DeviceDesktop
+	}
+
+	return r
+}
+
+// String returns a short description, eg. "Firefox 128 on Linux".
+func (u UserAgent) String() string {
+	b := u.Browser
+	if u.Version != "" {
+		b += " " + u.Version
+	}
+
+	if u.OS == Unknown {
+		return b
+	}
+
+	return b + " on " + u.OS
+}
+
+func majorVersion(s string) string {
+	end := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	if end < 0 {
+		return s
+	}
+	return s[:end]
+}
@@ -0,0 +1,54 @@
+package useragent_test
+
+import (
+	"testing"
+
+	"github.com/Simon-Martens/caveman/tools/useragent"
+)
+
+func TestParse(t *testing.T) {
+	scenarios := []struct {
+		ua       string
+		expected useragent.UserAgent
+	}{
+		{
+			"",
+			useragent.UserAgent{Browser: useragent.Unknown, OS: useragent.Unknown, Device: useragent.Unknown},
+		},
+		{
+			"Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0",
+			useragent.UserAgent{Browser: "Firefox", Version: "128", OS: "Linux", Device: useragent.DeviceDesktop},
+		},
+		{
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36 Edg/126.0.2592.87",
+			useragent.UserAgent{Browser: "Edge", Version: "126", OS: "Windows", Device: useragent.DeviceDesktop},
+		},
+		{
+			"Mozilla/5.0 (iPhone; CPU iPhone OS 17_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Mobile/15E148 Safari/604.1",
+			useragent.UserAgent{Browser: "Safari", Version: "17", OS: "iOS", Device: useragent.DeviceMobile},
+		},
+		{
+			"Mozilla/5.0 (Linux; Android 14; SM-X710) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36",
+			useragent.UserAgent{Browser: "Chrome", Version: "126", OS: "Android", Device: useragent.DeviceTablet},
+		},
+		{
+			"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			useragent.UserAgent{Browser: useragent.Unknown, OS: useragent.Unknown, Device: useragent.DeviceBot},
+		},
+		{
+			"curl/8.5.0",
+			useragent.UserAgent{Browser: "curl", Version: "8", OS: useragent.Unknown, Device: useragent.Unknown},
+		},
+	}
+
+	for i, s := range scenarios {
+		r := useragent.Parse(s.ua)
+		if r != s.expected {
+			t.Errorf("(%d) Expected %+v, got %+v", i, s.expected, r)
+		}
+	}
+
+	if s := useragent.Parse(scenarios[1].ua).String(); s != "Firefox 128 on Linux" {
+		t.Errorf("Unexpected string %q", s)
+	}
+}
@@ -0,0 +1,131 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+var ErrInvalidCBOR = errors.New("invalid cbor")
+
+// maxCBORDepth limits the nesting of decoded items. Authenticators never nest
+// deeper than a few levels.
+const maxCBORDepth = 16
+
+// decodeCBOR decodes the first item of b and returns it with the remaining
+// bytes. It supports the subset of CBOR (RFC 8949) used by WebAuthn: integers,
+// byte and text strings, arrays, maps and simple values, all of definite length.
+// Integers are int64, maps are map[any]any with int64 or string keys.
+func decodeCBOR(b []byte) (any, []byte, error) {
+	return decodeCBORItem(b, 0)
+}
+
+func decodeCBORItem(b []byte, depth int) (any, []byte, error) {
+	if depth > maxCBORDepth || len(b) == 0 {
+		return nil, nil, ErrInvalidCBOR
+	}
+
+	major := b[0] >> 5
+	info := b[0] & 0x1f
+	b = b[1:]
+
+	// Simple values carry no argument, floats are not used by WebAuthn
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, b, nil
+		case 21:
+			return true, b, nil
+		case 22, 23:
+			return nil, b, nil
+		default:
+			return nil, nil, ErrInvalidCBOR
+		}
+	}
+
+	arg, b, err := cborArgument(info, b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, nil, ErrInvalidCBOR
+		}
+		return int64(arg), b, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, ErrInvalidCBOR
+		}
+		return -1 - int64(arg), b, nil
+	case 2, 3:
+		if arg > uint64(len(b)) {
+			return nil, nil, ErrInvalidCBOR
+		}
+		if major == 3 {
+			return string(b[:arg]), b[arg:], nil
+		}
+		return append([]byte{}, b[:arg]...), b[arg:], nil
+	case 4:
+		// Every item takes at least a byte
+		if arg > uint64(len(b)) {
+			return nil, nil, ErrInvalidCBOR
+		}
+		items := make([]any, 0, arg)
+		for range arg {
+			var item any
+			if item, b, err = decodeCBORItem(b, depth+1); err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, b, nil
+	case 5:
+		if arg > uint64(len(b))/2 {
+			return nil, nil, ErrInvalidCBOR
+		}
+		m := make(map[any]any, arg)
+		for range arg {
+			var k, v any
+			if k, b, err = decodeCBORItem(b, depth+1); err != nil {
+				return nil, nil, err
+			}
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, nil, ErrInvalidCBOR
+			}
+			if _, ok := m[k]; ok {
+				return nil, nil, ErrInvalidCBOR
+			}
+			if v, b, err = decodeCBORItem(b, depth+1); err != nil {
+				return nil, nil, err
+			}
+			m[k] = v
+		}
+		return m, b, nil
+	default:
+		// Tags are not used by WebAuthn
+		return nil, nil, ErrInvalidCBOR
+	}
+}
+
+// cborArgument reads the argument of an item with the additional info.
+// Indefinite lengths are not supported.
+func cborArgument(info byte, b []byte) (uint64, []byte, error) {
+	switch {
+	case info < 24:
+		return uint64(info), b, nil
+	case info == 24 && len(b) >= 1:
+		return uint64(b[0]), b[1:], nil
+	case info == 25 && len(b) >= 2:
+		return uint64(binary.BigEndian.Uint16(b)), b[2:], nil
+	case info == 26 && len(b) >= 4:
+		return uint64(binary.BigEndian.Uint32(b)), b[4:], nil
+	case info == 27 && len(b) >= 8:
+		return binary.BigEndian.Uint64(b), b[8:], nil
+	default:
+		return 0, nil, ErrInvalidCBOR
+	}
+}
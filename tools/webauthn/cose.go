@@ -0,0 +1,121 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+)
+
+// COSE algorithms (RFC 9053) supported for credentials, in order of preference.
+const (
+	AlgES256 int64 = -7
+	AlgEdDSA int64 = -8
+	AlgRS256 int64 = -257
+)
+
+var Algorithms = []int64{AlgES256, AlgEdDSA, AlgRS256}
+
+var ErrUnsupportedKey = errors.New("unsupported public key")
+var ErrInvalidSignature = errors.New("invalid signature")
+
+// COSE key parameters
+const (
+	coseKty int64 = 1
+	coseAlg int64 = 3
+	coseCrv int64 = -1 // or n for RSA
+	coseX   int64 = -2 // or e for RSA
+	coseY   int64 = -3
+
+	coseKtyOKP int64 = 1
+	coseKtyEC2 int64 = 2
+	coseKtyRSA int64 = 3
+
+	coseCrvP256    int64 = 1
+	coseCrvEd25519 int64 = 6
+)
+
+// PublicKey is the public key of a credential, see ParsePublicKey.
+type PublicKey struct {
+	Algorithm int64
+	key       crypto.PublicKey
+}
+
+// ParsePublicKey parses a COSE_Key as stored with a credential.
+func ParsePublicKey(cose []byte) (*PublicKey, error) {
+	item, rest, err := decodeCBOR(cose)
+	if err != nil {
+		return nil, err
+	}
+
+	m, ok := item.(map[any]any)
+	if !ok || len(rest) != 0 {
+		return nil, ErrUnsupportedKey
+	}
+
+	kty, _ := m[coseKty].(int64)
+	alg, _ := m[coseAlg].(int64)
+
+	switch {
+	case kty == coseKtyEC2 && alg == AlgES256:
+		crv, _ := m[coseCrv].(int64)
+		x, _ := m[coseX].([]byte)
+		y, _ := m[coseY].([]byte)
+		if crv != coseCrvP256 || len(x) != 32 || len(y) != 32 {
+			return nil, ErrUnsupportedKey
+		}
+
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, ErrUnsupportedKey
+		}
+		return &PublicKey{Algorithm: alg, key: key}, nil
+
+	case kty == coseKtyOKP && alg == AlgEdDSA:
+		crv, _ := m[coseCrv].(int64)
+		x, _ := m[coseX].([]byte)
+		if crv != coseCrvEd25519 || len(x) != ed25519.PublicKeySize {
+			return nil, ErrUnsupportedKey
+		}
+		return &PublicKey{Algorithm: alg, key: ed25519.PublicKey(x)}, nil
+
+	case kty == coseKtyRSA && alg == AlgRS256:
+		n, _ := m[coseCrv].([]byte)
+		e, _ := m[coseX].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, ErrUnsupportedKey
+		}
+
+		exp := 0
+		for _, b := range e {
+			exp = exp<<8 | int(b)
+		}
+		return &PublicKey{Algorithm: alg, key: &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exp}}, nil
+	}
+
+	return nil, ErrUnsupportedKey
+}
+
+// Verify checks the signature of data.
+func (k *PublicKey) Verify(data, sig []byte) error {
+	var ok bool
+	switch key := k.key.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(data)
+		ok = ecdsa.VerifyASN1(key, digest[:], sig)
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(key, data, sig)
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(data)
+		ok = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil
+	}
+
+	if !ok {
+		return ErrInvalidSignature
+	}
+	return nil
+}
@@ -0,0 +1,457 @@
+// Package webauthn implements the relying party side of WebAuthn (Level 2) for
+// passkeys: the options of the registration and assertion ceremonies and the
+// verification of the responses of the browser.
+//
+// Attestation statements are not verified: the options request no attestation,
+// so authenticators are trusted like passwords are. Credentials may use ES256,
+// EdDSA or RS256. See package webauthntest for a software authenticator.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	TypePublicKey = "public-key"
+	TypeCreate    = "webauthn.create"
+	TypeGet       = "webauthn.get"
+
+	// MaxCredentialIDLength is the max. length of credential ids, in bytes.
+	MaxCredentialIDLength = 1023
+)
+
+// Flags of the authenticator data
+const (
+	FlagUserPresent    byte = 1 << 0
+	FlagUserVerified   byte = 1 << 2
+	FlagBackupEligible byte = 1 << 3
+	FlagBackedUp       byte = 1 << 4
+	FlagAttestedData   byte = 1 << 6
+	FlagExtensions     byte = 1 << 7
+)
+
+var ErrInvalidClientData = errors.New("invalid client data")
+var ErrInvalidAuthenticatorData = errors.New("invalid authenticator data")
+var ErrChallengeMismatch = errors.New("challenge mismatch")
+var ErrOriginMismatch = errors.New("origin mismatch")
+var ErrRPIDMismatch = errors.New("relying party id mismatch")
+var ErrUserNotPresent = errors.New("user not present")
+var ErrUserNotVerified = errors.New("user not verified")
+var ErrCredentialMismatch = errors.New("credential mismatch")
+var ErrSignCount = errors.New("signature counter did not increase, the authenticator may be cloned")
+
+// RelyingParty identifies the site credentials are created for. ID is the domain,
+// eg. "example.com", Origins are the origins the ceremonies may run on, eg.
+// "https://example.com". Timeout is the time users have for a ceremony.
+type RelyingParty struct {
+	ID      string
+	Name    string
+	Origins []string
+	Timeout time.Duration
+}
+
+// Bytes are binary data, encoded as base64url in JSON as WebAuthn clients expect.
+type Bytes []byte
+
+func (b Bytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *Bytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	d, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return err
+	}
+
+	*b = d
+	return nil
+}
+
+// String returns the base64url encoding of b.
+func (b Bytes) String() string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+type RelyingPartyEntity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// UserEntity identifies the user of a credential. ID is the user handle, which
+// must not contain personal data.
+type UserEntity struct {
+	ID          Bytes  `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type CredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int64  `json:"alg"`
+}
+
+type CredentialDescriptor struct {
+	Type       string   `json:"type"`
+	ID         Bytes    `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+type AuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	RequireResident  bool   `json:"requireResidentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// CreationOptions are the options of a registration ceremony, to be passed to
+// navigator.credentials.create(), eg. with PublicKeyCredential.parseCreationOptionsFromJSON().
+type CreationOptions struct {
+	RP                     RelyingPartyEntity     `json:"rp"`
+	User                   UserEntity             `json:"user"`
+	Challenge              Bytes                  `json:"challenge"`
+	PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout,omitempty"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// RequestOptions are the options of an assertion ceremony, to be passed to
+// navigator.credentials.get(), eg. with PublicKeyCredential.parseRequestOptionsFromJSON().
+// Without AllowCredentials, the user picks one of the passkeys of the site.
+type RequestOptions struct {
+	Challenge        Bytes                  `json:"challenge"`
+	Timeout          int64                  `json:"timeout,omitempty"`
+	RPID             string                 `json:"rpId"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// RegistrationResponse is the JSON encoded PublicKeyCredential returned by
+// navigator.credentials.create(), see PublicKeyCredential.toJSON().
+type RegistrationResponse struct {
+	ID       string              `json:"id"`
+	RawID    Bytes               `json:"rawId"`
+	Type     string              `json:"type"`
+	Response AttestationResponse `json:"response"`
+}
+
+type AttestationResponse struct {
+	ClientDataJSON    Bytes    `json:"clientDataJSON"`
+	AttestationObject Bytes    `json:"attestationObject"`
+	Transports        []string `json:"transports,omitempty"`
+}
+
+// AssertionResponse is the JSON encoded PublicKeyCredential returned by
+// navigator.credentials.get(), see PublicKeyCredential.toJSON().
+type AssertionResponse struct {
+	ID       string                `json:"id"`
+	RawID    Bytes                 `json:"rawId"`
+	Type     string                `json:"type"`
+	Response AuthenticatorResponse `json:"response"`
+}
+
+type AuthenticatorResponse struct {
+	ClientDataJSON    Bytes `json:"clientDataJSON"`
+	AuthenticatorData Bytes `json:"authenticatorData"`
+	Signature         Bytes `json:"signature"`
+	UserHandle        Bytes `json:"userHandle,omitempty"`
+}
+
+// ClientData is the data the browser collected for a ceremony.
+type ClientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+// AuthenticatorData is the data signed by the authenticator. CredentialID and
+// PublicKey are only set by registrations.
+type AuthenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	AAGUID       []byte
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+func (d *AuthenticatorData) Has(flag byte) bool {
+	return d.Flags&flag == flag
+}
+
+// Credential is a credential created by a registration, to be stored with the user.
+type Credential struct {
+	ID             []byte
+	PublicKey      []byte // COSE_Key, see ParsePublicKey
+	SignCount      uint32
+	AAGUID         []byte
+	Transports     []string
+	BackupEligible bool
+}
+
+// CreationOptions returns the options of a registration ceremony with the
+// challenge. Credentials that are already registered are excluded, so the user
+// can't register an authenticator twice. Passkeys must be discoverable.
+func (rp RelyingParty) CreationOptions(challenge []byte, user UserEntity, exclude [][]byte) *CreationOptions {
+	params := make([]CredentialParameter, len(Algorithms))
+	for i, alg := range Algorithms {
+		params[i] = CredentialParameter{Type: TypePublicKey, Alg: alg}
+	}
+
+	return &CreationOptions{
+		RP:                 RelyingPartyEntity{ID: rp.ID, Name: rp.Name},
+		User:               user,
+		Challenge:          challenge,
+		PubKeyCredParams:   params,
+		Timeout:            rp.Timeout.Milliseconds(),
+		ExcludeCredentials: descriptors(exclude),
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey:      "required",
+			RequireResident:  true,
+			UserVerification: "preferred",
+		},
+		Attestation: "none",
+	}
+}
+
+// RequestOptions returns the options of an assertion ceremony with the challenge.
+// User verification is required, so passkeys replace the password and a second factor.
+func (rp RelyingParty) RequestOptions(challenge []byte, allow [][]byte) *RequestOptions {
+	return &RequestOptions{
+		Challenge:        challenge,
+		Timeout:          rp.Timeout.Milliseconds(),
+		RPID:             rp.ID,
+		AllowCredentials: descriptors(allow),
+		UserVerification: "required",
+	}
+}
+
+func descriptors(ids [][]byte) []CredentialDescriptor {
+	d := make([]CredentialDescriptor, len(ids))
+	for i, id := range ids {
+		d[i] = CredentialDescriptor{Type: TypePublicKey, ID: id}
+	}
+	return d
+}
+
+// Challenge returns the challenge of the client data, so the relying party can
+// look up the ceremony before the response is verified.
+func Challenge(clientDataJSON []byte) ([]byte, error) {
+	cd := ClientData{}
+	if err := json.Unmarshal(clientDataJSON, &cd); err != nil {
+		return nil, ErrInvalidClientData
+	}
+
+	c, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(cd.Challenge, "="))
+	if err != nil || len(c) == 0 {
+		return nil, ErrInvalidClientData
+	}
+
+	return c, nil
+}
+
+// VerifyRegistration verifies the response of a registration ceremony with the
+// challenge and returns the new credential. If uv is set, the user must have been
+// verified by the authenticator, eg. with a PIN or biometrics.
+func (rp RelyingParty) VerifyRegistration(challenge []byte, resp *RegistrationResponse, uv bool) (*Credential, error) {
+	if resp.Type != TypePublicKey {
+		return nil, ErrInvalidClientData
+	}
+
+	if err := rp.verifyClientData(resp.Response.ClientDataJSON, TypeCreate, challenge); err != nil {
+		return nil, err
+	}
+
+	item, rest, err := decodeCBOR(resp.Response.AttestationObject)
+	if err != nil {
+		return nil, err
+	}
+
+	obj, ok := item.(map[any]any)
+	if !ok || len(rest) != 0 {
+		return nil, ErrInvalidCBOR
+	}
+
+	// The statement of the format is not verified, see the package doc
+	if _, ok := obj["fmt"].(string); !ok {
+		return nil, ErrInvalidCBOR
+	}
+
+	raw, _ := obj["authData"].([]byte)
+	data, err := ParseAuthenticatorData(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := rp.verifyAuthenticatorData(data, uv); err != nil {
+		return nil, err
+	}
+
+	if !data.Has(FlagAttestedData) {
+		return nil, ErrInvalidAuthenticatorData
+	}
+
+	if !bytes.Equal(data.CredentialID, resp.RawID) {
+		return nil, ErrCredentialMismatch
+	}
+
+	if _, err := ParsePublicKey(data.PublicKey); err != nil {
+		return nil, err
+	}
+
+	return &Credential{
+		ID:             data.CredentialID,
+		PublicKey:      data.PublicKey,
+		SignCount:      data.SignCount,
+		AAGUID:         data.AAGUID,
+		Transports:     resp.Response.Transports,
+		BackupEligible: data.Has(FlagBackupEligible),
+	}, nil
+}
+
+// VerifyAssertion verifies the response of an assertion ceremony with the
+// challenge, for the stored public key and signature counter of the credential.
+// It returns the new signature counter, which must be stored. Counters that did
+// not increase fail with ErrSignCount, unless the authenticator does not count.
+// User verification is required, see RequestOptions.
+func (rp RelyingParty) VerifyAssertion(challenge []byte, resp *AssertionResponse, publicKey []byte, signCount uint32) (uint32, error) {
+	if resp.Type != TypePublicKey {
+		return 0, ErrInvalidClientData
+	}
+
+	if err := rp.verifyClientData(resp.Response.ClientDataJSON, TypeGet, challenge); err != nil {
+		return 0, err
+	}
+
+	data, err := ParseAuthenticatorData(resp.Response.AuthenticatorData)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := rp.verifyAuthenticatorData(data, true); err != nil {
+		return 0, err
+	}
+
+	key, err := ParsePublicKey(publicKey)
+	if err != nil {
+		return 0, err
+	}
+
+	hash := sha256.Sum256(resp.Response.ClientDataJSON)
+	signed := append(append([]byte{}, resp.Response.AuthenticatorData...), hash[:]...)
+	if err := key.Verify(signed, resp.Response.Signature); err != nil {
+		return 0, err
+	}
+
+	if (data.SignCount != 0 || signCount != 0) && data.SignCount <= signCount {
+		return 0, ErrSignCount
+	}
+
+	return data.SignCount, nil
+}
+
+func (rp RelyingParty) verifyClientData(raw []byte, typ string, challenge []byte) error {
+	cd := ClientData{}
+	if err := json.Unmarshal(raw, &cd); err != nil || cd.Type != typ {
+		return ErrInvalidClientData
+	}
+
+	c, err := Challenge(raw)
+	if err != nil {
+		return err
+	}
+
+	if len(challenge) == 0 || subtle.ConstantTimeCompare(c, challenge) != 1 {
+		return ErrChallengeMismatch
+	}
+
+	if cd.CrossOrigin || !slices.Contains(rp.Origins, cd.Origin) {
+		return ErrOriginMismatch
+	}
+
+	return nil
+}
+
+func (rp RelyingParty) verifyAuthenticatorData(data *AuthenticatorData, uv bool) error {
+	hash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(data.RPIDHash, hash[:]) {
+		return ErrRPIDMismatch
+	}
+
+	if !data.Has(FlagUserPresent) {
+		return ErrUserNotPresent
+	}
+
+	if uv && !data.Has(FlagUserVerified) {
+		return ErrUserNotVerified
+	}
+
+	return nil
+}
+
+// ParseAuthenticatorData parses the authenticator data of a response.
+func ParseAuthenticatorData(b []byte) (*AuthenticatorData, error) {
+	if len(b) < 37 {
+		return nil, ErrInvalidAuthenticatorData
+	}
+
+	data := &AuthenticatorData{
+		RPIDHash:  b[:32],
+		Flags:     b[32],
+		SignCount: binary.BigEndian.Uint32(b[33:37]),
+	}
+	rest := b[37:]
+
+	if data.Has(FlagAttestedData) {
+		if len(rest) < 18 {
+			return nil, ErrInvalidAuthenticatorData
+		}
+
+		data.AAGUID = rest[:16]
+		n := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if n == 0 || n > MaxCredentialIDLength || len(rest) < n {
+			return nil, ErrInvalidAuthenticatorData
+		}
+
+		data.CredentialID = rest[:n]
+		rest = rest[n:]
+
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, ErrInvalidAuthenticatorData
+		}
+
+		data.PublicKey = rest[:len(rest)-len(after)]
+		rest = after
+	}
+
+	if data.Has(FlagExtensions) {
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, ErrInvalidAuthenticatorData
+		}
+		rest = after
+	}
+
+	if len(rest) != 0 {
+		return nil, ErrInvalidAuthenticatorData
+	}
+
+	return data, nil
+}
@@ -0,0 +1,198 @@
+package webauthn_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Simon-Martens/caveman/tools/webauthn"
+	"github.com/Simon-Martens/caveman/tools/webauthn/webauthntest"
+)
+
+var rp = webauthn.RelyingParty{
+	ID:      "example.com",
+	Name:    "Example",
+	Origins: []string{"https://example.com"},
+	Timeout: time.Minute,
+}
+
+var user = webauthn.UserEntity{ID: []byte{1, 2, 3}, Name: "user@example.com", DisplayName: "User"}
+
+func register(t *testing.T, a *webauthntest.Authenticator) *webauthn.Credential {
+	t.Helper()
+
+	challenge := []byte("registration challenge")
+	resp, err := a.Create(rp.CreationOptions(challenge, user, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cred, err := rp.VerifyRegistration(challenge, resp, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cred
+}
+
+func TestRegistration(t *testing.T) {
+	a := webauthntest.New(rp.ID, rp.Origins[0])
+	cred := register(t, a)
+
+	if string(cred.ID) != string(a.Credentials()[0].ID) || cred.SignCount != 0 {
+		t.Fatal("Unexpected credential", cred)
+	}
+
+	if _, err := webauthn.ParsePublicKey(cred.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+
+	// Registered credentials are excluded
+	if _, err := a.Create(rp.CreationOptions([]byte("c"), user, [][]byte{cred.ID})); err != webauthntest.ErrCredentialExcluded {
+		t.Fatal("Expected ErrCredentialExcluded, got", err)
+	}
+
+	scenarios := []struct {
+		name      string
+		rp        webauthn.RelyingParty
+		challenge string
+		flags     byte
+		uv        bool
+		expected  error
+	}{
+		{"wrong challenge", rp, "other", webauthn.FlagUserPresent, false, webauthn.ErrChallengeMismatch},
+		{"wrong origin", webauthn.RelyingParty{ID: rp.ID, Origins: []string{"https://evil.com"}}, "c", webauthn.FlagUserPresent, false, webauthn.ErrOriginMismatch},
+		{"wrong rp id", webauthn.RelyingParty{ID: "evil.com", Origins: rp.Origins}, "c", webauthn.FlagUserPresent, false, webauthn.ErrRPIDMismatch},
+		{"not present", rp, "c", 0, false, webauthn.ErrUserNotPresent},
+		{"not verified", rp, "c", webauthn.FlagUserPresent, true, webauthn.ErrUserNotVerified},
+		{"valid without uv", rp, "c", webauthn.FlagUserPresent, false, nil},
+	}
+
+	for _, s := range scenarios {
+		a := webauthntest.New(rp.ID, rp.Origins[0])
+		a.Flags = s.flags
+
+		resp, err := a.Create(rp.CreationOptions([]byte("c"), user, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := s.rp.VerifyRegistration([]byte(s.challenge), resp, s.uv); err != s.expected {
+			t.Errorf("(%s) Expected %v, got %v", s.name, s.expected, err)
+		}
+	}
+
+	// Tampered credential ids
+	resp, err := a.Create(rp.CreationOptions([]byte("c"), user, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.RawID = []byte("other")
+	if _, err := rp.VerifyRegistration([]byte("c"), resp, true); err != webauthn.ErrCredentialMismatch {
+		t.Fatal("Expected ErrCredentialMismatch, got", err)
+	}
+}
+
+func TestAssertion(t *testing.T) {
+	a := webauthntest.New(rp.ID, rp.Origins[0])
+	cred := register(t, a)
+
+	challenge := []byte("assertion challenge")
+	resp, err := a.Get(rp.RequestOptions(challenge, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The response survives the JSON round trip of the browser
+	b, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := &webauthn.AssertionResponse{}
+	if err := json.Unmarshal(b, decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if c, err := webauthn.Challenge(decoded.Response.ClientDataJSON); err != nil || string(c) != string(challenge) {
+		t.Fatal("Expected the challenge of the client data", c, err)
+	}
+
+	count, err := rp.VerifyAssertion(challenge, decoded, cred.PublicKey, cred.SignCount)
+	if err != nil || count != 1 {
+		t.Fatal("Expected the assertion to be valid", count, err)
+	}
+
+	// Replayed responses don't increase the counter
+	if _, err := rp.VerifyAssertion(challenge, decoded, cred.PublicKey, count); err != webauthn.ErrSignCount {
+		t.Fatal("Expected ErrSignCount, got", err)
+	}
+
+	// Signatures of other keys
+	other := register(t, webauthntest.New(rp.ID, rp.Origins[0]))
+	if _, err := rp.VerifyAssertion(challenge, decoded, other.PublicKey, 0); err != webauthn.ErrInvalidSignature {
+		t.Fatal("Expected ErrInvalidSignature, got", err)
+	}
+
+	// Tampered authenticator data
+	resp, err = a.Get(rp.RequestOptions(challenge, [][]byte{cred.ID}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Response.AuthenticatorData[len(resp.Response.AuthenticatorData)-1]++
+	if _, err := rp.VerifyAssertion(challenge, resp, cred.PublicKey, count); err != webauthn.ErrInvalidSignature {
+		t.Fatal("Expected ErrInvalidSignature, got", err)
+	}
+
+	// User verification is required
+	a.Flags = webauthn.FlagUserPresent
+	resp, err = a.Get(rp.RequestOptions(challenge, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rp.VerifyAssertion(challenge, resp, cred.PublicKey, count); err != webauthn.ErrUserNotVerified {
+		t.Fatal("Expected ErrUserNotVerified, got", err)
+	}
+
+	if _, err := a.Get(rp.RequestOptions(challenge, [][]byte{[]byte("unknown")})); err != webauthntest.ErrNoCredential {
+		t.Fatal("Expected ErrNoCredential, got", err)
+	}
+}
+
+func TestParseAuthenticatorData(t *testing.T) {
+	invalid := [][]byte{
+		nil,
+		make([]byte, 36),
+		// Attested credential data is missing
+		append(make([]byte, 32), webauthn.FlagAttestedData, 0, 0, 0, 0),
+		// Trailing bytes
+		append(make([]byte, 32), webauthn.FlagUserPresent, 0, 0, 0, 0, 1),
+	}
+
+	for i, b := range invalid {
+		if _, err := webauthn.ParseAuthenticatorData(b); err != webauthn.ErrInvalidAuthenticatorData {
+			t.Errorf("(%d) Expected ErrInvalidAuthenticatorData, got %v", i, err)
+		}
+	}
+
+	data, err := webauthn.ParseAuthenticatorData(append(make([]byte, 32), webauthn.FlagUserPresent, 0, 0, 1, 2))
+	if err != nil || !data.Has(webauthn.FlagUserPresent) || data.Has(webauthn.FlagUserVerified) || data.SignCount != 258 {
+		t.Fatal("Unexpected authenticator data", data, err)
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	invalid := [][]byte{
+		nil,
+		{0xa0},                   // empty map
+		{0xa1, 0x01, 0x02},       // EC2 without parameters
+		{0x9f},                   // indefinite array
+		{0xa2, 0x01, 0x01, 0x01}, // duplicate key
+	}
+
+	for i, b := range invalid {
+		if _, err := webauthn.ParsePublicKey(b); err == nil {
+			t.Errorf("(%d) Expected an error", i)
+		}
+	}
+}
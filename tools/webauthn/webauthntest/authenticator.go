@@ -0,0 +1,250 @@
+// Package webauthntest provides a software authenticator to test WebAuthn
+// ceremonies without a browser, see package webauthn. Credentials use ES256 and
+// are discoverable.
+package webauthntest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/Simon-Martens/caveman/tools/webauthn"
+)
+
+var ErrCredentialExcluded = errors.New("credential excluded")
+var ErrNoCredential = errors.New("no credential")
+var ErrRPIDMismatch = errors.New("relying party id mismatch")
+
+// Credential is a credential of the authenticator.
+type Credential struct {
+	ID         []byte
+	UserHandle []byte
+	Key        *ecdsa.PrivateKey
+	SignCount  uint32
+}
+
+// Authenticator is a software authenticator for the relying party ID, which runs
+// ceremonies on Origin. Flags are set in the authenticator data, by default the
+// user is present and verified.
+type Authenticator struct {
+	RPID   string
+	Origin string
+	Flags  byte
+
+	mu    sync.Mutex
+	creds []*Credential
+}
+
+// New returns an authenticator without credentials.
+func New(rpid, origin string) *Authenticator {
+	return &Authenticator{
+		RPID:   rpid,
+		Origin: origin,
+		Flags:  webauthn.FlagUserPresent | webauthn.FlagUserVerified,
+	}
+}
+
+// Credentials returns the credentials of the authenticator, newest last.
+func (a *Authenticator) Credentials() []*Credential {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]*Credential{}, a.creds...)
+}
+
+// Create runs a registration ceremony like navigator.credentials.create().
+func (a *Authenticator) Create(opts *webauthn.CreationOptions) (*webauthn.RegistrationResponse, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if opts.RP.ID != a.RPID {
+		return nil, ErrRPIDMismatch
+	}
+
+	for _, ex := range opts.ExcludeCredentials {
+		if a.find(ex.ID) != nil {
+			return nil, ErrCredentialExcluded
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	cred := &Credential{ID: id, UserHandle: opts.User.ID, Key: key}
+
+	x, y := make([]byte, 32), make([]byte, 32)
+	key.X.FillBytes(x)
+	key.Y.FillBytes(y)
+	cose := cborMap{
+		{int64(1), int64(2)},
+		{int64(3), webauthn.AlgES256},
+		{int64(-1), int64(1)},
+		{int64(-2), x},
+		{int64(-3), y},
+	}.encode()
+
+	data := a.authenticatorData(a.Flags|webauthn.FlagAttestedData, 0)
+	data = append(data, make([]byte, 16)...)
+	data = binary.BigEndian.AppendUint16(data, uint16(len(id)))
+	data = append(data, id...)
+	data = append(data, cose...)
+
+	att := cborMap{
+		{"fmt", "none"},
+		{"attStmt", cborMap{}},
+		{"authData", data},
+	}.encode()
+
+	cd, err := a.clientData(webauthn.TypeCreate, opts.Challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	a.creds = append(a.creds, cred)
+
+	return &webauthn.RegistrationResponse{
+		ID:    webauthn.Bytes(id).String(),
+		RawID: id,
+		Type:  webauthn.TypePublicKey,
+		Response: webauthn.AttestationResponse{
+			ClientDataJSON:    cd,
+			AttestationObject: att,
+			Transports:        []string{"internal"},
+		},
+	}, nil
+}
+
+// Get runs an assertion ceremony like navigator.credentials.get(), with the
+// newest allowed credential. Its signature counter is incremented.
+func (a *Authenticator) Get(opts *webauthn.RequestOptions) (*webauthn.AssertionResponse, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if opts.RPID != a.RPID {
+		return nil, ErrRPIDMismatch
+	}
+
+	var cred *Credential
+	if len(opts.AllowCredentials) == 0 {
+		if len(a.creds) > 0 {
+			cred = a.creds[len(a.creds)-1]
+		}
+	} else {
+		for _, allowed := range opts.AllowCredentials {
+			if c := a.find(allowed.ID); c != nil {
+				cred = c
+			}
+		}
+	}
+
+	if cred == nil {
+		return nil, ErrNoCredential
+	}
+
+	cred.SignCount++
+	data := a.authenticatorData(a.Flags, cred.SignCount)
+
+	cd, err := a.clientData(webauthn.TypeGet, opts.Challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(cd)
+	digest := sha256.Sum256(append(append([]byte{}, data...), hash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, cred.Key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &webauthn.AssertionResponse{
+		ID:    webauthn.Bytes(cred.ID).String(),
+		RawID: cred.ID,
+		Type:  webauthn.TypePublicKey,
+		Response: webauthn.AuthenticatorResponse{
+			ClientDataJSON:    cd,
+			AuthenticatorData: data,
+			Signature:         sig,
+			UserHandle:        cred.UserHandle,
+		},
+	}, nil
+}
+
+func (a *Authenticator) find(id []byte) *Credential {
+	for _, c := range a.creds {
+		if bytes.Equal(c.ID, id) {
+			return c
+		}
+	}
+	return nil
+}
+
+func (a *Authenticator) authenticatorData(flags byte, count uint32) []byte {
+	hash := sha256.Sum256([]byte(a.RPID))
+	data := append(hash[:], flags)
+	return binary.BigEndian.AppendUint32(data, count)
+}
+
+func (a *Authenticator) clientData(typ string, challenge []byte) ([]byte, error) {
+	return json.Marshal(webauthn.ClientData{
+		Type:      typ,
+		Challenge: webauthn.Bytes(challenge).String(),
+		Origin:    a.Origin,
+	})
+}
+
+// cborMap is a CBOR map that keeps the order of its keys.
+type cborMap [][2]any
+
+func (m cborMap) encode() []byte {
+	b := cborHead(5, uint64(len(m)))
+	for _, kv := range m {
+		b = append(b, cborEncode(kv[0])...)
+		b = append(b, cborEncode(kv[1])...)
+	}
+	return b
+}
+
+func cborEncode(v any) []byte {
+	switch v := v.(type) {
+	case int64:
+		if v < 0 {
+			return cborHead(1, uint64(-1-v))
+		}
+		return cborHead(0, uint64(v))
+	case []byte:
+		return append(cborHead(2, uint64(len(v))), v...)
+	case string:
+		return append(cborHead(3, uint64(len(v))), v...)
+	case cborMap:
+		return v.encode()
+	}
+	panic("webauthntest: unsupported cbor value")
+}
+
+func cborHead(major byte, arg uint64) []byte {
+	major <<= 5
+	switch {
+	case arg < 24:
+		return []byte{major | byte(arg)}
+	case arg <= 0xff:
+		return []byte{major | 24, byte(arg)}
+	case arg <= 0xffff:
+		return binary.BigEndian.AppendUint16([]byte{major | 25}, uint16(arg))
+	case arg <= 0xffffffff:
+		return binary.BigEndian.AppendUint32([]byte{major | 26}, uint32(arg))
+	default:
+		return binary.BigEndian.AppendUint64([]byte{major | 27}, arg)
+	}
+}